@@ -41,7 +41,8 @@ function Navbar() {
           picture: userPicture,
           email: data.email,
           userId: data.userId,
-          role: data.role as 'driver' | 'passenger' // 強制轉型
+          role: data.role as User['role'], // 強制轉型
+          orgs: data.orgs ?? [],
         };
 
         // 呼叫 Context 的 login 更新全域狀態
@@ -38,6 +38,13 @@ export const ChatRoom = ({ roomId, roomName, username, userId, onClose }: ChatRo
       {/* Messages */}
       <div className="flex-1 p-4 space-y-4 overflow-y-auto bg-gray-50">
         {messages.map((msg, index) => {
+          if (msg.system) {
+            return (
+              <div key={index} className="flex justify-center">
+                <span className="px-3 py-1 text-xs text-gray-600 bg-gray-200 rounded-full">{msg.content}</span>
+              </div>
+            );
+          }
           const isMe = msg.senderId === userId || msg.username === username;
           return (
             <div key={index} className={`flex gap-2 ${isMe ? 'flex-row-reverse' : 'flex-row'}`}>
@@ -7,7 +7,8 @@ interface AuthContextType {
   token: string | null;
   login: (userData: User, token: string) => void;
   logout: () => void;
-  updateRole: (role: "driver" | "passenger") => void;
+  // 由 auth service 改角色並重新發 token；不符合司機資格時會 throw (訊息是後端的原因)
+  updateRole: (role: "driver" | "passenger") => Promise<void>;
 }
 
 // 1. 建立 Context (這裡要 export，因為 Provider 檔案需要用到)
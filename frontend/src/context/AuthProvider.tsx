@@ -4,6 +4,8 @@ import type { User } from "../types";
 import { initializeStateFromStorage } from "../utils/auth.utils";
 import { AuthContext } from "./AuthContext"; // 引入剛剛上面的 Context
 
+const API_URL = import.meta.env.VITE_API_URL || "";
+
 export function AuthProvider({ children }: { children: ReactNode }) {
   // 初始化 State
   const [user, setUser] = useState<User | null>(() => initializeStateFromStorage().user);
@@ -22,12 +24,22 @@ export function AuthProvider({ children }: { children: ReactNode }) {
     localStorage.clear();
   };
 
-  const updateRole = (role: "driver" | "passenger") => {
-    if (user) {
-      const updated = { ...user, role };
-      setUser(updated);
-      localStorage.setItem("chat_user_info", JSON.stringify(updated));
+  // 角色存在資料庫與 JWT 裡，只改前端的話後端還是把你當乘客
+  const updateRole = async (role: "driver" | "passenger") => {
+    if (!user || !token) return;
+    const res = await fetch(`${API_URL}/auth/role`, {
+      method: "POST",
+      headers: {
+        "Content-Type": "application/json",
+        Authorization: `Bearer ${token}`,
+      },
+      body: JSON.stringify({ role }),
+    });
+    if (!res.ok) {
+      throw new Error((await res.text()).trim() || "Failed to switch role");
     }
+    const data = await res.json();
+    login({ ...user, role: data.role, orgs: data.orgs ?? [] }, data.token);
   };
 
   return (
@@ -1,4 +1,5 @@
 import { useEffect, useState, useRef } from 'react';
+import type { AppNotification } from '../types';
 
 // const API_URL = import.meta.env.VITE_API_URL || 'http://localhost:8000';
 const API_URL = import.meta.env.VITE_API_URL || '';
@@ -10,11 +11,14 @@ export interface ChatMessage {
   timestamp: string;
   senderPicture?: string; // 新增：後端會補上這欄位
   senderId?: string;      // 新增：方便前端判斷是不是自己
+  system?: boolean;       // 系統訊息 (出發前提醒等)，沒有發送者
 }
 
 export const useChat = (roomId: string, username: string, userId: string) => {
   const [messages, setMessages] = useState<ChatMessage[]>([]);
   const [isConnected, setIsConnected] = useState(false);
+  // 連線後收到的站內通知 (不限這個房間)，新的在前
+  const [notifications, setNotifications] = useState<AppNotification[]>([]);
   const socketRef = useRef<WebSocket | null>(null);
 
   useEffect(() => {
@@ -35,7 +39,12 @@ export const useChat = (roomId: string, username: string, userId: string) => {
     if (host.endsWith('/')) {
         host = host.slice(0, -1);
     }
-    const wsUrl = `${protocol}//${host}/ws?roomId=${roomId}`;
+    let wsUrl = `${protocol}//${host}/ws?roomId=${roomId}`;
+    // 沒有 token 伺服器會拒絕連線 (發送者與站內通知都以 token 為準)
+    const token = localStorage.getItem('chat_token');
+    if (token) {
+        wsUrl += `&token=${encodeURIComponent(token)}`;
+    }
     console.log("Connecting to WebSocket:", wsUrl); // 除錯用，讓你知道它連去哪
 
     const ws = new WebSocket(wsUrl);
@@ -47,6 +56,8 @@ export const useChat = (roomId: string, username: string, userId: string) => {
         const data = JSON.parse(event.data);
         if (Array.isArray(data)) {
           setMessages(data);
+        } else if (data.type === 'notification') {
+          setNotifications((prev) => [data.notification, ...prev]);
         } else {
           setMessages((prev) => [...prev, data]);
         }
@@ -67,11 +78,11 @@ export const useChat = (roomId: string, username: string, userId: string) => {
         content, 
         roomId, 
         timestamp,
-        senderId: userId // 帶上 ID，雖然可以從 Token 解，但這樣簡單點
+        senderId: userId // 只是顯示用，伺服器一律用 token 的使用者
       };
       socketRef.current.send(JSON.stringify(msg));
     }
   };
 
-  return { messages, sendMessage, isConnected };
+  return { messages, sendMessage, isConnected, notifications };
 };
\ No newline at end of file
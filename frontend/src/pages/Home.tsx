@@ -25,6 +25,15 @@ export const Home = () => {
     maxPassengers: 3,
   });
 
+  const handleSwitchRole = async (role: "driver" | "passenger") => {
+    if (user?.role === role) return;
+    try {
+      await updateRole(role);
+    } catch (e) {
+      alert(`Cannot switch role: ${e instanceof Error ? e.message : e}`);
+    }
+  };
+
   const fetchRides = () => {
     fetch(`${API_URL}/api/rides`)
       .then((res) => res.json())
@@ -79,6 +88,8 @@ export const Home = () => {
           maxPassengers: 3,
         });
         alert("Ride created successfully! Check 'My Rides'.");
+      } else if (res.status === 403) {
+        alert("Only drivers can create rides. Switch to driver first.");
       }
     } catch (e) {
       alert(e);
@@ -299,7 +310,7 @@ export const Home = () => {
       <div className="flex justify-center mb-8">
         <div className="flex gap-2 p-1 bg-gray-100 rounded-lg shadow-inner">
           <button
-            onClick={() => updateRole("passenger")}
+            onClick={() => handleSwitchRole("passenger")}
             className={`px-6 py-2 rounded-md font-medium transition ${
               user.role === "passenger"
                 ? "bg-white shadow text-blue-600"
@@ -309,7 +320,7 @@ export const Home = () => {
             I'm a passenger
           </button>
           <button
-            onClick={() => updateRole("driver")}
+            onClick={() => handleSwitchRole("driver")}
             className={`px-6 py-2 rounded-md font-medium transition ${
               user.role === "driver"
                 ? "bg-white shadow text-green-600"
@@ -3,7 +3,8 @@ export interface User {
   picture: string;
   email: string;
   userId: string;
-  role: "driver" | "passenger";
+  role: "driver" | "passenger" | "admin";
+  orgs?: string[]; // 所屬組織的 ID (登入時依 email 網域自動加入)
 }
 
 export interface Ride {
@@ -16,6 +17,53 @@ export interface Ride {
   maxPassengers: number;
   currentPassengers: number;
   status: string;
+  originCanonical?: string;
+  destinationCanonical?: string;
+  originLat?: number;
+  originLng?: number;
+  destinationLat?: number;
+  destinationLng?: number;
+  stops?: Stop[];
+  requiresApproval?: boolean;
+  // 不公開的旅程只能用邀請連結或邀請碼加入
+  visibility?: "public" | "private" | "org";
+  orgId?: string; // visibility 為 org 時只有這個組織的成員看得到
+  // 金額都是最小貨幣單位的整數
+  priceMode?: "per_seat" | "split";
+  priceAmount?: number;
+  currency?: string;
+  luggage?: "none" | "small" | "medium" | "large";
+  petsAllowed?: boolean;
+  smokingAllowed?: boolean;
+  music?: boolean;
+  childSeat?: boolean;
+  wheelchairAccessible?: boolean;
+  vehicleId?: string;
+  vehicle?: Vehicle;
+  driverRating?: RatingSummary;
+  bookingStatus?: "pending" | "confirmed" | "rejected" | "expired";
+  bookedSeats?: number;
+  shareAmount?: number;
+}
+
+// 停靠站 (seq 0 是起點，最後一站是終點)
+export interface Stop {
+  seq: number;
+  name: string;
+  canonical?: string;
+  lat?: number;
+  lng?: number;
+  estimatedTime?: string;
+}
+
+// GET /api/rides/search 的結果
+export interface RideMatch extends Ride {
+  originDistanceKm: number;
+  destinationDistanceKm: number;
+  detourKm: number;
+  fromStop: number;
+  toStop: number;
+  availableSeats: number;
 }
 
 // 用於置頂房間
@@ -24,3 +72,223 @@ export interface ChatRoomType {
   name: string;
   isPinned?: boolean;
 }
+
+// 評分統計 (顯示在司機名字旁邊)
+export interface RatingSummary {
+  average: number;
+  count: number;
+}
+
+// 司機登記的車輛 (plate 只有司機與已確認的乘客看得到)
+export interface Vehicle {
+  id: string;
+  make: string;
+  model: string;
+  color: string;
+  plate?: string;
+  seats: number;
+  amenities: string[];
+}
+
+// 乘客發布的搭車需求 (司機可以回應)
+export interface RideRequest {
+  id: string;
+  passengerId: string;
+  passengerName: string;
+  origin: string;
+  destination: string;
+  originLat?: number;
+  originLng?: number;
+  destinationLat?: number;
+  destinationLng?: number;
+  departureTime: string;
+  flexMinutes?: number;
+  earliestDeparture: string;
+  latestDeparture: string;
+  seats: number;
+  message?: string;
+  status: 'open' | 'matched' | 'cancelled' | 'expired';
+  rideId?: string;
+  createdAt: string;
+  offers?: RideOffer[];
+}
+
+// 司機對需求的回應：現有旅程 (rideId) 或新旅程的草稿 (ride)
+export interface RideOffer {
+  id: number;
+  requestId: string;
+  driverId: string;
+  driverName: string;
+  rideId?: string;
+  ride?: Ride;
+  message?: string;
+  status: 'pending' | 'accepted' | 'declined';
+  createdAt: string;
+}
+
+// 媒合引擎推薦的配對 (司機與乘客都看得到)
+export interface MatchProposal {
+  id: number;
+  rideId: string;
+  requestId: string;
+  driverId: string;
+  passengerId: string;
+  score: number;
+  timeScore: number;
+  proximityScore: number;
+  seatScore: number;
+  preferenceScore: number;
+  originDistanceKm: number;
+  destinationDistanceKm: number;
+  fromStop: number;
+  toStop: number;
+  freeSeats: number;
+  createdAt: string;
+  ride?: Ride;
+  request?: RideRequest;
+}
+
+// 儲存的搜尋條件 (criteria 跟 /api/rides/search 的參數一樣)
+export interface SavedSearch {
+  id: string;
+  userId: string;
+  name: string;
+  origin?: string;
+  destination?: string;
+  criteria: Record<string, unknown>;
+  alerts: boolean;
+  createdAt: string;
+  lastAlertAt?: string;
+}
+
+// 通知設定 (muted 是不想收到的通知類型，例如 ride_reminder)
+export interface NotificationPreferences {
+  email: boolean;
+  push: boolean;
+  inApp: boolean;
+  muted: string[];
+}
+
+// 站內通知
+export interface AppNotification {
+  id: number;
+  userId: string;
+  kind: string;
+  title: string;
+  body: string;
+  rideId?: string;
+  messageId?: number; // 聊天訊息的通知才有
+  link?: string;
+  createdAt: string;
+  readAt?: string;
+}
+
+// GET /api/notifications 的一頁
+export interface NotificationPage {
+  items: AppNotification[];
+  nextCursor?: string; // 沒有代表沒有更舊的了
+  unread: number;
+}
+
+// POST /api/rides/calendar-feed：行事曆訂閱網址 (只有建立時拿得到)
+export interface CalendarFeedLink {
+  url: string;
+  webcalUrl: string; // Apple 行事曆用
+}
+
+// 不公開旅程的邀請 (司機建立；link 與 code 二擇一分享給乘客)
+export interface RideInvite {
+  id: string;
+  rideId?: string;
+  scheduleId?: string;
+  code: string;
+  link?: string;
+  maxUses?: number;
+  uses: number;
+  expiresAt?: string;
+  revokedAt?: string;
+  createdAt: string;
+}
+
+// 組織 (公司、學校)：role 是我在組織裡的身分
+export interface Organization {
+  id: string;
+  name: string;
+  emailDomains: string[];
+  memberCount: number;
+  role?: "admin" | "member";
+  createdAt: string;
+}
+
+export interface OrgMember {
+  orgId: string;
+  userId: string;
+  name: string;
+  email: string;
+  role: "admin" | "member";
+  joinedVia: "creator" | "domain" | "invite";
+  joinedAt: string;
+}
+
+export interface OrgInvite {
+  code: string;
+  orgId: string;
+  maxUses?: number;
+  uses: number;
+  expiresAt?: string;
+  revokedAt?: string;
+  createdAt: string;
+}
+
+// 我封鎖的人 (對方的旅程不會出現，訊息也不會顯示)
+export interface BlockedUser {
+  userId: string;
+  name: string;
+  picture: string;
+  blockedAt: string;
+}
+
+export type ReportCategory = "spam" | "harassment" | "inappropriate" | "safety" | "fraud" | "other";
+
+// 檢舉 (targetId 是使用者 ID、旅程 ID 或訊息 ID)
+export interface Report {
+  id: number;
+  reporterId: string;
+  targetType: "user" | "ride" | "message";
+  targetId: string;
+  targetUserId?: string;
+  category: ReportCategory;
+  details?: string;
+  status: "open" | "resolved" | "dismissed";
+  resolution?: string;
+  resolvedAt?: string;
+  createdAt: string;
+  // 只有管理員的審核佇列會填
+  reporterName?: string;
+  targetUserName?: string;
+}
+
+// 管理員搜尋使用者的結果 (suspendedAt 只有停權中才有)
+export interface AdminUser {
+  id: string;
+  email: string;
+  name: string;
+  role: "driver" | "passenger" | "admin";
+  suspendedAt?: string;
+  suspendedUntil?: string;
+  suspensionReason?: string;
+  openReports: number;
+}
+
+// 管理員操作紀錄
+export interface AuditEntry {
+  id: number;
+  adminId: string;
+  adminName: string;
+  action: "suspend_user" | "unsuspend_user" | "cancel_ride" | "delete_message" | "resolve_report";
+  targetType: "user" | "ride" | "message" | "report";
+  targetId: string;
+  reason?: string;
+  details?: Record<string, unknown>;
+  createdAt: string;
+}
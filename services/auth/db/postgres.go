@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -61,6 +63,11 @@ func Init() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// 停權欄位 (chat service 也會建，誰先啟動都可以)
+	DB.Exec(`ALTER TABLE users
+		ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS suspended_until TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS suspension_reason TEXT`)
 	log.Println("Auth Service connected to DB.")
 }
 
@@ -76,4 +83,94 @@ func UpsertUser(user User) (string, error) {
 	`, user.ID, user.Email, user.Name, user.Picture).Scan(&role)
 
 	return role, err
-}
\ No newline at end of file
+}
+
+// GetUser: 換角色時重新發 token 用
+func GetUser(userID string) (User, error) {
+	var u User
+	err := DB.QueryRow(`SELECT id, email, COALESCE(name, ''), COALESCE(picture, ''), COALESCE(role, 'passenger') FROM users WHERE id = $1`,
+		userID).Scan(&u.ID, &u.Email, &u.Name, &u.Picture, &u.Role)
+	if err == sql.ErrNoRows {
+		return u, fmt.Errorf("user not found")
+	}
+	return u, err
+}
+
+// DriverEligibility: 切換成司機前要符合的條件，不符合時回傳原因
+// 車輛表由 chat service 建立 (刪除的車輛只做標記)
+func DriverEligibility(userID string) error {
+	suspended, err := Suspended(userID)
+	if err != nil {
+		return err
+	}
+	if suspended {
+		return fmt.Errorf("account suspended")
+	}
+	var hasVehicle bool
+	err = DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM vehicles WHERE owner_id = $1 AND deleted_at IS NULL)`, userID).Scan(&hasVehicle)
+	if err != nil {
+		return err
+	}
+	if !hasVehicle {
+		return fmt.Errorf("register a vehicle before driving")
+	}
+	return nil
+}
+
+// SetRole: passenger / driver 互換；管理員的角色不能用這裡改 (不然會把自己降級)
+func SetRole(userID, role string) error {
+	res, err := DB.Exec(`UPDATE users SET role = $2 WHERE id = $1 AND COALESCE(role, 'passenger') <> 'admin'`, userID, role)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("cannot change admin role")
+	}
+	return nil
+}
+
+// GrantAdmin: ADMIN_EMAILS 裡的人登入時升成管理員 (從名單拿掉不會自動降級，要改資料庫)
+func GrantAdmin(userID string) error {
+	_, err := DB.Exec(`UPDATE users SET role = 'admin' WHERE id = $1`, userID)
+	return err
+}
+
+// Suspended: 目前停權中 (沒有期限或期限還沒到)
+func Suspended(userID string) (bool, error) {
+	var suspended bool
+	err := DB.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM users WHERE id = $1
+			AND suspended_at IS NOT NULL AND (suspended_until IS NULL OR suspended_until > $2))`,
+		userID, time.Now().UTC()).Scan(&suspended)
+	return suspended, err
+}
+
+// SyncOrgMemberships: email 網域符合的組織自動加入 (被移除過的不會加回來)，回傳目前所屬的組織 ID
+// 組織相關的表由 chat service 建立
+func SyncOrgMemberships(userID, email string, verified bool) ([]string, error) {
+	if _, domain, ok := strings.Cut(strings.ToLower(email), "@"); ok && verified {
+		_, err := DB.Exec(`
+			INSERT INTO org_members (org_id, user_id, role, status, joined_via, joined_at)
+			SELECT id, $1, 'member', 'active', 'domain', $3 FROM organizations WHERE $2 = ANY(email_domains)
+			ON CONFLICT (org_id, user_id) DO NOTHING`, userID, domain, time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := DB.Query(`SELECT org_id FROM org_members WHERE user_id = $1 AND status = 'active' ORDER BY joined_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, id)
+	}
+	return orgs, rows.Err()
+}
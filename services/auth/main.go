@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -16,12 +17,19 @@ import (
 // 全域變數
 var jwtKey []byte // 改成動態讀取
 
+// ADMIN_EMAILS (逗號分隔)：這些 email 登入時會被設成管理員
+var adminEmails = map[string]bool{}
+
 // 定義 JWT 內容結構
 type Claims struct {
 	UserID string `json:"userId"`
 	Email  string `json:"email"`
 	Name   string `json:"name"`
 	Role   string `json:"role"`
+	// Google 確認過 email 是本人的 (chat service 只讓這種使用者認領組織網域)
+	EmailVerified bool `json:"emailVerified,omitempty"`
+	// 所屬組織的 ID (登入時依 email 網域自動加入)
+	Orgs []string `json:"orgs,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -29,21 +37,27 @@ type LoginRequest struct {
 	AccessToken string `json:"accessToken"`
 }
 
+type RoleRequest struct {
+	Role string `json:"role"` // driver 或 passenger
+}
+
 type GoogleUserInfo struct {
-	Sub     string `json:"sub"`
-	Name    string `json:"name"`
-	Picture string `json:"picture"`
-	Email   string `json:"email"`
+	Sub           string `json:"sub"`
+	Name          string `json:"name"`
+	Picture       string `json:"picture"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
 }
 
 type LoginResponse struct {
-	Message string `json:"message"`
-	UserID  string `json:"userId"`
-	Email   string `json:"email"`
-	Name    string `json:"name"`
-	Picture string `json:"picture"`
-	Token   string `json:"token"`
-	Role    string `json:"role"`
+	Message string   `json:"message"`
+	UserID  string   `json:"userId"`
+	Email   string   `json:"email"`
+	Name    string   `json:"name"`
+	Picture string   `json:"picture"`
+	Token   string   `json:"token"`
+	Role    string   `json:"role"`
+	Orgs    []string `json:"orgs"`
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -104,19 +118,34 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// ==========================================
 
-	// 4. 發放 JWT
-	expirationTime := time.Now().Add(7 * 24 * time.Hour)
-	claims := &Claims{
-		UserID: userInfo.Sub,
-		Email:  userInfo.Email,
-		Name:   userInfo.Name,
-		Role:   role, // 使用從 DB 拿出來的 role
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-		},
+	// 3. 停權的人不發 token；管理員名單只認 Google 驗證過的 email
+	suspended, err := db.Suspended(userInfo.Sub)
+	if err != nil {
+		log.Printf("Suspension check failed for %s: %v", userInfo.Sub, err)
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	if suspended {
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	}
+	if userInfo.EmailVerified && adminEmails[strings.ToLower(userInfo.Email)] && role != "admin" {
+		if err := db.GrantAdmin(userInfo.Sub); err != nil {
+			log.Printf("Grant admin failed for %s: %v", userInfo.Sub, err)
+		} else {
+			role = "admin"
+		}
+	}
+
+	// 3-1. 組織：email 驗證過的話，依網域自動加入 (查不到組織不影響登入)
+	orgs, err := db.SyncOrgMemberships(userInfo.Sub, userInfo.Email, userInfo.EmailVerified)
+	if err != nil {
+		log.Printf("Org sync failed for %s: %v", userInfo.Sub, err)
+		orgs = []string{}
+	}
+
+	// 4. 發放 JWT (使用從 DB 拿出來的 role)
+	tokenString, err := issueToken(userInfo.Sub, userInfo.Email, userInfo.Name, role, userInfo.EmailVerified, orgs)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
@@ -132,12 +161,127 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		Name:    userInfo.Name,
 		Picture: userInfo.Picture,
 		Role:    role,
+		Orgs:    orgs,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
+// issueToken: 登入與換角色都用這裡發 token (7 天)
+func issueToken(userID, email, name, role string, emailVerified bool, orgs []string) (string, error) {
+	claims := &Claims{
+		UserID:        userID,
+		Email:         email,
+		Name:          name,
+		Role:          role,
+		EmailVerified: emailVerified,
+		Orgs:          orgs,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(7 * 24 * time.Hour)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtKey)
+}
+
+// bearerClaims: 驗證 Authorization header 的 JWT
+func bearerClaims(r *http.Request) (*Claims, bool) {
+	tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, false
+	}
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) { return jwtKey, nil })
+	if err != nil || !token.Valid {
+		return nil, false
+	}
+	return claims, true
+}
+
+// POST /auth/role {role}：切換乘客 / 司機，寫回資料庫並重新發 token (舊 token 的 role 會過時)
+// 切成司機前要先符合 DriverEligibility 的條件
+func roleHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := bearerClaims(r)
+	if !ok {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+	var req RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Role != "driver" && req.Role != "passenger") {
+		http.Error(w, "role must be driver or passenger", http.StatusBadRequest)
+		return
+	}
+
+	user, err := db.GetUser(claims.UserID)
+	if err != nil {
+		log.Printf("Load user %s failed: %v", claims.UserID, err)
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	suspended, err := db.Suspended(user.ID)
+	if err != nil {
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+	if suspended {
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	}
+	if user.Role == "admin" {
+		http.Error(w, "cannot change admin role", http.StatusConflict)
+		return
+	}
+	if req.Role == "driver" {
+		if err := db.DriverEligibility(user.ID); err != nil {
+			switch err.Error() {
+			case "account suspended":
+				http.Error(w, "Account suspended", http.StatusForbidden)
+			case "register a vehicle before driving":
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				log.Printf("Driver eligibility check for %s failed: %v", user.ID, err)
+				http.Error(w, "Database Error", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+	if err := db.SetRole(user.ID, req.Role); err != nil {
+		if err.Error() == "cannot change admin role" {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, "Database Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// 只列出目前的組織 (verified = false：換角色不做網域自動加入)
+	orgs, err := db.SyncOrgMemberships(user.ID, user.Email, false)
+	if err != nil {
+		log.Printf("Org lookup failed for %s: %v", user.ID, err)
+		orgs = []string{}
+	}
+	// 驗證狀態沿用舊 token (只有登入時 Google 給的才算數)，email 變過就不算
+	verified := claims.EmailVerified && strings.EqualFold(claims.Email, user.Email)
+	tokenString, err := issueToken(user.ID, user.Email, user.Name, req.Role, verified, orgs)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s switched role to %s", user.ID, req.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{
+		Message: "Role updated",
+		Token:   tokenString,
+		UserID:  user.ID,
+		Email:   user.Email,
+		Name:    user.Name,
+		Picture: user.Picture,
+		Role:    req.Role,
+		Orgs:    orgs,
+	})
+}
+
 func main() {
 	// 讀取環境變數中的 JWT_SECRET
 	secret := os.Getenv("JWT_SECRET")
@@ -147,6 +291,12 @@ func main() {
 		jwtKey = []byte(secret)
 	}
 
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+			adminEmails[email] = true
+		}
+	}
+
 	db.Init()
 
 	http.HandleFunc("/auth/login", func(w http.ResponseWriter, r *http.Request) {
@@ -159,6 +309,18 @@ func main() {
 		}
 	})
 
+	http.HandleFunc("/auth/role", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		roleHandler(w, r)
+	})
+
 	fmt.Println("Auth Service running on :8081")
 	http.ListenAndServe(":8081", nil)
 }
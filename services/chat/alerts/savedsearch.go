@@ -0,0 +1,76 @@
+package alerts
+
+import (
+	"context"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/db"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/events"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/search"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// SavedSearchAlert: SavedSearchMatched 事件的內容
+type SavedSearchAlert struct {
+	SearchID   string     `json:"searchId"`
+	SearchName string     `json:"searchName"`
+	Ride       types.Ride `json:"ride"`
+}
+
+// SavedSearches: 新旅程建立後，通知儲存的搜尋條件符合的乘客
+// 去重與每日上限由 db.RecordSavedSearchAlert 處理，回傳實際通知了幾個人
+func SavedSearches(c context.Context, bus *events.Bus, rideID string) (int, error) {
+	rides, _, err := db.MatchRide(rideID)
+	if err != nil || len(rides) == 0 {
+		return 0, err
+	}
+	ride := rides[0]
+	searches, err := db.GetAlertingSavedSearches(ride)
+	if err != nil {
+		return 0, err
+	}
+
+	// 組織限定的旅程只通知同組織的人，跟司機有封鎖關係的不通知
+	users := make([]string, 0, len(searches))
+	for _, s := range searches {
+		users = append(users, s.UserID)
+	}
+	var members map[string]bool
+	if ride.Visibility == "org" {
+		if members, err = db.OrgMembers(ride.OrgID, users); err != nil {
+			return 0, err
+		}
+	}
+	blocked, err := db.BlockedWith(ride.DriverID, users)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, s := range searches {
+		if !Matches(ride, s.Criteria) || (members != nil && !members[s.UserID]) || blocked[s.UserID] {
+			continue
+		}
+		ok, err := db.RecordSavedSearchAlert(s, ride.ID)
+		if err != nil {
+			return sent, err
+		}
+		if !ok {
+			continue
+		}
+		sent++
+		bus.Publish(c, events.Event{Type: events.SavedSearchMatched, RideID: ride.ID, ActorID: ride.DriverID, UserID: s.UserID},
+			SavedSearchAlert{SearchID: s.ID, SearchName: s.Name, Ride: ride})
+	}
+	return sent, nil
+}
+
+// Matches: 旅程是否會出現在這組條件的搜尋結果裡 (路線 + 旅程設定)
+func Matches(ride types.Ride, q types.RideSearch) bool {
+	if q.OrgID != "" && ride.OrgID != q.OrgID {
+		return false
+	}
+	if _, ok := search.Match(ride, q); !ok {
+		return false
+	}
+	return search.MatchFeatures(ride, q.FeatureFilter)
+}
@@ -0,0 +1,302 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 停權中：有 suspended_at，而且沒有期限或期限還沒到
+const activeSuspension = `suspended_at IS NOT NULL AND (suspended_until IS NULL OR suspended_until > $2)`
+
+// UserSuspended: 每個需要登入的請求都會查 (停權立刻生效，不用等 token 過期)
+func UserSuspended(userID string) (bool, error) {
+	var suspended bool
+	err := DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND `+activeSuspension+`)`,
+		userID, time.Now().UTC()).Scan(&suspended)
+	return suspended, err
+}
+
+// IsAdmin: 以資料庫的 role 為準，被拿掉管理員的人手上的 token 也跟著失效
+func IsAdmin(userID string) (bool, error) {
+	var admin bool
+	err := DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND role = 'admin')`, userID).Scan(&admin)
+	return admin, err
+}
+
+// SearchUsers: 用 ID、Email 或名字找人 (不分大小寫、部分符合)，附上還沒處理的檢舉數
+func SearchUsers(q string, limit int) ([]types.AdminUser, error) {
+	rows, err := DB.Query(`
+		SELECT u.id, COALESCE(u.email, ''), COALESCE(u.name, ''), COALESCE(u.role, 'passenger'),
+			CASE WHEN `+activeSuspension+` THEN u.suspended_at END,
+			CASE WHEN `+activeSuspension+` THEN u.suspended_until END,
+			CASE WHEN `+activeSuspension+` THEN COALESCE(u.suspension_reason, '') ELSE '' END,
+			(SELECT COUNT(*) FROM reports rp WHERE rp.target_user_id = u.id AND rp.status = 'open')
+		FROM users u
+		WHERE u.id = $1 OR u.email ILIKE '%' || $1 || '%' OR u.name ILIKE '%' || $1 || '%'
+		ORDER BY u.name, u.id
+		LIMIT $3`, q, time.Now().UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]types.AdminUser, 0)
+	for rows.Next() {
+		var u types.AdminUser
+		var suspendedAt, suspendedUntil sql.NullTime
+		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.Role, &suspendedAt, &suspendedUntil, &u.SuspensionReason, &u.OpenReports); err != nil {
+			return nil, err
+		}
+		if suspendedAt.Valid {
+			u.SuspendedAt = &suspendedAt.Time
+		}
+		if suspendedUntil.Valid {
+			u.SuspendedUntil = &suspendedUntil.Time
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// audit: 跟操作寫在同一個交易，操作失敗就不會留下紀錄
+func audit(tx *sql.Tx, adminID, action, targetType, targetID, reason string, details map[string]interface{}) error {
+	var raw interface{}
+	if len(details) > 0 {
+		b, err := json.Marshal(details)
+		if err != nil {
+			return err
+		}
+		raw = string(b)
+	}
+	_, err := tx.Exec(`
+		INSERT INTO admin_audit_log (admin_id, action, target_type, target_id, reason, details, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		adminID, action, targetType, targetID, reason, raw, time.Now().UTC())
+	return err
+}
+
+// SuspendUser: 停權 (until 為 nil 代表沒有期限)；再停一次會覆蓋原本的期限與原因
+func SuspendUser(userID, adminID, reason string, until *time.Time) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var role string
+	err = tx.QueryRow(`SELECT COALESCE(role, 'passenger') FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("user not found")
+	}
+	if err != nil {
+		return err
+	}
+	if role == "admin" {
+		return fmt.Errorf("cannot suspend an admin")
+	}
+
+	var untilArg interface{}
+	details := map[string]interface{}{}
+	if until != nil {
+		untilArg = until.UTC()
+		details["until"] = until.UTC()
+	}
+	if _, err := tx.Exec(`
+		UPDATE users SET suspended_at = $2, suspended_until = $3, suspension_reason = $4 WHERE id = $1`,
+		userID, time.Now().UTC(), untilArg, reason); err != nil {
+		return err
+	}
+	if err := audit(tx, adminID, "suspend_user", "user", userID, reason, details); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnsuspendUser: 解除停權 (本來就沒停權也會記一筆，方便追查誰按過)
+func UnsuspendUser(userID, adminID, reason string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE users SET suspended_at = NULL, suspended_until = NULL, suspension_reason = NULL WHERE id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("user not found")
+	}
+	if err := audit(tx, adminID, "unsuspend_user", "user", userID, reason, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ForceCancelRide: 管理員取消任何人的旅程；付款的退款由呼叫端 settleRide 處理 (跟司機取消一樣)
+func ForceCancelRide(rideID, adminID, reason string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	driverID, err := lockRide(tx, rideID)
+	if err != nil {
+		return err
+	}
+	if err := changeRideStatus(tx, rideID, "cancelled"); err != nil {
+		return err
+	}
+	if err := audit(tx, adminID, "cancel_ride", "ride", rideID, reason, map[string]interface{}{"driverId": driverID}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteMessage: 只標記刪除 (內容留著給檢舉追查)，回傳旅程與 Redis stream 的 ID 讓呼叫端從聊天室拿掉
+// 加上 stream_id 之前存的訊息沒有 streamID，只能標記
+func DeleteMessage(messageID int64, adminID, reason string) (rideID, streamID string, err error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	var senderID sql.NullString
+	var stream sql.NullString
+	var deletedAt sql.NullTime
+	err = tx.QueryRow(`SELECT ride_id, sender_id, stream_id, deleted_at FROM messages WHERE id = $1 FOR UPDATE`, messageID).
+		Scan(&rideID, &senderID, &stream, &deletedAt)
+	if err == sql.ErrNoRows {
+		return "", "", fmt.Errorf("message not found")
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if deletedAt.Valid {
+		return "", "", fmt.Errorf("message already deleted")
+	}
+	if _, err := tx.Exec(`UPDATE messages SET deleted_at = $2, deleted_by = $3 WHERE id = $1`,
+		messageID, time.Now().UTC(), adminID); err != nil {
+		return "", "", err
+	}
+	details := map[string]interface{}{"rideId": rideID}
+	if senderID.Valid {
+		details["senderId"] = senderID.String
+	}
+	if err := audit(tx, adminID, "delete_message", "message", strconv.FormatInt(messageID, 10), reason, details); err != nil {
+		return "", "", err
+	}
+	return rideID, stream.String, tx.Commit()
+}
+
+// GetReportQueue: 審核佇列，舊的在前 (先進先處理)；cursor 是上一頁最後一筆的 ID
+func GetReportQueue(status string, after int64, limit int) (types.ReportPage, error) {
+	page := types.ReportPage{Items: make([]types.Report, 0)}
+	rows, err := DB.Query(`
+		SELECT `+reportColumns+`, reporter_name, target_user_name FROM (
+			SELECT rp.*, COALESCE(ru.name, '') AS reporter_name, COALESCE(tu.name, '') AS target_user_name
+			FROM reports rp
+			LEFT JOIN users ru ON ru.id = rp.reporter_id
+			LEFT JOIN users tu ON tu.id = rp.target_user_id
+			WHERE rp.status = $1 AND rp.id > $2
+		) q
+		ORDER BY id
+		LIMIT $3`, status, after, limit+1)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var reporterName, targetUserName string
+		r, err := scanReport(rows, &reporterName, &targetUserName)
+		if err != nil {
+			return page, err
+		}
+		r.ReporterName, r.TargetUserName = reporterName, targetUserName
+		page.Items = append(page.Items, r)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextCursor = fmt.Sprint(page.Items[limit-1].ID)
+	}
+	return page, nil
+}
+
+// ResolveReport: 結案 (resolved) 或駁回 (dismissed)；已經處理過的不能再改
+func ResolveReport(reportID int64, adminID, status, resolution string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRow(`SELECT status FROM reports WHERE id = $1 FOR UPDATE`, reportID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("report not found")
+	}
+	if err != nil {
+		return err
+	}
+	if current != "open" {
+		return fmt.Errorf("report is not open")
+	}
+	if _, err := tx.Exec(`
+		UPDATE reports SET status = $2, resolution = NULLIF($3, ''), resolved_by = $4, resolved_at = $5 WHERE id = $1`,
+		reportID, status, resolution, adminID, time.Now().UTC()); err != nil {
+		return err
+	}
+	if err := audit(tx, adminID, "resolve_report", "report", strconv.FormatInt(reportID, 10), resolution,
+		map[string]interface{}{"status": status}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAuditLog: 操作紀錄，新的在前；可以只看某個管理員或某個對象
+func GetAuditLog(adminID, targetType, targetID string, before int64, limit int) (types.AuditPage, error) {
+	page := types.AuditPage{Items: make([]types.AuditEntry, 0)}
+	rows, err := DB.Query(`
+		SELECT a.id, a.admin_id, COALESCE(u.name, ''), a.action, a.target_type, a.target_id, a.reason, a.details, a.created_at
+		FROM admin_audit_log a LEFT JOIN users u ON u.id = a.admin_id
+		WHERE ($1 = '' OR a.admin_id = $1) AND ($2 = '' OR a.target_type = $2) AND ($3 = '' OR a.target_id = $3)
+			AND ($4 = 0 OR a.id < $4)
+		ORDER BY a.id DESC
+		LIMIT $5`, adminID, targetType, targetID, before, limit+1)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e types.AuditEntry
+		var details []byte
+		if err := rows.Scan(&e.ID, &e.AdminID, &e.AdminName, &e.Action, &e.TargetType, &e.TargetID, &e.Reason, &details, &e.CreatedAt); err != nil {
+			return page, err
+		}
+		if len(details) > 0 {
+			e.Details = json.RawMessage(details)
+		}
+		page.Items = append(page.Items, e)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextCursor = fmt.Sprint(page.Items[limit-1].ID)
+	}
+	return page, nil
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/route"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 需要核准的旅程：出發前多久停止受理並讓未處理的申請失效 (main 會用 APPROVAL_CUTOFF 覆蓋)
+var ApprovalCutoff = time.Hour
+
+// insertBookingRequest: 需要核准的旅程，加入時只建立 pending 申請 (不檢查座位)
+// 被拒絕或過期的人可以重新申請；已確認的人不會被改回 pending
+func insertBookingRequest(tx *sql.Tx, b types.Booking) error {
+	var departure time.Time
+	if err := tx.QueryRow(`SELECT departure_time FROM rides WHERE id = $1`, b.RideID).Scan(&departure); err != nil {
+		return err
+	}
+	if !time.Now().UTC().Before(departure.Add(-ApprovalCutoff)) {
+		return fmt.Errorf("booking window closed")
+	}
+
+	stops, err := loadStops(tx, b.RideID)
+	if err != nil {
+		return err
+	}
+	seg, err := route.Resolve(b, len(stops))
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO ride_participants (ride_id, passenger_id, from_seq, to_seq, seats, status, message)
+		VALUES ($1, $2, $3, $4, $5, 'pending', NULLIF($6, ''))
+		ON CONFLICT (ride_id, passenger_id) DO UPDATE
+		SET status = 'pending', message = EXCLUDED.message, from_seq = EXCLUDED.from_seq, to_seq = EXCLUDED.to_seq,
+			seats = EXCLUDED.seats, joined_at = CURRENT_TIMESTAMP, decided_at = NULL
+		WHERE ride_participants.status <> 'confirmed'`,
+		b.RideID, b.PassengerID, seg.From, seg.To, seg.Seats, b.Message)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("already joined")
+	}
+	return nil
+}
+
+// GetPendingRequests: 司機的收件匣 (自己所有旅程中待核准的申請，快截止的排前面)
+func GetPendingRequests(driverID string) ([]types.BookingRequest, error) {
+	rows, err := DB.Query(`
+		SELECT p.ride_id, p.passenger_id, COALESCE(u.name, ''), COALESCE(u.picture, ''), COALESCE(p.message, ''),
+			p.seats, p.from_seq, COALESCE(p.to_seq, -1), p.status, p.joined_at,
+			r.origin, r.destination, r.departure_time
+		FROM ride_participants p
+		JOIN rides r ON r.id = p.ride_id
+		LEFT JOIN users u ON u.id = p.passenger_id
+		WHERE r.driver_id = $1 AND p.status = 'pending'
+		ORDER BY r.departure_time, p.joined_at`, driverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := make([]types.BookingRequest, 0)
+	for rows.Next() {
+		var req types.BookingRequest
+		err := rows.Scan(&req.RideID, &req.PassengerID, &req.PassengerName, &req.PassengerPicture, &req.Message,
+			&req.Seats, &req.FromStop, &req.ToStop, &req.Status, &req.RequestedAt,
+			&req.Origin, &req.Destination, &req.DepartureTime)
+		if err != nil {
+			return nil, err
+		}
+		req.ExpiresAt = req.DepartureTime.Add(-ApprovalCutoff)
+		requests = append(requests, req)
+	}
+	return requests, rows.Err()
+}
+
+// DecideBookingRequest: 司機核准或拒絕申請；核准時才檢查並佔用座位
+func DecideBookingRequest(rideID, driverID, passengerID string, approve bool) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	owner, err := lockRide(tx, rideID)
+	if err != nil {
+		return err
+	}
+	if owner != driverID {
+		return fmt.Errorf("ride not found")
+	}
+
+	var from, to, seats int
+	var departure time.Time
+	err = tx.QueryRow(`
+		SELECT p.from_seq, COALESCE(p.to_seq, -1), p.seats, r.departure_time
+		FROM ride_participants p JOIN rides r ON r.id = p.ride_id
+		WHERE p.ride_id = $1 AND p.passenger_id = $2 AND p.status = 'pending'`,
+		rideID, passengerID).Scan(&from, &to, &seats, &departure)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no pending request")
+	}
+	if err != nil {
+		return err
+	}
+	if !time.Now().UTC().Before(departure.Add(-ApprovalCutoff)) {
+		return fmt.Errorf("booking window closed")
+	}
+
+	if approve {
+		var maxPassengers int
+		if err := tx.QueryRow(`SELECT max_passengers FROM rides WHERE id = $1`, rideID).Scan(&maxPassengers); err != nil {
+			return err
+		}
+		stops, err := loadStops(tx, rideID)
+		if err != nil {
+			return err
+		}
+		if to < 0 {
+			to = len(stops) - 1
+		}
+		bookings, err := loadSegments(tx, rideID, len(stops))
+		if err != nil {
+			return err
+		}
+		seg := route.Segment{From: from, To: to, Seats: seats}
+		if route.FreeSeats(maxPassengers, route.Occupancy(len(stops), bookings), seg) < seg.Seats {
+			return fmt.Errorf("ride is full")
+		}
+	}
+
+	status := "rejected"
+	if approve {
+		status = "confirmed"
+	}
+	_, err = tx.Exec(`
+		UPDATE ride_participants SET status = $3, decided_at = $4
+		WHERE ride_id = $1 AND passenger_id = $2`, rideID, passengerID, status, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if err := updateShares(tx, rideID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ExpirePendingRequests: 截止時間 (出發前 ApprovalCutoff) 已過還沒處理的申請改成 expired
+func ExpirePendingRequests(fence Fence) (int64, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := fence.check(tx); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`
+		UPDATE ride_participants p SET status = 'expired', decided_at = $1
+		FROM rides r
+		WHERE r.id = p.ride_id AND p.status = 'pending' AND r.departure_time <= $2`,
+		time.Now().UTC(), time.Now().UTC().Add(ApprovalCutoff))
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return n, tx.Commit()
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// blockedWith: col 不是跟 $arg 有封鎖關係 (不管誰封鎖誰) 的人，給列表排除司機 / 乘客用
+func blockedWith(col string, arg int) string {
+	return fmt.Sprintf(`%[1]s NOT IN (
+		SELECT blocked_id FROM user_blocks WHERE blocker_id = $%[2]d
+		UNION SELECT blocker_id FROM user_blocks WHERE blocked_id = $%[2]d)`, col, arg)
+}
+
+func BlockUser(blockerID, blockedID string) error {
+	if blockerID == blockedID {
+		return fmt.Errorf("cannot block yourself")
+	}
+	var exists bool
+	if err := DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, blockedID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+	_, err := DB.Exec(`
+		INSERT INTO user_blocks (blocker_id, blocked_id, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (blocker_id, blocked_id) DO NOTHING`, blockerID, blockedID, time.Now().UTC())
+	return err
+}
+
+func UnblockUser(blockerID, blockedID string) error {
+	_, err := DB.Exec(`DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2`, blockerID, blockedID)
+	return err
+}
+
+// GetBlockedUsers: 我封鎖的人，最近封鎖的在前
+func GetBlockedUsers(blockerID string) ([]types.BlockedUser, error) {
+	rows, err := DB.Query(`
+		SELECT b.blocked_id, COALESCE(u.name, ''), COALESCE(u.picture, ''), b.created_at
+		FROM user_blocks b JOIN users u ON u.id = b.blocked_id
+		WHERE b.blocker_id = $1
+		ORDER BY b.created_at DESC`, blockerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]types.BlockedUser, 0)
+	for rows.Next() {
+		var u types.BlockedUser
+		if err := rows.Scan(&u.UserID, &u.Name, &u.Picture, &u.BlockedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// BlockedBy: userID 封鎖的人 (聊天室歷史訊息要濾掉這些人的)
+func BlockedBy(userID string) (map[string]bool, error) {
+	return userSet(`SELECT blocked_id FROM user_blocks WHERE blocker_id = $1`, userID)
+}
+
+// Blockers: 封鎖了 userID 的人 (這些人不會收到 userID 的訊息與訊息通知)
+func Blockers(userID string) (map[string]bool, error) {
+	return userSet(`SELECT blocker_id FROM user_blocks WHERE blocked_id = $1`, userID)
+}
+
+// BlockedWith: others 之中跟 userID 有封鎖關係的人 (不管誰封鎖誰)，媒合與搜尋通知用
+func BlockedWith(userID string, others []string) (map[string]bool, error) {
+	return userSet(`
+		SELECT blocked_id FROM user_blocks WHERE blocker_id = $1 AND blocked_id = ANY($2)
+		UNION SELECT blocker_id FROM user_blocks WHERE blocked_id = $1 AND blocker_id = ANY($2)`,
+		userID, pq.Array(others))
+}
+
+func userSet(query string, args ...interface{}) (map[string]bool, error) {
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	set := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		set[id] = true
+	}
+	return set, rows.Err()
+}
+
+// checkBlocked: 司機封鎖了乘客 (或乘客封鎖了司機) 就不能加入
+func checkBlocked(q queryer, driverID, passengerID string) error {
+	var blocked bool
+	err := q.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM user_blocks
+			WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1))`,
+		driverID, passengerID).Scan(&blocked)
+	if err == nil && blocked {
+		return fmt.Errorf("user is blocked")
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// GetCalendarRides: GetMyRides 再補上行事曆需要的版本資訊
+func GetCalendarRides(userID string) ([]types.Ride, error) {
+	rides, err := GetMyRides(userID)
+	if err != nil || len(rides) == 0 {
+		return rides, err
+	}
+	ids := make([]string, len(rides))
+	index := make(map[string]int, len(rides))
+	for i, r := range rides {
+		ids[i] = r.ID
+		index[r.ID] = i
+	}
+	rows, err := DB.Query(`SELECT id, calendar_sequence, calendar_updated_at FROM rides WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var seq int
+		var updated sql.NullTime
+		if err := rows.Scan(&id, &seq, &updated); err != nil {
+			return nil, err
+		}
+		r := &rides[index[id]]
+		r.CalendarSequence = seq
+		if updated.Valid {
+			r.CalendarUpdatedAt = &updated.Time
+		}
+	}
+	return rides, rows.Err()
+}
+
+// 訂閱 token 只存 SHA-256，資料庫外洩也拿不到可以用的網址
+func hashFeedToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetCalendarFeed: 設定新的訂閱 token (舊的網址立刻失效)
+func SetCalendarFeed(userID, token string) error {
+	_, err := DB.Exec(`
+		INSERT INTO calendar_feeds (user_id, token_hash, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET token_hash = EXCLUDED.token_hash, created_at = EXCLUDED.created_at`,
+		userID, hashFeedToken(token), time.Now().UTC())
+	return err
+}
+
+// GetCalendarFeed: 訂閱網址的建立時間，沒有訂閱回傳 nil
+func GetCalendarFeed(userID string) (*time.Time, error) {
+	var created time.Time
+	err := DB.QueryRow(`SELECT created_at FROM calendar_feeds WHERE user_id = $1`, userID).Scan(&created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func RevokeCalendarFeed(userID string) error {
+	_, err := DB.Exec(`DELETE FROM calendar_feeds WHERE user_id = $1`, userID)
+	return err
+}
+
+// CalendarFeedUser: token 對應的使用者
+func CalendarFeedUser(token string) (string, error) {
+	var userID string
+	err := DB.QueryRow(`SELECT user_id FROM calendar_feeds WHERE token_hash = $1`, hashFeedToken(token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("feed not found")
+	}
+	return userID, err
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/pricing"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// updateShares: 重算每位 confirmed 乘客應付的金額 (呼叫端要先 lockRide)
+// 依加入順序排序，split 的餘數才會固定分給同一批人
+func updateShares(q queryer, rideID string) error {
+	var p pricing.Price
+	err := q.QueryRow(`
+		SELECT COALESCE(price_mode, ''), price_amount, COALESCE(currency, '')
+		FROM rides WHERE id = $1`, rideID).Scan(&p.Mode, &p.Amount, &p.Currency)
+	if err != nil {
+		return err
+	}
+
+	rows, err := q.Query(`
+		SELECT passenger_id, seats FROM ride_participants
+		WHERE ride_id = $1 AND status = 'confirmed'
+		ORDER BY joined_at, passenger_id`, rideID)
+	if err != nil {
+		return err
+	}
+	var passengers []string
+	var seats []int
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			rows.Close()
+			return err
+		}
+		passengers = append(passengers, id)
+		seats = append(seats, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// 沒有佔座位的訂位 (pending / rejected / expired) 不用付錢
+	_, err = q.Exec(`
+		UPDATE ride_participants SET share_amount = NULL
+		WHERE ride_id = $1 AND status <> 'confirmed' AND share_amount IS NOT NULL`, rideID)
+	if err != nil {
+		return err
+	}
+	for i, share := range pricing.Shares(p, seats) {
+		_, err := q.Exec(`
+			UPDATE ride_participants SET share_amount = $3
+			WHERE ride_id = $1 AND passenger_id = $2`, rideID, passengers[i], share)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetCostBreakdown: 旅程的費用明細，只有司機與已確認的乘客看得到
+func GetCostBreakdown(rideID, userID string) (types.CostBreakdown, error) {
+	c := types.CostBreakdown{RideID: rideID, Shares: make([]types.CostShare, 0)}
+	var driverID string
+	err := DB.QueryRow(`
+		SELECT driver_id, COALESCE(price_mode, ''), price_amount, COALESCE(currency, '')
+		FROM rides WHERE id = $1`, rideID).Scan(&driverID, &c.PriceMode, &c.PriceAmount, &c.Currency)
+	if err == sql.ErrNoRows {
+		return c, fmt.Errorf("ride not found")
+	}
+	if err != nil {
+		return c, err
+	}
+
+	rows, err := DB.Query(`
+		SELECT p.passenger_id, COALESCE(u.name, 'Unknown'), p.seats, COALESCE(p.share_amount, 0)
+		FROM ride_participants p
+		LEFT JOIN users u ON u.id = p.passenger_id
+		WHERE p.ride_id = $1 AND p.status = 'confirmed'
+		ORDER BY p.joined_at, p.passenger_id`, rideID)
+	if err != nil {
+		return c, err
+	}
+	defer rows.Close()
+
+	visible := userID == driverID
+	for rows.Next() {
+		var s types.CostShare
+		if err := rows.Scan(&s.PassengerID, &s.PassengerName, &s.Seats, &s.Amount); err != nil {
+			return c, err
+		}
+		if s.PassengerID == userID {
+			visible = true
+		}
+		c.Seats += s.Seats
+		c.Total += s.Amount
+		c.Shares = append(c.Shares, s)
+	}
+	if err := rows.Err(); err != nil {
+		return c, err
+	}
+	if !visible {
+		return types.CostBreakdown{}, fmt.Errorf("not a participant")
+	}
+	return c, nil
+}
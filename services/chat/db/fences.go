@@ -0,0 +1,36 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrStaleFence: 租約已經被別的 replica 拿走 (對方的 fencing token 比較大)，這次的寫入要放棄
+var ErrStaleFence = errors.New("stale job lease")
+
+// Fence: 背景工作目前租約的名稱與 fencing token (jobs.Lease)；Token 0 代表不是從背景工作呼叫，不檢查
+//
+// 工作的每個交易一開始先呼叫 check：token 不比記錄的小才更新並鎖住那一列直到交易結束，
+// 所以卡住之後才醒來的舊持有者，只要新持有者寫過一次，之後的交易都會被拒絕
+// Redis 的計數器如果被清掉 (token 從 1 重新開始)，要手動刪掉 job_fences 裡那個工作的紀錄
+type Fence struct {
+	Job   string
+	Token int64
+}
+
+func (f Fence) check(tx *sql.Tx) error {
+	if f.Token == 0 {
+		return nil
+	}
+	var token int64
+	err := tx.QueryRow(`
+		INSERT INTO job_fences (job, token, updated_at) VALUES ($1, $2, $3)
+		ON CONFLICT (job) DO UPDATE SET token = EXCLUDED.token, updated_at = EXCLUDED.updated_at
+		WHERE job_fences.token <= EXCLUDED.token
+		RETURNING token`, f.Job, f.Token, time.Now().UTC()).Scan(&token)
+	if err == sql.ErrNoRows {
+		return ErrStaleFence
+	}
+	return err
+}
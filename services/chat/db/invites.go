@@ -0,0 +1,190 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+const inviteColumns = `id, COALESCE(ride_id, ''), COALESCE(schedule_id, ''), code, max_uses, uses, expires_at, revoked_at, created_at`
+
+func scanInvite(row rowScanner) (types.RideInvite, error) {
+	var inv types.RideInvite
+	var maxUses sql.NullInt64
+	var expiresAt, revokedAt sql.NullTime
+	err := row.Scan(&inv.ID, &inv.RideID, &inv.ScheduleID, &inv.Code, &maxUses, &inv.Uses, &expiresAt, &revokedAt, &inv.CreatedAt)
+	if maxUses.Valid {
+		n := int(maxUses.Int64)
+		inv.MaxUses = &n
+	}
+	if expiresAt.Valid {
+		inv.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		inv.RevokedAt = &revokedAt.Time
+	}
+	return inv, err
+}
+
+// CreateInvite: 司機替自己的旅程 (或週期排程) 建立邀請；ID 與邀請碼由呼叫端產生
+func CreateInvite(inv types.RideInvite, driverID string) error {
+	if err := checkInviteTarget(inv.RideID, inv.ScheduleID, driverID); err != nil {
+		return err
+	}
+	var expiresAt interface{}
+	if inv.ExpiresAt != nil {
+		expiresAt = inv.ExpiresAt.UTC()
+	}
+	_, err := DB.Exec(`
+		INSERT INTO ride_invites (id, ride_id, schedule_id, code, created_by, max_uses, expires_at, created_at)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, $5, $6, $7, $8)`,
+		inv.ID, inv.RideID, inv.ScheduleID, inv.Code, driverID, inv.MaxUses, expiresAt, inv.CreatedAt.UTC())
+	return err
+}
+
+// checkInviteTarget: 只有旅程 (或排程) 的司機可以管理邀請，別人的一律當作找不到
+func checkInviteTarget(rideID, scheduleID, driverID string) error {
+	var owner string
+	if scheduleID != "" {
+		err := DB.QueryRow(`SELECT driver_id FROM ride_schedules WHERE id = $1`, scheduleID).Scan(&owner)
+		if err == sql.ErrNoRows || (err == nil && owner != driverID) {
+			return fmt.Errorf("schedule not found")
+		}
+		return err
+	}
+	err := DB.QueryRow(`SELECT driver_id FROM rides WHERE id = $1`, rideID).Scan(&owner)
+	if err == sql.ErrNoRows || (err == nil && owner != driverID) {
+		return fmt.Errorf("ride not found")
+	}
+	return err
+}
+
+// GetInvites: 旅程或排程所有的邀請 (含已撤銷的)，新的在前
+func GetInvites(rideID, scheduleID, driverID string) ([]types.RideInvite, error) {
+	if err := checkInviteTarget(rideID, scheduleID, driverID); err != nil {
+		return nil, err
+	}
+	rows, err := DB.Query(`
+		SELECT `+inviteColumns+` FROM ride_invites
+		WHERE ($1 <> '' AND ride_id = $1) OR ($2 <> '' AND schedule_id = $2)
+		ORDER BY created_at DESC`, rideID, scheduleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := make([]types.RideInvite, 0)
+	for rows.Next() {
+		inv, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, inv)
+	}
+	return invites, rows.Err()
+}
+
+// RevokeInvite: 撤銷後連結與邀請碼都不能再用 (已經加入的人不受影響)
+func RevokeInvite(inviteID, driverID string) error {
+	res, err := DB.Exec(`
+		UPDATE ride_invites i SET revoked_at = COALESCE(i.revoked_at, $3)
+		WHERE i.id = $1 AND i.created_by = $2`, inviteID, driverID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("invite not found")
+	}
+	return nil
+}
+
+// findInvite: 用連結 (inviteID) 或邀請碼找邀請，lock = true 時鎖住這一筆
+func findInvite(q queryer, inviteID, code string, lock bool) (types.RideInvite, error) {
+	if inviteID == "" && code == "" {
+		return types.RideInvite{}, fmt.Errorf("invite required")
+	}
+	query := `SELECT ` + inviteColumns + ` FROM ride_invites WHERE ($1 <> '' AND id = $1) OR ($1 = '' AND code = $2)`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+	inv, err := scanInvite(q.QueryRow(query, inviteID, code))
+	if err == sql.ErrNoRows {
+		return inv, fmt.Errorf("invalid invite")
+	}
+	return inv, err
+}
+
+// usable: 撤銷、過期、次數用完的邀請不能再用 (旅程與組織的邀請共用)
+func usable(revokedAt, expiresAt *time.Time, maxUses *int, uses int, now time.Time) error {
+	switch {
+	case revokedAt != nil:
+		return fmt.Errorf("invite revoked")
+	case expiresAt != nil && !now.Before(*expiresAt):
+		return fmt.Errorf("invite expired")
+	case maxUses != nil && uses >= *maxUses:
+		return fmt.Errorf("invite used up")
+	}
+	return nil
+}
+
+// redeemInvite: 檢查邀請屬於這趟旅程 (或它的排程) 而且還能用，再把使用次數 +1 (呼叫端必須已經 lockRide)
+// 鎖住邀請那一筆，同時搶最後一次名額的人只有一個會成功
+func redeemInvite(tx *sql.Tx, b types.Booking) error {
+	inv, err := findInvite(tx, b.InviteID, b.InviteCode, true)
+	if err != nil {
+		return err
+	}
+	var scheduleID string
+	if err := tx.QueryRow(`SELECT COALESCE(schedule_id, '') FROM rides WHERE id = $1`, b.RideID).Scan(&scheduleID); err != nil {
+		return err
+	}
+	if inv.RideID != b.RideID && (inv.ScheduleID == "" || inv.ScheduleID != scheduleID) {
+		return fmt.Errorf("invalid invite")
+	}
+	if err := usable(inv.RevokedAt, inv.ExpiresAt, inv.MaxUses, inv.Uses, time.Now().UTC()); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE ride_invites SET uses = uses + 1 WHERE id = $1`, inv.ID)
+	return err
+}
+
+// GetInviteRides: 收到邀請的人看得到的旅程 (還沒出發的)；排程的邀請會列出之後每一班
+func GetInviteRides(inviteID, code string) (types.RideInvite, []types.Ride, error) {
+	inv, err := findInvite(DB, inviteID, code, false)
+	if err != nil {
+		return inv, nil, err
+	}
+	if err := usable(inv.RevokedAt, inv.ExpiresAt, inv.MaxUses, inv.Uses, time.Now().UTC()); err != nil {
+		return inv, nil, err
+	}
+	rows, err := DB.Query(`
+		SELECT `+rideColumns+` FROM rides r
+		WHERE COALESCE(r.status, 'open') = 'open' AND r.departure_time > $3
+			AND (($1 <> '' AND r.id = $1) OR ($2 <> '' AND r.schedule_id = $2))
+		ORDER BY r.departure_time`, inv.RideID, inv.ScheduleID, time.Now().UTC())
+	if err != nil {
+		return inv, nil, err
+	}
+	defer rows.Close()
+
+	rides := make([]types.Ride, 0)
+	for rows.Next() {
+		r, err := scanRide(rows)
+		if err != nil {
+			return inv, nil, err
+		}
+		rides = append(rides, r)
+	}
+	if err := rows.Err(); err != nil {
+		return inv, nil, err
+	}
+	if err := attachStops(rides); err != nil {
+		return inv, nil, err
+	}
+	if err := attachDriverRatings(rides); err != nil {
+		return inv, nil, err
+	}
+	return inv, rides, attachVehicles(rides, "")
+}
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// MatchRides: 給媒合引擎用的候選旅程 (還開放、出發時間在 [from, to] 之間)
+// 連同每一小段已佔用的座位一起回傳；組織限定的旅程也在裡面，呼叫端要確認乘客是成員 (OrgMembers)
+func MatchRides(from, to time.Time) ([]types.Ride, map[string][]int, error) {
+	return matchRides(`AND r.departure_time BETWEEN $2 AND $3 ORDER BY r.departure_time LIMIT 1000`, from.UTC(), to.UTC())
+}
+
+// MatchRide: 只查一趟 (新旅程建立後的增量媒合)
+func MatchRide(rideID string) ([]types.Ride, map[string][]int, error) {
+	return matchRides(`AND r.id = $2`, rideID)
+}
+
+func matchRides(cond string, args ...interface{}) ([]types.Ride, map[string][]int, error) {
+	query := `SELECT ` + rideColumns + ` FROM rides r
+		WHERE COALESCE(r.status, 'open') = 'open' AND r.departure_time > $1 AND r.visibility <> 'private' ` + cond
+	args = append([]interface{}{time.Now().UTC()}, args...)
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	rides := make([]types.Ride, 0)
+	for rows.Next() {
+		r, err := scanRide(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		rides = append(rides, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err := attachStops(rides); err != nil {
+		return nil, nil, err
+	}
+	// 車上設備要拿來比對偏好 (不需要車牌)
+	if err := attachVehicles(rides, ""); err != nil {
+		return nil, nil, err
+	}
+
+	occupancy, err := loadOccupancy(rides)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rides, occupancy, nil
+}
+
+// MatchRequests: 還沒媒合、可接受的出發時間區間和 [from, to] 有重疊的需求
+func MatchRequests(from, to time.Time) ([]types.RideRequest, error) {
+	return queryRideRequests(`
+		WHERE q.status = 'open' AND q.latest_departure > $1
+			AND q.earliest_departure <= $3 AND q.latest_departure >= $2
+		ORDER BY q.earliest_departure LIMIT 1000`, time.Now().UTC(), from.UTC(), to.UTC())
+}
+
+// SaveMatchProposals: 記錄配對，只回傳這次新增的 (同一組旅程 x 需求只會推薦一次)
+// 多個 replica 同時跑媒合時，靠 UNIQUE (ride_id, request_id) 保證只有一個拿到新配對
+func SaveMatchProposals(proposals []types.MatchProposal) ([]types.MatchProposal, error) {
+	created := make([]types.MatchProposal, 0)
+	now := time.Now().UTC()
+	for _, p := range proposals {
+		err := DB.QueryRow(`
+			INSERT INTO ride_matches (ride_id, request_id, driver_id, passenger_id, score, time_score, proximity_score,
+				seat_score, preference_score, origin_distance_km, destination_distance_km, from_seq, to_seq, free_seats, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+			ON CONFLICT (ride_id, request_id) DO NOTHING
+			RETURNING id`,
+			p.RideID, p.RequestID, p.DriverID, p.PassengerID, p.Score, p.TimeScore, p.ProximityScore,
+			p.SeatScore, p.PreferenceScore, p.OriginDistanceKm, p.DestinationDistanceKm, p.FromStop, p.ToStop, p.FreeSeats, now).
+			Scan(&p.ID)
+		if err == nil {
+			p.CreatedAt = now
+			created = append(created, p)
+			continue
+		}
+		if err != sql.ErrNoRows {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+// GetMyMatches: 推薦給我的配對 (司機看自己的旅程、乘客看自己的需求)
+// 旅程或需求已經不開放、或乘客已經在車上的配對不顯示
+func GetMyMatches(userID string) ([]types.MatchProposal, error) {
+	rows, err := DB.Query(`
+		SELECT m.id, m.ride_id, m.request_id, m.driver_id, m.passenger_id, m.score, m.time_score, m.proximity_score,
+			m.seat_score, m.preference_score, m.origin_distance_km, m.destination_distance_km,
+			m.from_seq, m.to_seq, m.free_seats, m.created_at
+		FROM ride_matches m
+		JOIN rides r ON r.id = m.ride_id
+		JOIN ride_requests q ON q.id = m.request_id
+		WHERE ((m.driver_id = $1 AND NOT m.driver_dismissed) OR (m.passenger_id = $1 AND NOT m.passenger_dismissed))
+			AND COALESCE(r.status, 'open') = 'open' AND r.departure_time > $2
+			AND q.status = 'open' AND q.latest_departure > $2
+			AND NOT EXISTS (SELECT 1 FROM ride_participants p WHERE p.ride_id = m.ride_id AND p.passenger_id = m.passenger_id)
+		ORDER BY m.score DESC, m.id
+		LIMIT 100`, userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := make([]types.MatchProposal, 0)
+	for rows.Next() {
+		var p types.MatchProposal
+		err := rows.Scan(&p.ID, &p.RideID, &p.RequestID, &p.DriverID, &p.PassengerID, &p.Score, &p.TimeScore,
+			&p.ProximityScore, &p.SeatScore, &p.PreferenceScore, &p.OriginDistanceKm, &p.DestinationDistanceKm,
+			&p.FromStop, &p.ToStop, &p.FreeSeats, &p.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return matches, attachMatchDetails(matches, userID)
+}
+
+// attachMatchDetails: 附上旅程與需求的內容
+func attachMatchDetails(matches []types.MatchProposal, viewerID string) error {
+	if len(matches) == 0 {
+		return nil
+	}
+	rideIDs := make([]string, 0, len(matches))
+	requestIDs := make([]string, 0, len(matches))
+	for _, m := range matches {
+		rideIDs = append(rideIDs, m.RideID)
+		requestIDs = append(requestIDs, m.RequestID)
+	}
+
+	rows, err := DB.Query(`SELECT `+rideColumns+` FROM rides r WHERE r.id = ANY($1)`, pq.Array(rideIDs))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	rides := make([]types.Ride, 0)
+	for rows.Next() {
+		r, err := scanRide(rows)
+		if err != nil {
+			return err
+		}
+		rides = append(rides, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := attachStops(rides); err != nil {
+		return err
+	}
+	if err := attachDriverRatings(rides); err != nil {
+		return err
+	}
+	if err := attachVehicles(rides, viewerID); err != nil {
+		return err
+	}
+
+	requests, err := queryRideRequests(`WHERE q.id = ANY($1)`, pq.Array(requestIDs))
+	if err != nil {
+		return err
+	}
+
+	for i := range matches {
+		for j := range rides {
+			if rides[j].ID == matches[i].RideID {
+				matches[i].Ride = &rides[j]
+			}
+		}
+		for j := range requests {
+			if requests[j].ID == matches[i].RequestID {
+				matches[i].Request = &requests[j]
+			}
+		}
+	}
+	return nil
+}
+
+// DismissMatch: 司機或乘客不想再看到這個配對 (只影響自己這一邊)
+func DismissMatch(matchID int64, userID string) error {
+	res, err := DB.Exec(`
+		UPDATE ride_matches SET
+			driver_dismissed = driver_dismissed OR driver_id = $2,
+			passenger_dismissed = passenger_dismissed OR passenger_id = $2
+		WHERE id = $1 AND (driver_id = $2 OR passenger_id = $2)`, matchID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("match not found")
+	}
+	return nil
+}
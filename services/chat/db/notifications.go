@@ -0,0 +1,294 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// GetNotificationPreferences: 沒設定過的人所有管道都開著
+func GetNotificationPreferences(userID string) (types.NotificationPreferences, error) {
+	p := types.NotificationPreferences{Email: true, Push: true, InApp: true, Muted: []string{}}
+	err := DB.QueryRow(`
+		SELECT email, push, in_app, muted FROM notification_preferences WHERE user_id = $1`, userID).
+		Scan(&p.Email, &p.Push, &p.InApp, pq.Array(&p.Muted))
+	if err == sql.ErrNoRows {
+		return p, nil
+	}
+	if p.Muted == nil {
+		p.Muted = []string{}
+	}
+	return p, err
+}
+
+func SaveNotificationPreferences(userID string, p types.NotificationPreferences) error {
+	if p.Muted == nil {
+		p.Muted = []string{}
+	}
+	_, err := DB.Exec(`
+		INSERT INTO notification_preferences (user_id, email, push, in_app, muted, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id) DO UPDATE SET
+			email = EXCLUDED.email, push = EXCLUDED.push, in_app = EXCLUDED.in_app,
+			muted = EXCLUDED.muted, updated_at = EXCLUDED.updated_at`,
+		userID, p.Email, p.Push, p.InApp, pq.Array(p.Muted), time.Now().UTC())
+	return err
+}
+
+// GetUserContact: 寄通知需要的 email 與名字
+func GetUserContact(userID string) (types.User, error) {
+	var u types.User
+	err := DB.QueryRow(`SELECT id, email, COALESCE(name, '') FROM users WHERE id = $1`, userID).Scan(&u.ID, &u.Email, &u.Name)
+	if err == sql.ErrNoRows {
+		return u, fmt.Errorf("user not found")
+	}
+	return u, err
+}
+
+// SavePushSubscription: 同一個 endpoint 換人登入時改成新的使用者
+func SavePushSubscription(userID string, s types.PushSubscription) error {
+	_, err := DB.Exec(`
+		INSERT INTO push_subscriptions (endpoint, user_id, p256dh, auth, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (endpoint) DO UPDATE SET user_id = EXCLUDED.user_id, p256dh = EXCLUDED.p256dh, auth = EXCLUDED.auth`,
+		s.Endpoint, userID, s.Keys.P256dh, s.Keys.Auth, time.Now().UTC())
+	return err
+}
+
+// DeletePushSubscription: userID 空字串代表不檢查擁有者 (推播服務回報訂閱已失效時)
+func DeletePushSubscription(endpoint, userID string) error {
+	_, err := DB.Exec(`DELETE FROM push_subscriptions WHERE endpoint = $1 AND ($2 = '' OR user_id = $2)`, endpoint, userID)
+	return err
+}
+
+func GetPushSubscriptions(userID string) ([]types.PushSubscription, error) {
+	rows, err := DB.Query(`SELECT endpoint, p256dh, auth FROM push_subscriptions WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := make([]types.PushSubscription, 0)
+	for rows.Next() {
+		var s types.PushSubscription
+		if err := rows.Scan(&s.Endpoint, &s.Keys.P256dh, &s.Keys.Auth); err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+// GetPushDeliveries: 這個推播工作已經送到的裝置
+func GetPushDeliveries(jobID int64) (map[string]bool, error) {
+	rows, err := DB.Query(`SELECT endpoint FROM push_deliveries WHERE job_id = $1`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	delivered := make(map[string]bool)
+	for rows.Next() {
+		var endpoint string
+		if err := rows.Scan(&endpoint); err != nil {
+			return nil, err
+		}
+		delivered[endpoint] = true
+	}
+	return delivered, rows.Err()
+}
+
+func RecordPushDelivery(jobID int64, endpoint string) error {
+	_, err := DB.Exec(`
+		INSERT INTO push_deliveries (job_id, endpoint, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (job_id, endpoint) DO NOTHING`, jobID, endpoint, time.Now().UTC())
+	return err
+}
+
+// EnqueueNotification: 排進通知佇列，DedupeKey 重複的直接略過 (回傳 false)
+func EnqueueNotification(j types.NotificationJob) (bool, error) {
+	now := time.Now().UTC()
+	res, err := DB.Exec(`
+		INSERT INTO notification_jobs (user_id, channel, kind, title, body, ride_id, message_id, link, dedupe_key, status, next_attempt_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, 0), NULLIF($8, ''), $9, 'pending', $10, $10)
+		ON CONFLICT (dedupe_key) DO NOTHING`,
+		j.UserID, j.Channel, j.Kind, j.Title, j.Body, j.RideID, j.MessageID, j.Link, j.DedupeKey, now)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// ClaimNotificationJobs: 取出到期的工作，並把下次嘗試時間往後推 lease (當作租約)
+// 用 SKIP LOCKED，多個 replica 同時取也不會拿到同一筆；送到一半掛掉的工作租約過期後會被重送
+func ClaimNotificationJobs(limit int, lease time.Duration) ([]types.NotificationJob, error) {
+	now := time.Now().UTC()
+	rows, err := DB.Query(`
+		UPDATE notification_jobs SET next_attempt_at = $3, attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM notification_jobs
+			WHERE status = 'pending' AND next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, user_id, channel, kind, title, body, COALESCE(ride_id, ''), COALESCE(message_id, 0), COALESCE(link, ''), dedupe_key, attempts`,
+		now, limit, now.Add(lease))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]types.NotificationJob, 0)
+	for rows.Next() {
+		var j types.NotificationJob
+		if err := rows.Scan(&j.ID, &j.UserID, &j.Channel, &j.Kind, &j.Title, &j.Body, &j.RideID, &j.MessageID, &j.Link, &j.DedupeKey, &j.Attempts); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+func CompleteNotificationJob(id int64) error {
+	_, err := DB.Exec(`UPDATE notification_jobs SET status = 'sent', sent_at = $2, last_error = NULL WHERE id = $1`, id, time.Now().UTC())
+	return err
+}
+
+// RetryNotificationJob: retryAt 為 nil 代表不再重試
+func RetryNotificationJob(id int64, cause error, retryAt *time.Time) error {
+	if retryAt == nil {
+		_, err := DB.Exec(`UPDATE notification_jobs SET status = 'failed', last_error = $2 WHERE id = $1`, id, cause.Error())
+		return err
+	}
+	_, err := DB.Exec(`UPDATE notification_jobs SET next_attempt_at = $2, last_error = $3 WHERE id = $1`,
+		id, retryAt.UTC(), cause.Error())
+	return err
+}
+
+// InsertNotification: 站內通知寫進通知中心；jobID 相同的重送不會重複新增 (回傳 false)
+func InsertNotification(n *types.Notification, jobID int64) (bool, error) {
+	err := DB.QueryRow(`
+		INSERT INTO notifications (user_id, kind, title, body, ride_id, message_id, link, job_id, created_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, NULLIF($7, ''), $8, $9)
+		ON CONFLICT (job_id) DO NOTHING
+		RETURNING id`,
+		n.UserID, n.Kind, n.Title, n.Body, n.RideID, n.MessageID, n.Link, jobID, n.CreatedAt.UTC()).Scan(&n.ID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetNotifications: 通知中心，新的在前；before 是上一頁最後一筆的 ID (0 = 第一頁)
+// 多拿一筆判斷還有沒有下一頁
+func GetNotifications(userID string, before int64, limit int) (types.NotificationPage, error) {
+	page := types.NotificationPage{Items: make([]types.Notification, 0)}
+	rows, err := DB.Query(`
+		SELECT id, user_id, kind, title, body, COALESCE(ride_id, ''), message_id, COALESCE(link, ''), created_at, read_at
+		FROM notifications
+		WHERE user_id = $1 AND ($2 = 0 OR id < $2)
+		ORDER BY id DESC
+		LIMIT $3`, userID, before, limit+1)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var n types.Notification
+		var messageID sql.NullInt64
+		var readAt sql.NullTime
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Kind, &n.Title, &n.Body, &n.RideID, &messageID, &n.Link, &n.CreatedAt, &readAt); err != nil {
+			return page, err
+		}
+		if messageID.Valid {
+			n.MessageID = &messageID.Int64
+		}
+		if readAt.Valid {
+			n.ReadAt = &readAt.Time
+		}
+		page.Items = append(page.Items, n)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextCursor = fmt.Sprint(page.Items[limit-1].ID)
+	}
+	page.Unread, err = CountUnreadNotifications(userID)
+	return page, err
+}
+
+func CountUnreadNotifications(userID string) (int, error) {
+	var n int
+	err := DB.QueryRow(`SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL`, userID).Scan(&n)
+	return n, err
+}
+
+// MarkNotificationsRead: ids 為空代表全部已讀；回傳剩下的未讀數
+func MarkNotificationsRead(userID string, ids []int64) (int, error) {
+	_, err := DB.Exec(`
+		UPDATE notifications SET read_at = $3
+		WHERE user_id = $1 AND read_at IS NULL AND (cardinality($2::BIGINT[]) = 0 OR id = ANY($2))`,
+		userID, pq.Array(ids), time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return CountUnreadNotifications(userID)
+}
+
+// GetChatAudience: 聊天室裡該收到訊息通知的人 (司機 + confirmed 乘客)
+func GetChatAudience(rideID string) ([]string, error) {
+	rows, err := DB.Query(`
+		SELECT driver_id FROM rides WHERE id = $1
+		UNION
+		SELECT passenger_id FROM ride_participants WHERE ride_id = $1 AND status = 'confirmed'`, rideID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		users = append(users, id)
+	}
+	return users, rows.Err()
+}
+
+// GetRideAudience: 旅程資料與 confirmed 乘客 (通知用，不管旅程狀態)
+func GetRideAudience(rideID string) (types.Ride, []string, error) {
+	ride, err := scanRide(DB.QueryRow(`SELECT `+rideColumns+` FROM rides r WHERE r.id = $1`, rideID))
+	if err == sql.ErrNoRows {
+		return ride, nil, fmt.Errorf("ride not found")
+	}
+	if err != nil {
+		return ride, nil, err
+	}
+	rows, err := DB.Query(`
+		SELECT passenger_id FROM ride_participants WHERE ride_id = $1 AND status = 'confirmed' ORDER BY joined_at`, rideID)
+	if err != nil {
+		return ride, nil, err
+	}
+	defer rows.Close()
+
+	passengers := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return ride, nil, err
+		}
+		passengers = append(passengers, id)
+	}
+	return ride, passengers, rows.Err()
+}
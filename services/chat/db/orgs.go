@@ -0,0 +1,435 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// visibleRides: 列表與搜尋看得到的旅程條件 (公開的 + viewer 所屬組織的)，arg 是 viewer ID 的參數位置
+// 一律查 org_members，被移除的人不用等 JWT 過期就看不到
+func visibleRides(arg int) string {
+	return fmt.Sprintf(`(r.visibility = 'public' OR (r.visibility = 'org' AND r.org_id IN (
+		SELECT org_id FROM org_members WHERE user_id = $%d AND status = 'active')))`, arg)
+}
+
+// checkRideOrg: 組織限定的旅程只有成員可以加入
+func checkRideOrg(q queryer, rideID, userID string) error {
+	var member bool
+	err := q.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM rides r JOIN org_members m ON m.org_id = r.org_id
+			WHERE r.id = $1 AND m.user_id = $2 AND m.status = 'active')`, rideID, userID).Scan(&member)
+	if err == nil && !member {
+		return fmt.Errorf("not an org member")
+	}
+	return err
+}
+
+// IsOrgMember: 建立組織旅程前檢查司機是不是成員
+func IsOrgMember(orgID, userID string) (bool, error) {
+	var member bool
+	err := DB.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM org_members WHERE org_id = $1 AND user_id = $2 AND status = 'active')`,
+		orgID, userID).Scan(&member)
+	return member, err
+}
+
+// OrgMembers: userIDs 之中哪些人是 orgID 的成員 (媒合與搜尋通知用來過濾組織旅程)
+func OrgMembers(orgID string, userIDs []string) (map[string]bool, error) {
+	rows, err := DB.Query(`
+		SELECT user_id FROM org_members WHERE org_id = $1 AND user_id = ANY($2) AND status = 'active'`,
+		orgID, pq.Array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		members[id] = true
+	}
+	return members, rows.Err()
+}
+
+// CreateOrg: 建立的人是第一個管理員；同網域已經註冊的人直接加入
+func CreateOrg(o types.Organization, creatorID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkDomainsFree(tx, o.ID, o.EmailDomains); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO organizations (id, name, email_domains, created_by, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		o.ID, o.Name, pq.Array(o.EmailDomains), creatorID, o.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO org_members (org_id, user_id, role, status, joined_via, joined_at)
+		VALUES ($1, $2, 'admin', 'active', 'creator', $3)`, o.ID, creatorID, o.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	if err := addDomainMembers(tx, o.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addDomainMembers: 已經註冊、email 網域符合的人加進組織 (之前被移除的不會加回來)
+// 之後才註冊的人由 auth service 登入時加入
+func addDomainMembers(tx *sql.Tx, orgID string) error {
+	_, err := tx.Exec(`
+		INSERT INTO org_members (org_id, user_id, role, status, joined_via, joined_at)
+		SELECT o.id, u.id, 'member', 'active', 'domain', $2
+		FROM organizations o JOIN users u ON split_part(lower(u.email), '@', 2) = ANY(o.email_domains)
+		WHERE o.id = $1
+		ON CONFLICT (org_id, user_id) DO NOTHING`, orgID, time.Now().UTC())
+	return err
+}
+
+// UpdateOrg: 管理員改名稱或網域 (網域拿掉時已經加入的人不受影響)
+func UpdateOrg(o types.Organization, adminID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockOrgAdmin(tx, o.ID, adminID); err != nil {
+		return err
+	}
+	if err := checkDomainsFree(tx, o.ID, o.EmailDomains); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE organizations SET name = $2, email_domains = $3 WHERE id = $1`,
+		o.ID, o.Name, pq.Array(o.EmailDomains))
+	if err != nil {
+		return err
+	}
+	if err := addDomainMembers(tx, o.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkDomainsFree: 一個網域只能屬於一個組織 (不然同網域的人登入時會被加進每個認領它的組織)
+// 用 advisory lock 讓同時認領網域的交易排隊，避免兩邊都檢查通過
+func checkDomainsFree(tx *sql.Tx, orgID string, domains []string) error {
+	if len(domains) == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('organizations.email_domains'))`); err != nil {
+		return err
+	}
+	var taken bool
+	err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM organizations WHERE id <> $1 AND email_domains && $2)`,
+		orgID, pq.Array(domains)).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return fmt.Errorf("domain already claimed")
+	}
+	return nil
+}
+
+// lockOrgAdmin: 鎖住組織那一筆 (成員與管理員的變更都要先拿這個鎖)，確認 userID 是管理員
+// 不是成員的一律當作找不到
+func lockOrgAdmin(tx *sql.Tx, orgID, userID string) error {
+	var role sql.NullString
+	err := tx.QueryRow(`
+		SELECT m.role FROM organizations o
+		LEFT JOIN org_members m ON m.org_id = o.id AND m.user_id = $2 AND m.status = 'active'
+		WHERE o.id = $1
+		FOR UPDATE OF o`, orgID, userID).Scan(&role)
+	if err == sql.ErrNoRows || (err == nil && !role.Valid) {
+		return fmt.Errorf("organization not found")
+	}
+	if err != nil {
+		return err
+	}
+	if role.String != "admin" {
+		return fmt.Errorf("not an org admin")
+	}
+	return nil
+}
+
+// GetMyOrgs: 我加入的組織 (含我的身分與成員數)
+func GetMyOrgs(userID string) ([]types.Organization, error) {
+	rows, err := DB.Query(`
+		SELECT o.id, o.name, o.email_domains, m.role, o.created_at,
+			(SELECT COUNT(*) FROM org_members c WHERE c.org_id = o.id AND c.status = 'active')
+		FROM org_members m JOIN organizations o ON o.id = m.org_id
+		WHERE m.user_id = $1 AND m.status = 'active'
+		ORDER BY o.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := make([]types.Organization, 0)
+	for rows.Next() {
+		var o types.Organization
+		if err := rows.Scan(&o.ID, &o.Name, pq.Array(&o.EmailDomains), &o.Role, &o.CreatedAt, &o.MemberCount); err != nil {
+			return nil, err
+		}
+		if o.EmailDomains == nil {
+			o.EmailDomains = []string{}
+		}
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+// GetOrgMembers: 成員才看得到成員名單，管理員在前
+func GetOrgMembers(orgID, viewerID string) ([]types.OrgMember, error) {
+	member, err := IsOrgMember(orgID, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	if !member {
+		return nil, fmt.Errorf("organization not found")
+	}
+	rows, err := DB.Query(`
+		SELECT m.org_id, m.user_id, COALESCE(u.name, ''), u.email, m.role, m.joined_via, m.joined_at
+		FROM org_members m JOIN users u ON u.id = m.user_id
+		WHERE m.org_id = $1 AND m.status = 'active'
+		ORDER BY m.role = 'admin' DESC, m.joined_at`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]types.OrgMember, 0)
+	for rows.Next() {
+		var m types.OrgMember
+		if err := rows.Scan(&m.OrgID, &m.UserID, &m.Name, &m.Email, &m.Role, &m.JoinedVia, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// SetOrgMemberRole: 管理員把成員升為管理員或降為一般成員 (至少要留一個管理員)
+func SetOrgMemberRole(orgID, userID, role, adminID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockOrgAdmin(tx, orgID, adminID); err != nil {
+		return err
+	}
+	if role != "admin" {
+		if err := keepLastAdmin(tx, orgID, userID); err != nil {
+			return err
+		}
+	}
+	res, err := tx.Exec(`UPDATE org_members SET role = $3 WHERE org_id = $1 AND user_id = $2 AND status = 'active'`,
+		orgID, userID, role)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("not an org member")
+	}
+	return tx.Commit()
+}
+
+// RemoveOrgMember: 管理員移除成員，或自己退出 (actorID == userID)
+// 移除後保留 removed 紀錄，網域相同也不會在下次登入時被加回來 (要重新加入得用邀請碼)
+func RemoveOrgMember(orgID, userID, actorID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if actorID == userID {
+		if _, err := tx.Exec(`SELECT id FROM organizations WHERE id = $1 FOR UPDATE`, orgID); err != nil {
+			return err
+		}
+	} else if err := lockOrgAdmin(tx, orgID, actorID); err != nil {
+		return err
+	}
+	if err := keepLastAdmin(tx, orgID, userID); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`UPDATE org_members SET status = 'removed', role = 'member' WHERE org_id = $1 AND user_id = $2 AND status = 'active'`,
+		orgID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("not an org member")
+	}
+	return tx.Commit()
+}
+
+// keepLastAdmin: userID 是唯一的管理員時不能降級或離開 (呼叫端已經鎖住組織)
+func keepLastAdmin(tx *sql.Tx, orgID, userID string) error {
+	var others int
+	var isAdmin bool
+	err := tx.QueryRow(`
+		SELECT COUNT(*) FILTER (WHERE user_id <> $2), COUNT(*) FILTER (WHERE user_id = $2) > 0
+		FROM org_members WHERE org_id = $1 AND role = 'admin' AND status = 'active'`, orgID, userID).Scan(&others, &isAdmin)
+	if err != nil {
+		return err
+	}
+	if isAdmin && others == 0 {
+		return fmt.Errorf("last org admin")
+	}
+	return nil
+}
+
+const orgInviteColumns = `code, org_id, max_uses, uses, expires_at, revoked_at, created_at`
+
+func scanOrgInvite(row rowScanner) (types.OrgInvite, error) {
+	var inv types.OrgInvite
+	var maxUses sql.NullInt64
+	var expiresAt, revokedAt sql.NullTime
+	err := row.Scan(&inv.Code, &inv.OrgID, &maxUses, &inv.Uses, &expiresAt, &revokedAt, &inv.CreatedAt)
+	if maxUses.Valid {
+		n := int(maxUses.Int64)
+		inv.MaxUses = &n
+	}
+	if expiresAt.Valid {
+		inv.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		inv.RevokedAt = &revokedAt.Time
+	}
+	return inv, err
+}
+
+// CreateOrgInvite: 管理員建立邀請碼 (邀請碼由呼叫端產生)
+func CreateOrgInvite(inv types.OrgInvite, adminID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockOrgAdmin(tx, inv.OrgID, adminID); err != nil {
+		return err
+	}
+	var expiresAt interface{}
+	if inv.ExpiresAt != nil {
+		expiresAt = inv.ExpiresAt.UTC()
+	}
+	_, err = tx.Exec(`
+		INSERT INTO org_invites (code, org_id, created_by, max_uses, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		inv.Code, inv.OrgID, adminID, inv.MaxUses, expiresAt, inv.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetOrgInvites: 管理員查看所有邀請碼 (含已撤銷的)，新的在前
+func GetOrgInvites(orgID, adminID string) ([]types.OrgInvite, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockOrgAdmin(tx, orgID, adminID); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(`SELECT `+orgInviteColumns+` FROM org_invites WHERE org_id = $1 ORDER BY created_at DESC`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := make([]types.OrgInvite, 0)
+	for rows.Next() {
+		inv, err := scanOrgInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, inv)
+	}
+	return invites, rows.Err()
+}
+
+// RevokeOrgInvite: 撤銷邀請碼 (已經加入的人不受影響)
+func RevokeOrgInvite(code, adminID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var orgID string
+	err = tx.QueryRow(`SELECT org_id FROM org_invites WHERE code = $1`, code).Scan(&orgID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("invite not found")
+	}
+	if err != nil {
+		return err
+	}
+	if err := lockOrgAdmin(tx, orgID, adminID); err != nil {
+		if err.Error() == "organization not found" || err.Error() == "not an org admin" {
+			return fmt.Errorf("invite not found")
+		}
+		return err
+	}
+	_, err = tx.Exec(`UPDATE org_invites SET revoked_at = COALESCE(revoked_at, $2) WHERE code = $1`, code, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// JoinOrg: 用邀請碼加入 (之前被移除的人也可以用邀請碼回來)，回傳加入的組織 ID
+func JoinOrg(code, userID string) (string, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	inv, err := scanOrgInvite(tx.QueryRow(`SELECT `+orgInviteColumns+` FROM org_invites WHERE code = $1 FOR UPDATE`, code))
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("invalid invite")
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := usable(inv.RevokedAt, inv.ExpiresAt, inv.MaxUses, inv.Uses, time.Now().UTC()); err != nil {
+		return "", err
+	}
+	res, err := tx.Exec(`
+		INSERT INTO org_members (org_id, user_id, role, status, joined_via, joined_at)
+		VALUES ($1, $2, 'member', 'active', 'invite', $3)
+		ON CONFLICT (org_id, user_id) DO UPDATE SET status = 'active', joined_via = 'invite', joined_at = EXCLUDED.joined_at
+		WHERE org_members.status <> 'active'`, inv.OrgID, userID, time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", fmt.Errorf("already a member")
+	}
+	if _, err := tx.Exec(`UPDATE org_invites SET uses = uses + 1 WHERE code = $1`, code); err != nil {
+		return "", err
+	}
+	return inv.OrgID, tx.Commit()
+}
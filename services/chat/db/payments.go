@@ -0,0 +1,384 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 授權送出後超過這個時間還沒有結果，就用同一個 idempotency key 重送
+var AuthorizationRetryAfter = time.Minute
+
+// Settlement: 結算一個旅程需要的資料
+// Shares 是目前 confirmed 乘客應付的金額，Payments 是每位乘客最新的一筆付款
+type Settlement struct {
+	RideID   string
+	DriverID string
+	Status   string
+	Currency string
+	Shares   map[string]int64
+	Payments map[string]types.Payment
+}
+
+const paymentColumns = `id, ride_id, passenger_id, idempotency_key, COALESCE(reference, ''), amount, captured, currency, status, updated_at`
+
+func scanPayment(row rowScanner) (types.Payment, error) {
+	var p types.Payment
+	err := row.Scan(&p.ID, &p.RideID, &p.PassengerID, &p.IdempotencyKey, &p.Reference, &p.Amount, &p.Captured, &p.Currency, &p.Status, &p.UpdatedAt)
+	return p, err
+}
+
+func GetSettlement(rideID string) (Settlement, error) {
+	s := Settlement{RideID: rideID, Shares: make(map[string]int64), Payments: make(map[string]types.Payment)}
+	err := DB.QueryRow(`
+		SELECT driver_id, COALESCE(status, 'open'), COALESCE(currency, '')
+		FROM rides WHERE id = $1`, rideID).Scan(&s.DriverID, &s.Status, &s.Currency)
+	if err == sql.ErrNoRows {
+		return s, fmt.Errorf("ride not found")
+	}
+	if err != nil {
+		return s, err
+	}
+
+	rows, err := DB.Query(`
+		SELECT passenger_id, share_amount FROM ride_participants
+		WHERE ride_id = $1 AND status = 'confirmed' AND share_amount > 0`, rideID)
+	if err != nil {
+		return s, err
+	}
+	for rows.Next() {
+		var id string
+		var share int64
+		if err := rows.Scan(&id, &share); err != nil {
+			rows.Close()
+			return s, err
+		}
+		s.Shares[id] = share
+	}
+	rows.Close()
+
+	rows, err = DB.Query(`
+		SELECT DISTINCT ON (passenger_id) `+paymentColumns+`
+		FROM ride_payments WHERE ride_id = $1
+		ORDER BY passenger_id, id DESC`, rideID)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return s, err
+		}
+		s.Payments[p.PassengerID] = p
+	}
+	return s, rows.Err()
+}
+
+// StartAuthorization: 建立一筆待授權的付款，回傳要送給供應商的 idempotency key
+// 已經有金額相同的有效授權就回傳空字串；卡在 authorizing 太久的沿用原本的 key 重送
+func StartAuthorization(rideID, passengerID string, amount int64, currency string) (string, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// 鎖住旅程，避免多個 replica 同時替同一位乘客授權
+	if _, err := lockRide(tx, rideID); err != nil {
+		return "", err
+	}
+	var key, status string
+	var current int64
+	var updated time.Time
+	err = tx.QueryRow(`
+		SELECT idempotency_key, amount, status, updated_at FROM ride_payments
+		WHERE ride_id = $1 AND passenger_id = $2 ORDER BY id DESC LIMIT 1`,
+		rideID, passengerID).Scan(&key, &current, &status, &updated)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if err == nil && current == amount {
+		switch status {
+		case "authorized", "captured", "failed":
+			// 同樣金額刷卡失敗的不自動重試，等金額改變 (或乘客重新加入) 再授權
+			return "", nil
+		case "authorizing":
+			if time.Since(updated) < AuthorizationRetryAfter {
+				return "", nil
+			}
+			_, err := tx.Exec(`UPDATE ride_payments SET updated_at = $2 WHERE idempotency_key = $1`, key, time.Now().UTC())
+			if err != nil {
+				return "", err
+			}
+			return key, tx.Commit()
+		}
+	}
+
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM ride_payments WHERE ride_id = $1 AND passenger_id = $2`, rideID, passengerID).Scan(&n); err != nil {
+		return "", err
+	}
+	key = fmt.Sprintf("%s:%s:%d", rideID, passengerID, n+1)
+	now := time.Now().UTC()
+	_, err = tx.Exec(`
+		INSERT INTO ride_payments (ride_id, passenger_id, idempotency_key, amount, currency, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, 'authorizing', $6, $6)`, rideID, passengerID, key, amount, currency, now)
+	if err != nil {
+		return "", err
+	}
+	return key, tx.Commit()
+}
+
+// 事件 -> 允許的前一個狀態
+var paymentTransitions = map[string]string{
+	"authorized": "authorizing",
+	"failed":     "authorizing",
+	"captured":   "authorized",
+	"voided":     "authorized",
+	"refunded":   "captured",
+}
+
+// 付款流程的先後 (authorizing -> authorized/failed -> captured/voided -> refunded)
+var paymentStage = map[string]int{
+	"authorizing": 0,
+	"authorized":  1,
+	"failed":      1,
+	"captured":    2,
+	"voided":      2,
+	"refunded":    3,
+}
+
+// ApplyPaymentEvent: 套用金流事件並記帳，回傳 false 代表這個事件已經處理過 (或狀態已經更新)
+// 同步回傳的結果跟 callback 都走這裡，事件 ID 與傳票 key 都是唯一的，所以重送不會重複記帳
+func ApplyPaymentEvent(e types.PaymentEvent) (bool, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO payment_events (id, type, reference, amount) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO NOTHING`, e.ID, e.Type, e.Reference, e.Amount)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	var p types.Payment
+	if e.IdempotencyKey != "" {
+		p, err = scanPayment(tx.QueryRow(`SELECT `+paymentColumns+` FROM ride_payments WHERE idempotency_key = $1 FOR UPDATE`, e.IdempotencyKey))
+	} else {
+		p, err = scanPayment(tx.QueryRow(`SELECT `+paymentColumns+` FROM ride_payments WHERE reference = $1 FOR UPDATE`, e.Reference))
+	}
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("payment not found")
+	}
+	if err != nil {
+		return false, err
+	}
+	var driverID string
+	if err := tx.QueryRow(`SELECT driver_id FROM rides WHERE id = $1`, p.RideID).Scan(&driverID); err != nil {
+		return false, err
+	}
+
+	// 每種事件只能從特定狀態轉過來；付款已經走到同一步或更後面的 (晚到或不同 ID 的重送) 直接略過
+	from, ok := paymentTransitions[e.Type]
+	if !ok {
+		return false, fmt.Errorf("unknown payment event")
+	}
+	if paymentStage[p.Status] >= paymentStage[e.Type] {
+		return false, tx.Commit()
+	}
+	if p.Status != from {
+		return false, fmt.Errorf("invalid payment transition")
+	}
+
+	payer := account("payer", p.PassengerID, p.Currency)
+	escrow := account("escrow", "", p.Currency)
+	driver := account("driver", driverID, p.Currency)
+	var postings []posting
+	captured := p.Captured
+	switch e.Type {
+	case "authorized":
+		// 圈存：乘客的錢先放到代管帳戶
+		postings = []posting{{escrow, p.Amount}, {payer, -p.Amount}}
+	case "captured":
+		// 請款：代管的錢轉給司機，沒請款的部分退回乘客
+		captured = e.Amount
+		postings = []posting{{escrow, -p.Amount}, {driver, captured}}
+		if rest := p.Amount - captured; rest > 0 {
+			postings = append(postings, posting{payer, rest})
+		}
+	case "voided":
+		postings = []posting{{escrow, -p.Amount}, {payer, p.Amount}}
+	case "refunded":
+		postings = []posting{{driver, -p.Captured}, {payer, p.Captured}}
+	}
+
+	reference := p.Reference
+	if reference == "" {
+		reference = e.Reference
+	}
+	if len(postings) > 0 {
+		if err := postJournal(tx, reference+":"+e.Type, p.ID, e.Type, postings); err != nil {
+			return false, err
+		}
+	}
+	_, err = tx.Exec(`
+		UPDATE ride_payments SET status = $2, reference = NULLIF($3, ''), captured = $4, updated_at = $5
+		WHERE id = $1`, p.ID, e.Type, reference, captured, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// 科目 ID：payer:<乘客>:<幣別>、driver:<司機>:<幣別>、escrow:<幣別> (平台代管)
+type ledgerAccount struct {
+	id, owner, kind, currency string
+}
+
+type posting struct {
+	account ledgerAccount
+	amount  int64
+}
+
+func account(kind, ownerID, currency string) ledgerAccount {
+	id := kind + ":" + currency
+	if ownerID != "" {
+		id = kind + ":" + ownerID + ":" + currency
+	}
+	return ledgerAccount{id: id, owner: ownerID, kind: kind, currency: currency}
+}
+
+// postJournal: 寫一張傳票，key 重複代表已經記過帳
+func postJournal(tx *sql.Tx, key string, paymentID int64, description string, postings []posting) error {
+	var sum int64
+	for _, p := range postings {
+		sum += p.amount
+	}
+	if sum != 0 {
+		return fmt.Errorf("unbalanced journal entry %s", key)
+	}
+
+	var journalID int64
+	err := tx.QueryRow(`
+		INSERT INTO ledger_journal (idempotency_key, payment_id, description) VALUES ($1, $2, $3)
+		ON CONFLICT (idempotency_key) DO NOTHING RETURNING id`, key, paymentID, description).Scan(&journalID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, p := range postings {
+		if p.amount == 0 {
+			continue
+		}
+		_, err := tx.Exec(`
+			INSERT INTO ledger_accounts (id, owner_id, kind, currency) VALUES ($1, NULLIF($2, ''), $3, $4)
+			ON CONFLICT (id) DO NOTHING`, p.account.id, p.account.owner, p.account.kind, p.account.currency)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO ledger_entries (journal_id, account_id, amount) VALUES ($1, $2, $3)`,
+			journalID, p.account.id, p.amount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RidesToSettle: 找出付款狀態跟訂位不一致的旅程 (要授權、請款、作廢或退款)
+func RidesToSettle(limit int) ([]string, error) {
+	stale := time.Now().UTC().Add(-AuthorizationRetryAfter)
+	rows, err := DB.Query(`
+		SELECT ride_id FROM (
+			-- confirmed 乘客還沒有金額相符的付款 (刷卡失敗的等金額改變再試)
+			SELECT p.ride_id FROM ride_participants p
+			JOIN rides r ON r.id = p.ride_id
+			WHERE p.status = 'confirmed' AND p.share_amount > 0
+				AND COALESCE(r.status, 'open') NOT IN ('completed', 'cancelled')
+				AND NOT EXISTS (
+					SELECT 1 FROM ride_payments x
+					WHERE x.ride_id = p.ride_id AND x.passenger_id = p.passenger_id AND x.amount = p.share_amount
+						AND (x.status IN ('authorized', 'failed') OR (x.status = 'authorizing' AND x.updated_at > $1)))
+			UNION
+			-- 授權中的付款：旅程結束要請款、取消或乘客離開要作廢
+			SELECT x.ride_id FROM ride_payments x
+			JOIN rides r ON r.id = x.ride_id
+			WHERE (x.status = 'authorized' AND (
+					COALESCE(r.status, 'open') IN ('completed', 'cancelled')
+					OR NOT EXISTS (
+						SELECT 1 FROM ride_participants p
+						WHERE p.ride_id = x.ride_id AND p.passenger_id = x.passenger_id
+							AND p.status = 'confirmed' AND p.share_amount = x.amount)))
+				OR (x.status = 'captured' AND r.status = 'cancelled')
+				OR (x.status = 'authorizing' AND x.updated_at <= $1)
+		) t LIMIT $2`, stale, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetLedgerAccounts: 使用者名下的科目與餘額 (乘客的 payer 科目是負數 = 已付出)
+func GetLedgerAccounts(userID string) ([]types.LedgerAccount, error) {
+	rows, err := DB.Query(`
+		SELECT a.id, a.kind, a.currency, COALESCE(SUM(e.amount), 0)
+		FROM ledger_accounts a
+		LEFT JOIN ledger_entries e ON e.account_id = a.id
+		WHERE a.owner_id = $1
+		GROUP BY a.id, a.kind, a.currency
+		ORDER BY a.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make([]types.LedgerAccount, 0)
+	for rows.Next() {
+		var a types.LedgerAccount
+		if err := rows.Scan(&a.ID, &a.Kind, &a.Currency, &a.Balance); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// GetMyPayments: 乘客自己的付款紀錄
+func GetMyPayments(userID string) ([]types.Payment, error) {
+	rows, err := DB.Query(`SELECT `+paymentColumns+` FROM ride_payments WHERE passenger_id = $1 ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := make([]types.Payment, 0)
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
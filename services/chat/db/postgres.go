@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	_ "github.com/lib/pq"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/geo"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/route"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/search"
 	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
 )
 
@@ -56,6 +60,11 @@ func createTables() {
 		picture TEXT,
 		role TEXT DEFAULT 'passenger'
 	)`)
+	// 1-1. 停權 (suspended_until 為 NULL 代表沒有期限)；auth service 登入時也會檢查
+	DB.Exec(`ALTER TABLE users
+		ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS suspended_until TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS suspension_reason TEXT`)
 
 	// 2. Rides 表 (旅程)
 	DB.Exec(`CREATE TABLE IF NOT EXISTS rides (
@@ -69,6 +78,93 @@ func createTables() {
 		status TEXT DEFAULT 'open'
 	)`)
 
+	// 2-1. 經緯度 (選填，附近搜尋用)
+	DB.Exec(`ALTER TABLE rides
+		ADD COLUMN IF NOT EXISTS origin_lat DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS origin_lng DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS destination_lat DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS destination_lng DOUBLE PRECISION`)
+	// 2-2. 地理編碼後的標準地名 (origin / destination 保留原始輸入)
+	DB.Exec(`ALTER TABLE rides
+		ADD COLUMN IF NOT EXISTS origin_canonical TEXT,
+		ADD COLUMN IF NOT EXISTS destination_canonical TEXT`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_rides_origin_coords ON rides (origin_lat, origin_lng)`)
+
+	// 2-3. 週期排程 (範本與規則都存 JSON，新增旅程欄位時排程不用跟著改表)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS ride_schedules (
+		id TEXT PRIMARY KEY,
+		driver_id TEXT NOT NULL REFERENCES users(id),
+		template JSONB NOT NULL,
+		rule JSONB NOT NULL,
+		status TEXT NOT NULL DEFAULT 'active',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	// 單一班次的例外 (skip = 這班不開、modify = 這班改時間或人數)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS ride_schedule_exceptions (
+		schedule_id TEXT NOT NULL REFERENCES ride_schedules(id),
+		occurrence_date DATE NOT NULL,
+		action TEXT NOT NULL,
+		overrides JSONB,
+		PRIMARY KEY (schedule_id, occurrence_date)
+	)`)
+	DB.Exec(`ALTER TABLE rides
+		ADD COLUMN IF NOT EXISTS schedule_id TEXT REFERENCES ride_schedules(id),
+		ADD COLUMN IF NOT EXISTS occurrence_date DATE`)
+	DB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_rides_schedule_occurrence
+		ON rides (schedule_id, occurrence_date) WHERE schedule_id IS NOT NULL`)
+
+	// 2-4. 客滿候補的處理方式 (auto / offer)
+	DB.Exec(`ALTER TABLE rides ADD COLUMN IF NOT EXISTS waitlist_mode TEXT NOT NULL DEFAULT 'auto'`)
+
+	// 2-5. 需要司機核准才能加入
+	DB.Exec(`ALTER TABLE rides ADD COLUMN IF NOT EXISTS requires_approval BOOLEAN NOT NULL DEFAULT FALSE`)
+
+	// 2-6. 分攤費用 (金額是最小貨幣單位的整數，price_mode 為 NULL 代表免費)
+	DB.Exec(`ALTER TABLE rides
+		ADD COLUMN IF NOT EXISTS price_mode TEXT,
+		ADD COLUMN IF NOT EXISTS price_amount BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS currency TEXT`)
+
+	// 2-7. 完成時間 (評分期限從這裡開始算)
+	DB.Exec(`ALTER TABLE rides ADD COLUMN IF NOT EXISTS completed_at TIMESTAMP`)
+
+	// 2-8. 車輛 (刪除只做標記，舊旅程還查得到車輛資料)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS vehicles (
+		id TEXT PRIMARY KEY,
+		owner_id TEXT NOT NULL REFERENCES users(id),
+		make TEXT NOT NULL,
+		model TEXT NOT NULL,
+		color TEXT,
+		plate TEXT NOT NULL,
+		seats INT NOT NULL,
+		amenities TEXT[] NOT NULL DEFAULT '{}',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		deleted_at TIMESTAMP
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_vehicles_owner ON vehicles (owner_id)`)
+	DB.Exec(`ALTER TABLE rides ADD COLUMN IF NOT EXISTS vehicle_id TEXT REFERENCES vehicles(id)`)
+
+	// 2-9. 旅程設定 (一般欄位，搜尋時可以直接過濾)
+	DB.Exec(`ALTER TABLE rides
+		ADD COLUMN IF NOT EXISTS luggage TEXT,
+		ADD COLUMN IF NOT EXISTS pets_allowed BOOLEAN NOT NULL DEFAULT FALSE,
+		ADD COLUMN IF NOT EXISTS smoking_allowed BOOLEAN NOT NULL DEFAULT FALSE,
+		ADD COLUMN IF NOT EXISTS music BOOLEAN NOT NULL DEFAULT FALSE,
+		ADD COLUMN IF NOT EXISTS child_seat BOOLEAN NOT NULL DEFAULT FALSE,
+		ADD COLUMN IF NOT EXISTS wheelchair_accessible BOOLEAN NOT NULL DEFAULT FALSE`)
+	// 乘客存在個人檔案的預設搜尋偏好 (NULL = 不限)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS user_ride_preferences (
+		user_id TEXT PRIMARY KEY REFERENCES users(id),
+		min_luggage TEXT,
+		pets_allowed BOOLEAN,
+		smoking_allowed BOOLEAN,
+		music BOOLEAN,
+		child_seat BOOLEAN,
+		wheelchair_accessible BOOLEAN,
+		amenities TEXT[] NOT NULL DEFAULT '{}',
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+
 	// 3. 乘客名單 (Many-to-Many)
 	// 紀錄誰加入了哪個旅程
 	DB.Exec(`CREATE TABLE IF NOT EXISTS ride_participants (
@@ -78,6 +174,278 @@ func createTables() {
 		PRIMARY KEY (ride_id, passenger_id)
 	)`)
 
+	// 3-1. 停靠站 (seq 0 是起點，最後一站是終點)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS ride_stops (
+		ride_id TEXT NOT NULL REFERENCES rides(id),
+		seq INT NOT NULL,
+		name TEXT NOT NULL,
+		canonical TEXT,
+		lat DOUBLE PRECISION,
+		lng DOUBLE PRECISION,
+		estimated_time TIMESTAMP,
+		PRIMARY KEY (ride_id, seq)
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_ride_stops_coords ON ride_stops (lat, lng)`)
+
+	// 3-2. 乘客搭乘區段 [from_seq, to_seq)，to_seq 為 NULL 代表坐到終點 (舊資料)
+	DB.Exec(`ALTER TABLE ride_participants
+		ADD COLUMN IF NOT EXISTS from_seq INT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS to_seq INT`)
+
+	// 3-3. 訂位狀態：pending (等司機核准) / confirmed / rejected / expired
+	// 只有 confirmed 會佔座位；舊資料預設就是 confirmed
+	DB.Exec(`ALTER TABLE ride_participants
+		ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'confirmed',
+		ADD COLUMN IF NOT EXISTS message TEXT,
+		ADD COLUMN IF NOT EXISTS decided_at TIMESTAMP`)
+
+	// 3-4. 一筆訂位可以佔多個座位 (幫同行朋友訂)
+	DB.Exec(`ALTER TABLE ride_participants ADD COLUMN IF NOT EXISTS seats INT NOT NULL DEFAULT 1`)
+	// 3-4-1. 每位乘客應付的金額，乘客加入或離開時重算 (只有 confirmed 有值)
+	DB.Exec(`ALTER TABLE ride_participants ADD COLUMN IF NOT EXISTS share_amount BIGINT`)
+
+	// 3-5. 候補名單 (id 遞增 = FIFO 順序)
+	// offered 狀態在 offer_expires_at 之前會佔住座位，過期後換下一位
+	DB.Exec(`CREATE TABLE IF NOT EXISTS ride_waitlist (
+		id SERIAL PRIMARY KEY,
+		ride_id TEXT NOT NULL REFERENCES rides(id),
+		user_id TEXT NOT NULL REFERENCES users(id),
+		from_seq INT NOT NULL DEFAULT 0,
+		to_seq INT,
+		status TEXT NOT NULL DEFAULT 'waiting',
+		offer_expires_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (ride_id, user_id)
+	)`)
+	DB.Exec(`ALTER TABLE ride_waitlist ADD COLUMN IF NOT EXISTS seats INT NOT NULL DEFAULT 1`)
+
+	// 3-6. 乘客的搭車需求與司機的回應
+	DB.Exec(`CREATE TABLE IF NOT EXISTS ride_requests (
+		id TEXT PRIMARY KEY,
+		passenger_id TEXT NOT NULL REFERENCES users(id),
+		origin TEXT NOT NULL,
+		destination TEXT NOT NULL,
+		origin_canonical TEXT,
+		destination_canonical TEXT,
+		origin_lat DOUBLE PRECISION,
+		origin_lng DOUBLE PRECISION,
+		destination_lat DOUBLE PRECISION,
+		destination_lng DOUBLE PRECISION,
+		departure_time TIMESTAMP NOT NULL,
+		earliest_departure TIMESTAMP NOT NULL,
+		latest_departure TIMESTAMP NOT NULL,
+		seats INT NOT NULL DEFAULT 1,
+		preferences JSONB NOT NULL DEFAULT '{}',
+		message TEXT,
+		status TEXT NOT NULL DEFAULT 'open',
+		ride_id TEXT REFERENCES rides(id),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_ride_requests_open ON ride_requests (status, latest_departure)`)
+	// ride 是新旅程的草稿 (ride_id 為 NULL 時)，接受之後才真的建立
+	DB.Exec(`CREATE TABLE IF NOT EXISTS ride_request_offers (
+		id SERIAL PRIMARY KEY,
+		request_id TEXT NOT NULL REFERENCES ride_requests(id),
+		driver_id TEXT NOT NULL REFERENCES users(id),
+		ride_id TEXT REFERENCES rides(id),
+		ride JSONB,
+		message TEXT,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (request_id, driver_id)
+	)`)
+	// 3-7. 媒合引擎推薦的配對 (同一組旅程 x 需求只推薦一次，司機 / 乘客可以各自略過)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS ride_matches (
+		id SERIAL PRIMARY KEY,
+		ride_id TEXT NOT NULL REFERENCES rides(id),
+		request_id TEXT NOT NULL REFERENCES ride_requests(id),
+		driver_id TEXT NOT NULL REFERENCES users(id),
+		passenger_id TEXT NOT NULL REFERENCES users(id),
+		score DOUBLE PRECISION NOT NULL,
+		time_score DOUBLE PRECISION NOT NULL,
+		proximity_score DOUBLE PRECISION NOT NULL,
+		seat_score DOUBLE PRECISION NOT NULL,
+		preference_score DOUBLE PRECISION NOT NULL,
+		origin_distance_km DOUBLE PRECISION NOT NULL,
+		destination_distance_km DOUBLE PRECISION NOT NULL,
+		from_seq INT NOT NULL,
+		to_seq INT NOT NULL,
+		free_seats INT NOT NULL,
+		driver_dismissed BOOLEAN NOT NULL DEFAULT FALSE,
+		passenger_dismissed BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (ride_id, request_id)
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_ride_matches_driver ON ride_matches (driver_id)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_ride_matches_passenger ON ride_matches (passenger_id)`)
+	// 3-8. 儲存的搜尋條件，以及已經通知過的旅程 (同一個人同一趟只通知一次)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS saved_searches (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL REFERENCES users(id),
+		name TEXT NOT NULL,
+		origin TEXT,
+		destination TEXT,
+		criteria JSONB NOT NULL DEFAULT '{}',
+		alerts BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_alert_at TIMESTAMP
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_saved_searches_user ON saved_searches (user_id)`)
+	// 起終點的經緯度外框 (沒給座標就是 NULL)，新旅程通知時先用 SQL 粗篩
+	DB.Exec(`ALTER TABLE saved_searches
+		ADD COLUMN IF NOT EXISTS origin_min_lat DOUBLE PRECISION, ADD COLUMN IF NOT EXISTS origin_max_lat DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS origin_min_lng DOUBLE PRECISION, ADD COLUMN IF NOT EXISTS origin_max_lng DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS destination_min_lat DOUBLE PRECISION, ADD COLUMN IF NOT EXISTS destination_max_lat DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS destination_min_lng DOUBLE PRECISION, ADD COLUMN IF NOT EXISTS destination_max_lng DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS boxed BOOLEAN NOT NULL DEFAULT FALSE`)
+	backfillSavedSearchBoxes()
+	DB.Exec(`CREATE TABLE IF NOT EXISTS saved_search_alerts (
+		user_id TEXT NOT NULL REFERENCES users(id),
+		ride_id TEXT NOT NULL REFERENCES rides(id),
+		search_id TEXT NOT NULL REFERENCES saved_searches(id) ON DELETE CASCADE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, ride_id)
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_saved_search_alerts_recent ON saved_search_alerts (user_id, created_at)`)
+	// 3-9. 通知：個人設定、Web Push 訂閱、待送佇列 (失敗會重試) 與站內通知中心
+	DB.Exec(`CREATE TABLE IF NOT EXISTS notification_preferences (
+		user_id TEXT PRIMARY KEY REFERENCES users(id),
+		email BOOLEAN NOT NULL DEFAULT TRUE,
+		push BOOLEAN NOT NULL DEFAULT TRUE,
+		in_app BOOLEAN NOT NULL DEFAULT TRUE,
+		muted TEXT[] NOT NULL DEFAULT '{}',
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS push_subscriptions (
+		endpoint TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL REFERENCES users(id),
+		p256dh TEXT NOT NULL,
+		auth TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_push_subscriptions_user ON push_subscriptions (user_id)`)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS notification_jobs (
+		id BIGSERIAL PRIMARY KEY,
+		user_id TEXT NOT NULL REFERENCES users(id),
+		channel TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		title TEXT NOT NULL,
+		body TEXT NOT NULL,
+		ride_id TEXT,
+		link TEXT,
+		dedupe_key TEXT NOT NULL UNIQUE,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NOT NULL,
+		last_error TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		sent_at TIMESTAMP
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_notification_jobs_due ON notification_jobs (status, next_attempt_at)`)
+	// 推播工作已經送到的裝置，重送時跳過
+	DB.Exec(`CREATE TABLE IF NOT EXISTS push_deliveries (
+		job_id BIGINT NOT NULL REFERENCES notification_jobs(id) ON DELETE CASCADE,
+		endpoint TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (job_id, endpoint)
+	)`)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS notifications (
+		id BIGSERIAL PRIMARY KEY,
+		user_id TEXT NOT NULL REFERENCES users(id),
+		kind TEXT NOT NULL,
+		title TEXT NOT NULL,
+		body TEXT NOT NULL,
+		ride_id TEXT,
+		link TEXT,
+		job_id BIGINT UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		read_at TIMESTAMP
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications (user_id, id DESC)`)
+	// 3-10. 聊天訊息的通知連到那一則訊息
+	DB.Exec(`ALTER TABLE notification_jobs ADD COLUMN IF NOT EXISTS message_id BIGINT`)
+	DB.Exec(`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS message_id BIGINT`)
+
+	// 3-11. 行事曆訂閱：旅程改時間或狀態時 SEQUENCE +1；每人一個訂閱 token (只存雜湊)
+	DB.Exec(`ALTER TABLE rides
+		ADD COLUMN IF NOT EXISTS calendar_sequence INT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS calendar_updated_at TIMESTAMP`)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS calendar_feeds (
+		user_id TEXT PRIMARY KEY REFERENCES users(id),
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP NOT NULL
+	)`)
+
+	// 3-12. 不公開旅程與邀請 (綁定一趟旅程或整個週期排程；uses 在加入時遞增)
+	DB.Exec(`ALTER TABLE rides ADD COLUMN IF NOT EXISTS visibility TEXT NOT NULL DEFAULT 'public'`)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS ride_invites (
+		id TEXT PRIMARY KEY,
+		ride_id TEXT REFERENCES rides(id),
+		schedule_id TEXT REFERENCES ride_schedules(id),
+		code TEXT NOT NULL UNIQUE,
+		created_by TEXT NOT NULL REFERENCES users(id),
+		max_uses INT,
+		uses INT NOT NULL DEFAULT 0,
+		expires_at TIMESTAMP,
+		revoked_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_ride_invites_ride ON ride_invites (ride_id)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_ride_invites_schedule ON ride_invites (schedule_id)`)
+
+	// 3-13. 組織：email 網域相同的人登入時自動加入 (auth service 負責)，其他人用邀請碼
+	// 被移除的成員保留一筆 removed，下次登入不會又被網域加回來
+	DB.Exec(`CREATE TABLE IF NOT EXISTS organizations (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		email_domains TEXT[] NOT NULL DEFAULT '{}',
+		created_by TEXT NOT NULL REFERENCES users(id),
+		created_at TIMESTAMP NOT NULL
+	)`)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS org_members (
+		org_id TEXT NOT NULL REFERENCES organizations(id),
+		user_id TEXT NOT NULL REFERENCES users(id),
+		role TEXT NOT NULL DEFAULT 'member',
+		status TEXT NOT NULL DEFAULT 'active',
+		joined_via TEXT NOT NULL,
+		joined_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (org_id, user_id)
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_org_members_user ON org_members (user_id) WHERE status = 'active'`)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS org_invites (
+		code TEXT PRIMARY KEY,
+		org_id TEXT NOT NULL REFERENCES organizations(id),
+		created_by TEXT NOT NULL REFERENCES users(id),
+		max_uses INT,
+		uses INT NOT NULL DEFAULT 0,
+		expires_at TIMESTAMP,
+		revoked_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL
+	)`)
+	DB.Exec(`ALTER TABLE rides ADD COLUMN IF NOT EXISTS org_id TEXT REFERENCES organizations(id)`)
+
+	// 3-14. 封鎖 (雙方互相看不到對方的旅程，被封鎖的人不能加入；封鎖的人看不到對方的訊息)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS user_blocks (
+		blocker_id TEXT NOT NULL REFERENCES users(id),
+		blocked_id TEXT NOT NULL REFERENCES users(id),
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (blocker_id, blocked_id)
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_user_blocks_blocked ON user_blocks (blocked_id)`)
+
+	// 3-15. 管理員操作紀錄 (跟操作寫在同一個交易，不會有做了沒記到的)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS admin_audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		admin_id TEXT NOT NULL REFERENCES users(id),
+		action TEXT NOT NULL,
+		target_type TEXT NOT NULL,
+		target_id TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		details JSONB,
+		created_at TIMESTAMP NOT NULL
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_admin_audit_target ON admin_audit_log (target_type, target_id)`)
+
 	// 4. 訊息表
 	DB.Exec(`CREATE TABLE IF NOT EXISTS messages (
 		id SERIAL PRIMARY KEY,
@@ -87,38 +455,253 @@ func createTables() {
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	)`)
 
+	// 4-1. 旅程互評 (role 是被評的人在這趟的身分)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS ride_ratings (
+		ride_id TEXT NOT NULL REFERENCES rides(id),
+		rater_id TEXT NOT NULL REFERENCES users(id),
+		ratee_id TEXT NOT NULL REFERENCES users(id),
+		role TEXT NOT NULL,
+		score INT NOT NULL CHECK (score BETWEEN 1 AND 5),
+		comment TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (ride_id, rater_id, ratee_id)
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_ride_ratings_ratee ON ride_ratings (ratee_id, role)`)
+
+	// 4-2. 系統訊息 (出發前提醒等) 沒有發送者
+	DB.Exec(`ALTER TABLE messages ALTER COLUMN sender_id DROP NOT NULL`)
+	DB.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS system BOOLEAN NOT NULL DEFAULT FALSE`)
+
+	// 4-3. 送過的出發前提醒 (出發時間改了會是新的一組)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS ride_reminders (
+		ride_id TEXT NOT NULL REFERENCES rides(id),
+		offset_seconds BIGINT NOT NULL,
+		departure_time TIMESTAMP NOT NULL,
+		sent_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (ride_id, offset_seconds, departure_time)
+	)`)
+
+	// 4-4. 檢舉 (管理員的審核佇列)；target_user_id 是被檢舉的人 (旅程的司機、訊息的發送者)
+	// 同一個人對同一個對象只能有一筆還沒處理的檢舉
+	DB.Exec(`CREATE TABLE IF NOT EXISTS reports (
+		id BIGSERIAL PRIMARY KEY,
+		reporter_id TEXT NOT NULL REFERENCES users(id),
+		target_type TEXT NOT NULL,
+		target_id TEXT NOT NULL,
+		target_user_id TEXT REFERENCES users(id),
+		category TEXT NOT NULL,
+		details TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'open',
+		resolution TEXT,
+		resolved_by TEXT REFERENCES users(id),
+		resolved_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL
+	)`)
+	DB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_reports_open
+		ON reports (reporter_id, target_type, target_id) WHERE status = 'open'`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_reports_queue ON reports (status, created_at)`)
+
+	// 4-5. 管理員刪除訊息 (只做標記，內容留著當證據)；stream_id 是 Redis stream 裡那一筆的 ID
+	DB.Exec(`ALTER TABLE messages
+		ADD COLUMN IF NOT EXISTS stream_id TEXT,
+		ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS deleted_by TEXT REFERENCES users(id)`)
+
+	// 5. 付款 (每次授權一筆，金額改變時舊的作廢、新增一筆)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS ride_payments (
+		id SERIAL PRIMARY KEY,
+		ride_id TEXT NOT NULL REFERENCES rides(id),
+		passenger_id TEXT NOT NULL REFERENCES users(id),
+		idempotency_key TEXT NOT NULL UNIQUE,
+		reference TEXT UNIQUE,
+		amount BIGINT NOT NULL,
+		captured BIGINT NOT NULL DEFAULT 0,
+		currency TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'authorizing',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_ride_payments_booking ON ride_payments (ride_id, passenger_id, id)`)
+	// 5-1. 處理過的金流事件 (callback 重送時直接略過)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS payment_events (
+		id TEXT PRIMARY KEY,
+		type TEXT NOT NULL,
+		reference TEXT,
+		amount BIGINT,
+		received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	// 5-2. 複式簿記：科目、傳票、分錄 (同一張傳票的分錄加總為 0，正數為借方)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS ledger_accounts (
+		id TEXT PRIMARY KEY,
+		owner_id TEXT,
+		kind TEXT NOT NULL,
+		currency TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS ledger_journal (
+		id SERIAL PRIMARY KEY,
+		idempotency_key TEXT NOT NULL UNIQUE,
+		payment_id INT REFERENCES ride_payments(id),
+		description TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS ledger_entries (
+		id SERIAL PRIMARY KEY,
+		journal_id INT NOT NULL REFERENCES ledger_journal(id),
+		account_id TEXT NOT NULL REFERENCES ledger_accounts(id),
+		amount BIGINT NOT NULL
+	)`)
+	DB.Exec(`CREATE INDEX IF NOT EXISTS idx_ledger_entries_account ON ledger_entries (account_id)`)
+
+	// 6. 背景工作看過最大的 fencing token (見 Fence)
+	DB.Exec(`CREATE TABLE IF NOT EXISTS job_fences (
+		job TEXT PRIMARY KEY,
+		token BIGINT NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`)
+
 	log.Println("Database tables initialized.")
 }
 
 // --- 業務邏輯函式 ---
 
-// 建立旅程
+// 所有查詢旅程的 SQL 共用這組欄位，順序必須跟 scanRide 一致
+const rideColumns = `
+	r.id,
+	r.driver_id,
+	COALESCE(r.driver_name, 'Unknown'),
+	r.origin,
+	r.destination,
+	r.departure_time,
+	r.max_passengers,
+	COALESCE(r.status, 'open'),
+	(SELECT COALESCE(SUM(p2.seats), 0) FROM ride_participants p2 WHERE p2.ride_id = r.id AND p2.status = 'confirmed') as current_passengers,
+	r.origin_lat,
+	r.origin_lng,
+	r.destination_lat,
+	r.destination_lng,
+	COALESCE(r.origin_canonical, ''),
+	COALESCE(r.destination_canonical, ''),
+	r.waitlist_mode,
+	r.requires_approval,
+	COALESCE(r.schedule_id, ''),
+	COALESCE(TO_CHAR(r.occurrence_date, 'YYYY-MM-DD'), ''),
+	COALESCE(r.price_mode, ''),
+	r.price_amount,
+	COALESCE(r.currency, ''),
+	COALESCE(r.vehicle_id, ''),
+	COALESCE(r.luggage, ''),
+	r.pets_allowed,
+	r.smoking_allowed,
+	r.music,
+	r.child_seat,
+	r.wheelchair_accessible,
+	r.visibility,
+	COALESCE(r.org_id, '')`
+
+// rowScanner: *sql.Row 跟 *sql.Rows 都有 Scan
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRide(row rowScanner) (types.Ride, error) {
+	var r types.Ride
+	var originLat, originLng, destLat, destLng sql.NullFloat64
+	err := row.Scan(
+		&r.ID,
+		&r.DriverID,
+		&r.DriverName,
+		&r.Origin,
+		&r.Destination,
+		&r.DepartureTime,
+		&r.MaxPassengers,
+		&r.Status,
+		&r.CurrentPassengers,
+		&originLat,
+		&originLng,
+		&destLat,
+		&destLng,
+		&r.OriginCanonical,
+		&r.DestinationCanonical,
+		&r.WaitlistMode,
+		&r.RequiresApproval,
+		&r.ScheduleID,
+		&r.OccurrenceDate,
+		&r.PriceMode,
+		&r.PriceAmount,
+		&r.Currency,
+		&r.VehicleID,
+		&r.Luggage,
+		&r.PetsAllowed,
+		&r.SmokingAllowed,
+		&r.Music,
+		&r.ChildSeat,
+		&r.WheelchairAccessible,
+		&r.Visibility,
+		&r.OrgID,
+	)
+	r.OriginLat = floatPtr(originLat)
+	r.OriginLng = floatPtr(originLng)
+	r.DestinationLat = floatPtr(destLat)
+	r.DestinationLng = floatPtr(destLng)
+	return r, err
+}
+
+func floatPtr(f sql.NullFloat64) *float64 {
+	if !f.Valid {
+		return nil
+	}
+	return &f.Float64
+}
+
+// 建立旅程 (連同停靠站一起寫入)
 func CreateRide(ride types.Ride) error {
-	_, err := DB.Exec(`
-		INSERT INTO rides (id, driver_id, driver_name, origin, destination, departure_time, max_passengers)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-		ride.ID, ride.DriverID, ride.DriverName, ride.Origin, ride.Destination, ride.DepartureTime, ride.MaxPassengers,
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertRide(tx, ride); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertRide(q queryer, ride types.Ride) error {
+	// rides.departure_time 是不含時區的 TIMESTAMP，一律存 UTC (過期、提醒、排程都拿 time.Now().UTC() 比)
+	_, err := q.Exec(`
+		INSERT INTO rides (id, driver_id, driver_name, origin, destination, departure_time, max_passengers,
+			origin_lat, origin_lng, destination_lat, destination_lng, origin_canonical, destination_canonical,
+			schedule_id, occurrence_date, waitlist_mode, requires_approval, price_mode, price_amount, currency, vehicle_id,
+			luggage, pets_allowed, smoking_allowed, music, child_seat, wheelchair_accessible, visibility, org_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12, ''), NULLIF($13, ''),
+			NULLIF($14, ''), NULLIF($15, '')::DATE, COALESCE(NULLIF($16, ''), 'auto'), $17,
+			NULLIF($18, ''), $19, NULLIF($20, ''), NULLIF($21, ''),
+			NULLIF($22, ''), $23, $24, $25, $26, $27, COALESCE(NULLIF($28, ''), 'public'), NULLIF($29, ''))`,
+		ride.ID, ride.DriverID, ride.DriverName, ride.Origin, ride.Destination, ride.DepartureTime.UTC(), ride.MaxPassengers,
+		ride.OriginLat, ride.OriginLng, ride.DestinationLat, ride.DestinationLng, ride.OriginCanonical, ride.DestinationCanonical,
+		ride.ScheduleID, ride.OccurrenceDate, ride.WaitlistMode, ride.RequiresApproval,
+		ride.PriceMode, ride.PriceAmount, ride.Currency, ride.VehicleID,
+		ride.Luggage, ride.PetsAllowed, ride.SmokingAllowed, ride.Music, ride.ChildSeat, ride.WheelchairAccessible,
+		ride.Visibility, ride.OrgID,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	return insertStops(q, ride.ID, route.Of(ride))
 }
 
-func GetRides() ([]types.Ride, error) {
+// GetRides: viewerID 看得到的旅程 (公開的 + 所屬組織的)，orgID 不是空字串時只列這個組織的 (組織看板)
+func GetRides(viewerID, orgID string) ([]types.Ride, error) {
 	// 1. 修改 SQL: 明確選取 driver_id, status 等所有欄位
 	// COALESCE 是為了防止資料庫有 NULL 導致 Go 崩潰
 	rows, err := DB.Query(`
-		SELECT 
-			r.id, 
-			r.driver_id,
-			COALESCE(r.driver_name, 'Unknown'), 
-			r.origin, 
-			r.destination, 
-			r.departure_time, 
-			r.max_passengers,
-			COALESCE(r.status, 'open'),
-			(SELECT COUNT(*) FROM ride_participants p WHERE p.ride_id = r.id) as current_passengers
+		SELECT `+rideColumns+`
 		FROM rides r
+		WHERE `+visibleRides(1)+` AND `+blockedWith("r.driver_id", 1)+` AND ($2 = '' OR r.org_id = $2)
 		ORDER BY r.departure_time DESC
-	`)
+	`, viewerID, orgID)
 	if err != nil {
 		log.Printf("Query Failed: %v", err)
 		return nil, err
@@ -129,19 +712,9 @@ func GetRides() ([]types.Ride, error) {
 	rides := make([]types.Ride, 0)
 
 	for rows.Next() {
-		var r types.Ride
-		// 2. 這裡的 Scan 順序必須跟上面的 SELECT 嚴格一致
-		if err := rows.Scan(
-			&r.ID,
-			&r.DriverID, // 補上
-			&r.DriverName,
-			&r.Origin,
-			&r.Destination,
-			&r.DepartureTime,
-			&r.MaxPassengers,
-			&r.Status,
-			&r.CurrentPassengers,
-		); err != nil {
+		// 2. Scan 順序統一由 scanRide 處理 (跟 rideColumns 一致)
+		r, err := scanRide(rows)
+		if err != nil {
 			log.Printf("Row Scan Failed: %v", err) // 如果有錯，Tilt Log 會看到
 			continue
 		}
@@ -154,14 +727,39 @@ func GetRides() ([]types.Ride, error) {
 		return nil, err
 	}
 
+	if err := attachStops(rides); err != nil {
+		return nil, err
+	}
+	if err := attachDriverRatings(rides); err != nil {
+		return nil, err
+	}
+	if err := attachVehicles(rides, ""); err != nil {
+		return nil, err
+	}
+
 	log.Printf("Successfully fetched %d rides", len(rides))
 	return rides, nil
 }
 
 // 儲存訊息
-func SaveMessage(rideID, senderID, content string) error {
-	_, err := DB.Exec(`INSERT INTO messages (ride_id, sender_id, content) VALUES ($1, $2, $3)`, rideID, senderID, content)
-	return err
+func SaveMessage(rideID, senderID, content, streamID string) (int64, error) {
+	var id int64
+	err := DB.QueryRow(`INSERT INTO messages (ride_id, sender_id, content, stream_id) VALUES ($1, $2, $3, NULLIF($4, '')) RETURNING id`,
+		rideID, senderID, content, streamID).Scan(&id)
+	return id, err
+}
+
+// CanDrive: 只有司機 (與管理員) 可以開旅程，停權中的不行；以資料庫為準，換角色要透過 auth service 的 /auth/role
+func CanDrive(userID string) (bool, error) {
+	return canDrive(DB, userID)
+}
+
+func canDrive(q queryer, userID string) (bool, error) {
+	var ok bool
+	err := q.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND role IN ('driver', 'admin') AND NOT (`+activeSuspension+`))`,
+		userID, time.Now().UTC()).Scan(&ok)
+	return ok, err
 }
 
 func GetUserInfo(userID string) (types.User, error) {
@@ -175,13 +773,11 @@ func GetUserInfo(userID string) (types.User, error) {
 func GetMyRides(userID string) ([]types.Ride, error) {
 	// 邏輯：我是司機 OR 我在乘客名單裡
 	rows, err := DB.Query(`
-		SELECT DISTINCT 
-			r.id, r.driver_id, COALESCE(r.driver_name, 'Unknown'), r.origin, r.destination, 
-			r.departure_time, r.max_passengers, COALESCE(r.status, 'open'),
-			(SELECT COUNT(*) FROM ride_participants p2 WHERE p2.ride_id = r.id) as current_passengers
+		SELECT ` + rideColumns + `
 		FROM rides r
-		LEFT JOIN ride_participants p ON r.id = p.ride_id
-		WHERE r.driver_id = $1 OR p.passenger_id = $1
+		WHERE r.driver_id = $1
+			OR EXISTS (SELECT 1 FROM ride_participants p WHERE p.ride_id = r.id AND p.passenger_id = $1
+				AND p.status IN ('confirmed', 'pending'))
 		ORDER BY r.departure_time DESC
 	`, userID)
 	if err != nil { return nil, err }
@@ -189,37 +785,484 @@ func GetMyRides(userID string) ([]types.Ride, error) {
 
 	rides := make([]types.Ride, 0)
 	for rows.Next() {
-		var r types.Ride
-		if err := rows.Scan(&r.ID, &r.DriverID, &r.DriverName, &r.Origin, &r.Destination, &r.DepartureTime, &r.MaxPassengers, &r.Status, &r.CurrentPassengers); err != nil {
+		r, err := scanRide(rows)
+		if err != nil {
 			continue
 		}
 		rides = append(rides, r)
 	}
+	if err := attachStops(rides); err != nil {
+		return nil, err
+	}
+	if err := attachBookingStatus(rides, userID); err != nil {
+		return nil, err
+	}
+	if err := attachDriverRatings(rides); err != nil {
+		return nil, err
+	}
+	if err := attachVehicles(rides, userID); err != nil {
+		return nil, err
+	}
 	return rides, nil
 }
-func JoinRide(rideID, passengerID string) error {
-	// 1. 檢查旅程是否存在以及人數是否已滿
-	var maxPassengers, currentPassengers int
-	err := DB.QueryRow(`
-		SELECT max_passengers,
-		(SELECT COUNT(*) FROM ride_participants WHERE ride_id = $1)
-		FROM rides WHERE id = $1
-	`, rideID).Scan(&maxPassengers, &currentPassengers)
 
+// attachBookingStatus: 補上「我」在每個旅程的訂位狀態 (自己開的車不會有)
+func attachBookingStatus(rides []types.Ride, userID string) error {
+	rows, err := DB.Query(`
+		SELECT ride_id, status, seats, COALESCE(share_amount, 0)
+		FROM ride_participants WHERE passenger_id = $1`, userID)
 	if err != nil {
-		return fmt.Errorf("ride not found or db error: %v", err)
+		return err
 	}
+	defer rows.Close()
 
-	if currentPassengers >= maxPassengers {
+	type booking struct {
+		status string
+		seats  int
+		share  int64
+	}
+	bookings := make(map[string]booking)
+	for rows.Next() {
+		var rideID string
+		var b booking
+		if err := rows.Scan(&rideID, &b.status, &b.seats, &b.share); err != nil {
+			return err
+		}
+		bookings[rideID] = b
+	}
+	for i := range rides {
+		b := bookings[rides[i].ID]
+		rides[i].BookingStatus, rides[i].BookedSeats, rides[i].ShareAmount = b.status, b.seats, b.share
+	}
+	return rows.Err()
+}
+
+// 加入旅程 (可以只訂其中一段)，用 FOR UPDATE 鎖住旅程避免同時超賣
+// 回傳訂位狀態：一般旅程是 confirmed，需要核准的旅程是 pending
+func JoinRide(b types.Booking) (string, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// 1. 檢查旅程是否存在，並鎖住這一筆
+	driverID, err := lockRide(tx, b.RideID)
+	if err != nil {
+		return "", fmt.Errorf("ride not found or db error: %v", err)
+	}
+	if driverID == b.PassengerID {
+		return "", fmt.Errorf("driver cannot join own ride")
+	}
+	if err := checkBlocked(tx, driverID, b.PassengerID); err != nil {
+		return "", err
+	}
+
+	var requiresApproval bool
+	var status, visibility string
+	err = tx.QueryRow(`SELECT requires_approval, COALESCE(status, 'open'), visibility FROM rides WHERE id = $1`, b.RideID).
+		Scan(&requiresApproval, &status, &visibility)
+	if err != nil {
+		return "", err
+	}
+	if status == "completed" || status == "cancelled" {
+		return "", fmt.Errorf("ride is %s", status)
+	}
+	// 不公開的旅程：邀請有效才能加入，加入 (或送出申請) 成功才算用掉一次
+	if visibility == "private" {
+		if err := redeemInvite(tx, b); err != nil {
+			return "", err
+		}
+	}
+	if visibility == "org" {
+		if err := checkRideOrg(tx, b.RideID, b.PassengerID); err != nil {
+			return "", err
+		}
+	}
+	if requiresApproval {
+		if err := insertBookingRequest(tx, b); err != nil {
+			return "", err
+		}
+		return "pending", tx.Commit()
+	}
+
+	if err := insertBooking(tx, b); err != nil {
+		return "", err
+	}
+	return "confirmed", tx.Commit()
+}
+
+// insertBooking: 檢查區段座位後寫入訂位 (呼叫端必須已經 lockRide)
+func insertBooking(tx *sql.Tx, b types.Booking) error {
+	var maxPassengers int
+	if err := tx.QueryRow(`SELECT max_passengers FROM rides WHERE id = $1`, b.RideID).Scan(&maxPassengers); err != nil {
+		return err
+	}
+
+	// 2. 算出要搭的區段，再看這一段每一小段的座位
+	stops, err := loadStops(tx, b.RideID)
+	if err != nil {
+		return err
+	}
+	seg, err := route.Resolve(b, len(stops))
+	if err != nil {
+		return err
+	}
+	bookings, err := loadSegments(tx, b.RideID, len(stops))
+	if err != nil {
+		return err
+	}
+	if route.FreeSeats(maxPassengers, route.Occupancy(len(stops), bookings), seg) < seg.Seats {
 		return fmt.Errorf("ride is full")
 	}
 
-	// 2. 寫入關聯表 (使用 ON CONFLICT 避免重複加入報錯)
-	_, err = DB.Exec(`
-		INSERT INTO ride_participants (ride_id, passenger_id)
-		VALUES ($1, $2)
-		ON CONFLICT (ride_id, passenger_id) DO NOTHING
-	`, rideID, passengerID)
+	// 3. 寫入關聯表
+	if err := upsertParticipant(tx, b.RideID, b.PassengerID, seg); err != nil {
+		return err
+	}
+
+	// 4. 原本在候補名單上的話，直接視為已遞補
+	_, err = tx.Exec(`
+		UPDATE ride_waitlist SET status = 'promoted'
+		WHERE ride_id = $1 AND user_id = $2 AND status IN ('waiting', 'offered')`, b.RideID, b.PassengerID)
+	if err != nil {
+		return err
+	}
+	return updateShares(tx, b.RideID)
+}
+
+// upsertParticipant: 寫入確認的訂位；之前被拒絕、申請過期或還在待核准的那一筆直接改成確認
+// 已經是確認狀態的話回傳 already joined (不能默默當作成功，座位沒有多訂)
+func upsertParticipant(tx *sql.Tx, rideID, passengerID string, seg route.Segment) error {
+	res, err := tx.Exec(`
+		INSERT INTO ride_participants (ride_id, passenger_id, from_seq, to_seq, seats)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (ride_id, passenger_id) DO UPDATE
+		SET status = 'confirmed', from_seq = EXCLUDED.from_seq, to_seq = EXCLUDED.to_seq, seats = EXCLUDED.seats,
+			joined_at = CURRENT_TIMESTAMP, decided_at = NULL
+		WHERE ride_participants.status <> 'confirmed'`,
+		rideID, passengerID, seg.From, seg.To, seg.Seats)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("already joined")
+	}
+	return nil
+}
+
+// 乘客退出旅程，空出來的位子交給候補名單
+func LeaveRide(rideID, passengerID string) ([]types.WaitlistEntry, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockRide(tx, rideID); err != nil {
+		return nil, err
+	}
+	if err := deleteBooking(tx, rideID, passengerID); err != nil {
+		return nil, err
+	}
+	changed, err := promoteWaitlist(tx, rideID)
+	if err != nil {
+		return nil, err
+	}
+	if err := updateShares(tx, rideID); err != nil {
+		return nil, err
+	}
+	return changed, tx.Commit()
+}
+
+// 司機把乘客移出旅程
+func RemovePassenger(rideID, driverID, passengerID string) ([]types.WaitlistEntry, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	owner, err := lockRide(tx, rideID)
+	if err != nil {
+		return nil, err
+	}
+	if owner != driverID {
+		return nil, fmt.Errorf("ride not found")
+	}
+	if err := deleteBooking(tx, rideID, passengerID); err != nil {
+		return nil, err
+	}
+	changed, err := promoteWaitlist(tx, rideID)
+	if err != nil {
+		return nil, err
+	}
+	if err := updateShares(tx, rideID); err != nil {
+		return nil, err
+	}
+	return changed, tx.Commit()
+}
+
+func deleteBooking(tx *sql.Tx, rideID, passengerID string) error {
+	res, err := tx.Exec(`DELETE FROM ride_participants WHERE ride_id = $1 AND passenger_id = $2`, rideID, passengerID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("not a participant")
+	}
+	return nil
+}
+
+// 減少自己訂的座位 (例如同行朋友不去了)，空出來的座位交給候補名單
+// 要全部取消請用 LeaveRide
+func ReduceSeats(c types.SeatChange, passengerID string) ([]types.WaitlistEntry, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockRide(tx, c.RideID); err != nil {
+		return nil, err
+	}
+	var current int
+	err = tx.QueryRow(`
+		SELECT seats FROM ride_participants
+		WHERE ride_id = $1 AND passenger_id = $2 AND status IN ('pending', 'confirmed')`,
+		c.RideID, passengerID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("not a participant")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.Seats < 1 || c.Seats >= current {
+		return nil, fmt.Errorf("can only reduce seats")
+	}
+
+	_, err = tx.Exec(`UPDATE ride_participants SET seats = $3 WHERE ride_id = $1 AND passenger_id = $2`,
+		c.RideID, passengerID, c.Seats)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := promoteWaitlist(tx, c.RideID)
+	if err != nil {
+		return nil, err
+	}
+	if err := updateShares(tx, c.RideID); err != nil {
+		return nil, err
+	}
+	return changed, tx.Commit()
+}
+
+// 司機標記旅程已完成 (出發後才可以)，之後會向乘客請款
+func CompleteRide(rideID, driverID string) error {
+	return setRideStatus(rideID, driverID, "completed")
+}
+
+// 司機取消旅程，乘客的授權會作廢、已請款的會退款
+func CancelRide(rideID, driverID string) error {
+	return setRideStatus(rideID, driverID, "cancelled")
+}
+
+func setRideStatus(rideID, driverID, status string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	owner, err := lockRide(tx, rideID)
+	if err != nil {
+		return err
+	}
+	if owner != driverID {
+		return fmt.Errorf("ride not found")
+	}
+	if err := changeRideStatus(tx, rideID, status); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
+// changeRideStatus: 已經結束的旅程不能再改；還沒出發不能完成 (呼叫端必須已經 lockRide)
+func changeRideStatus(tx *sql.Tx, rideID, status string) error {
+	var current string
+	var departure time.Time
+	err := tx.QueryRow(`SELECT COALESCE(status, 'open'), departure_time FROM rides WHERE id = $1`, rideID).Scan(&current, &departure)
+	if err != nil {
+		return err
+	}
+	if current == "completed" || current == "cancelled" {
+		return fmt.Errorf("ride is %s", current)
+	}
+	if status == "completed" && departure.After(time.Now().UTC()) {
+		return fmt.Errorf("ride has not departed")
+	}
+	_, err = tx.Exec(`
+		UPDATE rides SET status = $2, completed_at = CASE WHEN $2 = 'completed' THEN $3 ELSE completed_at END,
+			calendar_sequence = calendar_sequence + 1, calendar_updated_at = $3
+		WHERE id = $1`, rideID, status, time.Now().UTC())
+	return err
+}
+
+// 司機修改旅程設定；調高人數上限時會自動處理候補
+func UpdateRide(u types.RideUpdate, driverID string) ([]types.WaitlistEntry, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	owner, err := lockRide(tx, u.RideID)
+	if err != nil {
+		return nil, err
+	}
+	if owner != driverID {
+		return nil, fmt.Errorf("ride not found")
+	}
+	if u.WaitlistMode != nil {
+		if _, err := tx.Exec(`UPDATE rides SET waitlist_mode = $2 WHERE id = $1`, u.RideID, *u.WaitlistMode); err != nil {
+			return nil, err
+		}
+	}
+	if u.RequiresApproval != nil {
+		if _, err := tx.Exec(`UPDATE rides SET requires_approval = $2 WHERE id = $1`, u.RideID, *u.RequiresApproval); err != nil {
+			return nil, err
+		}
+	}
+	if u.Visibility != nil {
+		// 沒有設定組織的旅程不能改成組織限定
+		res, err := tx.Exec(`UPDATE rides SET visibility = $2 WHERE id = $1 AND ($2 <> 'org' OR org_id IS NOT NULL)`, u.RideID, *u.Visibility)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil, fmt.Errorf("ride has no organization")
+		}
+	}
+	if u.MaxPassengers != nil {
+		if err := setMaxPassengers(tx, u.RideID, *u.MaxPassengers); err != nil {
+			return nil, err
+		}
+	}
+	changed, err := promoteWaitlist(tx, u.RideID)
+	if err != nil {
+		return nil, err
+	}
+	return changed, tx.Commit()
+}
+
+// setMaxPassengers: 新的上限不能低於目前最擠那一段的人數
+func setMaxPassengers(tx *sql.Tx, rideID string, maxPassengers int) error {
+	stops, err := loadStops(tx, rideID)
+	if err != nil {
+		return err
+	}
+	bookings, err := loadSegments(tx, rideID, len(stops))
+	if err != nil {
+		return err
+	}
+	if maxPassengers < busiest(route.Occupancy(len(stops), bookings)) {
+		return fmt.Errorf("maxPassengers is below current bookings")
+	}
+	var vehicleSeats sql.NullInt64
+	err = tx.QueryRow(`
+		SELECT v.seats FROM rides r JOIN vehicles v ON v.id = r.vehicle_id WHERE r.id = $1`, rideID).Scan(&vehicleSeats)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if vehicleSeats.Valid && int64(maxPassengers) > vehicleSeats.Int64 {
+		return fmt.Errorf("maxPassengers exceeds vehicle seats")
+	}
+	_, err = tx.Exec(`UPDATE rides SET max_passengers = $2 WHERE id = $1`, rideID, maxPassengers)
 	return err
-}
\ No newline at end of file
+}
+
+func busiest(occ []int) int {
+	max := 0
+	for _, n := range occ {
+		if n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+// 附近旅程搜尋：SQL 只做狀態、時間跟外框粗篩，精確距離與排序交給 search package
+func SearchRides(q types.RideSearch) ([]types.RideMatch, error) {
+	query := `
+		SELECT ` + rideColumns + `
+		FROM rides r
+		WHERE COALESCE(r.status, 'open') = 'open' AND r.departure_time > $1 AND ` + visibleRides(2) + ` AND ` + blockedWith("r.driver_id", 2)
+	args := []interface{}{time.Now().UTC(), q.ViewerID}
+	if q.OrgID != "" {
+		args = append(args, q.OrgID)
+		query += fmt.Sprintf(` AND r.org_id = $%d`, len(args))
+	}
+
+	originKm, destinationKm := search.Radii(q)
+	if p, ok := geo.NewPoint(q.OriginLat, q.OriginLng); ok {
+		minLat, maxLat, minLng, maxLng := geo.BoundingBox(p, originKm)
+		args = append(args, minLat, maxLat, minLng, maxLng)
+		query += nearAnyStop("origin", len(args)-3)
+	}
+	if p, ok := geo.NewPoint(q.DestinationLat, q.DestinationLng); ok {
+		minLat, maxLat, minLng, maxLng := geo.BoundingBox(p, destinationKm)
+		args = append(args, minLat, maxLat, minLng, maxLng)
+		query += nearAnyStop("destination", len(args)-3)
+	}
+	query, args = featureConditions(query, args, q.FeatureFilter)
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rides := make([]types.Ride, 0)
+	for rows.Next() {
+		r, err := scanRide(rows)
+		if err != nil {
+			log.Printf("Row Scan Failed: %v", err)
+			continue
+		}
+		rides = append(rides, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := attachStops(rides); err != nil {
+		return nil, err
+	}
+	if err := attachDriverRatings(rides); err != nil {
+		return nil, err
+	}
+	if err := attachVehicles(rides, ""); err != nil {
+		return nil, err
+	}
+
+	matches := make([]types.RideMatch, 0)
+	candidates := make([]types.Ride, 0, len(rides))
+	for _, r := range rides {
+		m, ok := search.Match(r, q)
+		if !ok {
+			continue
+		}
+		candidates = append(candidates, r)
+		matches = append(matches, m)
+	}
+	// 座位是看「這一段」還剩多少，不是整趟；所有候選旅程的訂位一次查完
+	occupancy, err := loadOccupancy(candidates)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range candidates {
+		seg := route.Segment{From: matches[i].FromStop, To: matches[i].ToStop}
+		matches[i].AvailableSeats = route.FreeSeats(r.MaxPassengers, occupancy[r.ID], seg)
+	}
+
+	search.Rank(matches)
+	return matches, nil
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/search"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// featureConditions: 把旅程設定的條件接到 SearchRides 的 WHERE 後面
+func featureConditions(query string, args []interface{}, f types.FeatureFilter) (string, []interface{}) {
+	if f.MinLuggage != "" {
+		args = append(args, pq.Array(search.LuggageAtLeast(f.MinLuggage)))
+		query += fmt.Sprintf(` AND r.luggage = ANY($%d)`, len(args))
+	}
+	for _, c := range []struct {
+		column string
+		want   *bool
+	}{
+		{"pets_allowed", f.PetsAllowed},
+		{"smoking_allowed", f.SmokingAllowed},
+		{"music", f.Music},
+		{"child_seat", f.ChildSeat},
+		{"wheelchair_accessible", f.WheelchairAccessible},
+	} {
+		if c.want != nil {
+			args = append(args, *c.want)
+			query += fmt.Sprintf(` AND r.%s = $%d`, c.column, len(args))
+		}
+	}
+	if len(f.Amenities) > 0 {
+		args = append(args, pq.Array(f.Amenities))
+		query += fmt.Sprintf(` AND EXISTS (SELECT 1 FROM vehicles v WHERE v.id = r.vehicle_id AND v.amenities @> $%d)`, len(args))
+	}
+	return query, args
+}
+
+// GetRidePreferences: 乘客的預設搜尋偏好 (沒存過就是空的 = 不限)
+func GetRidePreferences(userID string) (types.FeatureFilter, error) {
+	var f types.FeatureFilter
+	var pets, smoking, music, childSeat, wheelchair sql.NullBool
+	err := DB.QueryRow(`
+		SELECT COALESCE(min_luggage, ''), pets_allowed, smoking_allowed, music, child_seat, wheelchair_accessible, amenities
+		FROM user_ride_preferences WHERE user_id = $1`, userID).Scan(
+		&f.MinLuggage, &pets, &smoking, &music, &childSeat, &wheelchair, pq.Array(&f.Amenities))
+	if err == sql.ErrNoRows {
+		return f, nil
+	}
+	f.PetsAllowed = boolPtr(pets)
+	f.SmokingAllowed = boolPtr(smoking)
+	f.Music = boolPtr(music)
+	f.ChildSeat = boolPtr(childSeat)
+	f.WheelchairAccessible = boolPtr(wheelchair)
+	return f, err
+}
+
+func SaveRidePreferences(userID string, f types.FeatureFilter) error {
+	if f.Amenities == nil {
+		f.Amenities = []string{}
+	}
+	_, err := DB.Exec(`
+		INSERT INTO user_ride_preferences
+			(user_id, min_luggage, pets_allowed, smoking_allowed, music, child_seat, wheelchair_accessible, amenities, updated_at)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (user_id) DO UPDATE SET
+			min_luggage = EXCLUDED.min_luggage, pets_allowed = EXCLUDED.pets_allowed,
+			smoking_allowed = EXCLUDED.smoking_allowed, music = EXCLUDED.music,
+			child_seat = EXCLUDED.child_seat, wheelchair_accessible = EXCLUDED.wheelchair_accessible,
+			amenities = EXCLUDED.amenities, updated_at = EXCLUDED.updated_at`,
+		userID, f.MinLuggage, f.PetsAllowed, f.SmokingAllowed, f.Music, f.ChildSeat, f.WheelchairAccessible,
+		pq.Array(f.Amenities), time.Now().UTC())
+	return err
+}
+
+func boolPtr(b sql.NullBool) *bool {
+	if !b.Valid {
+		return nil
+	}
+	return &b.Bool
+}
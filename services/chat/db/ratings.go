@@ -0,0 +1,154 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 旅程完成後多久內可以評分
+var RatingWindow = 7 * 24 * time.Hour
+
+// RateUser: 乘客評司機、司機評乘客 (只有 confirmed 的乘客算參與者)
+func RateUser(r types.Rating) error {
+	var driverID, status string
+	var completedAt sql.NullTime
+	err := DB.QueryRow(`
+		SELECT driver_id, COALESCE(status, 'open'), completed_at FROM rides WHERE id = $1`,
+		r.RideID).Scan(&driverID, &status, &completedAt)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("ride not found")
+	}
+	if err != nil {
+		return err
+	}
+	if status != "completed" || !completedAt.Valid {
+		return fmt.Errorf("ride is not completed")
+	}
+	if time.Now().UTC().After(completedAt.Time.Add(RatingWindow)) {
+		return fmt.Errorf("rating window closed")
+	}
+
+	// 決定被評的人的身分；另一方一定要是這趟的 confirmed 乘客
+	passengerID := r.RaterID
+	r.Role = "driver"
+	if r.RaterID == driverID {
+		passengerID, r.Role = r.RateeID, "passenger"
+	} else if r.RateeID != driverID {
+		return fmt.Errorf("not a participant")
+	}
+	var confirmed bool
+	err = DB.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM ride_participants WHERE ride_id = $1 AND passenger_id = $2 AND status = 'confirmed')`,
+		r.RideID, passengerID).Scan(&confirmed)
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		return fmt.Errorf("not a participant")
+	}
+
+	res, err := DB.Exec(`
+		INSERT INTO ride_ratings (ride_id, rater_id, ratee_id, role, score, comment, created_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7)
+		ON CONFLICT (ride_id, rater_id, ratee_id) DO NOTHING`,
+		r.RideID, r.RaterID, r.RateeID, r.Role, r.Score, r.Comment, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("already rated")
+	}
+	return nil
+}
+
+// attachDriverRatings: 一次查出所有司機的評分，填進 Ride.DriverRating
+func attachDriverRatings(rides []types.Ride) error {
+	if len(rides) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(rides))
+	for _, r := range rides {
+		ids = append(ids, r.DriverID)
+	}
+	rows, err := DB.Query(`
+		SELECT ratee_id, AVG(score), COUNT(*) FROM ride_ratings
+		WHERE ratee_id = ANY($1) AND role = 'driver'
+		GROUP BY ratee_id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	summaries := make(map[string]*types.RatingSummary)
+	for rows.Next() {
+		var id string
+		s := &types.RatingSummary{}
+		if err := rows.Scan(&id, &s.Average, &s.Count); err != nil {
+			return err
+		}
+		summaries[id] = s
+	}
+	for i := range rides {
+		rides[i].DriverRating = summaries[rides[i].DriverID]
+	}
+	return rows.Err()
+}
+
+// GetUserProfile: 使用者公開資料 + 兩種身分的評分統計 + 最近的評論
+func GetUserProfile(userID string) (types.UserProfile, error) {
+	p := types.UserProfile{RecentRatings: make([]types.Rating, 0)}
+	err := DB.QueryRow(`
+		SELECT id, COALESCE(name, ''), COALESCE(picture, ''), COALESCE(role, 'passenger')
+		FROM users WHERE id = $1`, userID).Scan(&p.ID, &p.Name, &p.Picture, &p.Role)
+	if err == sql.ErrNoRows {
+		return p, fmt.Errorf("user not found")
+	}
+	if err != nil {
+		return p, err
+	}
+
+	rows, err := DB.Query(`
+		SELECT role, AVG(score), COUNT(*) FROM ride_ratings
+		WHERE ratee_id = $1 GROUP BY role`, userID)
+	if err != nil {
+		return p, err
+	}
+	for rows.Next() {
+		var role string
+		s := &types.RatingSummary{}
+		if err := rows.Scan(&role, &s.Average, &s.Count); err != nil {
+			rows.Close()
+			return p, err
+		}
+		if role == "driver" {
+			p.AsDriver = s
+		} else {
+			p.AsPassenger = s
+		}
+	}
+	rows.Close()
+
+	rows, err = DB.Query(`
+		SELECT r.ride_id, r.rater_id, COALESCE(u.name, 'Unknown'), r.ratee_id, r.role, r.score, COALESCE(r.comment, ''), r.created_at
+		FROM ride_ratings r
+		LEFT JOIN users u ON u.id = r.rater_id
+		WHERE r.ratee_id = $1
+		ORDER BY r.created_at DESC LIMIT 20`, userID)
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r types.Rating
+		if err := rows.Scan(&r.RideID, &r.RaterID, &r.RaterName, &r.RateeID, &r.Role, &r.Score, &r.Comment, &r.CreatedAt); err != nil {
+			return p, err
+		}
+		p.RecentRatings = append(p.RecentRatings, r)
+	}
+	return p, rows.Err()
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// GetUpcomingRides: 還開著、出發時間在 (from, to] 之間的旅程 (出發前提醒用)
+func GetUpcomingRides(from, to time.Time) ([]types.Ride, error) {
+	rows, err := DB.Query(`
+		SELECT `+rideColumns+` FROM rides r
+		WHERE COALESCE(r.status, 'open') = 'open' AND r.departure_time > $1 AND r.departure_time <= $2
+		ORDER BY r.departure_time`, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rides := make([]types.Ride, 0)
+	for rows.Next() {
+		r, err := scanRide(rows)
+		if err != nil {
+			return nil, err
+		}
+		rides = append(rides, r)
+	}
+	return rides, rows.Err()
+}
+
+// ClaimRideReminder: 登記這個提醒並寫入聊天室的系統訊息，回傳訊息 ID
+// 已經送過 (別的 replica 搶先或重啟前送過)、旅程已經取消或出發時間改了，回傳 false
+// 出發時間也是 key 的一部分：改時間之後會照新的時間重新提醒
+func ClaimRideReminder(rideID string, offset time.Duration, departure time.Time, content string, fence Fence) (int64, bool, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	if err := fence.check(tx); err != nil {
+		return 0, false, err
+	}
+	// 鎖住旅程，跟改時間、取消互斥
+	var open bool
+	err = tx.QueryRow(`
+		SELECT COALESCE(status, 'open') = 'open' AND departure_time = $2 FROM rides WHERE id = $1 FOR UPDATE`,
+		rideID, departure.UTC()).Scan(&open)
+	if err == sql.ErrNoRows || (err == nil && !open) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	res, err := tx.Exec(`
+		INSERT INTO ride_reminders (ride_id, offset_seconds, departure_time, sent_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING`, rideID, int64(offset/time.Second), departure.UTC(), time.Now().UTC())
+	if err != nil {
+		return 0, false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, false, nil
+	}
+	var id int64
+	err = tx.QueryRow(`INSERT INTO messages (ride_id, sender_id, content, system) VALUES ($1, NULL, $2, TRUE) RETURNING id`,
+		rideID, content).Scan(&id)
+	if err != nil {
+		return 0, false, err
+	}
+	return id, true, tx.Commit()
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+const reportColumns = `id, reporter_id, target_type, target_id, COALESCE(target_user_id, ''), category, details, status,
+	COALESCE(resolution, ''), resolved_at, created_at`
+
+// scanReport: extra 是 reportColumns 後面多查的欄位 (管理員佇列的名字)
+func scanReport(row rowScanner, extra ...interface{}) (types.Report, error) {
+	var r types.Report
+	var resolvedAt sql.NullTime
+	dest := []interface{}{&r.ID, &r.ReporterID, &r.TargetType, &r.TargetID, &r.TargetUserID, &r.Category, &r.Details, &r.Status,
+		&r.Resolution, &resolvedAt, &r.CreatedAt}
+	err := row.Scan(append(dest, extra...)...)
+	if resolvedAt.Valid {
+		r.ResolvedAt = &resolvedAt.Time
+	}
+	return r, err
+}
+
+// CreateReport: 檢舉進審核佇列；先找出被檢舉的人 (旅程是司機、訊息是發送者)
+// 同一個對象還有沒處理完的檢舉時回傳 already reported
+func CreateReport(r *types.Report) error {
+	target, err := reportTarget(r.TargetType, r.TargetID)
+	if err != nil {
+		return err
+	}
+	if target == r.ReporterID {
+		return fmt.Errorf("cannot report yourself")
+	}
+	r.TargetUserID, r.Status, r.CreatedAt = target, "open", time.Now().UTC()
+	err = DB.QueryRow(`
+		INSERT INTO reports (reporter_id, target_type, target_id, target_user_id, category, details, status, created_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, 'open', $7)
+		ON CONFLICT (reporter_id, target_type, target_id) WHERE status = 'open' DO NOTHING
+		RETURNING id`,
+		r.ReporterID, r.TargetType, r.TargetID, r.TargetUserID, r.Category, r.Details, r.CreatedAt).Scan(&r.ID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("already reported")
+	}
+	return err
+}
+
+// reportTarget: 被檢舉對象的擁有者 (系統訊息沒有發送者，回傳空字串)
+func reportTarget(targetType, targetID string) (string, error) {
+	var owner sql.NullString
+	var err error
+	switch targetType {
+	case "user":
+		err = DB.QueryRow(`SELECT id FROM users WHERE id = $1`, targetID).Scan(&owner)
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("user not found")
+		}
+	case "ride":
+		err = DB.QueryRow(`SELECT driver_id FROM rides WHERE id = $1`, targetID).Scan(&owner)
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("ride not found")
+		}
+	case "message":
+		id, convErr := strconv.ParseInt(targetID, 10, 64)
+		if convErr != nil {
+			return "", fmt.Errorf("message not found")
+		}
+		err = DB.QueryRow(`SELECT sender_id FROM messages WHERE id = $1`, id).Scan(&owner)
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("message not found")
+		}
+	default:
+		return "", fmt.Errorf("invalid report target")
+	}
+	return owner.String, err
+}
+
+// GetMyReports: 我送出的檢舉與處理結果，新的在前
+func GetMyReports(reporterID string) ([]types.Report, error) {
+	rows, err := DB.Query(`SELECT `+reportColumns+` FROM reports WHERE reporter_id = $1 ORDER BY id DESC LIMIT 100`, reporterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := make([]types.Report, 0)
+	for rows.Next() {
+		r, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
@@ -0,0 +1,390 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/geo"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/search"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 過了最晚出發時間還沒媒合的需求，查詢時顯示成 expired
+const rideRequestColumns = `
+	q.id,
+	q.passenger_id,
+	COALESCE(u.name, 'Unknown'),
+	q.origin,
+	q.destination,
+	COALESCE(q.origin_canonical, ''),
+	COALESCE(q.destination_canonical, ''),
+	q.origin_lat,
+	q.origin_lng,
+	q.destination_lat,
+	q.destination_lng,
+	q.departure_time,
+	q.earliest_departure,
+	q.latest_departure,
+	q.seats,
+	q.preferences,
+	COALESCE(q.message, ''),
+	CASE WHEN q.status = 'open' AND q.latest_departure <= NOW() AT TIME ZONE 'UTC' THEN 'expired' ELSE q.status END,
+	COALESCE(q.ride_id, ''),
+	q.created_at`
+
+func scanRideRequest(row rowScanner) (types.RideRequest, error) {
+	var q types.RideRequest
+	var originLat, originLng, destLat, destLng sql.NullFloat64
+	var prefs []byte
+	err := row.Scan(&q.ID, &q.PassengerID, &q.PassengerName, &q.Origin, &q.Destination,
+		&q.OriginCanonical, &q.DestinationCanonical, &originLat, &originLng, &destLat, &destLng,
+		&q.DepartureTime, &q.EarliestDeparture, &q.LatestDeparture, &q.Seats, &prefs, &q.Message,
+		&q.Status, &q.RideID, &q.CreatedAt)
+	if err != nil {
+		return q, err
+	}
+	q.OriginLat, q.OriginLng = floatPtr(originLat), floatPtr(originLng)
+	q.DestinationLat, q.DestinationLng = floatPtr(destLat), floatPtr(destLng)
+	if err := json.Unmarshal(prefs, &q.Preferences); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+func queryRideRequests(query string, args ...interface{}) ([]types.RideRequest, error) {
+	rows, err := DB.Query(`SELECT `+rideRequestColumns+` FROM ride_requests q LEFT JOIN users u ON u.id = q.passenger_id `+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := make([]types.RideRequest, 0)
+	for rows.Next() {
+		q, err := scanRideRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, q)
+	}
+	return requests, rows.Err()
+}
+
+func CreateRideRequest(q types.RideRequest) error {
+	prefs, err := json.Marshal(q.Preferences)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec(`
+		INSERT INTO ride_requests (id, passenger_id, origin, destination, origin_canonical, destination_canonical,
+			origin_lat, origin_lng, destination_lat, destination_lng, departure_time, earliest_departure, latest_departure,
+			seats, preferences, message, status, created_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), $7, $8, $9, $10, $11, $12, $13, $14, $15, NULLIF($16, ''), 'open', $17)`,
+		q.ID, q.PassengerID, q.Origin, q.Destination, q.OriginCanonical, q.DestinationCanonical,
+		q.OriginLat, q.OriginLng, q.DestinationLat, q.DestinationLng,
+		q.DepartureTime.UTC(), q.EarliestDeparture.UTC(), q.LatestDeparture.UTC(),
+		q.Seats, prefs, q.Message, q.CreatedAt.UTC())
+	return err
+}
+
+func GetRideRequest(id string) (types.RideRequest, error) {
+	list, err := queryRideRequests(`WHERE q.id = $1`, id)
+	if err != nil {
+		return types.RideRequest{}, err
+	}
+	if len(list) == 0 {
+		return types.RideRequest{}, fmt.Errorf("request not found")
+	}
+	return list[0], nil
+}
+
+// GetOpenRideRequests: 司機瀏覽還沒媒合的需求 (不含自己的與有封鎖關係的乘客)，可以用起點座標 + 半徑過濾
+func GetOpenRideRequests(viewerID string, near types.RideSearch) ([]types.RideRequest, error) {
+	query := `WHERE q.status = 'open' AND q.latest_departure > $1 AND q.passenger_id <> $2 AND ` + blockedWith("q.passenger_id", 2)
+	args := []interface{}{time.Now().UTC(), viewerID}
+	originKm, destinationKm := search.Radii(near)
+	if p, ok := geo.NewPoint(near.OriginLat, near.OriginLng); ok {
+		minLat, maxLat, minLng, maxLng := geo.BoundingBox(p, originKm)
+		args = append(args, minLat, maxLat, minLng, maxLng)
+		query += fmt.Sprintf(` AND q.origin_lat BETWEEN $%d AND $%d AND q.origin_lng BETWEEN $%d AND $%d`,
+			len(args)-3, len(args)-2, len(args)-1, len(args))
+	}
+	if p, ok := geo.NewPoint(near.DestinationLat, near.DestinationLng); ok {
+		minLat, maxLat, minLng, maxLng := geo.BoundingBox(p, destinationKm)
+		args = append(args, minLat, maxLat, minLng, maxLng)
+		query += fmt.Sprintf(` AND q.destination_lat BETWEEN $%d AND $%d AND q.destination_lng BETWEEN $%d AND $%d`,
+			len(args)-3, len(args)-2, len(args)-1, len(args))
+	}
+	return queryRideRequests(query+` ORDER BY q.earliest_departure LIMIT 200`, args...)
+}
+
+// GetMyRideRequests: 乘客自己的需求，附上司機的回應
+func GetMyRideRequests(passengerID string) ([]types.RideRequest, error) {
+	requests, err := queryRideRequests(`WHERE q.passenger_id = $1 ORDER BY q.created_at DESC`, passengerID)
+	if err != nil || len(requests) == 0 {
+		return requests, err
+	}
+	ids := make([]string, 0, len(requests))
+	for _, q := range requests {
+		ids = append(ids, q.ID)
+	}
+	offers, err := queryRideOffers(`WHERE o.request_id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range offers {
+		for i := range requests {
+			if requests[i].ID == o.RequestID {
+				requests[i].Offers = append(requests[i].Offers, o)
+			}
+		}
+	}
+	return requests, nil
+}
+
+// CancelRideRequest: 乘客撤回需求，還沒處理的回應一起婉拒
+func CancelRideRequest(requestID, passengerID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockOpenRequest(tx, requestID, passengerID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE ride_requests SET status = 'cancelled' WHERE id = $1`, requestID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE ride_request_offers SET status = 'declined' WHERE request_id = $1 AND status = 'pending'`, requestID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// lockOpenRequest: 鎖住需求；passengerID 不是空字串時要是本人的
+func lockOpenRequest(tx *sql.Tx, requestID, passengerID string) error {
+	var owner, status string
+	var latest time.Time
+	err := tx.QueryRow(`
+		SELECT passenger_id, status, latest_departure FROM ride_requests WHERE id = $1 FOR UPDATE`,
+		requestID).Scan(&owner, &status, &latest)
+	if err == sql.ErrNoRows || (err == nil && passengerID != "" && owner != passengerID) {
+		return fmt.Errorf("request not found")
+	}
+	if err != nil {
+		return err
+	}
+	if status != "open" || !latest.After(time.Now().UTC()) {
+		return fmt.Errorf("request is not open")
+	}
+	return nil
+}
+
+const rideOfferColumns = `o.id, o.request_id, o.driver_id, COALESCE(u.name, 'Unknown'), COALESCE(o.ride_id, ''), o.ride,
+	COALESCE(o.message, ''), o.status, o.created_at`
+
+func queryRideOffers(query string, args ...interface{}) ([]types.RideOffer, error) {
+	rows, err := DB.Query(`SELECT `+rideOfferColumns+` FROM ride_request_offers o LEFT JOIN users u ON u.id = o.driver_id `+query+` ORDER BY o.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	offers := make([]types.RideOffer, 0)
+	for rows.Next() {
+		var o types.RideOffer
+		var draft []byte
+		if err := rows.Scan(&o.ID, &o.RequestID, &o.DriverID, &o.DriverName, &o.RideID, &draft, &o.Message, &o.Status, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		if draft != nil {
+			o.Ride = &types.Ride{}
+			if err := json.Unmarshal(draft, o.Ride); err != nil {
+				return nil, err
+			}
+		}
+		offers = append(offers, o)
+	}
+	return offers, rows.Err()
+}
+
+// CreateRideOffer: 司機回應需求 (同一個司機再回應一次會蓋掉原本還沒處理的回應)
+// 用現有旅程的話要是自己的、還沒出發 (座位在乘客接受時才檢查)
+func CreateRideOffer(o types.RideOffer) (int64, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := lockOpenRequest(tx, o.RequestID, ""); err != nil {
+		return 0, err
+	}
+	var passengerID string
+	var earliest, latest time.Time
+	err = tx.QueryRow(`SELECT passenger_id, earliest_departure, latest_departure FROM ride_requests WHERE id = $1`, o.RequestID).
+		Scan(&passengerID, &earliest, &latest)
+	if err != nil {
+		return 0, err
+	}
+	if passengerID == o.DriverID {
+		return 0, fmt.Errorf("cannot offer own request")
+	}
+	if err := checkBlocked(tx, o.DriverID, passengerID); err != nil {
+		return 0, err
+	}
+	inWindow := func(t time.Time) bool { return !t.Before(earliest) && !t.After(latest) }
+
+	var draft []byte
+	if o.RideID != "" {
+		var driverID, status string
+		var departure time.Time
+		err := tx.QueryRow(`SELECT driver_id, COALESCE(status, 'open'), departure_time FROM rides WHERE id = $1`, o.RideID).
+			Scan(&driverID, &status, &departure)
+		if err == sql.ErrNoRows || (err == nil && driverID != o.DriverID) {
+			return 0, fmt.Errorf("ride not found")
+		}
+		if err != nil {
+			return 0, err
+		}
+		if status != "open" || !departure.After(time.Now().UTC()) {
+			return 0, fmt.Errorf("ride is not open")
+		}
+		if !inWindow(departure) {
+			return 0, fmt.Errorf("departure outside requested window")
+		}
+	} else if o.Ride != nil {
+		if !inWindow(o.Ride.DepartureTime.UTC()) {
+			return 0, fmt.Errorf("departure outside requested window")
+		}
+		if draft, err = json.Marshal(o.Ride); err != nil {
+			return 0, err
+		}
+	} else {
+		return 0, fmt.Errorf("offer needs a ride")
+	}
+
+	var id int64
+	err = tx.QueryRow(`
+		INSERT INTO ride_request_offers (request_id, driver_id, ride_id, ride, message, status, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, NULLIF($5, ''), 'pending', $6)
+		ON CONFLICT (request_id, driver_id) DO UPDATE SET
+			ride_id = EXCLUDED.ride_id, ride = EXCLUDED.ride, message = EXCLUDED.message,
+			status = 'pending', created_at = EXCLUDED.created_at
+		RETURNING id`,
+		o.RequestID, o.DriverID, o.RideID, draft, o.Message, time.Now().UTC()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// AcceptRideOffer: 乘客接受回應，需求轉成旅程 (新旅程在這裡才建立)，乘客直接是 confirmed
+// 回傳乘客搭的旅程 ID；新建立的旅程另外回傳 (呼叫端要發 RideCreated)
+func AcceptRideOffer(requestID string, offerID int64, passengerID string) (string, *types.Ride, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockOpenRequest(tx, requestID, passengerID); err != nil {
+		return "", nil, err
+	}
+	var seats int
+	if err := tx.QueryRow(`SELECT seats FROM ride_requests WHERE id = $1`, requestID).Scan(&seats); err != nil {
+		return "", nil, err
+	}
+
+	var rideID string
+	var draft []byte
+	var created *types.Ride
+	err = tx.QueryRow(`
+		SELECT COALESCE(ride_id, ''), ride FROM ride_request_offers
+		WHERE id = $1 AND request_id = $2 AND status = 'pending'`, offerID, requestID).Scan(&rideID, &draft)
+	if err == sql.ErrNoRows {
+		return "", nil, fmt.Errorf("offer not found")
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	if rideID == "" {
+		var ride types.Ride
+		if err := json.Unmarshal(draft, &ride); err != nil {
+			return "", nil, err
+		}
+		if !ride.DepartureTime.After(time.Now().UTC()) {
+			return "", nil, fmt.Errorf("ride is not open")
+		}
+		// 回應之後才換回乘客 (或被停權) 的司機，不能再建立旅程
+		ok, err := canDrive(tx, ride.DriverID)
+		if err != nil {
+			return "", nil, err
+		}
+		if !ok {
+			return "", nil, fmt.Errorf("Only drivers can create rides")
+		}
+		if err := insertRide(tx, ride); err != nil {
+			return "", nil, err
+		}
+		rideID, created = ride.ID, &ride
+	}
+	var status string
+	if err := tx.QueryRow(`SELECT COALESCE(status, 'open') FROM rides WHERE id = $1`, rideID).Scan(&status); err != nil {
+		return "", nil, err
+	}
+	if status != "open" {
+		return "", nil, fmt.Errorf("ride is not open")
+	}
+	driverID, err := lockRide(tx, rideID)
+	if err != nil {
+		return "", nil, err
+	}
+	// 回應之後才封鎖的，接受時擋下來
+	if err := checkBlocked(tx, driverID, passengerID); err != nil {
+		return "", nil, err
+	}
+	// 司機主動提供的座位，不用再經過核准
+	if err := insertBooking(tx, types.Booking{RideID: rideID, PassengerID: passengerID, Seats: seats}); err != nil {
+		return "", nil, err
+	}
+
+	if _, err := tx.Exec(`UPDATE ride_requests SET status = 'matched', ride_id = $2 WHERE id = $1`, requestID, rideID); err != nil {
+		return "", nil, err
+	}
+	_, err = tx.Exec(`
+		UPDATE ride_request_offers SET status = CASE WHEN id = $2 THEN 'accepted' ELSE 'declined' END
+		WHERE request_id = $1 AND status = 'pending'`, requestID, offerID)
+	if err != nil {
+		return "", nil, err
+	}
+	return rideID, created, tx.Commit()
+}
+
+// DeclineRideOffer: 乘客婉拒某個回應 (需求維持 open)
+func DeclineRideOffer(requestID string, offerID int64, passengerID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockOpenRequest(tx, requestID, passengerID); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`
+		UPDATE ride_request_offers SET status = 'declined'
+		WHERE id = $1 AND request_id = $2 AND status = 'pending'`, offerID, requestID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("offer not found")
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/geo"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/route"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/search"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 每個人最多存幾組搜尋條件
+const MaxSavedSearches = 20
+
+// 每個人 24 小時內最多收到幾則新旅程通知 (main 可以用環境變數覆蓋)
+var SavedSearchDailyCap = 10
+
+const savedSearchColumns = `id, user_id, name, COALESCE(origin, ''), COALESCE(destination, ''), criteria, alerts, created_at, last_alert_at`
+
+func scanSavedSearch(row rowScanner) (types.SavedSearch, error) {
+	var s types.SavedSearch
+	var criteria []byte
+	var lastAlert sql.NullTime
+	err := row.Scan(&s.ID, &s.UserID, &s.Name, &s.Origin, &s.Destination, &criteria, &s.Alerts, &s.CreatedAt, &lastAlert)
+	if err != nil {
+		return s, err
+	}
+	if lastAlert.Valid {
+		s.LastAlertAt = &lastAlert.Time
+	}
+	return s, json.Unmarshal(criteria, &s.Criteria)
+}
+
+func querySavedSearches(query string, args ...interface{}) ([]types.SavedSearch, error) {
+	rows, err := DB.Query(`SELECT `+savedSearchColumns+` FROM saved_searches `+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	searches := make([]types.SavedSearch, 0)
+	for rows.Next() {
+		s, err := scanSavedSearch(rows)
+		if err != nil {
+			return nil, err
+		}
+		searches = append(searches, s)
+	}
+	return searches, rows.Err()
+}
+
+func CreateSavedSearch(s types.SavedSearch) error {
+	criteria, err := json.Marshal(s.Criteria)
+	if err != nil {
+		return err
+	}
+	var count int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM saved_searches WHERE user_id = $1`, s.UserID).Scan(&count); err != nil {
+		return err
+	}
+	if count >= MaxSavedSearches {
+		return fmt.Errorf("too many saved searches")
+	}
+	args := append([]interface{}{s.ID, s.UserID, s.Name, s.Origin, s.Destination, criteria, s.Alerts, s.CreatedAt.UTC()},
+		searchBoxes(s.Criteria)...)
+	_, err = DB.Exec(`
+		INSERT INTO saved_searches (id, user_id, name, origin, destination, criteria, alerts, created_at,
+			origin_min_lat, origin_max_lat, origin_min_lng, origin_max_lng,
+			destination_min_lat, destination_max_lat, destination_min_lng, destination_max_lng, boxed)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, TRUE)`, args...)
+	return err
+}
+
+// searchBoxes: 起點與終點的外框 (minLat, maxLat, minLng, maxLng 各四個)，沒給座標的那一端是 NULL
+func searchBoxes(q types.RideSearch) []interface{} {
+	originKm, destinationKm := search.Radii(q)
+	box := func(lat, lng *float64, radiusKm float64) []interface{} {
+		p, ok := geo.NewPoint(lat, lng)
+		if !ok {
+			return []interface{}{nil, nil, nil, nil}
+		}
+		minLat, maxLat, minLng, maxLng := geo.BoundingBox(p, radiusKm)
+		return []interface{}{minLat, maxLat, minLng, maxLng}
+	}
+	return append(box(q.OriginLat, q.OriginLng, originKm), box(q.DestinationLat, q.DestinationLng, destinationKm)...)
+}
+
+// backfillSavedSearchBoxes: 加上外框欄位之前存的搜尋條件補算外框 (只有第一次啟動會有資料)
+func backfillSavedSearchBoxes() {
+	searches, err := querySavedSearches(`WHERE NOT boxed`)
+	if err != nil {
+		log.Printf("backfill saved search boxes: %v", err)
+		return
+	}
+	for _, s := range searches {
+		args := append([]interface{}{s.ID}, searchBoxes(s.Criteria)...)
+		if _, err := DB.Exec(`
+			UPDATE saved_searches SET origin_min_lat = $2, origin_max_lat = $3, origin_min_lng = $4, origin_max_lng = $5,
+				destination_min_lat = $6, destination_max_lat = $7, destination_min_lng = $8, destination_max_lng = $9, boxed = TRUE
+			WHERE id = $1`, args...); err != nil {
+			log.Printf("backfill saved search %s: %v", s.ID, err)
+		}
+	}
+}
+
+func GetSavedSearches(userID string) ([]types.SavedSearch, error) {
+	return querySavedSearches(`WHERE user_id = $1 ORDER BY created_at`, userID)
+}
+
+// SetSavedSearchAlerts: 開關新旅程通知
+func SetSavedSearchAlerts(id, userID string, alerts bool) error {
+	res, err := DB.Exec(`UPDATE saved_searches SET alerts = $3 WHERE id = $1 AND user_id = $2`, id, userID, alerts)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("saved search not found")
+	}
+	return nil
+}
+
+func DeleteSavedSearch(id, userID string) error {
+	res, err := DB.Exec(`DELETE FROM saved_searches WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("saved search not found")
+	}
+	return nil
+}
+
+// GetAlertingSavedSearches: 開著通知、而且旅程有停靠站落在起終點外框裡的搜尋條件 (不含司機自己的)
+// SQL 只做外框粗篩，精確距離與上下車順序交給 alerts.Matches
+// 還沒補算外框的舊資料 (boxed = FALSE) 不篩，一律交給 alerts.Matches
+func GetAlertingSavedSearches(ride types.Ride) ([]types.SavedSearch, error) {
+	var lats, lngs []float64
+	for _, s := range route.Of(ride) {
+		if p, ok := geo.NewPoint(s.Lat, s.Lng); ok {
+			lats, lngs = append(lats, p.Lat), append(lngs, p.Lng)
+		}
+	}
+	return querySavedSearches(`
+		WHERE alerts AND user_id <> $1
+			AND (NOT boxed OR (`+stopInBox("origin")+` AND `+stopInBox("destination")+`))
+		ORDER BY user_id, created_at`, ride.DriverID, pq.Array(lats), pq.Array(lngs))
+}
+
+// stopInBox: 那一端沒給座標就不篩，有給的話至少要有一站在外框裡 ($2, $3 是停靠站的緯度、經度)
+func stopInBox(end string) string {
+	return fmt.Sprintf(`(%[1]s_min_lat IS NULL OR EXISTS (
+		SELECT 1 FROM unnest($2::float8[], $3::float8[]) AS p(lat, lng)
+		WHERE p.lat BETWEEN %[1]s_min_lat AND %[1]s_max_lat AND p.lng BETWEEN %[1]s_min_lng AND %[1]s_max_lng))`, end)
+}
+
+// RecordSavedSearchAlert: 記錄要通知的旅程，回傳 false 代表不用通知
+// (這個人已經因為別的搜尋條件收過這趟，或 24 小時內的通知已經到上限)
+// 同一個人的通知用 advisory lock 排隊，多個 replica 同時處理也不會超過上限
+func RecordSavedSearchAlert(s types.SavedSearch, rideID string) (bool, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('saved_search_alerts:' || $1))`, s.UserID); err != nil {
+		return false, err
+	}
+	now := time.Now().UTC()
+	var sent int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM saved_search_alerts WHERE user_id = $1 AND created_at > $2`,
+		s.UserID, now.Add(-24*time.Hour)).Scan(&sent)
+	if err != nil {
+		return false, err
+	}
+	if sent >= SavedSearchDailyCap {
+		return false, nil
+	}
+	res, err := tx.Exec(`
+		INSERT INTO saved_search_alerts (user_id, ride_id, search_id, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, ride_id) DO NOTHING`, s.UserID, rideID, s.ID, now)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(`UPDATE saved_searches SET last_alert_at = $2 WHERE id = $1`, s.ID, now); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
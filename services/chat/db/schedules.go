@@ -0,0 +1,396 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/schedule"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 建立週期排程 (範本裡的 ID / 出發時間會在產生班次時覆蓋)
+func CreateSchedule(s types.RideSchedule) error {
+	template, err := json.Marshal(s.Ride)
+	if err != nil {
+		return err
+	}
+	rule, err := json.Marshal(s.Rule)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec(`
+		INSERT INTO ride_schedules (id, driver_id, template, rule)
+		VALUES ($1, $2, $3, $4)`,
+		s.ID, s.DriverID, template, rule,
+	)
+	return err
+}
+
+const scheduleColumns = `id, driver_id, template, rule, status, created_at`
+
+func scanSchedule(row rowScanner) (types.RideSchedule, error) {
+	var s types.RideSchedule
+	var template, rule []byte
+	if err := row.Scan(&s.ID, &s.DriverID, &template, &rule, &s.Status, &s.CreatedAt); err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(template, &s.Ride); err != nil {
+		return s, err
+	}
+	err := json.Unmarshal(rule, &s.Rule)
+	return s, err
+}
+
+// 司機自己的所有排程
+func GetMySchedules(driverID string) ([]types.RideSchedule, error) {
+	rows, err := DB.Query(`
+		SELECT `+scheduleColumns+` FROM ride_schedules
+		WHERE driver_id = $1 ORDER BY created_at DESC`, driverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := make([]types.RideSchedule, 0)
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			log.Printf("Schedule Scan Failed: %v", err)
+			continue
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, rows.Err()
+}
+
+// 確認排程存在、屬於這位司機而且還沒取消
+func ownedActiveSchedule(q queryer, scheduleID, driverID string) error {
+	var owner, status string
+	err := q.QueryRow(`SELECT driver_id, status FROM ride_schedules WHERE id = $1`, scheduleID).Scan(&owner, &status)
+	if err == sql.ErrNoRows || (err == nil && owner != driverID) {
+		return fmt.Errorf("schedule not found")
+	}
+	if err != nil {
+		return err
+	}
+	if status != "active" {
+		return fmt.Errorf("schedule is cancelled")
+	}
+	return nil
+}
+
+// 取消整個系列：排程停用，尚未出發的班次一起取消
+func CancelSchedule(scheduleID, driverID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := ownedActiveSchedule(tx, scheduleID, driverID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE ride_schedules SET status = 'cancelled' WHERE id = $1`, scheduleID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE rides SET status = 'cancelled', calendar_sequence = calendar_sequence + 1, calendar_updated_at = $2
+		WHERE schedule_id = $1 AND departure_time > $2`, scheduleID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 跳過單一班次：記錄例外 (之後不會再產生)，已經產生的班次改成取消
+func SkipOccurrence(scheduleID, driverID, date string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := ownedActiveSchedule(tx, scheduleID, driverID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO ride_schedule_exceptions (schedule_id, occurrence_date, action)
+		VALUES ($1, $2, 'skip')
+		ON CONFLICT (schedule_id, occurrence_date) DO UPDATE SET action = 'skip', overrides = NULL`,
+		scheduleID, date)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE rides SET status = 'cancelled', calendar_sequence = calendar_sequence + 1, calendar_updated_at = $3
+		WHERE schedule_id = $1 AND occurrence_date = $2`, scheduleID, date, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 修改單一班次：記錄例外 (還沒產生的班次會在產生時套用)，已經產生的直接更新
+// 回傳已經產生的旅程 ID (還沒產生就是空字串) 與調高人數後狀態有變動的候補
+func ModifyOccurrence(scheduleID, driverID, date string, o types.OccurrenceOverride) (string, []types.WaitlistEntry, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback()
+
+	if err := ownedActiveSchedule(tx, scheduleID, driverID); err != nil {
+		return "", nil, err
+	}
+	overrides, err := json.Marshal(o)
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO ride_schedule_exceptions (schedule_id, occurrence_date, action, overrides)
+		VALUES ($1, $2, 'modify', $3)
+		ON CONFLICT (schedule_id, occurrence_date) DO UPDATE SET action = 'modify', overrides = EXCLUDED.overrides`,
+		scheduleID, date, overrides)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var rideID string
+	err = tx.QueryRow(`
+		SELECT id FROM rides WHERE schedule_id = $1 AND occurrence_date = $2 FOR UPDATE`,
+		scheduleID, date).Scan(&rideID)
+	if err == sql.ErrNoRows {
+		return "", nil, tx.Commit() // 還沒產生，等排程套用
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	changed, err := applyOverride(tx, rideID, o)
+	if err != nil {
+		return "", nil, err
+	}
+	return rideID, changed, tx.Commit()
+}
+
+// 把單一班次的修改套用到已經存在的旅程，回傳狀態有變動的候補
+func applyOverride(tx *sql.Tx, rideID string, o types.OccurrenceOverride) ([]types.WaitlistEntry, error) {
+	var changed []types.WaitlistEntry
+	if o.MaxPassengers != nil {
+		if err := setMaxPassengers(tx, rideID, *o.MaxPassengers); err != nil {
+			return nil, err
+		}
+		// 調高人數時候補名單可以遞補
+		var err error
+		if changed, err = promoteWaitlist(tx, rideID); err != nil {
+			return nil, err
+		}
+	}
+	if o.DepartureTime != nil {
+		return changed, setDepartureTime(tx, rideID, *o.DepartureTime)
+	}
+	return changed, nil
+}
+
+// setDepartureTime: 改出發時間，停靠站的預估時間跟著平移
+func setDepartureTime(tx *sql.Tx, rideID string, departure time.Time) error {
+	var old time.Time
+	if err := tx.QueryRow(`SELECT departure_time FROM rides WHERE id = $1`, rideID).Scan(&old); err != nil {
+		return err
+	}
+	delta := departure.UTC().Sub(old)
+	_, err := tx.Exec(`
+		UPDATE rides SET departure_time = $2, calendar_sequence = calendar_sequence + 1, calendar_updated_at = $3
+		WHERE id = $1`, rideID, departure.UTC(), time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE ride_stops SET estimated_time = estimated_time + make_interval(secs => $2)
+		WHERE ride_id = $1 AND estimated_time IS NOT NULL`, rideID, delta.Seconds())
+	return err
+}
+
+// MaterializeSchedules: 把所有啟用中的排程展開成未來 horizon 內的實際旅程
+// 每個排程用 advisory lock 保護，多個 replica 同時跑也不會重複產生
+func MaterializeSchedules(horizon time.Duration, fence Fence) (int, error) {
+	// 換回乘客的司機，排程先不展開 (排程維持 active，換回司機後會接著產生)
+	rows, err := DB.Query(`SELECT ` + scheduleColumns + ` FROM ride_schedules
+		WHERE status = 'active' AND driver_id IN (SELECT id FROM users WHERE role IN ('driver', 'admin'))`)
+	if err != nil {
+		return 0, err
+	}
+	var schedules []types.RideSchedule
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			log.Printf("Schedule Scan Failed: %v", err)
+			continue
+		}
+		schedules = append(schedules, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for _, s := range schedules {
+		n, err := materializeSchedule(s, horizon, fence)
+		if err == ErrStaleFence {
+			return created, err
+		}
+		if err != nil {
+			log.Printf("Materialize schedule %s failed: %v", s.ID, err)
+			continue
+		}
+		created += n
+	}
+	return created, nil
+}
+
+// MaterializeSchedule: 展開單一排程，回傳新產生的班次數
+func MaterializeSchedule(s types.RideSchedule, horizon time.Duration) (int, error) {
+	return materializeSchedule(s, horizon, Fence{})
+}
+
+func materializeSchedule(s types.RideSchedule, horizon time.Duration, fence Fence) (int, error) {
+	now := time.Now()
+	occurrences, err := s.Rule.Occurrences(now, now.Add(horizon))
+	if err != nil || len(occurrences) == 0 {
+		return 0, err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := fence.check(tx); err != nil {
+		return 0, err
+	}
+	var locked bool
+	if err := tx.QueryRow(`SELECT pg_try_advisory_xact_lock(hashtext($1))`, "ride_schedule:"+s.ID).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil // 另一個 replica 正在處理
+	}
+	// 列出排程之後才換角色的也不展開
+	if ok, err := canDrive(tx, s.DriverID); err != nil || !ok {
+		return 0, err
+	}
+
+	// 已經產生過的班次與例外
+	existing := make(map[string]bool)
+	rows, err := tx.Query(`
+		SELECT TO_CHAR(occurrence_date, 'YYYY-MM-DD') FROM rides WHERE schedule_id = $1
+		UNION ALL
+		SELECT TO_CHAR(occurrence_date, 'YYYY-MM-DD') FROM ride_schedule_exceptions
+		WHERE schedule_id = $1 AND action = 'skip'`, s.ID)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var date string
+		if err := rows.Scan(&date); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		existing[date] = true
+	}
+	rows.Close()
+
+	overrides, err := loadOverrides(tx, s.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for _, occ := range occurrences {
+		if existing[occ.Date] {
+			continue
+		}
+		ride := occurrenceRide(s, occ)
+		if o, ok := overrides[occ.Date]; ok {
+			if o.MaxPassengers != nil {
+				ride.MaxPassengers = *o.MaxPassengers
+			}
+			if o.DepartureTime != nil {
+				ride = retime(ride, *o.DepartureTime)
+			}
+		}
+		if err := insertRide(tx, ride); err != nil {
+			return 0, err
+		}
+		created++
+	}
+	return created, tx.Commit()
+}
+
+func loadOverrides(tx *sql.Tx, scheduleID string) (map[string]types.OccurrenceOverride, error) {
+	rows, err := tx.Query(`
+		SELECT TO_CHAR(occurrence_date, 'YYYY-MM-DD'), overrides FROM ride_schedule_exceptions
+		WHERE schedule_id = $1 AND action = 'modify'`, scheduleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string]types.OccurrenceOverride)
+	for rows.Next() {
+		var date string
+		var raw []byte
+		if err := rows.Scan(&date, &raw); err != nil {
+			return nil, err
+		}
+		var o types.OccurrenceOverride
+		if err := json.Unmarshal(raw, &o); err != nil {
+			return nil, err
+		}
+		out[date] = o
+	}
+	return out, rows.Err()
+}
+
+// occurrenceRide: 用範本產生某一班的旅程，ID 由排程 ID + 日期組成 (重跑也不會變)
+func occurrenceRide(s types.RideSchedule, occ schedule.Occurrence) types.Ride {
+	ride := s.Ride
+	ride.ID = fmt.Sprintf("%s-%s", s.ID, strings.ReplaceAll(occ.Date, "-", ""))
+	ride.DriverID = s.DriverID
+	ride.ScheduleID = s.ID
+	ride.OccurrenceDate = occ.Date
+	ride.Status = "open"
+	ride.CurrentPassengers = 0
+	return retime(ride, occ.Departure)
+}
+
+// retime: 改出發時間，停靠站的預估時間跟著平移 (範本以第一站的時間為基準)
+func retime(ride types.Ride, departure time.Time) types.Ride {
+	stops := make([]types.Stop, len(ride.Stops))
+	copy(stops, ride.Stops)
+	if len(stops) == 0 || stops[0].EstimatedTime == nil {
+		// 範本沒有時間基準，只更新起點
+		if len(stops) > 0 {
+			stops[0].EstimatedTime = &departure
+		}
+		ride.Stops = stops
+		ride.DepartureTime = departure
+		return ride
+	}
+	base := *stops[0].EstimatedTime
+	for i := range stops {
+		if stops[i].EstimatedTime == nil {
+			continue
+		}
+		t := departure.Add(stops[i].EstimatedTime.Sub(base))
+		stops[i].EstimatedTime = &t
+	}
+	ride.Stops = stops
+	ride.DepartureTime = departure
+	return ride
+}
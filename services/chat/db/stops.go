@@ -0,0 +1,220 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/route"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// queryer: *sql.DB 跟 *sql.Tx 共用的查詢介面
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func insertStops(q queryer, rideID string, stops []types.Stop) error {
+	for i, s := range stops {
+		var eta *time.Time
+		if s.EstimatedTime != nil {
+			t := s.EstimatedTime.UTC()
+			eta = &t
+		}
+		_, err := q.Exec(`
+			INSERT INTO ride_stops (ride_id, seq, name, canonical, lat, lng, estimated_time)
+			VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7)`,
+			rideID, i, s.Name, s.Canonical, s.Lat, s.Lng, eta,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanStop(row rowScanner) (string, types.Stop, error) {
+	var rideID string
+	var s types.Stop
+	var lat, lng sql.NullFloat64
+	var eta sql.NullTime
+	err := row.Scan(&rideID, &s.Seq, &s.Name, &s.Canonical, &lat, &lng, &eta)
+	s.Lat, s.Lng = floatPtr(lat), floatPtr(lng)
+	if eta.Valid {
+		t := eta.Time
+		s.EstimatedTime = &t
+	}
+	return rideID, s, err
+}
+
+const stopColumns = `ride_id, seq, name, COALESCE(canonical, ''), lat, lng, estimated_time`
+
+// attachStops: 一次查出多筆旅程的停靠站 (避免 N+1)
+// 沒有 ride_stops 的舊資料維持 nil，呼叫端用 route.Of 補起終點
+func attachStops(rides []types.Ride) error {
+	if len(rides) == 0 {
+		return nil
+	}
+	ids := make([]string, len(rides))
+	index := make(map[string]int, len(rides))
+	for i, r := range rides {
+		ids[i] = r.ID
+		index[r.ID] = i
+	}
+
+	rows, err := DB.Query(`SELECT `+stopColumns+` FROM ride_stops WHERE ride_id = ANY($1) ORDER BY ride_id, seq`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rideID, s, err := scanStop(rows)
+		if err != nil {
+			return err
+		}
+		i := index[rideID]
+		rides[i].Stops = append(rides[i].Stops, s)
+	}
+	return rows.Err()
+}
+
+// loadStops: 單一旅程的完整路線 (舊資料補成起點 -> 終點)
+func loadStops(q queryer, rideID string) ([]types.Stop, error) {
+	rows, err := q.Query(`SELECT `+stopColumns+` FROM ride_stops WHERE ride_id = $1 ORDER BY seq`, rideID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ride types.Ride
+	for rows.Next() {
+		_, s, err := scanStop(rows)
+		if err != nil {
+			return nil, err
+		}
+		ride.Stops = append(ride.Stops, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ride.Stops) < 2 {
+		ride.Stops = nil
+		err := q.QueryRow(`
+			SELECT origin, destination, departure_time, origin_lat, origin_lng, destination_lat, destination_lng
+			FROM rides WHERE id = $1`, rideID).Scan(
+			&ride.Origin, &ride.Destination, &ride.DepartureTime,
+			nullFloat{&ride.OriginLat}, nullFloat{&ride.OriginLng}, nullFloat{&ride.DestinationLat}, nullFloat{&ride.DestinationLng},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return route.Of(ride), nil
+}
+
+// nullFloat: 直接 Scan 到 *float64 欄位 (NULL -> nil)
+type nullFloat struct{ dst **float64 }
+
+func (n nullFloat) Scan(src interface{}) error {
+	var f sql.NullFloat64
+	if err := f.Scan(src); err != nil {
+		return err
+	}
+	*n.dst = floatPtr(f)
+	return nil
+}
+
+// loadSegments: 旅程目前所有已確認訂位佔用的區段 (含候補名單中還沒過期的保留位)
+func loadSegments(q queryer, rideID string, numStops int) ([]route.Segment, error) {
+	rows, err := q.Query(`
+		SELECT from_seq, COALESCE(to_seq, $2), seats
+		FROM ride_participants WHERE ride_id = $1 AND status = 'confirmed'
+		UNION ALL
+		SELECT from_seq, COALESCE(to_seq, $2), seats
+		FROM ride_waitlist WHERE ride_id = $1 AND status = 'offered' AND offer_expires_at > $3`,
+		rideID, numStops-1, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segs []route.Segment
+	for rows.Next() {
+		var seg route.Segment
+		if err := rows.Scan(&seg.From, &seg.To, &seg.Seats); err != nil {
+			return nil, err
+		}
+		segs = append(segs, seg)
+	}
+	return segs, rows.Err()
+}
+
+// loadOccupancy: 一次查完多趟旅程的佔用 (列表、搜尋用，不用每趟查一次)，key 是旅程 ID
+func loadOccupancy(rides []types.Ride) (map[string][]int, error) {
+	occupancy := make(map[string][]int, len(rides))
+	if len(rides) == 0 {
+		return occupancy, nil
+	}
+	ids := make([]string, len(rides))
+	for i, r := range rides {
+		ids[i] = r.ID
+	}
+	rows, err := DB.Query(`
+		SELECT ride_id, from_seq, to_seq, seats
+		FROM ride_participants WHERE ride_id = ANY($1) AND status = 'confirmed'
+		UNION ALL
+		SELECT ride_id, from_seq, to_seq, seats
+		FROM ride_waitlist WHERE ride_id = ANY($1) AND status = 'offered' AND offer_expires_at > $2`,
+		pq.Array(ids), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	segs := make(map[string][]route.Segment)
+	for rows.Next() {
+		var rideID string
+		var seg route.Segment
+		var to sql.NullInt64
+		if err := rows.Scan(&rideID, &seg.From, &to, &seg.Seats); err != nil {
+			return nil, err
+		}
+		// 沒有 to_seq 的是坐到終點，終點編號每趟不一樣，下面再補
+		seg.To = -1
+		if to.Valid {
+			seg.To = int(to.Int64)
+		}
+		segs[rideID] = append(segs[rideID], seg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, r := range rides {
+		n := len(route.Of(r))
+		bookings := segs[r.ID]
+		for i := range bookings {
+			if bookings[i].To < 0 {
+				bookings[i].To = n - 1
+			}
+		}
+		occupancy[r.ID] = route.Occupancy(n, bookings)
+	}
+	return occupancy, nil
+}
+
+// 附近搜尋的 SQL 粗篩：任一停靠站在外框內即可 (沒有 ride_stops 的舊資料看 rides 的起終點)
+// argStart 是外框四個參數 (minLat, maxLat, minLng, maxLng) 中第一個的編號
+func nearAnyStop(end string, argStart int) string {
+	a, b, c, d := argStart, argStart+1, argStart+2, argStart+3
+	return fmt.Sprintf(`
+		AND (
+			EXISTS (SELECT 1 FROM ride_stops s WHERE s.ride_id = r.id
+				AND s.lat BETWEEN $%d AND $%d AND s.lng BETWEEN $%d AND $%d)
+			OR (r.%s_lat BETWEEN $%d AND $%d AND r.%s_lng BETWEEN $%d AND $%d)
+		)`, a, b, c, d, end, a, b, end, c, d)
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+const vehicleColumns = `id, owner_id, make, model, COALESCE(color, ''), plate, seats, amenities`
+
+func scanVehicle(row rowScanner) (types.Vehicle, error) {
+	var v types.Vehicle
+	err := row.Scan(&v.ID, &v.OwnerID, &v.Make, &v.Model, &v.Color, &v.Plate, &v.Seats, pq.Array(&v.Amenities))
+	if v.Amenities == nil {
+		v.Amenities = []string{}
+	}
+	return v, err
+}
+
+func CreateVehicle(v types.Vehicle) error {
+	_, err := DB.Exec(`
+		INSERT INTO vehicles (id, owner_id, make, model, color, plate, seats, amenities, created_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8, $9)`,
+		v.ID, v.OwnerID, v.Make, v.Model, v.Color, v.Plate, v.Seats, pq.Array(v.Amenities), time.Now().UTC())
+	return err
+}
+
+// GetMyVehicles: 司機自己的車 (不含已刪除)
+func GetMyVehicles(ownerID string) ([]types.Vehicle, error) {
+	rows, err := DB.Query(`
+		SELECT `+vehicleColumns+` FROM vehicles
+		WHERE owner_id = $1 AND deleted_at IS NULL ORDER BY created_at`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	vehicles := make([]types.Vehicle, 0)
+	for rows.Next() {
+		v, err := scanVehicle(rows)
+		if err != nil {
+			return nil, err
+		}
+		vehicles = append(vehicles, v)
+	}
+	return vehicles, rows.Err()
+}
+
+// GetVehicle: 建立旅程時檢查車輛是不是自己的
+func GetVehicle(vehicleID, ownerID string) (types.Vehicle, error) {
+	v, err := scanVehicle(DB.QueryRow(`
+		SELECT `+vehicleColumns+` FROM vehicles
+		WHERE id = $1 AND owner_id = $2 AND deleted_at IS NULL`, vehicleID, ownerID))
+	if err == sql.ErrNoRows {
+		return v, fmt.Errorf("vehicle not found")
+	}
+	return v, err
+}
+
+// DeleteVehicle: 只做標記，已經建立的旅程繼續顯示這台車
+func DeleteVehicle(vehicleID, ownerID string) error {
+	res, err := DB.Exec(`
+		UPDATE vehicles SET deleted_at = $3
+		WHERE id = $1 AND owner_id = $2 AND deleted_at IS NULL`, vehicleID, ownerID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("vehicle not found")
+	}
+	return nil
+}
+
+// attachVehicles: 填入車輛摘要；車牌只給司機本人與 confirmed 乘客 (viewerID 空字串 = 未登入)
+// 判斷乘客身分用的是 BookingStatus，所以要在 attachBookingStatus 之後呼叫
+func attachVehicles(rides []types.Ride, viewerID string) error {
+	ids := make([]string, 0, len(rides))
+	for _, r := range rides {
+		if r.VehicleID != "" {
+			ids = append(ids, r.VehicleID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	rows, err := DB.Query(`SELECT `+vehicleColumns+` FROM vehicles WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	vehicles := make(map[string]types.Vehicle)
+	for rows.Next() {
+		v, err := scanVehicle(rows)
+		if err != nil {
+			return err
+		}
+		vehicles[v.ID] = v
+	}
+	for i := range rides {
+		v, ok := vehicles[rides[i].VehicleID]
+		if !ok {
+			continue
+		}
+		v.OwnerID = ""
+		if viewerID == "" || (viewerID != rides[i].DriverID && rides[i].BookingStatus != "confirmed") {
+			v.Plate = ""
+		}
+		rides[i].Vehicle = &v
+	}
+	return rows.Err()
+}
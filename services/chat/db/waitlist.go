@@ -0,0 +1,391 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/route"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// offer 模式下保留位子給候補者確認的時間 (main 會用 WAITLIST_OFFER_TTL 覆蓋)
+var WaitlistOfferTTL = 30 * time.Minute
+
+const waitlistColumns = `
+	w.ride_id,
+	w.user_id,
+	COALESCE(u.name, ''),
+	w.from_seq,
+	COALESCE(w.to_seq, -1),
+	w.seats,
+	w.status,
+	CASE WHEN w.status = 'waiting' THEN
+		(SELECT COUNT(*) FROM ride_waitlist w2 WHERE w2.ride_id = w.ride_id AND w2.status = 'waiting' AND w2.id <= w.id)
+	ELSE 0 END,
+	w.offer_expires_at,
+	w.created_at`
+
+func scanWaitlistEntry(row rowScanner) (types.WaitlistEntry, error) {
+	var e types.WaitlistEntry
+	var expires sql.NullTime
+	err := row.Scan(&e.RideID, &e.UserID, &e.UserName, &e.FromStop, &e.ToStop, &e.Seats, &e.Status, &e.Position, &expires, &e.CreatedAt)
+	if expires.Valid {
+		t := expires.Time
+		e.OfferExpiresAt = &t
+	}
+	return e, err
+}
+
+// lockRide: 鎖住旅程那一筆 (所有會動到座位的操作都要先拿這個鎖)，回傳司機 ID
+func lockRide(tx *sql.Tx, rideID string) (string, error) {
+	var driverID string
+	err := tx.QueryRow(`SELECT driver_id FROM rides WHERE id = $1 FOR UPDATE`, rideID).Scan(&driverID)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("ride not found")
+	}
+	return driverID, err
+}
+
+// JoinWaitlist: 排進候補名單 (重新排隊的人排到最後面)
+func JoinWaitlist(b types.Booking) (types.WaitlistEntry, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return types.WaitlistEntry{}, err
+	}
+	defer tx.Rollback()
+
+	driverID, err := lockRide(tx, b.RideID)
+	if err != nil {
+		return types.WaitlistEntry{}, err
+	}
+	if driverID == b.PassengerID {
+		return types.WaitlistEntry{}, fmt.Errorf("driver cannot join own ride")
+	}
+	if err := checkBlocked(tx, driverID, b.PassengerID); err != nil {
+		return types.WaitlistEntry{}, err
+	}
+	var joined, requiresApproval bool
+	var visibility string
+	err = tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM ride_participants WHERE ride_id = $1 AND passenger_id = $2 AND status = 'confirmed'),
+			(SELECT requires_approval FROM rides WHERE id = $1), (SELECT visibility FROM rides WHERE id = $1)`,
+		b.RideID, b.PassengerID).Scan(&joined, &requiresApproval, &visibility)
+	if err != nil {
+		return types.WaitlistEntry{}, err
+	}
+	if joined {
+		return types.WaitlistEntry{}, fmt.Errorf("already joined")
+	}
+	// 需要核准的旅程直接送申請即可 (申請不佔座位，核准時才檢查)
+	if requiresApproval {
+		return types.WaitlistEntry{}, fmt.Errorf("ride requires approval")
+	}
+
+	var maxPassengers int
+	if err := tx.QueryRow(`SELECT max_passengers FROM rides WHERE id = $1`, b.RideID).Scan(&maxPassengers); err != nil {
+		return types.WaitlistEntry{}, err
+	}
+	stops, err := loadStops(tx, b.RideID)
+	if err != nil {
+		return types.WaitlistEntry{}, err
+	}
+	seg, err := route.Resolve(b, len(stops))
+	if err != nil {
+		return types.WaitlistEntry{}, err
+	}
+	bookings, err := loadSegments(tx, b.RideID, len(stops))
+	if err != nil {
+		return types.WaitlistEntry{}, err
+	}
+	if route.FreeSeats(maxPassengers, route.Occupancy(len(stops), bookings), seg) >= seg.Seats {
+		return types.WaitlistEntry{}, fmt.Errorf("seats available")
+	}
+	// 不公開的旅程：排進候補也要邀請，之後遞補不會再用一次
+	if visibility == "private" {
+		if err := redeemInvite(tx, b); err != nil {
+			return types.WaitlistEntry{}, err
+		}
+	}
+	if visibility == "org" {
+		if err := checkRideOrg(tx, b.RideID, b.PassengerID); err != nil {
+			return types.WaitlistEntry{}, err
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM ride_waitlist WHERE ride_id = $1 AND user_id = $2`, b.RideID, b.PassengerID)
+	if err != nil {
+		return types.WaitlistEntry{}, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO ride_waitlist (ride_id, user_id, from_seq, to_seq, seats)
+		VALUES ($1, $2, $3, $4, $5)`, b.RideID, b.PassengerID, seg.From, seg.To, seg.Seats)
+	if err != nil {
+		return types.WaitlistEntry{}, err
+	}
+
+	entry, err := getWaitlistEntry(tx, b.RideID, b.PassengerID)
+	if err != nil {
+		return entry, err
+	}
+	return entry, tx.Commit()
+}
+
+func getWaitlistEntry(q queryer, rideID, userID string) (types.WaitlistEntry, error) {
+	e, err := scanWaitlistEntry(q.QueryRow(`
+		SELECT `+waitlistColumns+`
+		FROM ride_waitlist w LEFT JOIN users u ON u.id = w.user_id
+		WHERE w.ride_id = $1 AND w.user_id = $2`, rideID, userID))
+	if err == sql.ErrNoRows {
+		return e, fmt.Errorf("not on waitlist")
+	}
+	return e, err
+}
+
+// GetWaitlistEntry: 查自己的候補狀態與順位
+func GetWaitlistEntry(rideID, userID string) (types.WaitlistEntry, error) {
+	return getWaitlistEntry(DB, rideID, userID)
+}
+
+// GetWaitlist: 司機查看整個候補名單 (還在排或保留中的)
+func GetWaitlist(rideID, driverID string) ([]types.WaitlistEntry, error) {
+	var owner string
+	err := DB.QueryRow(`SELECT driver_id FROM rides WHERE id = $1`, rideID).Scan(&owner)
+	if err == sql.ErrNoRows || (err == nil && owner != driverID) {
+		return nil, fmt.Errorf("ride not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := DB.Query(`
+		SELECT `+waitlistColumns+`
+		FROM ride_waitlist w LEFT JOIN users u ON u.id = w.user_id
+		WHERE w.ride_id = $1 AND w.status IN ('waiting', 'offered')
+		ORDER BY w.id`, rideID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]types.WaitlistEntry, 0)
+	for rows.Next() {
+		e, err := scanWaitlistEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// LeaveWaitlist: 退出候補 (保留中的位子會讓給下一位)
+func LeaveWaitlist(rideID, userID string) ([]types.WaitlistEntry, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockRide(tx, rideID); err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(`
+		UPDATE ride_waitlist SET status = 'left'
+		WHERE ride_id = $1 AND user_id = $2 AND status IN ('waiting', 'offered')`, rideID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("not on waitlist")
+	}
+	changed, err := promoteWaitlist(tx, rideID)
+	if err != nil {
+		return nil, err
+	}
+	return changed, tx.Commit()
+}
+
+// AcceptWaitlistOffer: 在保留時間內確認，正式加入旅程
+func AcceptWaitlistOffer(rideID, userID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockRide(tx, rideID); err != nil {
+		return err
+	}
+	var from, to, seats int
+	err = tx.QueryRow(`
+		SELECT from_seq, COALESCE(to_seq, -1), seats FROM ride_waitlist
+		WHERE ride_id = $1 AND user_id = $2 AND status = 'offered' AND offer_expires_at > $3`,
+		rideID, userID, time.Now().UTC()).Scan(&from, &to, &seats)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no active offer")
+	}
+	if err != nil {
+		return err
+	}
+
+	// 先把保留位釋放掉，再用一般的座位檢查寫入 (保留期間沒人能搶走這個位子)
+	if _, err := tx.Exec(`UPDATE ride_waitlist SET status = 'promoted' WHERE ride_id = $1 AND user_id = $2`, rideID, userID); err != nil {
+		return err
+	}
+	b := types.Booking{RideID: rideID, PassengerID: userID, FromStop: &from, Seats: seats}
+	if to >= 0 {
+		b.ToStop = &to
+	}
+	if err := insertBooking(tx, b); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// promoteWaitlist: 有空位時依 FIFO 處理候補 (呼叫端必須已經 lockRide)
+// 區段塞不下的人會被跳過，讓後面剛好塞得下的人先遞補
+// 回傳狀態有變動的候補 (promoted 或 offered)
+func promoteWaitlist(tx *sql.Tx, rideID string) ([]types.WaitlistEntry, error) {
+	var maxPassengers int
+	var mode, status string
+	var departure time.Time
+	err := tx.QueryRow(`
+		SELECT max_passengers, waitlist_mode, COALESCE(status, 'open'), departure_time
+		FROM rides WHERE id = $1`, rideID).Scan(&maxPassengers, &mode, &status, &departure)
+	if err != nil {
+		return nil, err
+	}
+	if status != "open" || !departure.After(time.Now().UTC()) {
+		return nil, nil
+	}
+
+	stops, err := loadStops(tx, rideID)
+	if err != nil {
+		return nil, err
+	}
+	bookings, err := loadSegments(tx, rideID, len(stops))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`
+		SELECT user_id, from_seq, COALESCE(to_seq, $2), seats FROM ride_waitlist
+		WHERE ride_id = $1 AND status = 'waiting' ORDER BY id`, rideID, len(stops)-1)
+	if err != nil {
+		return nil, err
+	}
+	type candidate struct {
+		userID string
+		seg    route.Segment
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.userID, &c.seg.From, &c.seg.To, &c.seg.Seats); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+
+	var changed []types.WaitlistEntry
+	for _, c := range candidates {
+		if route.FreeSeats(maxPassengers, route.Occupancy(len(stops), bookings), c.seg) < c.seg.Seats {
+			continue
+		}
+		if mode == "offer" {
+			_, err = tx.Exec(`
+				UPDATE ride_waitlist SET status = 'offered', offer_expires_at = $3
+				WHERE ride_id = $1 AND user_id = $2`, rideID, c.userID, time.Now().UTC().Add(WaitlistOfferTTL))
+		} else {
+			err = upsertParticipant(tx, rideID, c.userID, c.seg)
+			if err != nil && err.Error() == "already joined" {
+				// 已經在車上 (沒有佔用新的座位)，候補這一筆直接結束
+				if _, err := tx.Exec(`UPDATE ride_waitlist SET status = 'promoted' WHERE ride_id = $1 AND user_id = $2`, rideID, c.userID); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err == nil {
+				_, err = tx.Exec(`UPDATE ride_waitlist SET status = 'promoted' WHERE ride_id = $1 AND user_id = $2`, rideID, c.userID)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		bookings = append(bookings, c.seg)
+
+		e, err := getWaitlistEntry(tx, rideID, c.userID)
+		if err != nil {
+			return nil, err
+		}
+		changed = append(changed, e)
+	}
+	if len(changed) > 0 && mode != "offer" {
+		return changed, updateShares(tx, rideID)
+	}
+	return changed, nil
+}
+
+// ExpireWaitlistOffers: 過期的保留位改成 expired，並把位子讓給下一位
+// 每個旅程各自一個交易並先鎖住旅程，多個 replica 同時跑也只會處理一次
+func ExpireWaitlistOffers(fence Fence) ([]types.WaitlistEntry, error) {
+	now := time.Now().UTC()
+	rows, err := DB.Query(`
+		SELECT DISTINCT ride_id FROM ride_waitlist
+		WHERE status = 'offered' AND offer_expires_at <= $1`, now)
+	if err != nil {
+		return nil, err
+	}
+	var rideIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rideIDs = append(rideIDs, id)
+	}
+	rows.Close()
+
+	var changed []types.WaitlistEntry
+	for _, rideID := range rideIDs {
+		entries, err := expireRideOffers(rideID, now, fence)
+		if err != nil {
+			return changed, err
+		}
+		changed = append(changed, entries...)
+	}
+	return changed, nil
+}
+
+func expireRideOffers(rideID string, now time.Time, fence Fence) ([]types.WaitlistEntry, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := fence.check(tx); err != nil {
+		return nil, err
+	}
+	if _, err := lockRide(tx, rideID); err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(`
+		UPDATE ride_waitlist SET status = 'expired'
+		WHERE ride_id = $1 AND status = 'offered' AND offer_expires_at <= $2`, rideID, now)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, nil // 另一個 replica 已經處理過
+	}
+	changed, err := promoteWaitlist(tx, rideID)
+	if err != nil {
+		return nil, err
+	}
+	return changed, tx.Commit()
+}
@@ -0,0 +1,98 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis 上的事件頻道 (其他服務可以訂閱)
+const Channel = "ride_events"
+
+// 事件類型
+const (
+	RideCreated          = "ride.created"
+	RideJoined           = "ride.joined"
+	RideLeft             = "ride.left"
+	PassengerRemoved     = "ride.passenger_removed" // 司機移除乘客 (UserID 是被移除的人)
+	RideCancelled        = "ride.cancelled"
+	RideCompleted        = "ride.completed"
+	RideTimeChanged      = "ride.time_changed"
+	WaitlistPromoted     = "waitlist.promoted" // 候補自動遞補成乘客
+	WaitlistOffered      = "waitlist.offered"  // 候補拿到限時保留位
+	RideRequestCreated   = "ride_request.created"
+	RideRequestCancelled = "ride_request.cancelled"
+	RideOfferCreated     = "ride_request.offer_created"
+	RideRequestMatched   = "ride_request.matched"
+	MatchProposed        = "match.proposed"
+	SavedSearchMatched   = "saved_search.matched"
+	MessagePosted        = "message.posted"
+)
+
+// Event: 領域事件；Data 是各事件自己的內容
+type Event struct {
+	Type      string          `json:"type"`
+	RideID    string          `json:"rideId,omitempty"`
+	RequestID string          `json:"requestId,omitempty"`
+	ActorID   string          `json:"actorId,omitempty"` // 觸發事件的使用者
+	UserID    string          `json:"userId,omitempty"`  // 只跟某個使用者有關的事件 (例如通知)
+	At        time.Time       `json:"at"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// Handler: 同一個 replica 裡的訂閱者
+type Handler func(Event)
+
+// Bus: 事件先交給本機的訂閱者 (只有產生事件的 replica 會處理，不會重複)，再發到 Redis 給其他服務
+type Bus struct {
+	rdb      *redis.Client
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+// New: rdb 可以是 nil (只在本機分派)
+func New(rdb *redis.Client) *Bus {
+	return &Bus{rdb: rdb, handlers: make(map[string][]Handler)}
+}
+
+// Subscribe: 訂閱指定類型的事件
+func (b *Bus) Subscribe(h Handler, eventTypes ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, t := range eventTypes {
+		b.handlers[t] = append(b.handlers[t], h)
+	}
+}
+
+// Publish: 非同步分派，呼叫端不會被訂閱者拖慢；data 會轉成 JSON
+func (b *Bus) Publish(c context.Context, e Event, data interface{}) {
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			log.Printf("Marshal event %s failed: %v", e.Type, err)
+			return
+		}
+		e.Data = raw
+	}
+
+	b.mu.RLock()
+	handlers := b.handlers[e.Type]
+	b.mu.RUnlock()
+	for _, h := range handlers {
+		go h(e)
+	}
+
+	if b.rdb != nil {
+		payload, _ := json.Marshal(e)
+		if err := b.rdb.Publish(c, Channel, payload).Err(); err != nil {
+			log.Printf("Publish event %s failed: %v", e.Type, err)
+		}
+	}
+}
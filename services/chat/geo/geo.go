@@ -0,0 +1,57 @@
+package geo
+
+import "math"
+
+// 地球平均半徑 (公里)
+const EarthRadiusKm = 6371.0
+
+// Point 代表一個經緯度座標
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// NewPoint: 兩個座標都有值才回傳 Point (座標在 Ride 上是選填欄位)
+func NewPoint(lat, lng *float64) (Point, bool) {
+	if lat == nil || lng == nil {
+		return Point{}, false
+	}
+	p := Point{Lat: *lat, Lng: *lng}
+	return p, p.Valid()
+}
+
+// Valid: 檢查經緯度是否在合法範圍內
+func (p Point) Valid() bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lng >= -180 && p.Lng <= 180
+}
+
+// DistanceKm: 用 Haversine 公式計算兩點間的大圓距離 (公里)
+func DistanceKm(a, b Point) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := (b.Lat - a.Lat) * math.Pi / 180
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EarthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// BoundingBox: 回傳以 p 為中心、半徑 radiusKm 的經緯度外框
+// 給 SQL 先粗篩用，精確距離還是要用 DistanceKm 算
+func BoundingBox(p Point, radiusKm float64) (minLat, maxLat, minLng, maxLng float64) {
+	dLat := radiusKm / EarthRadiusKm * 180 / math.Pi
+	minLat, maxLat = p.Lat-dLat, p.Lat+dLat
+
+	cosLat := math.Cos(p.Lat * math.Pi / 180)
+	if cosLat < 1e-6 || maxLat >= 90 || minLat <= -90 {
+		// 靠近極點時經度範圍直接放寬
+		return math.Max(minLat, -90), math.Min(maxLat, 90), -180, 180
+	}
+	dLng := dLat / cosLat
+	if p.Lng-dLng < -180 || p.Lng+dLng > 180 {
+		// 跨越換日線也一樣放寬，交給精確距離過濾
+		return minLat, maxLat, -180, 180
+	}
+	return minLat, maxLat, p.Lng - dLng, p.Lng + dLng
+}
@@ -0,0 +1,171 @@
+package geocode
+
+import (
+	"context"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 內建的預設地名表 (本地開發 / 測試不需要網路)
+//
+//go:embed gazetteer.csv
+var defaultGazetteer string
+
+// 地名表中的一筆資料
+type gazetteerEntry struct {
+	Name    string   `json:"name"`
+	Lat     float64  `json:"lat"`
+	Lng     float64  `json:"lng"`
+	Aliases []string `json:"aliases"`
+}
+
+// Gazetteer: 離線地名表，名稱或別名完全符合優先，其次找輸入中包含的最長地名
+type Gazetteer struct {
+	byKey map[string]Place
+	keys  []string // 依長度由長到短，部分比對時先找最具體的地名
+}
+
+func DefaultGazetteer() (*Gazetteer, error) {
+	return ParseGazetteerCSV(strings.NewReader(defaultGazetteer))
+}
+
+// LoadGazetteerFile: 依副檔名讀取 .csv 或 .json
+func LoadGazetteerFile(path string) (*Gazetteer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return ParseGazetteerCSV(f)
+	case ".json":
+		return ParseGazetteerJSON(f)
+	default:
+		return nil, fmt.Errorf("unsupported gazetteer format: %s", path)
+	}
+}
+
+// CSV 格式：name,lat,lng,aliases (aliases 用 | 分隔，# 開頭為註解)
+func ParseGazetteerCSV(r io.Reader) (*Gazetteer, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+
+	var entries []gazetteerEntry
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("gazetteer line %d: expected name,lat,lng[,aliases]", line)
+		}
+		if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "name") {
+			continue // 標題列
+		}
+		lat, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("gazetteer line %d: invalid lat: %v", line, err)
+		}
+		lng, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("gazetteer line %d: invalid lng: %v", line, err)
+		}
+		e := gazetteerEntry{Name: strings.TrimSpace(record[0]), Lat: lat, Lng: lng}
+		if len(record) > 3 && record[3] != "" {
+			e.Aliases = strings.Split(record[3], "|")
+		}
+		entries = append(entries, e)
+	}
+	return newGazetteer(entries)
+}
+
+// JSON 格式：[{"name": "...", "lat": 25.04, "lng": 121.51, "aliases": ["..."]}]
+func ParseGazetteerJSON(r io.Reader) (*Gazetteer, error) {
+	var entries []gazetteerEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+	return newGazetteer(entries)
+}
+
+func newGazetteer(entries []gazetteerEntry) (*Gazetteer, error) {
+	g := &Gazetteer{byKey: make(map[string]Place)}
+	for _, e := range entries {
+		if e.Name == "" {
+			return nil, fmt.Errorf("gazetteer entry without name")
+		}
+		place := Place{Name: e.Name, Lat: e.Lat, Lng: e.Lng}
+		for _, alias := range append([]string{e.Name}, e.Aliases...) {
+			key := Normalize(alias)
+			if key == "" {
+				continue
+			}
+			if _, exists := g.byKey[key]; !exists {
+				g.keys = append(g.keys, key)
+			}
+			g.byKey[key] = place
+		}
+	}
+	// 長的 key 先比對，"taipei main station" 要優先於 "taipei"
+	sort.Slice(g.keys, func(i, j int) bool {
+		if len(g.keys[i]) != len(g.keys[j]) {
+			return len(g.keys[i]) > len(g.keys[j])
+		}
+		return g.keys[i] < g.keys[j]
+	})
+	return g, nil
+}
+
+func (g *Gazetteer) Geocode(ctx context.Context, query string) (Place, error) {
+	q := Normalize(query)
+	if q == "" {
+		return Place{}, ErrNotFound
+	}
+	if p, ok := g.byKey[q]; ok {
+		return p, nil
+	}
+	for _, key := range g.keys {
+		if containsWord(q, key) {
+			return g.byKey[key], nil
+		}
+	}
+	return Place{}, ErrNotFound
+}
+
+// containsWord: 英文要整個字相符 ("taipei" 不能比對到 "taipeicity")，中文直接找子字串
+func containsWord(s, key string) bool {
+	for start := 0; start < len(s); {
+		i := strings.Index(s[start:], key)
+		if i < 0 {
+			return false
+		}
+		i += start
+		if boundary(s, i-1, key[0]) && boundary(s, i+len(key), key[len(key)-1]) {
+			return true
+		}
+		start = i + 1
+	}
+	return false
+}
+
+// 非 ASCII (中文) 不需要字邊界；ASCII 字母數字則要求旁邊是空白或字串邊界
+func boundary(s string, idx int, edge byte) bool {
+	if edge >= 0x80 || idx < 0 || idx >= len(s) {
+		return true
+	}
+	return s[idx] == ' ' || s[idx] >= 0x80
+}
@@ -0,0 +1,60 @@
+package geocode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// 找不到地點時回傳 (呼叫端可以決定要不要當成錯誤)
+var ErrNotFound = errors.New("place not found")
+
+// Place: 地理編碼的結果
+type Place struct {
+	Name string  `json:"name"` // 正規化後的地名 (canonical)
+	Lat  float64 `json:"lat"`
+	Lng  float64 `json:"lng"`
+}
+
+// Geocoder: 把使用者輸入的地名轉成座標
+// 目前只有離線的 Gazetteer，之後要接 Google / Nominatim 只要實作這個介面即可
+type Geocoder interface {
+	Geocode(ctx context.Context, query string) (Place, error)
+}
+
+// New: 依照 GEOCODER 環境變數選擇實作 (預設 gazetteer)
+func New() (Geocoder, error) {
+	switch provider := os.Getenv("GEOCODER"); provider {
+	case "", "gazetteer":
+		if path := os.Getenv("GAZETTEER_PATH"); path != "" {
+			return LoadGazetteerFile(path)
+		}
+		return DefaultGazetteer()
+	default:
+		return nil, fmt.Errorf("unknown geocoder: %s", provider)
+	}
+}
+
+// Normalize: 比對用的正規化 (大小寫、全半形空白、臺/台、標點)
+func Normalize(s string) string {
+	s = strings.ReplaceAll(strings.ToLower(s), "臺", "台")
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteRune(r)
+		default:
+			// 空白與標點都當成分隔
+			space = true
+		}
+	}
+	return b.String()
+}
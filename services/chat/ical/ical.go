@@ -0,0 +1,122 @@
+package ical
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Event: 行事曆上的一個事件 (VEVENT)
+type Event struct {
+	UID          string // 同一趟旅程永遠一樣，行事曆才會更新而不是新增
+	Sequence     int    // 改時間或取消時遞增
+	Summary      string
+	Description  string
+	Location     string
+	URL          string
+	Start        time.Time
+	End          time.Time
+	Status       string // CONFIRMED / TENTATIVE / CANCELLED
+	LastModified *time.Time
+}
+
+// Calendar: 一份 RFC 5545 的 VCALENDAR
+type Calendar struct {
+	Name    string
+	Refresh time.Duration // 建議訂閱端多久更新一次
+	Events  []Event
+}
+
+// Marshal: 輸出 .ics (CRLF 換行、超過 75 bytes 折行)；now 是 DTSTAMP
+func (cal Calendar) Marshal(now time.Time) []byte {
+	var b bytes.Buffer
+	line := func(name, value string) {
+		fold(&b, name+":"+value)
+	}
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", "-//k8s-ride-sharing//Rides//EN")
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", "PUBLISH")
+	if cal.Name != "" {
+		line("X-WR-CALNAME", escape(cal.Name))
+	}
+	if cal.Refresh > 0 {
+		line("REFRESH-INTERVAL;VALUE=DURATION", duration(cal.Refresh))
+		line("X-PUBLISHED-TTL", duration(cal.Refresh))
+	}
+	for _, e := range cal.Events {
+		line("BEGIN", "VEVENT")
+		line("UID", e.UID)
+		line("DTSTAMP", stamp(now))
+		line("SEQUENCE", fmt.Sprint(e.Sequence))
+		line("DTSTART", stamp(e.Start))
+		line("DTEND", stamp(e.End))
+		line("SUMMARY", escape(e.Summary))
+		if e.Description != "" {
+			line("DESCRIPTION", escape(e.Description))
+		}
+		if e.Location != "" {
+			line("LOCATION", escape(e.Location))
+		}
+		if e.URL != "" {
+			line("URL", e.URL)
+		}
+		if e.Status != "" {
+			line("STATUS", e.Status)
+		}
+		if e.LastModified != nil {
+			line("LAST-MODIFIED", stamp(*e.LastModified))
+		}
+		line("END", "VEVENT")
+	}
+	line("END", "VCALENDAR")
+	return b.Bytes()
+}
+
+// stamp: UTC 的 DATE-TIME，例如 20250102T150405Z
+func stamp(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// duration: RFC 5545 的 DURATION，只用到時分秒
+func duration(d time.Duration) string {
+	d = d.Round(time.Second)
+	s := "PT"
+	if h := d / time.Hour; h > 0 {
+		s += fmt.Sprintf("%dH", h)
+	}
+	if m := d % time.Hour / time.Minute; m > 0 {
+		s += fmt.Sprintf("%dM", m)
+	}
+	if sec := d % time.Minute / time.Second; sec > 0 || s == "PT" {
+		s += fmt.Sprintf("%dS", sec)
+	}
+	return s
+}
+
+// escape: TEXT 值裡的 \ ; , 與換行要跳脫
+var escaper = strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// fold: 每行最多 75 bytes，續行以空白開頭；不會切在 UTF-8 字元中間
+func fold(b *bytes.Buffer, s string) {
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		b.WriteString(s[:cut])
+		b.WriteString("\r\n ")
+		s = s[cut:]
+		limit = 74 // 續行開頭的空白也算
+	}
+	b.WriteString(s)
+	b.WriteString("\r\n")
+}
@@ -0,0 +1,87 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"short", "SUMMARY:Taipei → Taoyuan"},
+		{"exactly 75 bytes", "DESCRIPTION:" + strings.Repeat("a", 63)},
+		{"ascii", "DESCRIPTION:" + strings.Repeat("0123456789", 20)},
+		// 中文一個字 3 bytes，切點不能落在字的中間
+		{"multi-byte", "LOCATION:" + strings.Repeat("台北車站東三門", 12)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			fold(&b, tt.in)
+			out := b.String()
+			if !strings.HasSuffix(out, "\r\n") {
+				t.Fatalf("output does not end with CRLF: %q", out)
+			}
+			lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+			for i, l := range lines {
+				if len(l) > 75 {
+					t.Errorf("line %d is %d bytes", i, len(l))
+				}
+				if i > 0 && !strings.HasPrefix(l, " ") {
+					t.Errorf("continuation line %d does not start with a space: %q", i, l)
+				}
+				if !utf8.ValidString(l) {
+					t.Errorf("line %d splits a UTF-8 character: %q", i, l)
+				}
+				if strings.Contains(l, "\n") || strings.Contains(l, "\r") {
+					t.Errorf("line %d has a bare line break: %q", i, l)
+				}
+			}
+			// 照 RFC 5545 展開 (拿掉 CRLF + 一個空白) 要得到原本的內容
+			if got := strings.ReplaceAll(strings.TrimSuffix(out, "\r\n"), "\r\n ", ""); got != tt.in {
+				t.Errorf("unfolded = %q, want %q", got, tt.in)
+			}
+		})
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	now := time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)
+	cal := Calendar{
+		Name:    "My rides",
+		Refresh: time.Hour,
+		Events: []Event{{
+			UID:         "ride-r1@rides",
+			Sequence:    2,
+			Summary:     "Ride: Taipei, Main Station → Taoyuan Airport",
+			Description: "Driver: Alice\nSeats: 1; luggage: medium",
+			Start:       now.Add(24 * time.Hour),
+			End:         now.Add(25 * time.Hour),
+			Status:      "CONFIRMED",
+		}},
+	}
+	out := string(cal.Marshal(now))
+
+	if strings.Contains(strings.ReplaceAll(out, "\r\n", ""), "\n") {
+		t.Error("found a line ending that is not CRLF")
+	}
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"REFRESH-INTERVAL;VALUE=DURATION:PT1H\r\n",
+		"DTSTAMP:20260302T080000Z\r\n",
+		"DTSTART:20260303T080000Z\r\n",
+		"SEQUENCE:2\r\n",
+		`SUMMARY:Ride: Taipei\, Main Station → Taoyuan Airport` + "\r\n",
+		`DESCRIPTION:Driver: Alice\nSeats: 1\; luggage: medium` + "\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+}
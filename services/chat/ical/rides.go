@@ -0,0 +1,103 @@
+package ical
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// UID 的網域部分 (改了的話所有人的行事曆會變成重複的事件)
+const Domain = "rideshare.local"
+
+// 停靠站沒有預估時間時，事件長度用這個
+var DefaultDuration = time.Hour
+
+// Rides: userID 的旅程轉成行事曆；baseURL 是前端網址 (連回「我的旅程」)
+func Rides(userID string, rides []types.Ride, baseURL string) Calendar {
+	cal := Calendar{Name: "My rides", Refresh: time.Hour, Events: make([]Event, 0, len(rides))}
+	for _, r := range rides {
+		cal.Events = append(cal.Events, RideEvent(userID, r, baseURL))
+	}
+	return cal
+}
+
+// RideEvent: 一趟旅程；司機看到的是「開車」，乘客是「搭車」
+func RideEvent(userID string, r types.Ride, baseURL string) Event {
+	e := Event{
+		UID:          fmt.Sprintf("ride-%s@%s", r.ID, Domain),
+		Sequence:     r.CalendarSequence,
+		Location:     place(r.Origin, r.OriginCanonical),
+		Start:        r.DepartureTime,
+		End:          arrival(r),
+		Status:       status(userID, r),
+		LastModified: r.CalendarUpdatedAt,
+	}
+	if baseURL != "" {
+		e.URL = strings.TrimRight(baseURL, "/") + "/my-rides?rideId=" + r.ID
+	}
+
+	route := r.Origin + " → " + r.Destination
+	var desc []string
+	if r.DriverID == userID {
+		e.Summary = "Driving: " + route
+		desc = append(desc, fmt.Sprintf("Passengers: %d / %d", r.CurrentPassengers, r.MaxPassengers))
+	} else {
+		e.Summary = "Ride: " + route
+		desc = append(desc, "Driver: "+r.DriverName)
+		if r.BookedSeats > 1 {
+			desc = append(desc, fmt.Sprintf("Seats: %d", r.BookedSeats))
+		}
+	}
+	if len(r.Stops) > 2 {
+		names := make([]string, 0, len(r.Stops))
+		for _, s := range r.Stops {
+			names = append(names, s.Name)
+		}
+		desc = append(desc, "Route: "+strings.Join(names, " → "))
+	}
+	if r.Vehicle != nil {
+		desc = append(desc, "Vehicle: "+strings.TrimSpace(r.Vehicle.Color+" "+r.Vehicle.Make+" "+r.Vehicle.Model))
+	}
+	if e.URL != "" {
+		desc = append(desc, e.URL)
+	}
+	e.Description = strings.Join(desc, "\n")
+	return e
+}
+
+// status: 旅程取消或我的訂位沒成立都算取消；等司機核准中是暫定
+func status(userID string, r types.Ride) string {
+	if r.Status == "cancelled" {
+		return "CANCELLED"
+	}
+	if r.DriverID == userID {
+		return "CONFIRMED"
+	}
+	switch r.BookingStatus {
+	case "pending":
+		return "TENTATIVE"
+	case "rejected", "expired":
+		return "CANCELLED"
+	default:
+		return "CONFIRMED"
+	}
+}
+
+// arrival: 終點站有預估時間就用，沒有就當作 DefaultDuration
+func arrival(r types.Ride) time.Time {
+	if n := len(r.Stops); n > 0 {
+		if t := r.Stops[n-1].EstimatedTime; t != nil && t.After(r.DepartureTime) {
+			return *t
+		}
+	}
+	return r.DepartureTime.Add(DefaultDuration)
+}
+
+func place(raw, canonical string) string {
+	if canonical != "" {
+		return canonical
+	}
+	return raw
+}
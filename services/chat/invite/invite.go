@@ -0,0 +1,62 @@
+package invite
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// 邀請碼用的字元 (去掉容易看錯的 0 / O / 1 / I / L)
+const alphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// CodeLength: 邀請碼長度 (31^8 ≈ 8.5e11 種，猜不到)
+const CodeLength = 8
+
+// Sign: 邀請連結裡的 token = inviteID.簽章
+// 簽章是用伺服器的密鑰對 inviteID 做 HMAC，只知道資料庫裡的 ID 也做不出可以用的連結
+func Sign(secret []byte, inviteID string) string {
+	return inviteID + "." + signature(secret, inviteID)
+}
+
+// Verify: 簽章正確才回傳 inviteID
+func Verify(secret []byte, token string) (string, bool) {
+	id, sig, ok := strings.Cut(token, ".")
+	if !ok || id == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, id))) {
+		return "", false
+	}
+	return id, true
+}
+
+func signature(secret []byte, inviteID string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("ride-invite:" + inviteID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewCode: 可以口頭或傳訊息給別人的短邀請碼
+func NewCode() string {
+	b := make([]byte, CodeLength)
+	rand.Read(b)
+	code := make([]byte, CodeLength)
+	for i, v := range b {
+		// 256 不是 31 的倍數，會有一點點偏差，對邀請碼沒有影響
+		code[i] = alphabet[int(v)%len(alphabet)]
+	}
+	return string(code)
+}
+
+// NormalizeCode: 使用者輸入的邀請碼不分大小寫，可以有空白或 -
+func NormalizeCode(s string) string {
+	s = strings.ToUpper(s)
+	return strings.NewReplacer(" ", "", "-", "").Replace(s)
+}
+
+// IsToken: 連結的 token 有 "."，邀請碼沒有
+func IsToken(s string) bool {
+	return strings.Contains(s, ".")
+}
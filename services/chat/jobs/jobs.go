@@ -0,0 +1,273 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// Job: 定期執行的背景工作，整個叢集每個週期只有一個 replica 會跑
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Jitter   time.Duration // 每次額外隨機延後 0 ~ Jitter，避免所有工作擠在同一刻
+	Timeout  time.Duration // 單次執行的上限，預設等於 Interval
+	Run      func(c context.Context) error
+}
+
+// Scheduler: 用 Redis 租約決定誰跑，下次執行時間與結果也存在 Redis
+// 每個 replica 都輪詢，輪到的時候搶租約；搶到後再確認一次還沒有人跑過，才真的執行
+type Scheduler struct {
+	Owner       string        // 這個 replica 的名字 (記在執行紀錄裡)
+	Prefix      string        // Redis key 前綴
+	Poll        time.Duration // 最久多久看一次 (持有者掛掉時，租約過期後最慢這麼久會被接手)
+	LeaseTTL    time.Duration // 租約長度，執行中每 1/3 續約一次
+	BackoffBase time.Duration // 失敗後重試：BackoffBase * 2^(連續失敗次數-1)
+	BackoffMax  time.Duration // 重試間隔上限 (不會比 Interval 短)
+
+	rdb  *redis.Client
+	mu   sync.Mutex
+	jobs []Job
+}
+
+func New(rdb *redis.Client, owner string) *Scheduler {
+	return &Scheduler{
+		Owner:       owner,
+		Prefix:      "jobs:",
+		Poll:        15 * time.Second,
+		LeaseTTL:    30 * time.Second,
+		BackoffBase: 10 * time.Second,
+		BackoffMax:  30 * time.Minute,
+		rdb:         rdb,
+	}
+}
+
+// Register: 要在 Start 之前呼叫
+func (s *Scheduler) Register(j Job) {
+	if j.Timeout <= 0 {
+		j.Timeout = j.Interval
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, j)
+}
+
+// Start: 每個工作一個 goroutine，直到 c 結束
+func (s *Scheduler) Start(c context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		go s.loop(c, j)
+	}
+}
+
+func (s *Scheduler) loop(c context.Context, j Job) {
+	for {
+		wait := s.Poll
+		if next, err := s.nextRun(c, j.Name); err != nil {
+			log.Printf("Job %s: read schedule failed: %v", j.Name, err)
+		} else {
+			wait = min(wait, time.Until(next))
+		}
+		// 多等一點亂數，各個 replica 不要同一刻去搶
+		wait = max(wait, 0) + time.Duration(rand.Int63n(int64(time.Second)))
+		select {
+		case <-c.Done():
+			return
+		case <-time.After(wait):
+		}
+		if _, err := s.RunOnce(c, j); err != nil {
+			log.Printf("Job %s: %v", j.Name, err)
+		}
+	}
+}
+
+// RunOnce: 到期而且搶到租約才執行，回傳有沒有執行 (err 是排程本身的錯誤，工作的錯誤記在執行紀錄)
+func (s *Scheduler) RunOnce(c context.Context, j Job) (bool, error) {
+	due, err := s.nextRun(c, j.Name)
+	if err != nil || time.Now().Before(due) {
+		return false, err
+	}
+	lease, ok, err := Acquire(c, s.rdb, s.Prefix+"lock:"+j.Name, s.Owner, s.LeaseTTL)
+	if err != nil || !ok {
+		return false, err
+	}
+	defer func() {
+		if err := lease.Release(context.Background()); err != nil {
+			log.Printf("Job %s: release lease failed: %v", j.Name, err)
+		}
+	}()
+
+	// 搶到之前可能剛好有別人跑完
+	st, err := s.status(c, j)
+	if err != nil {
+		return false, err
+	}
+	if st.NextRunAt != nil && time.Now().Before(*st.NextRunAt) {
+		return false, nil
+	}
+
+	start := time.Now()
+	runErr := s.execute(c, j, lease)
+	st.LastRunAt = &start
+	st.LastOwner = s.Owner
+	st.LastToken = lease.Token
+	st.DurationMs = time.Since(start).Milliseconds()
+	st.LastError = ""
+	var next time.Time
+	if runErr == nil {
+		st.Failures = 0
+		next = time.Now().Add(j.Interval)
+		if j.Jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(j.Jitter))))
+		}
+	} else {
+		st.Failures++
+		st.LastError = runErr.Error()
+		next = time.Now().Add(s.Backoff(j, st.Failures))
+		log.Printf("Job %s failed (%d in a row): %v", j.Name, st.Failures, runErr)
+	}
+	st.NextRunAt = &next
+
+	// 只有租約還在 (fencing token 沒被超過) 的時候才寫入結果
+	err = lease.whileHeld(c, func(p redis.Pipeliner) {
+		p.HSet(c, s.Prefix+"status:"+j.Name, encodeStatus(st))
+	})
+	if err == ErrLeaseLost {
+		return true, fmt.Errorf("lease lost while running, result discarded")
+	}
+	return true, err
+}
+
+// execute: 執行期間定期續約，續約失敗 (租約被別人拿走) 就取消工作的 context
+func (s *Scheduler) execute(c context.Context, j Job, lease *Lease) (err error) {
+	c = context.WithValue(context.WithValue(c, tokenKey{}, lease.Token), nameKey{}, j.Name)
+	c, cancel := context.WithTimeout(c, j.Timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(s.LeaseTTL / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if err := lease.Renew(c); err != nil {
+					log.Printf("Job %s: renew lease failed: %v", j.Name, err)
+					if err == ErrLeaseLost {
+						cancel()
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return j.Run(c)
+}
+
+// Backoff: 連續失敗 failures 次之後多久重試
+func (s *Scheduler) Backoff(j Job, failures int) time.Duration {
+	limit := max(s.BackoffMax, j.Interval)
+	d := s.BackoffBase
+	for i := 1; i < failures && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+// Status: 所有註冊的工作最近一次的執行結果
+func (s *Scheduler) Status(c context.Context) ([]types.JobStatus, error) {
+	s.mu.Lock()
+	jobs := append([]Job(nil), s.jobs...)
+	s.mu.Unlock()
+
+	list := make([]types.JobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		st, err := s.status(c, j)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, st)
+	}
+	return list, nil
+}
+
+func (s *Scheduler) status(c context.Context, j Job) (types.JobStatus, error) {
+	h, err := s.rdb.HGetAll(c, s.Prefix+"status:"+j.Name).Result()
+	if err != nil {
+		return types.JobStatus{}, err
+	}
+	st := decodeStatus(h)
+	st.Name, st.Interval = j.Name, j.Interval.String()
+	return st, nil
+}
+
+// nextRun: 還沒跑過的話是現在
+func (s *Scheduler) nextRun(c context.Context, name string) (time.Time, error) {
+	v, err := s.rdb.HGet(c, s.Prefix+"status:"+name, "next_run_at").Result()
+	if err == redis.Nil {
+		return time.Now(), nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Now(), nil
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// Redis hash 的欄位 (時間存 Unix 毫秒)
+func encodeStatus(st types.JobStatus) map[string]interface{} {
+	h := map[string]interface{}{
+		"last_owner":  st.LastOwner,
+		"last_token":  st.LastToken,
+		"duration_ms": st.DurationMs,
+		"last_error":  st.LastError,
+		"failures":    st.Failures,
+	}
+	if st.LastRunAt != nil {
+		h["last_run_at"] = st.LastRunAt.UnixMilli()
+	}
+	if st.NextRunAt != nil {
+		h["next_run_at"] = st.NextRunAt.UnixMilli()
+	}
+	return h
+}
+
+func decodeStatus(h map[string]string) types.JobStatus {
+	st := types.JobStatus{LastOwner: h["last_owner"], LastError: h["last_error"]}
+	st.LastToken, _ = strconv.ParseInt(h["last_token"], 10, 64)
+	st.DurationMs, _ = strconv.ParseInt(h["duration_ms"], 10, 64)
+	st.Failures, _ = strconv.Atoi(h["failures"])
+	st.LastRunAt = unixMilli(h["last_run_at"])
+	st.NextRunAt = unixMilli(h["next_run_at"])
+	return st
+}
+
+func unixMilli(v string) *time.Time {
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil
+	}
+	t := time.UnixMilli(ms).UTC()
+	return &t
+}
@@ -0,0 +1,87 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunOnceOnlyOneReplicaRuns(t *testing.T) {
+	c := context.Background()
+	rdb, _ := newRedis(t)
+	a, b := New(rdb, "replica-a"), New(rdb, "replica-b")
+
+	runs := 0
+	var token int64
+	var name string
+	j := Job{Name: "sweeper", Interval: time.Hour, Timeout: time.Minute, Run: func(c context.Context) error {
+		runs++
+		token, name = Token(c), Name(c)
+		return nil
+	}}
+
+	if ran, err := a.RunOnce(c, j); err != nil || !ran {
+		t.Fatalf("replica a = %v, %v", ran, err)
+	}
+	// a 剛跑完，下次執行是一小時後
+	if ran, err := b.RunOnce(c, j); err != nil || ran {
+		t.Fatalf("replica b = %v, %v", ran, err)
+	}
+	if runs != 1 {
+		t.Errorf("job ran %d times, want 1", runs)
+	}
+	if token == 0 || name != j.Name {
+		t.Errorf("context token = %d, name = %q", token, name)
+	}
+
+	a.Register(j)
+	st, err := a.Status(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st) != 1 || st[0].LastOwner != "replica-a" || st[0].LastToken != token || st[0].NextRunAt == nil {
+		t.Errorf("status = %+v", st)
+	}
+}
+
+func TestRunOnceBacksOffAfterFailure(t *testing.T) {
+	c := context.Background()
+	rdb, _ := newRedis(t)
+	s := New(rdb, "replica-a")
+	s.BackoffBase = time.Minute
+
+	j := Job{Name: "settler", Interval: time.Hour, Timeout: time.Minute, Run: func(context.Context) error {
+		return errors.New("provider unavailable")
+	}}
+	before := time.Now()
+	if ran, err := s.RunOnce(c, j); err != nil || !ran {
+		t.Fatalf("RunOnce = %v, %v", ran, err)
+	}
+	s.Register(j)
+	st, err := s.Status(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st[0].Failures != 1 || st[0].LastError != "provider unavailable" {
+		t.Errorf("status = %+v", st[0])
+	}
+	// 失敗後照 BackoffBase 重試，不用等到下一個 Interval
+	if next := st[0].NextRunAt; next == nil || next.Sub(before) > 2*time.Minute {
+		t.Errorf("next run = %v, want about a minute after %v", next, before)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := &Scheduler{BackoffBase: 10 * time.Second, BackoffMax: time.Minute}
+	j := Job{Interval: 30 * time.Second}
+	for failures, want := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 3: 40 * time.Second, 4: time.Minute, 9: time.Minute} {
+		if got := s.Backoff(j, failures); got != want {
+			t.Errorf("Backoff(%d) = %v, want %v", failures, got, want)
+		}
+	}
+	// 上限不會比 Interval 短
+	if got := s.Backoff(Job{Interval: time.Hour}, 20); got != time.Hour {
+		t.Errorf("Backoff with long interval = %v, want 1h", got)
+	}
+}
@@ -0,0 +1,122 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrLeaseLost: 租約已經過期或被別人拿走
+var ErrLeaseLost = errors.New("lease lost")
+
+// Lease: Redis 上的租約 (分散式鎖)
+// key 存持有者的隨機值，key + ":fence" 是計數器；Token (fencing token) 每次成功取得都會比上一次大，
+// 持有者卡住、租約過期後才醒來的話，下游可以用 Token 比較拒絕舊持有者的寫入
+type Lease struct {
+	Key   string
+	Owner string
+	Token int64
+	TTL   time.Duration
+
+	rdb   *redis.Client
+	value string
+}
+
+// Acquire: 沒人持有才取得，ok = false 代表別人持有中
+// 檢查、遞增 fencing 計數器與寫入在同一個 WATCH / MULTI 交易裡，Token 的順序跟實際取得的順序一致
+func Acquire(c context.Context, rdb *redis.Client, key, owner string, ttl time.Duration) (*Lease, bool, error) {
+	l := &Lease{Key: key, Owner: owner, TTL: ttl, rdb: rdb, value: owner + ":" + nonce()}
+	err := rdb.Watch(c, func(tx *redis.Tx) error {
+		if err := tx.Get(c, key).Err(); err != redis.Nil {
+			if err == nil {
+				return ErrLeaseLost // 別人持有中
+			}
+			return err
+		}
+		var fence *redis.IntCmd
+		_, err := tx.TxPipelined(c, func(p redis.Pipeliner) error {
+			fence = p.Incr(c, key+":fence")
+			p.Set(c, key, l.value, ttl)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		l.Token = fence.Val()
+		return nil
+	}, key)
+	if err == ErrLeaseLost || err == redis.TxFailedErr {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return l, true, nil
+}
+
+// Renew: 還持有的話把租約延長 TTL
+func (l *Lease) Renew(c context.Context) error {
+	return l.whileHeld(c, func(p redis.Pipeliner) {
+		p.PExpire(c, l.Key, l.TTL)
+	})
+}
+
+// Release: 還持有的話釋放 (已經過期就什麼都不做)
+func (l *Lease) Release(c context.Context) error {
+	err := l.whileHeld(c, func(p redis.Pipeliner) {
+		p.Del(c, l.Key)
+	})
+	if err == ErrLeaseLost {
+		return nil
+	}
+	return err
+}
+
+// whileHeld: 確認租約還是自己的才執行 fn 裡的指令 (整批在同一個交易)
+func (l *Lease) whileHeld(c context.Context, fn func(redis.Pipeliner)) error {
+	err := l.rdb.Watch(c, func(tx *redis.Tx) error {
+		v, err := tx.Get(c, l.Key).Result()
+		if err == redis.Nil || (err == nil && v != l.value) {
+			return ErrLeaseLost
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(c, func(p redis.Pipeliner) error {
+			fn(p)
+			return nil
+		})
+		return err
+	}, l.Key)
+	if err == redis.TxFailedErr {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+func nonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type tokenKey struct{}
+
+type nameKey struct{}
+
+// Token: 執行中的 job 目前租約的 fencing token (不是從 job 呼叫的話回傳 0)
+// 下游要記住看過最大的 token 並拒絕比它小的寫入才有保護效果 (例如 db.Fence)
+func Token(c context.Context) int64 {
+	t, _ := c.Value(tokenKey{}).(int64)
+	return t
+}
+
+// Name: 執行中的 job 名稱 (不是從 job 呼叫的話回傳空字串)
+func Name(c context.Context) string {
+	n, _ := c.Value(nameKey{}).(string)
+	return n
+}
@@ -0,0 +1,94 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/redisfake"
+)
+
+// clock: 假 Redis 的時間，測試裡手動往前推 (租約過期不用真的等)
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newRedis(t *testing.T) (*redis.Client, *clock) {
+	t.Helper()
+	srv, err := redisfake.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	clk := &clock{now: time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)}
+	srv.Now = clk.Now
+	rdb := redis.NewClient(&redis.Options{Addr: srv.Addr(), Protocol: 2})
+	t.Cleanup(func() { rdb.Close() })
+	return rdb, clk
+}
+
+func TestAcquireIsExclusive(t *testing.T) {
+	c := context.Background()
+	rdb, _ := newRedis(t)
+
+	a, ok, err := Acquire(c, rdb, "lock:test", "a", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("first acquire = %v, %v", ok, err)
+	}
+	if _, ok, err := Acquire(c, rdb, "lock:test", "b", time.Minute); err != nil || ok {
+		t.Fatalf("second acquire while held = %v, %v", ok, err)
+	}
+	if err := a.Release(c); err != nil {
+		t.Fatal(err)
+	}
+	b, ok, err := Acquire(c, rdb, "lock:test", "b", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("acquire after release = %v, %v", ok, err)
+	}
+	if b.Token <= a.Token {
+		t.Errorf("token %d is not greater than previous %d", b.Token, a.Token)
+	}
+}
+
+func TestExpiredLeaseCannotRenewOrRelease(t *testing.T) {
+	c := context.Background()
+	rdb, clk := newRedis(t)
+
+	a, _, err := Acquire(c, rdb, "lock:test", "a", 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a 卡住超過租約，b 接手
+	clk.Advance(time.Minute)
+	b, ok, err := Acquire(c, rdb, "lock:test", "b", 30*time.Second)
+	if err != nil || !ok {
+		t.Fatalf("takeover = %v, %v", ok, err)
+	}
+
+	if err := a.Renew(c); err != ErrLeaseLost {
+		t.Errorf("stale renew = %v, want ErrLeaseLost", err)
+	}
+	// 舊持有者釋放不能把新持有者的租約刪掉
+	if err := a.Release(c); err != nil {
+		t.Errorf("stale release = %v", err)
+	}
+	if err := b.Renew(c); err != nil {
+		t.Errorf("new holder lost its lease: %v", err)
+	}
+}
@@ -1,19 +1,48 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/smtp"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
 
+	"github.com/neo1202/k8s-ride-sharing/services/chat/alerts"
 	"github.com/neo1202/k8s-ride-sharing/services/chat/db"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/events"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/geo"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/geocode"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/ical"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/invite"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/jobs"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/match"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/notify"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/payment"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/pricing"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/reminder"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/route"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/schedule"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/search"
 	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
 )
 
@@ -21,9 +50,34 @@ import (
 var rdb *redis.Client
 var ctx = context.Background()
 
+// 領域事件 (本機訂閱者 + Redis ride_events 頻道)
+var bus *events.Bus
+
+// 通知佇列與 Web Push (沒設定 VAPID_PRIVATE_KEY 時 webPush 是 nil)
+var notifications *notify.Queue
+var webPush *notify.WebPush
+
+// 背景工作排程 (initJobs 註冊)
+var scheduler *jobs.Scheduler
+
+// 地名 -> 座標 (預設是離線的 gazetteer)
+var geocoder geocode.Geocoder
+
+// 金流供應商 (預設是本機的 fake)
+var payments payment.Provider
+
+// 供應商 callback 的簽章金鑰，沒設定就不開放 callback 端點
+var paymentCallbackSecret = []byte(os.Getenv("PAYMENT_CALLBACK_SECRET"))
+
+// 週期排程要預先產生多久以後的班次
+var scheduleHorizon = envDuration("SCHEDULE_HORIZON", 14*24*time.Hour)
+
 // 讀取 JWT Secret (從 Secret.yaml 注入的環境變數)
 var jwtKey = []byte(os.Getenv("JWT_SECRET"))
 
+// 邀請連結的簽章金鑰 (INVITE_SECRET，沒設定就沿用 JWT_SECRET)
+var inviteSecret = []byte(cmp.Or(os.Getenv("INVITE_SECRET"), os.Getenv("JWT_SECRET")))
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
@@ -31,21 +85,254 @@ var upgrader = websocket.Upgrader{
 // Key: WebSocket 連線, Value: 房間 ID
 var clients = make(map[*websocket.Conn]string)
 
+// Key: WebSocket 連線, Value: 使用者 ID (從連線的 token 來，聊天訊息的發送者與站內通知都用這個)
+var clientUsers = make(map[*websocket.Conn]string)
+
+// Key: WebSocket 連線, Value: 這個使用者封鎖的人 (連線時載入，封鎖 / 解除封鎖時由 blocksChannel 通知重新載入)
+var clientBlocked = make(map[*websocket.Conn]map[string]bool)
+
+// clientsMu 保護 clients、clientUsers 與 clientBlocked；寫入連線也要拿著 (gorilla 的連線不能同時寫)
+// 廣播拿讀鎖就夠了，因為只有 handleMessages 一個 goroutine 在廣播
+var clientsMu sync.RWMutex
+
+// removeClient: 連線結束時從所有 map 拿掉
+func removeClient(ws *websocket.Conn) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	delete(clients, ws)
+	delete(clientUsers, ws)
+	delete(clientBlocked, ws)
+}
+
+// Redis 頻道：聊天訊息、站內通知、刪除訊息、封鎖變更 (每個 replica 處理自己身上的連線)
+const (
+	chatChannel         = "chat_channel"
+	notificationChannel = "notification_channel"
+	moderationChannel   = "moderation_channel"
+	blocksChannel       = "blocks_channel" // 內容是封鎖名單變了的使用者 ID
+)
+
 // JWT Claims 結構 (用於 Middleware 解析)
 type Claims struct {
 	UserID string `json:"userId"`
 	Email  string `json:"email"`
 	Name   string `json:"name"`
 	Role   string `json:"role"`
+	// Google 確認過 email 是本人的 (沒確認過的不能認領組織網域)
+	EmailVerified bool `json:"emailVerified,omitempty"`
+	// 登入當下所屬的組織 ID (前端顯示用；權限一律查 org_members，被移除的人不用等 token 過期)
+	Orgs []string `json:"orgs,omitempty"`
 	jwt.RegisteredClaims
 }
+type OccurrenceRequest struct {
+	ScheduleID string `json:"scheduleId"`
+	Date       string `json:"date"` // 班次的當地日期 YYYY-MM-DD
+	types.OccurrenceOverride
+}
 type JoinRideRequest struct {
+	RideID   string `json:"rideId"`
+	FromStop *int   `json:"fromStop,omitempty"` // 上車站 Seq (不給 = 起點)
+	ToStop   *int   `json:"toStop,omitempty"`   // 下車站 Seq (不給 = 終點)
+	Waitlist bool   `json:"waitlist,omitempty"` // 客滿時自動排進候補名單
+	Message  string `json:"message,omitempty"`  // 需要核准的旅程：給司機的留言
+	Seats    int    `json:"seats,omitempty"`    // 訂幾個座位 (預設 1)
+	Invite   string `json:"invite,omitempty"`   // 不公開的旅程：邀請連結的 token 或邀請碼
+}
+type RideRequestAction struct {
+	RequestID string      `json:"requestId"`
+	OfferID   int64       `json:"offerId,omitempty"`
+	RideID    string      `json:"rideId,omitempty"` // 司機用現有的旅程回應
+	Ride      *types.Ride `json:"ride,omitempty"`   // 或是開一趟新的 (沒給的欄位用需求的內容)
+	Message   string      `json:"message,omitempty"`
+}
+type RideInviteRequest struct {
+	RideID     string     `json:"rideId,omitempty"`
+	ScheduleID string     `json:"scheduleId,omitempty"` // 週期排程的邀請，之後每一班都能用
+	MaxUses    *int       `json:"maxUses,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+}
+type OrgRequest struct {
+	OrgID        string   `json:"orgId,omitempty"`
+	Name         string   `json:"name"`
+	EmailDomains []string `json:"emailDomains,omitempty"`
+}
+type OrgMemberRequest struct {
+	OrgID  string `json:"orgId"`
+	UserID string `json:"userId,omitempty"` // 移除成員時不給 = 自己退出
+	Role   string `json:"role,omitempty"`
+}
+type OrgInviteRequest struct {
+	OrgID     string     `json:"orgId,omitempty"`
+	Code      string     `json:"code,omitempty"` // 加入與撤銷時使用
+	MaxUses   *int       `json:"maxUses,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+type RideActionRequest struct {
+	RideID      string `json:"rideId"`
+	PassengerID string `json:"passengerId,omitempty"` // 司機移除乘客時使用
+}
+type UserActionRequest struct {
+	UserID string `json:"userId"`
+}
+
+// 管理員操作都要給原因 (寫進操作紀錄)
+type AdminUserRequest struct {
+	UserID string     `json:"userId"`
+	Reason string     `json:"reason"`
+	Until  *time.Time `json:"until,omitempty"` // 停權期限，不給 = 沒有期限
+}
+type AdminRideRequest struct {
 	RideID string `json:"rideId"`
+	Reason string `json:"reason"`
+}
+type AdminMessageRequest struct {
+	MessageID int64  `json:"messageId"`
+	Reason    string `json:"reason"`
+}
+type ResolveReportRequest struct {
+	ReportID   int64  `json:"reportId"`
+	Status     string `json:"status"` // resolved 或 dismissed
+	Resolution string `json:"resolution"`
 }
 
 // --- 初始化 Redis ---
 func initRedis() {
 	rdb = redis.NewClient(&redis.Options{Addr: "redis:6379"})
+	bus = events.New(rdb)
+}
+
+// 讀取 time.Duration 格式的環境變數 (例如 "10m", "336h")
+func envDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+		log.Printf("Invalid %s=%q, using default %v", key, v, def)
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+		log.Printf("Invalid %s=%q, using default %d", key, v, def)
+	}
+	return def
+}
+
+// envDurations: 逗號分隔的多個時間長度，例如 "24h,30m"
+func envDurations(key string, def []time.Duration) []time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var list []time.Duration
+	for _, s := range strings.Split(v, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil || d <= 0 {
+			log.Printf("Invalid %s=%q, using default %v", key, v, def)
+			return def
+		}
+		list = append(list, d)
+	}
+	return list
+}
+
+// 伺服器端產生的 ID (排程等)
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 從 Header 取出 JWT Claims (authMiddleware 已經驗證過簽名)
+func getClaims(r *http.Request) *Claims {
+	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	claims := &Claims{}
+	jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) { return jwtKey, nil })
+	return claims
+}
+
+// --- 初始化 Geocoder ---
+func initGeocoder() {
+	g, err := geocode.New()
+	if err != nil {
+		log.Fatal("Failed to init geocoder:", err)
+	}
+	geocoder = g
+}
+
+// 把地名轉成座標與標準地名；已經有座標的那端只補標準地名
+// 找不到地點不算錯誤 (座標是選填)，只記 Log
+func geocodeEndpoint(c context.Context, raw string, lat, lng **float64, canonical *string) {
+	place, err := geocoder.Geocode(c, raw)
+	if err != nil {
+		if !errors.Is(err, geocode.ErrNotFound) {
+			log.Printf("Geocode Error (%q): %v", raw, err)
+		}
+		return
+	}
+	*canonical = place.Name
+	if *lat == nil && *lng == nil {
+		*lat, *lng = &place.Lat, &place.Lng
+	}
+}
+
+// 有給停靠站時，以完整路線為準：第一站是起點、最後一站是終點
+// 沒給就只做地理編碼：原始字串保留在 Origin / Destination，標準地名另外存
+func prepareRoute(c context.Context, ride *types.Ride) error {
+	if len(ride.Stops) > 0 {
+		return prepareStops(c, ride)
+	}
+	ride.OriginCanonical, ride.DestinationCanonical = "", ""
+	geocodeEndpoint(c, ride.Origin, &ride.OriginLat, &ride.OriginLng, &ride.OriginCanonical)
+	geocodeEndpoint(c, ride.Destination, &ride.DestinationLat, &ride.DestinationLng, &ride.DestinationCanonical)
+	return nil
+}
+
+// 整理前端傳來的完整路線：重新編號、補座標，並同步回 Ride 的起終點欄位
+func prepareStops(c context.Context, ride *types.Ride) error {
+	for i := range ride.Stops {
+		s := &ride.Stops[i]
+		s.Seq = i
+		if !validCoordinates(s.Lat, s.Lng) {
+			return fmt.Errorf("stop %d has invalid coordinates", i)
+		}
+		s.Canonical = ""
+		geocodeEndpoint(c, s.Name, &s.Lat, &s.Lng, &s.Canonical)
+	}
+	if len(ride.Stops) < 2 {
+		return fmt.Errorf("a route needs at least an origin and a destination")
+	}
+
+	first, last := &ride.Stops[0], &ride.Stops[len(ride.Stops)-1]
+	// 起點的時間就是出發時間
+	if first.EstimatedTime != nil {
+		ride.DepartureTime = *first.EstimatedTime
+	} else {
+		departure := ride.DepartureTime
+		first.EstimatedTime = &departure
+	}
+	if err := route.Validate(ride.Stops); err != nil {
+		return err
+	}
+
+	ride.Origin, ride.OriginCanonical, ride.OriginLat, ride.OriginLng = first.Name, first.Canonical, first.Lat, first.Lng
+	ride.Destination, ride.DestinationCanonical, ride.DestinationLat, ride.DestinationLng = last.Name, last.Canonical, last.Lat, last.Lng
+	return nil
+}
+
+// 需要登入、而且只接受單一 HTTP Method 的 API
+func authMethod(method string, next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	})
 }
 
 // --- Middleware: JWT 驗證 ---
@@ -77,6 +364,18 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		// 停權查資料庫，不用等 token 過期
+		suspended, err := db.UserSuspended(claims.UserID)
+		if err != nil {
+			log.Printf("Suspension check for %s failed: %v", claims.UserID, err)
+			http.Error(w, "Failed to check account", http.StatusInternalServerError)
+			return
+		}
+		if suspended {
+			http.Error(w, "Account suspended", http.StatusForbidden)
+			return
+		}
+
 		// 可以在這裡把 claims 塞進 r.Context() 供後續使用 (例如取得 DriverID)
 		next(w, r)
 	}
@@ -84,6 +383,20 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 // services/chat/main.go
 
+// requireDriver: 開旅程 (直接建立、週期排程、回應乘客需求) 前檢查角色，不是司機就回 403
+func requireDriver(w http.ResponseWriter, userID string) bool {
+	ok, err := db.CanDrive(userID)
+	if err != nil {
+		writeError(w, err, "Failed to check role")
+		return false
+	}
+	if !ok {
+		http.Error(w, "Only drivers can create rides", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 func createRideHandler(w http.ResponseWriter, r *http.Request) {
 	var ride types.Ride
 
@@ -108,10 +421,20 @@ func createRideHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !requireDriver(w, claims.UserID) {
+		return
+	}
+
 	// 3. 強制覆蓋 DriverID (不信任前端傳來的)
 	ride.DriverID = claims.UserID
 	ride.DriverName = claims.Name
 
+	// 3-1. 座標、候補方式、價格、行李、車輛、停靠站
+	if err := prepareRide(r.Context(), &ride); err != nil {
+		writeError(w, err, "Failed to prepare ride")
+		return
+	}
+
 	// 加個 Log 看看資料對不對
 	log.Printf("Creating Ride: ID=%s, Driver=%s, Time=%v", ride.ID, ride.DriverName, ride.DepartureTime)
 
@@ -123,12 +446,19 @@ func createRideHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	bus.Publish(ctx, events.Event{Type: events.RideCreated, RideID: ride.ID, ActorID: ride.DriverID}, ride)
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(ride)
 }
 
+// GET /api/rides?orgId=：公開旅程 + 有登入的話加上所屬組織的旅程；給 orgId 只列這個組織的 (組織看板)
 func getRidesHandler(w http.ResponseWriter, r *http.Request) {
-	rides, err := db.GetRides()
+	var viewerID string
+	if claims := optionalClaims(r); claims != nil {
+		viewerID = claims.UserID
+	}
+	rides, err := db.GetRides(viewerID, r.URL.Query().Get("orgId"))
 	if err != nil {
 		http.Error(w, "Failed to query rides", http.StatusInternalServerError)
 		return
@@ -136,6 +466,179 @@ func getRidesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(rides)
 }
+// GET /api/rides/search?originLat=&originLng=&originRadiusKm=&destinationLat=&destinationLng=&destinationRadiusKm=
+// 找出起點、終點都在指定半徑內的旅程，依繞路距離排序 (公開，不需要 Token)
+// 沒有座標時也可以用 origin= / destination= 傳地名，會先經過 geocoder 轉換
+func searchRidesHandler(w http.ResponseWriter, r *http.Request) {
+	var q types.RideSearch
+	var err error
+	params := r.URL.Query()
+	if q.OriginLat, err = parseFloatParam(params.Get("originLat")); err == nil {
+		q.OriginLng, err = parseFloatParam(params.Get("originLng"))
+	}
+	if err == nil {
+		q.DestinationLat, err = parseFloatParam(params.Get("destinationLat"))
+	}
+	if err == nil {
+		q.DestinationLng, err = parseFloatParam(params.Get("destinationLng"))
+	}
+	// 只給一半 (例如有 originLat 沒有 originLng) 也算錯，不要默默忽略
+	if err != nil || !validCoordinates(q.OriginLat, q.OriginLng) || !validCoordinates(q.DestinationLat, q.DestinationLng) {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+	if !resolveSearchEndpoint(r.Context(), params.Get("origin"), &q.OriginLat, &q.OriginLng) {
+		http.Error(w, "Unknown origin", http.StatusBadRequest)
+		return
+	}
+	if !resolveSearchEndpoint(r.Context(), params.Get("destination"), &q.DestinationLat, &q.DestinationLng) {
+		http.Error(w, "Unknown destination", http.StatusBadRequest)
+		return
+	}
+	if v, _ := parseFloatParam(params.Get("originRadiusKm")); v != nil {
+		q.OriginRadiusKm = *v
+	}
+	if v, _ := parseFloatParam(params.Get("destinationRadiusKm")); v != nil {
+		q.DestinationRadiusKm = *v
+	}
+
+	// 旅程設定的條件：有登入的乘客沒指定的條件用個人預設偏好補上 (usePreferences=false 可以關掉)
+	if q.FeatureFilter, err = parseFeatureFilter(params); err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.OrgID = params.Get("orgId")
+	claims := optionalClaims(r)
+	if claims != nil {
+		q.ViewerID = claims.UserID
+	}
+	if claims != nil && params.Get("usePreferences") != "false" {
+		defaults, err := db.GetRidePreferences(claims.UserID)
+		if err != nil {
+			log.Printf("Load preferences for %s failed: %v", claims.UserID, err)
+		} else {
+			q.FeatureFilter = search.MergeFilter(q.FeatureFilter, defaults)
+		}
+	}
+
+	matches, err := db.SearchRides(q)
+	if err != nil {
+		log.Printf("DB SearchRides Error: %v", err)
+		http.Error(w, "Failed to search rides", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(matches)
+}
+
+// 搜尋時只給地名的話，用 geocoder 補上座標；地名查不到回傳 false
+func resolveSearchEndpoint(c context.Context, name string, lat, lng **float64) bool {
+	if name == "" || (*lat != nil && *lng != nil) {
+		return true
+	}
+	place, err := geocoder.Geocode(c, name)
+	if err != nil {
+		return false
+	}
+	*lat, *lng = &place.Lat, &place.Lng
+	return true
+}
+
+// 經緯度要嘛都沒給，要嘛都給而且在合法範圍內
+func validCoordinates(lat, lng *float64) bool {
+	if lat == nil && lng == nil {
+		return true
+	}
+	_, ok := geo.NewPoint(lat, lng)
+	return ok
+}
+
+// parseFeatureFilter: luggage=small&petsAllowed=true&amenities=wifi,usb
+func parseFeatureFilter(params url.Values) (types.FeatureFilter, error) {
+	f := types.FeatureFilter{MinLuggage: params.Get("luggage")}
+	for _, p := range []struct {
+		name string
+		dst  **bool
+	}{
+		{"petsAllowed", &f.PetsAllowed},
+		{"smokingAllowed", &f.SmokingAllowed},
+		{"music", &f.Music},
+		{"childSeat", &f.ChildSeat},
+		{"wheelchairAccessible", &f.WheelchairAccessible},
+	} {
+		v := params.Get(p.name)
+		if v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid %s", p.name)
+		}
+		*p.dst = &b
+	}
+	if v := params.Get("amenities"); v != "" {
+		f.Amenities = normalizeAmenities(strings.Split(v, ","))
+	}
+	return f, search.ValidateFilter(f)
+}
+
+func normalizeAmenities(list []string) []string {
+	amenities := make([]string, 0, len(list))
+	for _, a := range list {
+		if a = strings.ToLower(strings.TrimSpace(a)); a != "" {
+			amenities = append(amenities, a)
+		}
+	}
+	return amenities
+}
+
+// optionalClaims: 公開的端點有帶合法 token 時取得使用者 (沒帶或無效回傳 nil)
+func optionalClaims(r *http.Request) *Claims {
+	return tokenClaims(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+// GET /api/users/preferences：我的預設搜尋偏好；POST：整份覆蓋
+func preferencesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getClaims(r).UserID
+	if r.Method == "GET" {
+		f, err := db.GetRidePreferences(userID)
+		if err != nil {
+			writeError(w, err, "Failed to query preferences")
+			return
+		}
+		writeJSON(w, f)
+		return
+	}
+
+	var f types.FeatureFilter
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	f.Amenities = normalizeAmenities(f.Amenities)
+	if err := search.ValidateFilter(f); err != nil {
+		http.Error(w, "Invalid preferences: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := db.SaveRidePreferences(userID, f); err != nil {
+		writeError(w, err, "Failed to save preferences")
+		return
+	}
+	writeJSON(w, f)
+}
+
+// 空字串回傳 nil (代表沒給這個條件)
+func parseFloatParam(v string) (*float64, error) {
+	if v == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
 func joinRideHandler(w http.ResponseWriter, r *http.Request) {
 	// 1. 解析 Request Body
 	var req JoinRideRequest
@@ -153,140 +656,2527 @@ func joinRideHandler(w http.ResponseWriter, r *http.Request) {
 		return jwtKey, nil
 	})
 
+	if req.Seats < 0 {
+		http.Error(w, "Invalid seats", http.StatusBadRequest)
+		return
+	}
+
 	// 3. 呼叫 DB
-	if err := db.JoinRide(req.RideID, claims.UserID); err != nil {
-		if err.Error() == "ride is full" {
+	booking := types.Booking{RideID: req.RideID, PassengerID: claims.UserID, FromStop: req.FromStop, ToStop: req.ToStop,
+		Message: req.Message, Seats: req.Seats}
+	if err := applyInvite(&booking, req.Invite); err != nil {
+		writeError(w, err, "Failed to join ride")
+		return
+	}
+	status, err := db.JoinRide(booking)
+	recordInviteGuess(booking.PassengerID, err)
+	if err != nil {
+		if err.Error() == "ride is full" && req.Waitlist {
+			// 3-1. 客滿但願意候補：排進候補名單並回傳順位
+			entry, err := db.JoinWaitlist(booking)
+			if err != nil {
+				writeError(w, err, "Failed to join waitlist")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(entry)
+		} else if err.Error() == "ride is full" {
 			http.Error(w, "Ride is full", http.StatusConflict)
 		} else {
-			http.Error(w, "Failed to join ride: "+err.Error(), http.StatusInternalServerError)
+			writeError(w, err, "Failed to join ride")
 		}
 		return
 	}
 
+	// 4. 需要核准的旅程：只是送出申請，等司機處理
+	if status == "pending" {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"message": "Request sent", "status": "pending"}`))
+		return
+	}
+
+	settleRide(req.RideID)
+	bus.Publish(ctx, events.Event{Type: events.RideJoined, RideID: req.RideID, ActorID: claims.UserID}, nil)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"message": "Joined successfully"}`))
 }
 
-// --- WebSocket ---
+// 把 db 回傳的錯誤訊息對應成 HTTP 狀態碼 (db 層用固定的錯誤字串)
+func writeError(w http.ResponseWriter, err error, fallback string) {
+	msg := err.Error()
+	var bad badRequest
+	switch {
+	case errors.As(err, &bad):
+		http.Error(w, msg, http.StatusBadRequest)
+	case msg == "ride not found", msg == "schedule not found", msg == "not a participant",
+		msg == "not on waitlist", msg == "no active offer", msg == "no pending request", msg == "user not found",
+		msg == "vehicle not found", msg == "request not found", msg == "offer not found",
+		msg == "match not found", msg == "saved search not found", msg == "feed not found", msg == "invite not found",
+		msg == "organization not found", msg == "message not found", msg == "report not found":
+		http.Error(w, msg, http.StatusNotFound)
+	case msg == "invite required", msg == "invalid invite", msg == "not an org member", msg == "not an org admin",
+		msg == "user is blocked", msg == "Only drivers can create rides":
+		http.Error(w, msg, http.StatusForbidden)
+	case msg == "invite revoked", msg == "invite expired", msg == "invite used up":
+		http.Error(w, msg, http.StatusGone)
+	case msg == "too many invite attempts":
+		http.Error(w, msg, http.StatusTooManyRequests)
+	case msg == "ride is full", msg == "already joined", msg == "seats available",
+		msg == "driver cannot join own ride", msg == "schedule is cancelled",
+		msg == "maxPassengers is below current bookings", msg == "booking window closed",
+		msg == "ride requires approval", msg == "ride is completed", msg == "ride is cancelled",
+		msg == "ride has not departed", msg == "ride is not completed", msg == "rating window closed",
+		msg == "already rated", msg == "too many saved searches", msg == "request is not open", msg == "cannot offer own request",
+		msg == "departure outside requested window", msg == "ride is not open",
+		msg == "already a member", msg == "last org admin", msg == "ride has no organization", msg == "already reported",
+		msg == "cannot suspend an admin", msg == "message already deleted", msg == "report is not open",
+		msg == "domain already claimed":
+		http.Error(w, msg, http.StatusConflict)
+	case msg == "can only reduce seats", msg == "maxPassengers exceeds vehicle seats",
+		msg == "cannot block yourself", msg == "cannot report yourself", msg == "invalid report target":
+		http.Error(w, msg, http.StatusBadRequest)
+	case strings.HasPrefix(msg, "invalid segment"):
+		http.Error(w, "Invalid stops: "+msg, http.StatusBadRequest)
+	default:
+		log.Printf("%s: %v", fallback, err)
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
 
-func handleConnections(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// POST /api/rides/leave：乘客退出，空位交給候補名單
+func leaveRideHandler(w http.ResponseWriter, r *http.Request) {
+	var req RideActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RideID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	userID := getClaims(r).UserID
+	changed, err := db.LeaveRide(req.RideID, userID)
 	if err != nil {
+		writeError(w, err, "Failed to leave ride")
 		return
 	}
-	defer ws.Close()
+	settleRide(req.RideID)
+	bus.Publish(ctx, events.Event{Type: events.RideLeft, RideID: req.RideID, ActorID: userID}, nil)
+	publishWaitlist(changed)
+	w.Write([]byte(`{"message": "Left successfully"}`))
+}
 
-	// 這裡改用 rideId 因為我們現在是 "Ride"
-	rideID := r.URL.Query().Get("roomId")
-	if rideID == "" {
-		rideID = "general"
+// POST /api/rides/seats：減少自己訂的座位數
+func reduceSeatsHandler(w http.ResponseWriter, r *http.Request) {
+	var c types.SeatChange
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil || c.RideID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
 	}
-
-	clients[ws] = rideID
-
-	// 1. 讀取歷史紀錄 (從 Redis Stream)
-	// 這裡簡化：只負責讀取，不負責像上次那樣倒序處理 (你可以之後加上)
-	streamKey := fmt.Sprintf("stream:%s", rideID)
-	var historyMessages []types.ChatMessage
-	streams, err := rdb.XRevRangeN(ctx, streamKey, "+", "-", 50).Result()
-	if err == nil {
-		for i := len(streams) - 1; i >= 0; i-- {
-			msgData := streams[i].Values["data"]
-			if jsonStr, ok := msgData.(string); ok {
-				var msg types.ChatMessage
-				json.Unmarshal([]byte(jsonStr), &msg)
-				historyMessages = append(historyMessages, msg)
-			}
-		}
-		if len(historyMessages) > 0 {
-			ws.WriteJSON(historyMessages)
-		}
+	changed, err := db.ReduceSeats(c, getClaims(r).UserID)
+	if err != nil {
+		writeError(w, err, "Failed to update seats")
+		return
 	}
+	settleRide(c.RideID)
+	publishWaitlist(changed)
+	w.Write([]byte(`{"message": "Seats updated"}`))
+}
 
-	// 2. 處理新訊息
-	for {
-		var msg types.ChatMessage
-		err := ws.ReadJSON(&msg)
-		if err != nil {
-			delete(clients, ws)
-			break
+// POST /api/rides/complete、/api/rides/cancel：司機結束或取消旅程，付款會跟著請款或退款
+func rideStatusHandler(update func(rideID, driverID string) error, eventType, message string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RideActionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RideID == "" {
+			http.Error(w, "Invalid body", http.StatusBadRequest)
+			return
 		}
-
-		msg.RideID = rideID // 確保 ID 正確
-
-		// A. 補全發送者資訊 (去 DB 查這個 ID 的名字和頭貼)
-		// 假設前端有傳 SenderID
-		if msg.SenderID != "" {
-			userInfo, err := db.GetUserInfo(msg.SenderID)
-			if err == nil {
-				msg.SenderName = userInfo.Name
-				msg.SenderPicture = userInfo.Picture
-			}
+		driverID := getClaims(r).UserID
+		if err := update(req.RideID, driverID); err != nil {
+			writeError(w, err, "Failed to update ride")
+			return
 		}
+		settleRide(req.RideID)
+		bus.Publish(ctx, events.Event{Type: eventType, RideID: req.RideID, ActorID: driverID}, nil)
+		writeJSON(w, map[string]string{"message": message})
+	}
+}
 
-		jsonMsg, _ := json.Marshal(msg)
-
-		// B. 寫入 Redis Stream (熱數據)
-		rdb.XAdd(ctx, &redis.XAddArgs{
-			Stream: streamKey,
-			Values: map[string]interface{}{"data": jsonMsg},
-		})
-
-		// C. 寫入 Postgres (冷數據 - 使用 db package)
-		go func(m types.ChatMessage) {
-			if err := db.SaveMessage(m.RideID, m.SenderID, m.Content); err != nil {
-				log.Printf("Error saving to DB: %v", err)
-			}
-		}(msg)
-
-		// D. Pub/Sub (即時廣播)
-		rdb.Publish(ctx, "chat_channel", jsonMsg)
+// POST /api/rides/rate：旅程完成後評分 (乘客評司機、司機評乘客)
+func rateHandler(w http.ResponseWriter, r *http.Request) {
+	var rating types.Rating
+	if err := json.NewDecoder(r.Body).Decode(&rating); err != nil || rating.RideID == "" || rating.RateeID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if rating.Score < 1 || rating.Score > 5 {
+		http.Error(w, "score must be between 1 and 5", http.StatusBadRequest)
+		return
 	}
+	if len(rating.Comment) > 1000 {
+		http.Error(w, "comment is too long", http.StatusBadRequest)
+		return
+	}
+	rating.RaterID = getClaims(r).UserID
+	if err := db.RateUser(rating); err != nil {
+		writeError(w, err, "Failed to save rating")
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(`{"message": "Rating saved"}`))
 }
 
-func handleMessages() {
-	pubsub := rdb.Subscribe(ctx, "chat_channel")
-	defer pubsub.Close()
-	ch := pubsub.Channel()
+// GET /api/users/profile?userId=...：使用者資料與評分 (不給 userId 就是自己)
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("userId")
+	if userID == "" {
+		userID = getClaims(r).UserID
+	}
+	profile, err := db.GetUserProfile(userID)
+	if err != nil {
+		writeError(w, err, "Failed to query profile")
+		return
+	}
+	writeJSON(w, profile)
+}
+
+// POST /api/rides/remove：司機移除乘客
+func removePassengerHandler(w http.ResponseWriter, r *http.Request) {
+	var req RideActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RideID == "" || req.PassengerID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	driverID := getClaims(r).UserID
+	changed, err := db.RemovePassenger(req.RideID, driverID, req.PassengerID)
+	if err != nil {
+		writeError(w, err, "Failed to remove passenger")
+		return
+	}
+	settleRide(req.RideID)
+	bus.Publish(ctx, events.Event{Type: events.PassengerRemoved, RideID: req.RideID, ActorID: driverID, UserID: req.PassengerID}, nil)
+	publishWaitlist(changed)
+	w.Write([]byte(`{"message": "Passenger removed"}`))
+}
+
+// POST /api/rides/update：司機修改人數上限或候補模式
+func updateRideHandler(w http.ResponseWriter, r *http.Request) {
+	var u types.RideUpdate
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil || u.RideID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if u.MaxPassengers != nil && *u.MaxPassengers <= 0 {
+		http.Error(w, "maxPassengers must be positive", http.StatusBadRequest)
+		return
+	}
+	// 建立時空字串代表預設 (auto)，修改時一定要明確給 auto 或 offer
+	if u.WaitlistMode != nil && (*u.WaitlistMode == "" || !validWaitlistMode(*u.WaitlistMode)) {
+		http.Error(w, "Invalid waitlistMode", http.StatusBadRequest)
+		return
+	}
+	if u.Visibility != nil && !validVisibility(*u.Visibility) {
+		http.Error(w, "Invalid visibility", http.StatusBadRequest)
+		return
+	}
+	driverID := getClaims(r).UserID
+	changed, err := db.UpdateRide(u, driverID)
+	if err != nil {
+		writeError(w, err, "Failed to update ride")
+		return
+	}
+	settleRide(u.RideID)
+	publishWaitlist(changed)
+	w.Write([]byte(`{"message": "Ride updated"}`))
+}
+
+// badRequest: 驗證失敗，writeError 會回 400
+type badRequest string
+
+func (e badRequest) Error() string { return string(e) }
+
+// prepareRide: 建立旅程前的檢查與補值 (DriverID 要先設好)
+// 座標是選填，但有給就要成對而且合法；車輛座位數是人數上限；停靠站會做地理編碼
+func prepareRide(c context.Context, ride *types.Ride) error {
+	if !validCoordinates(ride.OriginLat, ride.OriginLng) || !validCoordinates(ride.DestinationLat, ride.DestinationLng) {
+		return badRequest("Invalid coordinates")
+	}
+	if !validWaitlistMode(ride.WaitlistMode) {
+		return badRequest("Invalid waitlistMode")
+	}
+	if err := prepareVisibility(ride); err != nil {
+		return err
+	}
+	if err := preparePrice(ride); err != nil {
+		return badRequest("Invalid price: " + err.Error())
+	}
+	if ride.Luggage != "" && !search.ValidLuggage(ride.Luggage) {
+		return badRequest("Invalid luggage")
+	}
+	if err := applyVehicle(ride); err != nil {
+		return err
+	}
+	if err := prepareRoute(c, ride); err != nil {
+		return badRequest("Invalid stops: " + err.Error())
+	}
+	return nil
+}
+
+// applyVehicle: 檢查車輛是司機自己的，沒給人數就用車輛座位數，給了不能超過
+func applyVehicle(ride *types.Ride) error {
+	ride.Vehicle = nil
+	if ride.VehicleID == "" {
+		return nil
+	}
+	v, err := db.GetVehicle(ride.VehicleID, ride.DriverID)
+	if err != nil {
+		return err
+	}
+	if ride.MaxPassengers == 0 {
+		ride.MaxPassengers = v.Seats
+	}
+	if ride.MaxPassengers > v.Seats {
+		return fmt.Errorf("maxPassengers exceeds vehicle seats")
+	}
+	return nil
+}
+
+// GET /api/vehicles：我的車輛；POST /api/vehicles：登記新車輛
+func vehiclesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getClaims(r).UserID
+	if r.Method == "GET" {
+		vehicles, err := db.GetMyVehicles(userID)
+		if err != nil {
+			writeError(w, err, "Failed to query vehicles")
+			return
+		}
+		writeJSON(w, vehicles)
+		return
+	}
+
+	var v types.Vehicle
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	v.Make, v.Model, v.Color = strings.TrimSpace(v.Make), strings.TrimSpace(v.Model), strings.TrimSpace(v.Color)
+	v.Plate = strings.ToUpper(strings.TrimSpace(v.Plate))
+	if v.Make == "" || v.Model == "" || v.Plate == "" {
+		http.Error(w, "make, model and plate are required", http.StatusBadRequest)
+		return
+	}
+	if v.Seats <= 0 || v.Seats > 50 {
+		http.Error(w, "Invalid seats", http.StatusBadRequest)
+		return
+	}
+	v.Amenities = normalizeAmenities(v.Amenities)
+	if len(v.Amenities) > 20 {
+		http.Error(w, "Too many amenities", http.StatusBadRequest)
+		return
+	}
+	v.ID = newID()
+	v.OwnerID = userID
+	if err := db.CreateVehicle(v); err != nil {
+		writeError(w, err, "Failed to create vehicle")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v)
+}
+
+// POST /api/vehicles/delete：刪除車輛 (已經建立的旅程不受影響)
+func deleteVehicleHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		VehicleID string `json:"vehicleId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.VehicleID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := db.DeleteVehicle(req.VehicleID, getClaims(r).UserID); err != nil {
+		writeError(w, err, "Failed to delete vehicle")
+		return
+	}
+	w.Write([]byte(`{"message": "Vehicle deleted"}`))
+}
+
+// preparePrice: 有收費但沒給幣別時用預設幣別，再檢查價格設定；不收費的旅程不存幣別
+func preparePrice(ride *types.Ride) error {
+	if ride.PriceMode == pricing.Free {
+		ride.Currency = ""
+	} else if ride.Currency == "" {
+		ride.Currency = pricing.DefaultCurrency
+	}
+	ride.Currency = strings.ToUpper(ride.Currency)
+	return pricing.Price{Mode: ride.PriceMode, Amount: ride.PriceAmount, Currency: ride.Currency}.Validate()
+}
+
+// GET /api/rides/costs?rideId=...：旅程費用明細 (每位乘客的分攤金額)
+func rideCostsHandler(w http.ResponseWriter, r *http.Request) {
+	costs, err := db.GetCostBreakdown(r.URL.Query().Get("rideId"), getClaims(r).UserID)
+	if err != nil {
+		writeError(w, err, "Failed to query costs")
+		return
+	}
+	writeJSON(w, costs)
+}
+
+func validWaitlistMode(mode string) bool {
+	return mode == "" || mode == "auto" || mode == "offer"
+}
+
+func validVisibility(v string) bool {
+	return v == "public" || v == "private" || v == "org"
+}
+
+// prepareVisibility: 有給 orgId 預設只給組織看；組織旅程只有成員能開 (DriverID 要先設好)
+func prepareVisibility(ride *types.Ride) error {
+	if ride.Visibility == "" && ride.OrgID != "" {
+		ride.Visibility = "org"
+	}
+	if ride.Visibility == "" {
+		ride.Visibility = "public"
+	}
+	if !validVisibility(ride.Visibility) {
+		return badRequest("Invalid visibility")
+	}
+	if ride.Visibility == "org" && ride.OrgID == "" {
+		return badRequest("orgId required for org rides")
+	}
+	if ride.OrgID == "" {
+		return nil
+	}
+	member, err := db.IsOrgMember(ride.OrgID, ride.DriverID)
+	if err == nil && !member {
+		return fmt.Errorf("not an org member")
+	}
+	return err
+}
+
+// --- 司機核准 ---
+
+// GET /api/rides/approvals：司機收件匣 (待核准的申請)
+func pendingRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	requests, err := db.GetPendingRequests(getClaims(r).UserID)
+	if err != nil {
+		writeError(w, err, "Failed to query requests")
+		return
+	}
+	writeJSON(w, requests)
+}
+
+// POST /api/rides/approvals/{approve,reject}
+func decideRequestHandler(approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RideActionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RideID == "" || req.PassengerID == "" {
+			http.Error(w, "Invalid body", http.StatusBadRequest)
+			return
+		}
+		if err := db.DecideBookingRequest(req.RideID, getClaims(r).UserID, req.PassengerID, approve); err != nil {
+			writeError(w, err, "Failed to update request")
+			return
+		}
+		settleRide(req.RideID)
+		w.Write([]byte(`{"message": "Request updated"}`))
+	}
+}
+
+// 定期讓過了截止時間的申請失效
+func sweepApprovals(c context.Context) error {
+	n, err := db.ExpirePendingRequests(jobFence(c))
+	if n > 0 {
+		log.Printf("Approval sweeper expired %d requests", n)
+	}
+	return err
+}
+
+// --- 候補名單 ---
+
+// GET /api/rides/waitlist?rideId=：我的候補狀態與順位
+// POST /api/rides/waitlist：排進候補 (body 同 join)
+func waitlistHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getClaims(r).UserID
+	if r.Method == "GET" {
+		entry, err := db.GetWaitlistEntry(r.URL.Query().Get("rideId"), userID)
+		if err != nil {
+			writeError(w, err, "Failed to query waitlist")
+			return
+		}
+		writeJSON(w, entry)
+		return
+	}
+
+	var req JoinRideRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RideID == "" || req.Seats < 0 {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	booking := types.Booking{RideID: req.RideID, PassengerID: userID, FromStop: req.FromStop, ToStop: req.ToStop,
+		Seats: req.Seats}
+	if err := applyInvite(&booking, req.Invite); err != nil {
+		writeError(w, err, "Failed to join waitlist")
+		return
+	}
+	entry, err := db.JoinWaitlist(booking)
+	recordInviteGuess(userID, err)
+	if err != nil {
+		writeError(w, err, "Failed to join waitlist")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// GET /api/rides/waitlist/entries?rideId=：司機查看整個候補名單
+func waitlistEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := db.GetWaitlist(r.URL.Query().Get("rideId"), getClaims(r).UserID)
+	if err != nil {
+		writeError(w, err, "Failed to query waitlist")
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// POST /api/rides/waitlist/leave：退出候補
+func leaveWaitlistHandler(w http.ResponseWriter, r *http.Request) {
+	var req RideActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RideID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	changed, err := db.LeaveWaitlist(req.RideID, getClaims(r).UserID)
+	if err != nil {
+		writeError(w, err, "Failed to leave waitlist")
+		return
+	}
+	publishWaitlist(changed)
+	w.Write([]byte(`{"message": "Left waitlist"}`))
+}
+
+// POST /api/rides/waitlist/accept：在保留時間內確認候補到的位子
+func acceptWaitlistOfferHandler(w http.ResponseWriter, r *http.Request) {
+	var req RideActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RideID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := db.AcceptWaitlistOffer(req.RideID, getClaims(r).UserID); err != nil {
+		writeError(w, err, "Failed to accept offer")
+		return
+	}
+	settleRide(req.RideID)
+	w.Write([]byte(`{"message": "Joined successfully"}`))
+}
+
+// initPayments: 選擇金流供應商 (fake 的交易狀態放在 Redis，每個 replica 共用)
+func initPayments() {
+	p, err := payment.New(rdb)
+	if err != nil {
+		log.Fatal("Failed to init payment provider:", err)
+	}
+	// 本機的 fake 會模擬 callback (同一個事件會再送一次)，直接走跟 webhook 相同的處理
+	if f, ok := p.(*payment.Fake); ok {
+		f.OnEvent = func(e types.PaymentEvent) {
+			if _, err := db.ApplyPaymentEvent(e); err != nil {
+				log.Printf("Apply payment event %s failed: %v", e.ID, err)
+			}
+		}
+	}
+	payments = p
+}
+
+// settleRide: 訂位有變動後在背景同步付款，失敗的話由 runPaymentSettler 補做
+func settleRide(rideID string) {
+	go func() {
+		c, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := payment.Settle(c, payments, rideID); err != nil {
+			log.Printf("Settle ride %s failed: %v", rideID, err)
+		}
+	}()
+}
+
+func settlePayments(c context.Context) error {
+	n, err := payment.SettlePending(c, payments)
+	if n > 0 {
+		log.Printf("Payment settler settled %d rides", n)
+	}
+	return err
+}
+
+// POST /api/payments/callback：金流供應商的非同步通知
+// 用 X-Payment-Signature (body 的 HMAC-SHA256 hex) 驗證，重送的事件直接回 200
+func paymentCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if len(paymentCallbackSecret) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	mac := hmac.New(sha256.New, paymentCallbackSecret)
+	mac.Write(body)
+	signature, err := hex.DecodeString(r.Header.Get("X-Payment-Signature"))
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var e types.PaymentEvent
+	if err := json.Unmarshal(body, &e); err != nil || e.ID == "" || e.Type == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if _, err := db.ApplyPaymentEvent(e); err != nil {
+		if err.Error() == "payment not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("Apply payment event %s failed: %v", e.ID, err)
+		http.Error(w, "Failed to apply event", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(`{"message": "ok"}`))
+}
+
+// GET /api/payments：我的付款紀錄與帳本餘額
+func myPaymentsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getClaims(r).UserID
+	list, err := db.GetMyPayments(userID)
+	if err != nil {
+		writeError(w, err, "Failed to query payments")
+		return
+	}
+	accounts, err := db.GetLedgerAccounts(userID)
+	if err != nil {
+		writeError(w, err, "Failed to query ledger")
+		return
+	}
+	writeJSON(w, map[string]interface{}{"payments": list, "accounts": accounts})
+}
+
+// GET /api/rides/requests：司機瀏覽乘客的搭車需求 (參數同搜尋的 originLat/originLng/originRadiusKm...)
+// POST /api/rides/requests：乘客發布需求
+func rideRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getClaims(r).UserID
+	if r.Method == "GET" {
+		var near types.RideSearch
+		var err error
+		params := r.URL.Query()
+		if near.OriginLat, err = parseFloatParam(params.Get("originLat")); err == nil {
+			near.OriginLng, err = parseFloatParam(params.Get("originLng"))
+		}
+		if err == nil {
+			near.DestinationLat, err = parseFloatParam(params.Get("destinationLat"))
+		}
+		if err == nil {
+			near.DestinationLng, err = parseFloatParam(params.Get("destinationLng"))
+		}
+		if err != nil {
+			http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+			return
+		}
+		if v, _ := parseFloatParam(params.Get("originRadiusKm")); v != nil {
+			near.OriginRadiusKm = *v
+		}
+		if v, _ := parseFloatParam(params.Get("destinationRadiusKm")); v != nil {
+			near.DestinationRadiusKm = *v
+		}
+		requests, err := db.GetOpenRideRequests(userID, near)
+		if err != nil {
+			writeError(w, err, "Failed to query requests")
+			return
+		}
+		writeJSON(w, requests)
+		return
+	}
+
+	var q types.RideRequest
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	q.Origin, q.Destination = strings.TrimSpace(q.Origin), strings.TrimSpace(q.Destination)
+	if q.Origin == "" || q.Destination == "" {
+		http.Error(w, "origin and destination are required", http.StatusBadRequest)
+		return
+	}
+	if !validCoordinates(q.OriginLat, q.OriginLng) || !validCoordinates(q.DestinationLat, q.DestinationLng) {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	if !q.DepartureTime.After(now) {
+		http.Error(w, "departureTime must be in the future", http.StatusBadRequest)
+		return
+	}
+	if q.FlexMinutes == 0 {
+		q.FlexMinutes = 30
+	}
+	if q.FlexMinutes < 0 || q.FlexMinutes > 24*60 {
+		http.Error(w, "Invalid flexMinutes", http.StatusBadRequest)
+		return
+	}
+	if q.Seats == 0 {
+		q.Seats = 1
+	}
+	if q.Seats < 0 || q.Seats > 8 {
+		http.Error(w, "Invalid seats", http.StatusBadRequest)
+		return
+	}
+	q.Preferences.Amenities = normalizeAmenities(q.Preferences.Amenities)
+	if err := search.ValidateFilter(q.Preferences); err != nil {
+		http.Error(w, "Invalid preferences: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flex := time.Duration(q.FlexMinutes) * time.Minute
+	q.EarliestDeparture, q.LatestDeparture = q.DepartureTime.Add(-flex), q.DepartureTime.Add(flex)
+	if q.EarliestDeparture.Before(now) {
+		q.EarliestDeparture = now
+	}
+	q.OriginCanonical, q.DestinationCanonical = "", ""
+	geocodeEndpoint(r.Context(), q.Origin, &q.OriginLat, &q.OriginLng, &q.OriginCanonical)
+	geocodeEndpoint(r.Context(), q.Destination, &q.DestinationLat, &q.DestinationLng, &q.DestinationCanonical)
+
+	claims := getClaims(r)
+	q.ID = newID()
+	q.PassengerID, q.PassengerName = claims.UserID, claims.Name
+	q.Status = "open"
+	q.CreatedAt = now
+	if err := db.CreateRideRequest(q); err != nil {
+		writeError(w, err, "Failed to create request")
+		return
+	}
+	bus.Publish(ctx, events.Event{Type: events.RideRequestCreated, RequestID: q.ID, ActorID: q.PassengerID}, q)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(q)
+}
+
+// GET /api/rides/requests/mine：我發布的需求與司機的回應
+func myRideRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	requests, err := db.GetMyRideRequests(getClaims(r).UserID)
+	if err != nil {
+		writeError(w, err, "Failed to query requests")
+		return
+	}
+	writeJSON(w, requests)
+}
+
+// POST /api/rides/requests/cancel：乘客撤回需求
+func cancelRideRequestHandler(w http.ResponseWriter, r *http.Request) {
+	var req RideRequestAction
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RequestID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	userID := getClaims(r).UserID
+	if err := db.CancelRideRequest(req.RequestID, userID); err != nil {
+		writeError(w, err, "Failed to cancel request")
+		return
+	}
+	bus.Publish(ctx, events.Event{Type: events.RideRequestCancelled, RequestID: req.RequestID, ActorID: userID}, nil)
+	w.Write([]byte(`{"message": "Request cancelled"}`))
+}
+
+// POST /api/rides/requests/offer：司機回應需求 (rideId = 用現有旅程，ride = 開新的旅程)
+func offerRideHandler(w http.ResponseWriter, r *http.Request) {
+	var req RideRequestAction
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RequestID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if (req.RideID == "") == (req.Ride == nil) {
+		http.Error(w, "Provide either rideId or ride", http.StatusBadRequest)
+		return
+	}
+	claims := getClaims(r)
+	if !requireDriver(w, claims.UserID) {
+		return
+	}
+	q, err := db.GetRideRequest(req.RequestID)
+	if err != nil {
+		writeError(w, err, "Failed to load request")
+		return
+	}
+
+	offer := types.RideOffer{RequestID: q.ID, DriverID: claims.UserID, DriverName: claims.Name, RideID: req.RideID, Message: req.Message}
+	if req.Ride != nil {
+		// 新旅程的草稿：沒給的欄位用需求的內容補上，乘客接受後才建立
+		ride := *req.Ride
+		if ride.Origin == "" {
+			ride.Origin, ride.OriginLat, ride.OriginLng = q.Origin, q.OriginLat, q.OriginLng
+		}
+		if ride.Destination == "" {
+			ride.Destination, ride.DestinationLat, ride.DestinationLng = q.Destination, q.DestinationLat, q.DestinationLng
+		}
+		if ride.DepartureTime.IsZero() {
+			ride.DepartureTime = q.DepartureTime
+		}
+		ride.ID = newID()
+		ride.DriverID, ride.DriverName = claims.UserID, claims.Name
+		ride.ScheduleID, ride.OccurrenceDate = "", ""
+		if err := prepareRide(r.Context(), &ride); err != nil {
+			writeError(w, err, "Failed to prepare ride")
+			return
+		}
+		if ride.MaxPassengers == 0 {
+			ride.MaxPassengers = q.Seats
+		}
+		if ride.MaxPassengers < q.Seats {
+			http.Error(w, "Not enough seats for this request", http.StatusBadRequest)
+			return
+		}
+		offer.Ride = &ride
+	}
+
+	id, err := db.CreateRideOffer(offer)
+	if err != nil {
+		writeError(w, err, "Failed to create offer")
+		return
+	}
+	offer.ID = id
+	offer.Status = "pending"
+	offer.CreatedAt = time.Now().UTC()
+	bus.Publish(ctx, events.Event{Type: events.RideOfferCreated, RequestID: q.ID, RideID: offer.RideID, ActorID: claims.UserID}, offer)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(offer)
+}
+
+// POST /api/rides/requests/accept：乘客接受回應，直接成為該旅程的乘客
+func acceptRideOfferHandler(w http.ResponseWriter, r *http.Request) {
+	var req RideRequestAction
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RequestID == "" || req.OfferID == 0 {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	userID := getClaims(r).UserID
+	rideID, created, err := db.AcceptRideOffer(req.RequestID, req.OfferID, userID)
+	if err != nil {
+		writeError(w, err, "Failed to accept offer")
+		return
+	}
+	// 草稿旅程到這裡才真的建立，跟一般開車一樣要觸發增量媒合與搜尋通知
+	if created != nil {
+		bus.Publish(ctx, events.Event{Type: events.RideCreated, RideID: created.ID, ActorID: created.DriverID}, *created)
+	}
+	settleRide(rideID)
+	bus.Publish(ctx, events.Event{Type: events.RideRequestMatched, RequestID: req.RequestID, RideID: rideID, ActorID: userID},
+		map[string]int64{"offerId": req.OfferID})
+	writeJSON(w, map[string]string{"message": "Joined successfully", "rideId": rideID})
+}
+
+// POST /api/rides/requests/decline：乘客婉拒某個回應
+func declineRideOfferHandler(w http.ResponseWriter, r *http.Request) {
+	var req RideRequestAction
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RequestID == "" || req.OfferID == 0 {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := db.DeclineRideOffer(req.RequestID, req.OfferID, getClaims(r).UserID); err != nil {
+		writeError(w, err, "Failed to decline offer")
+		return
+	}
+	w.Write([]byte(`{"message": "Offer declined"}`))
+}
+
+// 定期清掉過期的候補保留位，讓下一位遞補
+func sweepWaitlist(c context.Context) error {
+	changed, err := db.ExpireWaitlistOffers(jobFence(c))
+	if len(changed) > 0 {
+		log.Printf("Waitlist sweeper updated %d entries", len(changed))
+	}
+	publishWaitlist(changed)
+	return err
+}
+
+// publishWaitlist: 遞補或拿到保留位的候補各發一個事件 (通知本人)
+func publishWaitlist(changed []types.WaitlistEntry) {
+	for _, e := range changed {
+		eventType := events.WaitlistPromoted
+		if e.Status == "offered" {
+			eventType = events.WaitlistOffered
+		}
+		bus.Publish(ctx, events.Event{Type: eventType, RideID: e.RideID, UserID: e.UserID}, e)
+	}
+}
+
+// --- WebSocket ---
+
+func handleConnections(w http.ResponseWriter, r *http.Request) {
+	// 沒有 token 或停權的人連不進聊天室 (升級成 WebSocket 之前還能回一般的 HTTP 錯誤)
+	claims := tokenClaims(r.URL.Query().Get("token"))
+	if claims == nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+	if suspended, err := db.UserSuspended(claims.UserID); err != nil || suspended {
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	// 這裡改用 rideId 因為我們現在是 "Ride"
+	rideID := r.URL.Query().Get("roomId")
+	if rideID == "" {
+		rideID = "general"
+	}
+
+	// 連線也會收到自己的站內通知 (不管在哪個房間)
+	userID := claims.UserID
+
+	// 1. 讀取歷史紀錄 (從 Redis Stream)
+	// 這裡簡化：只負責讀取，不負責像上次那樣倒序處理 (你可以之後加上)
+	streamKey := fmt.Sprintf("stream:%s", rideID)
+	var historyMessages []types.ChatMessage
+	// 我封鎖的人的訊息不顯示
+	blocked, err := db.BlockedBy(userID)
+	if err != nil {
+		log.Printf("Load blocks for %s failed: %v", userID, err)
+	}
+	streams, err := rdb.XRevRangeN(ctx, streamKey, "+", "-", 50).Result()
+	if err == nil {
+		for i := len(streams) - 1; i >= 0; i-- {
+			msgData := streams[i].Values["data"]
+			if jsonStr, ok := msgData.(string); ok {
+				var msg types.ChatMessage
+				json.Unmarshal([]byte(jsonStr), &msg)
+				if blocked[msg.SenderID] {
+					continue
+				}
+				msg.StreamID = streams[i].ID
+				historyMessages = append(historyMessages, msg)
+			}
+		}
+	}
+	// 註冊跟送歷史紀錄拿同一把鎖，廣播不會跟歷史紀錄同時寫進這條連線
+	clientsMu.Lock()
+	clients[ws] = rideID
+	clientUsers[ws] = userID
+	clientBlocked[ws] = blocked
+	if len(historyMessages) > 0 {
+		ws.WriteJSON(historyMessages)
+	}
+	clientsMu.Unlock()
+	defer removeClient(ws)
+
+	// 2. 處理新訊息
+	for {
+		var msg types.ChatMessage
+		err := ws.ReadJSON(&msg)
+		if err != nil {
+			break
+		}
+
+		// 房間與發送者一律以連線為準，不信任前端傳來的
+		msg.RideID, msg.SenderID = rideID, userID
+		msg.SenderName, msg.SenderPicture = "", ""
+		msg.ID, msg.StreamID = 0, ""
+
+		// 連線之後才被停權的人，下一則訊息就斷線
+		if suspended, err := db.UserSuspended(userID); err != nil || suspended {
+			removeClient(ws)
+			ws.WriteJSON(map[string]string{"type": "error", "error": "Account suspended"})
+			break
+		}
+
+		// A. 補全發送者資訊 (去 DB 查這個 ID 的名字和頭貼)
+		if userInfo, err := db.GetUserInfo(userID); err == nil {
+			msg.SenderName = userInfo.Name
+			msg.SenderPicture = userInfo.Picture
+		}
+
+		jsonMsg, _ := json.Marshal(msg)
+
+		// B. 寫入 Redis Stream (熱數據)；stream 的 ID 讓管理員刪訊息時找得到這一筆
+		msg.StreamID, err = rdb.XAdd(ctx, &redis.XAddArgs{
+			Stream: streamKey,
+			Values: map[string]interface{}{"data": jsonMsg},
+		}).Result()
+		if err != nil {
+			log.Printf("XAdd %s failed: %v", streamKey, err)
+		}
+		jsonMsg, _ = json.Marshal(msg)
+
+		// C. 寫入 Postgres (冷數據 - 使用 db package)
+		go func(m types.ChatMessage) {
+			id, err := db.SaveMessage(m.RideID, m.SenderID, m.Content, m.StreamID)
+			if err != nil {
+				log.Printf("Error saving to DB: %v", err)
+				return
+			}
+			// 存成功才通知 (通知會連到這則訊息)
+			m.ID = int(id)
+			bus.Publish(ctx, events.Event{Type: events.MessagePosted, RideID: m.RideID, ActorID: m.SenderID}, m)
+		}(msg)
+
+		// D. Pub/Sub (即時廣播)
+		rdb.Publish(ctx, chatChannel, jsonMsg)
+	}
+}
+
+// postSystemMessage: 伺服器發的聊天室訊息 (已經寫進 Postgres)，跟一般訊息一樣進 Redis stream 並廣播
+func postSystemMessage(m types.ChatMessage) {
+	jsonMsg, _ := json.Marshal(m)
+	id, err := rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: fmt.Sprintf("stream:%s", m.RideID),
+		Values: map[string]interface{}{"data": jsonMsg},
+	}).Result()
+	if err == nil {
+		m.StreamID = id
+		jsonMsg, _ = json.Marshal(m)
+	}
+	rdb.Publish(ctx, chatChannel, jsonMsg)
+}
+
+// NotificationFrame: WebSocket 上的站內通知 (聊天訊息是沒有 type 的 ChatMessage)
+type NotificationFrame struct {
+	Type         string             `json:"type"` // 固定是 "notification"
+	Notification types.Notification `json:"notification"`
+}
+
+// ModerationFrame: 管理員刪掉的訊息，前端用 streamId 從畫面上拿掉
+type ModerationFrame struct {
+	Type     string `json:"type"` // 固定是 "message_deleted"
+	RideID   string `json:"rideId"`
+	StreamID string `json:"streamId"`
+}
+
+// handleMessages: 所有頻道都在同一個 goroutine 寫，同一條連線不會被同時寫入
+func handleMessages() {
+	pubsub := rdb.Subscribe(ctx, chatChannel, notificationChannel, moderationChannel, blocksChannel)
+	defer pubsub.Close()
+	ch := pubsub.Channel()
+
+	for msg := range ch {
+		broadcast(msg)
+	}
+}
+
+// broadcast: 把一則 Redis 訊息推給這個 replica 上相關的連線
+func broadcast(msg *redis.Message) {
+	switch msg.Channel {
+	case blocksChannel:
+		reloadBlocks(msg.Payload)
+	case moderationChannel:
+		var f ModerationFrame
+		if err := json.Unmarshal([]byte(msg.Payload), &f); err != nil {
+			return
+		}
+		clientsMu.RLock()
+		defer clientsMu.RUnlock()
+		for client, rideID := range clients {
+			if rideID == f.RideID {
+				client.WriteJSON(f)
+			}
+		}
+	case notificationChannel:
+		var n types.Notification
+		if err := json.Unmarshal([]byte(msg.Payload), &n); err != nil {
+			return
+		}
+		clientsMu.RLock()
+		defer clientsMu.RUnlock()
+		for client, userID := range clientUsers {
+			if userID == n.UserID {
+				client.WriteJSON(NotificationFrame{Type: "notification", Notification: n})
+			}
+		}
+	default:
+		var chatMsg types.ChatMessage
+		if err := json.Unmarshal([]byte(msg.Payload), &chatMsg); err != nil {
+			return
+		}
+		// 封鎖了發送者的人收不到 (用連線上快取的封鎖名單)
+		clientsMu.RLock()
+		defer clientsMu.RUnlock()
+		for client, rideID := range clients {
+			if rideID == chatMsg.RideID && !clientBlocked[client][chatMsg.SenderID] {
+				client.WriteJSON(chatMsg)
+			}
+		}
+	}
+}
+
+// reloadBlocks: userID 封鎖或解除封鎖了某人，重新載入他在這個 replica 上所有連線的封鎖名單
+// 這個 replica 上沒有他的連線就不用查資料庫
+func reloadBlocks(userID string) {
+	connected := false
+	clientsMu.RLock()
+	for _, id := range clientUsers {
+		connected = connected || id == userID
+	}
+	clientsMu.RUnlock()
+	if !connected {
+		return
+	}
+	blocked, err := db.BlockedBy(userID)
+	if err != nil {
+		log.Printf("Reload blocks for %s failed: %v", userID, err)
+		return
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for client, id := range clientUsers {
+		if id == userID {
+			clientBlocked[client] = blocked
+		}
+	}
+}
+
+// publishBlocksChanged: 封鎖名單改了，通知所有 replica 更新這個人連線上的快取
+func publishBlocksChanged(userID string) {
+	if err := rdb.Publish(ctx, blocksChannel, userID).Err(); err != nil {
+		log.Printf("Publish block change for %s failed: %v", userID, err)
+	}
+}
+
+// tokenClaims: 驗證 query string 帶的 token (瀏覽器的 WebSocket 沒辦法帶 Header)
+func tokenClaims(tokenString string) *Claims {
+	if tokenString == "" {
+		return nil
+	}
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) { return jwtKey, nil })
+	if err != nil || !token.Valid {
+		return nil
+	}
+	return claims
+}
+func getMyRidesHandler(w http.ResponseWriter, r *http.Request) {
+	// 從 Header 解析 UserID (這段邏輯跟 createRide 一樣，建議抽成 helper)
+	authHeader := r.Header.Get("Authorization")
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+	claims := &Claims{}
+	jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) { return jwtKey, nil })
+	
+	rides, err := db.GetMyRides(claims.UserID)
+	if err != nil {
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(rides)
+}
+
+// --- 行事曆訂閱 ---
+
+// GET /api/rides/mine.ics：我的旅程 (RFC 5545)
+// Google / Apple 行事曆訂閱時帶不了 JWT，用 ?token= 的訂閱 token；前端下載時也可以用 Authorization header
+func calendarFeedICSHandler(w http.ResponseWriter, r *http.Request) {
+	var userID string
+	if token := r.URL.Query().Get("token"); token != "" {
+		id, err := db.CalendarFeedUser(token)
+		if err != nil {
+			writeError(w, err, "Failed to query feed")
+			return
+		}
+		userID = id
+	} else if claims := optionalClaims(r); claims != nil {
+		userID = claims.UserID
+	} else {
+		http.Error(w, "Missing token", http.StatusUnauthorized)
+		return
+	}
+
+	rides, err := db.GetCalendarRides(userID)
+	if err != nil {
+		writeError(w, err, "Failed to query rides")
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="rides.ics"`)
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write(ical.Rides(userID, rides, appBaseURL(r)).Marshal(time.Now()))
+}
+
+// GET /api/rides/calendar-feed：有沒有訂閱網址 (網址只在建立時回傳一次)
+// POST：產生新的訂閱網址，舊的立刻失效
+func calendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getClaims(r).UserID
+	if r.Method == "GET" {
+		created, err := db.GetCalendarFeed(userID)
+		if err != nil {
+			writeError(w, err, "Failed to query feed")
+			return
+		}
+		writeJSON(w, map[string]interface{}{"active": created != nil, "createdAt": created})
+		return
+	}
+
+	token := newID() + newID()
+	if err := db.SetCalendarFeed(userID, token); err != nil {
+		writeError(w, err, "Failed to create feed")
+		return
+	}
+	feedURL := appBaseURL(r) + "/api/rides/mine.ics?token=" + token
+	writeJSON(w, map[string]string{
+		"url":       feedURL,
+		"webcalUrl": "webcal://" + strings.SplitN(feedURL, "://", 2)[1],
+	})
+}
+
+// POST /api/rides/calendar-feed/revoke：停用訂閱網址
+func revokeCalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	if err := db.RevokeCalendarFeed(getClaims(r).UserID); err != nil {
+		writeError(w, err, "Failed to revoke feed")
+		return
+	}
+	w.Write([]byte(`{"message": "Calendar feed revoked"}`))
+}
+
+// appBaseURL: 對外的網址 (APP_BASE_URL，沒設定就用這個請求的 Host)
+func appBaseURL(r *http.Request) string {
+	if base := os.Getenv("APP_BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// --- 不公開旅程的邀請 ---
+
+// 邀請碼猜錯的次數上限：同一個人在 inviteGuessWindow 內猜錯這麼多次就先擋下來 (所有 replica 共用 Redis 的計數)
+const (
+	inviteGuessLimit  = 10
+	inviteGuessWindow = 15 * time.Minute
+)
+
+func inviteGuessKey(userID string) string {
+	return "invite_guesses:" + userID
+}
+
+// checkInviteGuesses: 猜錯太多次回傳 "too many invite attempts" (429)；Redis 掛掉時不擋
+func checkInviteGuesses(userID string) error {
+	n, err := rdb.Get(ctx, inviteGuessKey(userID)).Int()
+	if err != nil && err != redis.Nil {
+		log.Printf("Read invite guesses for %s failed: %v", userID, err)
+		return nil
+	}
+	if n >= inviteGuessLimit {
+		return fmt.Errorf("too many invite attempts")
+	}
+	return nil
+}
+
+// recordInviteGuess: 找不到邀請 (invalid invite) 才算猜錯；每猜錯一次時間窗重新計算
+func recordInviteGuess(userID string, err error) {
+	if err == nil || err.Error() != "invalid invite" {
+		return
+	}
+	key := inviteGuessKey(userID)
+	if _, err := rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Incr(ctx, key)
+		p.PExpire(ctx, key, inviteGuessWindow)
+		return nil
+	}); err != nil {
+		log.Printf("Record invite guess for %s failed: %v", userID, err)
+	}
+}
+
+// applyInvite: 邀請連結的 token 要先驗過簽章，邀請碼不分大小寫
+// b.PassengerID 要先設好 (猜錯次數是算在這個人身上)
+func applyInvite(b *types.Booking, s string) error {
+	if s == "" {
+		return nil
+	}
+	if err := checkInviteGuesses(b.PassengerID); err != nil {
+		return err
+	}
+	if !invite.IsToken(s) {
+		b.InviteCode = invite.NormalizeCode(s)
+		return nil
+	}
+	id, ok := invite.Verify(inviteSecret, s)
+	if !ok {
+		err := fmt.Errorf("invalid invite")
+		recordInviteGuess(b.PassengerID, err)
+		return err
+	}
+	b.InviteID = id
+	return nil
+}
+
+// inviteLink: 前端首頁帶 ?invite= 會打開邀請的旅程
+func inviteLink(r *http.Request, inviteID string) string {
+	return appBaseURL(r) + "/?invite=" + url.QueryEscape(invite.Sign(inviteSecret, inviteID))
+}
+
+// GET  /api/rides/invites?rideId=|scheduleId=：司機查看邀請
+// POST /api/rides/invites：建立邀請，回傳邀請碼與連結
+func rideInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	driverID := getClaims(r).UserID
+	if r.Method == "GET" {
+		q := r.URL.Query()
+		if (q.Get("rideId") == "") == (q.Get("scheduleId") == "") {
+			http.Error(w, "rideId or scheduleId required", http.StatusBadRequest)
+			return
+		}
+		invites, err := db.GetInvites(q.Get("rideId"), q.Get("scheduleId"), driverID)
+		if err != nil {
+			writeError(w, err, "Failed to query invites")
+			return
+		}
+		for i := range invites {
+			invites[i].Link = inviteLink(r, invites[i].ID)
+		}
+		writeJSON(w, invites)
+		return
+	}
+
+	var req RideInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.RideID == "") == (req.ScheduleID == "") {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if req.MaxUses != nil && *req.MaxUses <= 0 {
+		http.Error(w, "maxUses must be positive", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expiresAt must be in the future", http.StatusBadRequest)
+		return
+	}
+	inv := types.RideInvite{ID: newID(), RideID: req.RideID, ScheduleID: req.ScheduleID, Code: invite.NewCode(),
+		MaxUses: req.MaxUses, ExpiresAt: req.ExpiresAt, CreatedAt: time.Now().UTC()}
+	if err := db.CreateInvite(inv, driverID); err != nil {
+		writeError(w, err, "Failed to create invite")
+		return
+	}
+	inv.Link = inviteLink(r, inv.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(inv)
+}
+
+// POST /api/rides/invites/revoke：撤銷邀請
+func revokeInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		InviteID string `json:"inviteId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.InviteID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := db.RevokeInvite(req.InviteID, getClaims(r).UserID); err != nil {
+		writeError(w, err, "Failed to revoke invite")
+		return
+	}
+	w.Write([]byte(`{"message": "Invite revoked"}`))
+}
+
+// GET /api/rides/invite?invite=：收到邀請的人先看旅程內容 (invite 是連結的 token 或邀請碼)
+func inviteRidesHandler(w http.ResponseWriter, r *http.Request) {
+	b := types.Booking{PassengerID: getClaims(r).UserID}
+	if err := applyInvite(&b, r.URL.Query().Get("invite")); err != nil {
+		writeError(w, err, "Failed to query invite")
+		return
+	}
+	inv, rides, err := db.GetInviteRides(b.InviteID, b.InviteCode)
+	recordInviteGuess(b.PassengerID, err)
+	if err != nil {
+		writeError(w, err, "Failed to query invite")
+		return
+	}
+	writeJSON(w, map[string]interface{}{"code": inv.Code, "expiresAt": inv.ExpiresAt, "rides": rides})
+}
+
+// --- 封鎖與檢舉 ---
+
+// GET /api/users/blocks：我封鎖的人；POST {userId}：封鎖
+func blocksHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getClaims(r).UserID
+	if r.Method == "GET" {
+		users, err := db.GetBlockedUsers(userID)
+		if err != nil {
+			writeError(w, err, "Failed to query blocks")
+			return
+		}
+		writeJSON(w, users)
+		return
+	}
+
+	var req UserActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := db.BlockUser(userID, req.UserID); err != nil {
+		writeError(w, err, "Failed to block user")
+		return
+	}
+	publishBlocksChanged(userID)
+	w.Write([]byte(`{"message": "User blocked"}`))
+}
+
+// POST /api/users/blocks/remove {userId}：解除封鎖
+func unblockHandler(w http.ResponseWriter, r *http.Request) {
+	var req UserActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	userID := getClaims(r).UserID
+	if err := db.UnblockUser(userID, req.UserID); err != nil {
+		writeError(w, err, "Failed to unblock user")
+		return
+	}
+	publishBlocksChanged(userID)
+	w.Write([]byte(`{"message": "User unblocked"}`))
+}
+
+var reportCategories = map[string]bool{
+	"spam": true, "harassment": true, "inappropriate": true, "safety": true, "fraud": true, "other": true,
+}
+
+// GET /api/reports：我送出的檢舉；POST：檢舉使用者、旅程或訊息 (進管理員的審核佇列)
+func reportsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getClaims(r).UserID
+	if r.Method == "GET" {
+		reports, err := db.GetMyReports(userID)
+		if err != nil {
+			writeError(w, err, "Failed to query reports")
+			return
+		}
+		writeJSON(w, reports)
+		return
+	}
+
+	var report types.Report
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil || report.TargetID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !reportCategories[report.Category] {
+		http.Error(w, "Invalid category", http.StatusBadRequest)
+		return
+	}
+	if len(report.Details) > 2000 {
+		http.Error(w, "details too long", http.StatusBadRequest)
+		return
+	}
+	report.ReporterID = userID
+	if err := db.CreateReport(&report); err != nil {
+		writeError(w, err, "Failed to create report")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
+
+// --- 管理員 ---
+
+// adminMethod: 只有管理員能用的 API；角色查資料庫，不看 token 裡的 role
+func adminMethod(method string, next http.HandlerFunc) http.HandlerFunc {
+	return authMethod(method, func(w http.ResponseWriter, r *http.Request) {
+		admin, err := db.IsAdmin(getClaims(r).UserID)
+		if err != nil {
+			writeError(w, err, "Failed to check role")
+			return
+		}
+		if !admin {
+			http.Error(w, "Admin only", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// 管理員操作的原因必填，寫進操作紀錄
+func validReason(reason string) bool {
+	reason = strings.TrimSpace(reason)
+	return reason != "" && len(reason) <= 1000
+}
+
+// GET /api/admin/users?q=：用 ID、Email 或名字找人
+func adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	users, err := db.SearchUsers(q, 50)
+	if err != nil {
+		writeError(w, err, "Failed to search users")
+		return
+	}
+	writeJSON(w, users)
+}
+
+// POST /api/admin/users/suspend {userId, reason, until}、/unsuspend {userId, reason}
+func suspendUserHandler(suspend bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req AdminUserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+			http.Error(w, "Invalid body", http.StatusBadRequest)
+			return
+		}
+		if !validReason(req.Reason) {
+			http.Error(w, "reason is required", http.StatusBadRequest)
+			return
+		}
+		adminID := getClaims(r).UserID
+		var err error
+		if suspend {
+			if req.Until != nil && !req.Until.After(time.Now()) {
+				http.Error(w, "until must be in the future", http.StatusBadRequest)
+				return
+			}
+			err = db.SuspendUser(req.UserID, adminID, req.Reason, req.Until)
+		} else {
+			err = db.UnsuspendUser(req.UserID, adminID, req.Reason)
+		}
+		if err != nil {
+			writeError(w, err, "Failed to update user")
+			return
+		}
+		if suspend {
+			writeJSON(w, map[string]string{"message": "User suspended"})
+		} else {
+			writeJSON(w, map[string]string{"message": "User unsuspended"})
+		}
+	}
+}
+
+// POST /api/admin/rides/cancel {rideId, reason}：強制取消旅程，付款跟司機取消一樣退款
+func adminCancelRideHandler(w http.ResponseWriter, r *http.Request) {
+	var req AdminRideRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RideID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !validReason(req.Reason) {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+	adminID := getClaims(r).UserID
+	if err := db.ForceCancelRide(req.RideID, adminID, req.Reason); err != nil {
+		writeError(w, err, "Failed to cancel ride")
+		return
+	}
+	settleRide(req.RideID)
+	bus.Publish(ctx, events.Event{Type: events.RideCancelled, RideID: req.RideID, ActorID: adminID}, nil)
+	writeJSON(w, map[string]string{"message": "Ride cancelled"})
+}
+
+// POST /api/admin/messages/delete {messageId, reason}：從聊天室拿掉訊息 (Postgres 只做標記)
+func adminDeleteMessageHandler(w http.ResponseWriter, r *http.Request) {
+	var req AdminMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID <= 0 {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if !validReason(req.Reason) {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+	rideID, streamID, err := db.DeleteMessage(req.MessageID, getClaims(r).UserID, req.Reason)
+	if err != nil {
+		writeError(w, err, "Failed to delete message")
+		return
+	}
+	if streamID != "" {
+		if err := rdb.XDel(ctx, fmt.Sprintf("stream:%s", rideID), streamID).Err(); err != nil {
+			log.Printf("XDel %s failed: %v", streamID, err)
+		}
+		frame, _ := json.Marshal(ModerationFrame{Type: "message_deleted", RideID: rideID, StreamID: streamID})
+		rdb.Publish(ctx, moderationChannel, frame)
+	}
+	writeJSON(w, map[string]string{"message": "Message deleted"})
+}
+
+// GET /api/admin/reports?status=&cursor=&limit=：審核佇列 (預設 open)，舊的在前
+func adminReportsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	status := cmp.Or(q.Get("status"), "open")
+	if status != "open" && status != "resolved" && status != "dismissed" {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	after, limit, err := parsePage(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := db.GetReportQueue(status, after, limit)
+	if err != nil {
+		writeError(w, err, "Failed to query reports")
+		return
+	}
+	writeJSON(w, page)
+}
+
+// POST /api/admin/reports/resolve {reportId, status, resolution}
+func resolveReportHandler(w http.ResponseWriter, r *http.Request) {
+	var req ResolveReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ReportID <= 0 {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if req.Status != "resolved" && req.Status != "dismissed" {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	if len(req.Resolution) > 2000 {
+		http.Error(w, "resolution too long", http.StatusBadRequest)
+		return
+	}
+	if err := db.ResolveReport(req.ReportID, getClaims(r).UserID, req.Status, req.Resolution); err != nil {
+		writeError(w, err, "Failed to resolve report")
+		return
+	}
+	writeJSON(w, map[string]string{"message": "Report " + req.Status})
+}
+
+// GET /api/admin/audit?adminId=&targetType=&targetId=&cursor=&limit=：操作紀錄，新的在前
+func auditLogHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	before, limit, err := parsePage(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := db.GetAuditLog(q.Get("adminId"), q.Get("targetType"), q.Get("targetId"), before, limit)
+	if err != nil {
+		writeError(w, err, "Failed to query audit log")
+		return
+	}
+	writeJSON(w, page)
+}
+
+// --- 組織 ---
+
+// 公用信箱的網域不能當組織網域 (不然所有用 gmail 的人都會被加進來)
+var publicEmailDomains = map[string]bool{
+	"gmail.com": true, "googlemail.com": true, "outlook.com": true, "hotmail.com": true, "live.com": true,
+	"yahoo.com": true, "icloud.com": true, "proton.me": true, "protonmail.com": true, "msn.com": true,
+	"yahoo.com.tw": true, "hotmail.com.tw": true, "qq.com": true, "163.com": true,
+}
+
+func emailDomain(email string) string {
+	_, domain, _ := strings.Cut(strings.ToLower(email), "@")
+	return domain
+}
+
+// orgDomains: 正規化組織的 email 網域
+// 新增的網域只能是自己 email 的網域，而且 email 要是 Google 驗證過的 (證明是這個網域的人)，已經在組織上的可以保留
+func orgDomains(domains []string, claims *Claims, existing []string) ([]string, error) {
+	list := make([]string, 0, len(domains))
+	seen := make(map[string]bool)
+	for _, d := range domains {
+		d = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(d)), "@")
+		if d == "" || seen[d] {
+			continue
+		}
+		if !strings.Contains(d, ".") || strings.ContainsAny(d, "@ /") || publicEmailDomains[d] {
+			return nil, badRequest("Invalid email domain: " + d)
+		}
+		if !slices.Contains(existing, d) {
+			if d != emailDomain(claims.Email) {
+				return nil, badRequest("Email domain must match your own email: " + d)
+			}
+			if !claims.EmailVerified {
+				return nil, badRequest("Verify your email before adding its domain: " + d)
+			}
+		}
+		seen[d] = true
+		list = append(list, d)
+	}
+	return list, nil
+}
+
+// GET /api/orgs：我加入的組織；POST：建立組織 (建立的人是管理員)
+func orgsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := getClaims(r)
+	if r.Method == "GET" {
+		orgs, err := db.GetMyOrgs(claims.UserID)
+		if err != nil {
+			writeError(w, err, "Failed to query organizations")
+			return
+		}
+		writeJSON(w, orgs)
+		return
+	}
+
+	var req OrgRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	domains, err := orgDomains(req.EmailDomains, claims, nil)
+	if err != nil {
+		writeError(w, err, "Failed to create organization")
+		return
+	}
+	org := types.Organization{ID: newID(), Name: strings.TrimSpace(req.Name), EmailDomains: domains,
+		Role: "admin", CreatedAt: time.Now().UTC()}
+	if err := db.CreateOrg(org, claims.UserID); err != nil {
+		writeError(w, err, "Failed to create organization")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(org)
+}
+
+// POST /api/orgs/update：管理員修改名稱與網域 (整份覆蓋)
+func updateOrgHandler(w http.ResponseWriter, r *http.Request) {
+	claims := getClaims(r)
+	var req OrgRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OrgID == "" || strings.TrimSpace(req.Name) == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	orgs, err := db.GetMyOrgs(claims.UserID)
+	if err != nil {
+		writeError(w, err, "Failed to update organization")
+		return
+	}
+	var existing []string
+	for _, o := range orgs {
+		if o.ID == req.OrgID {
+			existing = o.EmailDomains
+		}
+	}
+	domains, err := orgDomains(req.EmailDomains, claims, existing)
+	if err != nil {
+		writeError(w, err, "Failed to update organization")
+		return
+	}
+	org := types.Organization{ID: req.OrgID, Name: strings.TrimSpace(req.Name), EmailDomains: domains}
+	if err := db.UpdateOrg(org, claims.UserID); err != nil {
+		writeError(w, err, "Failed to update organization")
+		return
+	}
+	w.Write([]byte(`{"message": "Organization updated"}`))
+}
+
+// GET /api/orgs/members?orgId=：成員名單 (成員才看得到)
+func orgMembersHandler(w http.ResponseWriter, r *http.Request) {
+	members, err := db.GetOrgMembers(r.URL.Query().Get("orgId"), getClaims(r).UserID)
+	if err != nil {
+		writeError(w, err, "Failed to query members")
+		return
+	}
+	writeJSON(w, members)
+}
+
+// POST /api/orgs/members/role：管理員設定成員身分 (admin / member)
+func orgMemberRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var req OrgMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OrgID == "" || req.UserID == "" ||
+		(req.Role != "admin" && req.Role != "member") {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := db.SetOrgMemberRole(req.OrgID, req.UserID, req.Role, getClaims(r).UserID); err != nil {
+		writeError(w, err, "Failed to update member")
+		return
+	}
+	w.Write([]byte(`{"message": "Member updated"}`))
+}
+
+// POST /api/orgs/members/remove：管理員移除成員，不給 userId 是自己退出
+func removeOrgMemberHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getClaims(r).UserID
+	var req OrgMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OrgID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		req.UserID = userID
+	}
+	if err := db.RemoveOrgMember(req.OrgID, req.UserID, userID); err != nil {
+		writeError(w, err, "Failed to remove member")
+		return
+	}
+	w.Write([]byte(`{"message": "Member removed"}`))
+}
+
+// GET /api/orgs/invites?orgId=：管理員查看邀請碼；POST：建立邀請碼
+func orgInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	adminID := getClaims(r).UserID
+	if r.Method == "GET" {
+		invites, err := db.GetOrgInvites(r.URL.Query().Get("orgId"), adminID)
+		if err != nil {
+			writeError(w, err, "Failed to query invites")
+			return
+		}
+		writeJSON(w, invites)
+		return
+	}
+
+	var req OrgInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OrgID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if req.MaxUses != nil && *req.MaxUses <= 0 {
+		http.Error(w, "maxUses must be positive", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expiresAt must be in the future", http.StatusBadRequest)
+		return
+	}
+	inv := types.OrgInvite{Code: invite.NewCode(), OrgID: req.OrgID, MaxUses: req.MaxUses, ExpiresAt: req.ExpiresAt,
+		CreatedAt: time.Now().UTC()}
+	if err := db.CreateOrgInvite(inv, adminID); err != nil {
+		writeError(w, err, "Failed to create invite")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(inv)
+}
+
+// POST /api/orgs/invites/revoke：撤銷邀請碼
+func revokeOrgInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var req OrgInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := db.RevokeOrgInvite(invite.NormalizeCode(req.Code), getClaims(r).UserID); err != nil {
+		writeError(w, err, "Failed to revoke invite")
+		return
+	}
+	w.Write([]byte(`{"message": "Invite revoked"}`))
+}
+
+// POST /api/orgs/join：用邀請碼加入組織
+func joinOrgHandler(w http.ResponseWriter, r *http.Request) {
+	var req OrgInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	userID := getClaims(r).UserID
+	if err := checkInviteGuesses(userID); err != nil {
+		writeError(w, err, "Failed to join organization")
+		return
+	}
+	orgID, err := db.JoinOrg(invite.NormalizeCode(req.Code), userID)
+	recordInviteGuess(userID, err)
+	if err != nil {
+		writeError(w, err, "Failed to join organization")
+		return
+	}
+	writeJSON(w, map[string]string{"message": "Joined organization", "orgId": orgID})
+}
+
+// --- 週期排程 ---
 
-	for msg := range ch {
-		var chatMsg types.ChatMessage
-		if err := json.Unmarshal([]byte(msg.Payload), &chatMsg); err != nil {
-			continue
-		}
-		for client, rideID := range clients {
-			if rideID == chatMsg.RideID {
-				client.WriteJSON(chatMsg)
+// POST /api/rides/schedules：建立排程後立刻產生 horizon 內的班次
+func createScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var s types.RideSchedule
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, "Invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.Rule.Validate(); err != nil {
+		http.Error(w, "Invalid rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	claims := getClaims(r)
+	if !requireDriver(w, claims.UserID) {
+		return
+	}
+	s.Ride.DriverID = claims.UserID
+	if err := applyVehicle(&s.Ride); err != nil {
+		writeError(w, err, "Failed to load vehicle")
+		return
+	}
+	if s.Ride.MaxPassengers <= 0 {
+		http.Error(w, "maxPassengers must be positive", http.StatusBadRequest)
+		return
+	}
+	if !validCoordinates(s.Ride.OriginLat, s.Ride.OriginLng) || !validCoordinates(s.Ride.DestinationLat, s.Ride.DestinationLng) {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+	// 停靠站的預估時間是相對於第一站平移的，所以第一站一定要有時間基準
+	if len(s.Ride.Stops) > 0 && s.Ride.Stops[0].EstimatedTime == nil && s.Ride.DepartureTime.IsZero() {
+		for _, stop := range s.Ride.Stops {
+			if stop.EstimatedTime != nil {
+				http.Error(w, "Stops with estimated times need a departureTime on the template", http.StatusBadRequest)
+				return
 			}
 		}
 	}
+	if err := prepareRoute(r.Context(), &s.Ride); err != nil {
+		http.Error(w, "Invalid stops: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := preparePrice(&s.Ride); err != nil {
+		http.Error(w, "Invalid price: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.Ride.Luggage != "" && !search.ValidLuggage(s.Ride.Luggage) {
+		http.Error(w, "Invalid luggage", http.StatusBadRequest)
+		return
+	}
+
+	s.ID = newID()
+	s.DriverID = claims.UserID
+	s.Status = "active"
+	s.CreatedAt = time.Now()
+	s.Ride.ID = ""
+	s.Ride.DriverID = claims.UserID
+	s.Ride.DriverName = claims.Name
+	if err := prepareVisibility(&s.Ride); err != nil {
+		writeError(w, err, "Failed to create schedule")
+		return
+	}
+
+	if err := db.CreateSchedule(s); err != nil {
+		log.Printf("DB CreateSchedule Error: %v", err)
+		http.Error(w, "Failed to create schedule", http.StatusInternalServerError)
+		return
+	}
+	if n, err := db.MaterializeSchedule(s, scheduleHorizon); err != nil {
+		log.Printf("Materialize schedule %s failed: %v", s.ID, err)
+	} else {
+		log.Printf("Schedule %s created with %d rides", s.ID, n)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
 }
-func getMyRidesHandler(w http.ResponseWriter, r *http.Request) {
-	// 從 Header 解析 UserID (這段邏輯跟 createRide 一樣，建議抽成 helper)
-	authHeader := r.Header.Get("Authorization")
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	claims := &Claims{}
-	jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) { return jwtKey, nil })
-	
-	rides, err := db.GetMyRides(claims.UserID)
+
+// GET /api/rides/schedules：我的排程
+func getMySchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	schedules, err := db.GetMySchedules(getClaims(r).UserID)
 	if err != nil {
 		http.Error(w, "Query failed", http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(rides)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+// POST /api/rides/schedules/{cancel,skip,modify}
+func scheduleActionHandler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req OccurrenceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ScheduleID == "" {
+			http.Error(w, "Invalid body", http.StatusBadRequest)
+			return
+		}
+		if action != "cancel" {
+			if _, err := schedule.ParseDate(req.Date); err != nil {
+				http.Error(w, "Invalid date (want YYYY-MM-DD)", http.StatusBadRequest)
+				return
+			}
+		}
+
+		driverID := getClaims(r).UserID
+		var err error
+		switch action {
+		case "cancel":
+			err = db.CancelSchedule(req.ScheduleID, driverID)
+		case "skip":
+			err = db.SkipOccurrence(req.ScheduleID, driverID, req.Date)
+		case "modify":
+			if req.MaxPassengers != nil && *req.MaxPassengers <= 0 {
+				http.Error(w, "maxPassengers must be positive", http.StatusBadRequest)
+				return
+			}
+			var rideID string
+			var changed []types.WaitlistEntry
+			rideID, changed, err = db.ModifyOccurrence(req.ScheduleID, driverID, req.Date, req.OccurrenceOverride)
+			if err == nil && rideID != "" && req.DepartureTime != nil {
+				bus.Publish(ctx, events.Event{Type: events.RideTimeChanged, RideID: rideID, ActorID: driverID}, nil)
+			}
+			publishWaitlist(changed)
+		}
+		if err != nil {
+			writeError(w, err, "Failed to update schedule")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"message": "Schedule updated"}`))
+	}
+}
+
+// initMatcher: 旅程或需求建立時，在產生事件的 replica 上做增量媒合
+func initMatcher() {
+	bus.Subscribe(func(e events.Event) {
+		if n, err := match.ForRide(ctx, bus, e.RideID); err != nil {
+			log.Printf("Match ride %s failed: %v", e.RideID, err)
+		} else if n > 0 {
+			log.Printf("Matched ride %s with %d requests", e.RideID, n)
+		}
+	}, events.RideCreated)
+	bus.Subscribe(func(e events.Event) {
+		if n, err := match.ForRequest(ctx, bus, e.RequestID); err != nil {
+			log.Printf("Match request %s failed: %v", e.RequestID, err)
+		} else if n > 0 {
+			log.Printf("Matched request %s with %d rides", e.RequestID, n)
+		}
+	}, events.RideRequestCreated)
+}
+
+// initSavedSearchAlerts: 新旅程建立後通知儲存的搜尋條件符合的乘客
+func initSavedSearchAlerts() {
+	bus.Subscribe(func(e events.Event) {
+		if n, err := alerts.SavedSearches(ctx, bus, e.RideID); err != nil {
+			log.Printf("Saved search alerts for ride %s failed: %v", e.RideID, err)
+		} else if n > 0 {
+			log.Printf("Ride %s alerted %d saved searches", e.RideID, n)
+		}
+	}, events.RideCreated)
+}
+
+// GET /api/rides/saved-searches：我儲存的搜尋條件
+// POST /api/rides/saved-searches：儲存一組條件 (criteria 跟 GET /api/rides/search 的參數一樣)
+func savedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getClaims(r).UserID
+	if r.Method == "GET" {
+		searches, err := db.GetSavedSearches(userID)
+		if err != nil {
+			writeError(w, err, "Failed to query saved searches")
+			return
+		}
+		writeJSON(w, searches)
+		return
+	}
+
+	var s types.SavedSearch
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	q := &s.Criteria
+	if !validCoordinates(q.OriginLat, q.OriginLng) || !validCoordinates(q.DestinationLat, q.DestinationLng) {
+		http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+		return
+	}
+	s.Origin, s.Destination = strings.TrimSpace(s.Origin), strings.TrimSpace(s.Destination)
+	if !resolveSearchEndpoint(r.Context(), s.Origin, &q.OriginLat, &q.OriginLng) {
+		http.Error(w, "Unknown origin", http.StatusBadRequest)
+		return
+	}
+	if !resolveSearchEndpoint(r.Context(), s.Destination, &q.DestinationLat, &q.DestinationLng) {
+		http.Error(w, "Unknown destination", http.StatusBadRequest)
+		return
+	}
+	// 沒有起終點的條件會對每一趟新旅程都發通知
+	if q.OriginLat == nil && q.DestinationLat == nil {
+		http.Error(w, "origin or destination is required", http.StatusBadRequest)
+		return
+	}
+	if q.OriginRadiusKm < 0 || q.DestinationRadiusKm < 0 {
+		http.Error(w, "Invalid radius", http.StatusBadRequest)
+		return
+	}
+	q.Amenities = normalizeAmenities(q.Amenities)
+	if err := search.ValidateFilter(q.FeatureFilter); err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		s.Name = strings.TrimSpace(s.Origin + " → " + s.Destination)
+	}
+
+	s.ID = newID()
+	s.UserID = userID
+	s.CreatedAt = time.Now().UTC()
+	s.LastAlertAt = nil
+	if err := db.CreateSavedSearch(s); err != nil {
+		writeError(w, err, "Failed to save search")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+type SavedSearchAction struct {
+	ID     string `json:"id"`
+	Alerts bool   `json:"alerts"`
+}
+
+// POST /api/rides/saved-searches/alerts：開關新旅程通知
+func savedSearchAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	var req SavedSearchAction
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := db.SetSavedSearchAlerts(req.ID, getClaims(r).UserID, req.Alerts); err != nil {
+		writeError(w, err, "Failed to update saved search")
+		return
+	}
+	w.Write([]byte(`{"message": "Saved search updated"}`))
+}
+
+// POST /api/rides/saved-searches/delete
+func deleteSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	var req SavedSearchAction
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := db.DeleteSavedSearch(req.ID, getClaims(r).UserID); err != nil {
+		writeError(w, err, "Failed to delete saved search")
+		return
+	}
+	w.Write([]byte(`{"message": "Saved search deleted"}`))
+}
+
+// initNotifications: 站內通知一定有；email 要設 SMTP_ADDR (fake = 本機假伺服器)，推播要設 VAPID_PRIVATE_KEY
+func initNotifications() {
+	notifications = notify.NewQueue()
+	notifications.Channels[notify.InApp] = notify.Inbox{Delivered: func(n types.Notification) {
+		payload, _ := json.Marshal(n)
+		if err := rdb.Publish(ctx, notificationChannel, payload).Err(); err != nil {
+			log.Printf("Publish notification %d failed: %v", n.ID, err)
+		}
+	}}
+
+	if tz := os.Getenv("NOTIFY_TIMEZONE"); tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			notify.Location = loc
+		} else {
+			log.Printf("Invalid NOTIFY_TIMEZONE=%q: %v", tz, err)
+		}
+	}
+
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		mailer := &notify.SMTP{Addr: addr, From: os.Getenv("SMTP_FROM"), BaseURL: os.Getenv("APP_BASE_URL")}
+		if mailer.From == "" {
+			mailer.From = "no-reply@rideshare.local"
+		}
+		if addr == "fake" {
+			fake, err := notify.StartFakeSMTP("127.0.0.1:0")
+			if err != nil {
+				log.Fatalf("Start fake SMTP failed: %v", err)
+			}
+			fake.OnMail = func(m notify.Mail) { log.Printf("Fake SMTP: mail from %s to %v", m.From, m.To) }
+			mailer.Addr = fake.Addr()
+		} else if user := os.Getenv("SMTP_USERNAME"); user != "" {
+			host, _, _ := net.SplitHostPort(addr)
+			mailer.Auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		notifications.Channels[notify.Email] = mailer
+	}
+
+	if key := os.Getenv("VAPID_PRIVATE_KEY"); key != "" {
+		subject := os.Getenv("VAPID_SUBJECT")
+		if subject == "" {
+			subject = "mailto:no-reply@rideshare.local"
+		}
+		p, err := notify.NewWebPush(key, subject)
+		if err != nil {
+			log.Fatalf("Web Push: %v", err)
+		}
+		p.Subscriptions = db.GetPushSubscriptions
+		p.Delivered, p.MarkDelivered = db.GetPushDeliveries, db.RecordPushDelivery
+		p.Gone = func(endpoint string) {
+			if err := db.DeletePushSubscription(endpoint, ""); err != nil {
+				log.Printf("Delete push subscription failed: %v", err)
+			}
+		}
+		webPush = p
+		notifications.Channels[notify.Push] = p
+	}
+
+	notifications.Subscribe(bus)
+}
+
+// GET /api/notifications?cursor=&limit=：通知中心，新的在前；cursor 是上一頁的 nextCursor
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	before, limit, err := parsePage(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := db.GetNotifications(getClaims(r).UserID, before, limit)
+	if err != nil {
+		writeError(w, err, "Failed to query notifications")
+		return
+	}
+	writeJSON(w, page)
+}
+
+// parsePage: ?cursor=&limit= 的分頁參數 (cursor 是上一頁的 nextCursor，limit 預設 20、最多 100)
+func parsePage(q url.Values) (int64, int, error) {
+	var cursor int64
+	if c := q.Get("cursor"); c != "" {
+		v, err := strconv.ParseInt(c, 10, 64)
+		if err != nil || v <= 0 {
+			return 0, 0, fmt.Errorf("Invalid cursor")
+		}
+		cursor = v
+	}
+	limit := 20
+	if l := q.Get("limit"); l != "" {
+		v, err := strconv.Atoi(l)
+		if err != nil || v <= 0 {
+			return 0, 0, fmt.Errorf("Invalid limit")
+		}
+		limit = min(v, 100)
+	}
+	return cursor, limit, nil
+}
+
+// POST /api/notifications/read {ids}：標記已讀；/read-all 全部已讀。回傳剩下的未讀數
+func markNotificationsReadHandler(all bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			IDs []int64 `json:"ids"`
+		}
+		if !all {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.IDs) == 0 {
+				http.Error(w, "ids is required", http.StatusBadRequest)
+				return
+			}
+		}
+		unread, err := db.MarkNotificationsRead(getClaims(r).UserID, req.IDs)
+		if err != nil {
+			writeError(w, err, "Failed to update notifications")
+			return
+		}
+		writeJSON(w, map[string]int{"unread": unread})
+	}
+}
+
+// GET / POST /api/notifications/preferences：各管道的開關與靜音的類型
+func notificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getClaims(r).UserID
+	if r.Method == "GET" {
+		p, err := db.GetNotificationPreferences(userID)
+		if err != nil {
+			writeError(w, err, "Failed to query preferences")
+			return
+		}
+		writeJSON(w, p)
+		return
+	}
+
+	var p types.NotificationPreferences
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	for _, kind := range p.Muted {
+		if !notify.ValidKind(kind) {
+			http.Error(w, "Unknown notification kind: "+kind, http.StatusBadRequest)
+			return
+		}
+	}
+	if err := db.SaveNotificationPreferences(userID, p); err != nil {
+		writeError(w, err, "Failed to save preferences")
+		return
+	}
+	writeJSON(w, p)
+}
+
+// GET /api/notifications/push/key：前端訂閱推播用的 VAPID 公鑰
+func pushKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if webPush == nil {
+		http.Error(w, "Push notifications are not configured", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]string{"publicKey": webPush.PublicKey()})
+}
+
+// POST /api/notifications/push/subscribe、/unsubscribe：body 是 PushSubscription.toJSON()
+func pushSubscriptionHandler(subscribe bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var s types.PushSubscription
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil || !strings.HasPrefix(s.Endpoint, "https://") {
+			http.Error(w, "Invalid subscription", http.StatusBadRequest)
+			return
+		}
+		userID := getClaims(r).UserID
+		var err error
+		if subscribe {
+			if s.Keys.P256dh == "" || s.Keys.Auth == "" {
+				http.Error(w, "Invalid subscription", http.StatusBadRequest)
+				return
+			}
+			err = db.SavePushSubscription(userID, s)
+		} else {
+			err = db.DeletePushSubscription(s.Endpoint, userID)
+		}
+		if err != nil {
+			writeError(w, err, "Failed to update push subscription")
+			return
+		}
+		w.Write([]byte(`{"message": "Push subscription updated"}`))
+	}
+}
+
+// 定期整批重新媒合 (排程展開的旅程、座位變動後才對得上的配對都靠這裡)
+func matchBatch(horizon time.Duration) func(context.Context) error {
+	return func(c context.Context) error {
+		n, err := match.Batch(c, bus, horizon)
+		if n > 0 {
+			log.Printf("Matcher proposed %d matches", n)
+		}
+		return err
+	}
+}
+
+// GET /api/rides/matches：推薦給我的配對
+// 乘客用 /api/rides/join (帶 fromStop / toStop) 加入，司機用 /api/rides/requests/offer (帶 rideId) 回應
+func myMatchesHandler(w http.ResponseWriter, r *http.Request) {
+	matches, err := db.GetMyMatches(getClaims(r).UserID)
+	if err != nil {
+		writeError(w, err, "Failed to query matches")
+		return
+	}
+	writeJSON(w, matches)
+}
+
+// POST /api/rides/matches/dismiss：不再顯示這個配對
+func dismissMatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MatchID int64 `json:"matchId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MatchID == 0 {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := db.DismissMatch(req.MatchID, getClaims(r).UserID); err != nil {
+		writeError(w, err, "Failed to dismiss match")
+		return
+	}
+	w.Write([]byte(`{"message": "Match dismissed"}`))
+}
+
+// 出發前提醒 (REMINDER_OFFSETS，例如 "24h,30m")；就算同時有兩個 replica 在跑也只會送一次，見 db.ClaimRideReminder
+func sendReminders(s *reminder.Scheduler) func(context.Context) error {
+	return func(c context.Context) error {
+		n, err := s.Tick(c, jobFence(c))
+		if n > 0 {
+			log.Printf("Reminder scheduler sent %d reminders", n)
+		}
+		return err
+	}
+}
+
+// 定期把排程展開成實際旅程 (多個 replica 同時跑也安全，見 db.MaterializeSchedule)
+func materializeSchedules(c context.Context) error {
+	n, err := db.MaterializeSchedules(scheduleHorizon, jobFence(c))
+	if n > 0 {
+		log.Printf("Schedule materializer created %d rides", n)
+	}
+	return err
+}
+
+// jobFence: 背景工作寫資料庫時帶上租約的 fencing token，卡住後才醒來的舊持有者寫不進去
+// 付款與媒合的寫入本身就是 idempotent (idempotency key / ON CONFLICT)，沒有帶
+func jobFence(c context.Context) db.Fence {
+	return db.Fence{Job: jobs.Name(c), Token: jobs.Token(c)}
+}
+
+// initJobs: 定期的背景工作，整個叢集每個週期只由一個 replica 執行 (Redis 租約，見 jobs.Scheduler)
+// 間隔可以用環境變數調整；Jitter 是間隔的 1/10
+func initJobs() {
+	owner, _ := os.Hostname()
+	scheduler = jobs.New(rdb, owner)
+	reminders := &reminder.Scheduler{
+		Offsets: envDurations("REMINDER_OFFSETS", reminder.DefaultOffsets),
+		Queue:   notifications,
+		Post:    postSystemMessage,
+	}
+	for _, j := range []jobs.Job{
+		{Name: "schedule-materializer", Interval: envDuration("SCHEDULE_MATERIALIZE_INTERVAL", 10*time.Minute), Run: materializeSchedules},
+		{Name: "waitlist-sweeper", Interval: envDuration("WAITLIST_SWEEP_INTERVAL", time.Minute), Run: sweepWaitlist},
+		{Name: "approval-sweeper", Interval: envDuration("APPROVAL_SWEEP_INTERVAL", time.Minute), Run: sweepApprovals},
+		{Name: "payment-settler", Interval: envDuration("PAYMENT_SETTLE_INTERVAL", 30*time.Second), Run: settlePayments},
+		{Name: "matcher", Interval: envDuration("MATCH_INTERVAL", 10*time.Minute), Run: matchBatch(envDuration("MATCH_HORIZON", 7*24*time.Hour))},
+		{Name: "reminders", Interval: envDuration("REMINDER_INTERVAL", time.Minute), Run: sendReminders(reminders)},
+	} {
+		j.Jitter = j.Interval / 10
+		scheduler.Register(j)
+	}
+}
+
+// GET /internal/jobs：各背景工作最近一次的執行結果 (只在叢集內部，Ingress 沒有開放)
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := scheduler.Status(r.Context())
+	if err != nil {
+		writeError(w, err, "Failed to query jobs")
+		return
+	}
+	writeJSON(w, list)
 }
+
 func main() {
 	initRedis()
+	initGeocoder()
+	initPayments()
 	db.Init()
+	db.WaitlistOfferTTL = envDuration("WAITLIST_OFFER_TTL", db.WaitlistOfferTTL)
+	db.ApprovalCutoff = envDuration("APPROVAL_CUTOFF", db.ApprovalCutoff)
+	db.RatingWindow = envDuration("RATING_WINDOW", db.RatingWindow)
+	db.SavedSearchDailyCap = envInt("SAVED_SEARCH_DAILY_CAP", db.SavedSearchDailyCap)
+	initMatcher()
+	initNotifications()
+	initSavedSearchAlerts()
 
 	go handleMessages()
+	initJobs()
+	scheduler.Start(ctx)
+	go notifications.Run(ctx)
 
 	http.HandleFunc("/ws", handleConnections)
+	http.HandleFunc("/internal/jobs", jobStatusHandler)
+	http.HandleFunc("/api/rides/mine.ics", calendarFeedICSHandler)
+	http.HandleFunc("/api/rides/calendar-feed", authMiddleware(calendarFeedHandler))
+	http.HandleFunc("/api/rides/calendar-feed/revoke", authMethod("POST", revokeCalendarFeedHandler))
 	http.HandleFunc("/api/rides/mine", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
 			getMyRidesHandler(w, r)
 		}
 	}))
+	http.HandleFunc("/api/rides/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.Method == "GET" {
+			searchRidesHandler(w, r)
+			return
+		}
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	})
+	http.HandleFunc("/api/rides/schedules", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			getMySchedulesHandler(w, r)
+		case "POST":
+			createScheduleHandler(w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	for _, action := range []string{"cancel", "skip", "modify"} {
+		http.HandleFunc("/api/rides/schedules/"+action, authMethod("POST", scheduleActionHandler(action)))
+	}
+	http.HandleFunc("/api/rides/invites", authMiddleware(rideInvitesHandler))
+	http.HandleFunc("/api/rides/invites/revoke", authMethod("POST", revokeInviteHandler))
+	http.HandleFunc("/api/rides/invite", authMethod("GET", inviteRidesHandler))
+	http.HandleFunc("/api/users/blocks", authMiddleware(blocksHandler))
+	http.HandleFunc("/api/users/blocks/remove", authMethod("POST", unblockHandler))
+	http.HandleFunc("/api/reports", authMiddleware(reportsHandler))
+	http.HandleFunc("/api/admin/users", adminMethod("GET", adminUsersHandler))
+	http.HandleFunc("/api/admin/users/suspend", adminMethod("POST", suspendUserHandler(true)))
+	http.HandleFunc("/api/admin/users/unsuspend", adminMethod("POST", suspendUserHandler(false)))
+	http.HandleFunc("/api/admin/rides/cancel", adminMethod("POST", adminCancelRideHandler))
+	http.HandleFunc("/api/admin/messages/delete", adminMethod("POST", adminDeleteMessageHandler))
+	http.HandleFunc("/api/admin/reports", adminMethod("GET", adminReportsHandler))
+	http.HandleFunc("/api/admin/reports/resolve", adminMethod("POST", resolveReportHandler))
+	http.HandleFunc("/api/admin/audit", adminMethod("GET", auditLogHandler))
+	http.HandleFunc("/api/orgs", authMiddleware(orgsHandler))
+	http.HandleFunc("/api/orgs/update", authMethod("POST", updateOrgHandler))
+	http.HandleFunc("/api/orgs/members", authMethod("GET", orgMembersHandler))
+	http.HandleFunc("/api/orgs/members/role", authMethod("POST", orgMemberRoleHandler))
+	http.HandleFunc("/api/orgs/members/remove", authMethod("POST", removeOrgMemberHandler))
+	http.HandleFunc("/api/orgs/invites", authMiddleware(orgInvitesHandler))
+	http.HandleFunc("/api/orgs/invites/revoke", authMethod("POST", revokeOrgInviteHandler))
+	http.HandleFunc("/api/orgs/join", authMethod("POST", joinOrgHandler))
+	http.HandleFunc("/api/rides/leave", authMethod("POST", leaveRideHandler))
+	http.HandleFunc("/api/rides/seats", authMethod("POST", reduceSeatsHandler))
+	http.HandleFunc("/api/rides/remove", authMethod("POST", removePassengerHandler))
+	http.HandleFunc("/api/rides/update", authMethod("POST", updateRideHandler))
+	http.HandleFunc("/api/rides/complete", authMethod("POST", rideStatusHandler(db.CompleteRide, events.RideCompleted, "Ride completed")))
+	http.HandleFunc("/api/rides/cancel", authMethod("POST", rideStatusHandler(db.CancelRide, events.RideCancelled, "Ride cancelled")))
+	http.HandleFunc("/api/rides/rate", authMethod("POST", rateHandler))
+	http.HandleFunc("/api/users/profile", authMethod("GET", profileHandler))
+	http.HandleFunc("/api/users/preferences", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "POST" {
+			preferencesHandler(w, r)
+		} else {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	http.HandleFunc("/api/vehicles", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "POST" {
+			vehiclesHandler(w, r)
+		} else {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	http.HandleFunc("/api/vehicles/delete", authMethod("POST", deleteVehicleHandler))
+	http.HandleFunc("/api/payments", authMethod("GET", myPaymentsHandler))
+	http.HandleFunc("/api/payments/callback", paymentCallbackHandler)
+	http.HandleFunc("/api/rides/costs", authMethod("GET", rideCostsHandler))
+	http.HandleFunc("/api/rides/approvals", authMethod("GET", pendingRequestsHandler))
+	http.HandleFunc("/api/rides/approvals/approve", authMethod("POST", decideRequestHandler(true)))
+	http.HandleFunc("/api/rides/approvals/reject", authMethod("POST", decideRequestHandler(false)))
+	http.HandleFunc("/api/rides/requests", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "POST" {
+			rideRequestsHandler(w, r)
+		} else {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	http.HandleFunc("/api/notifications/preferences", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "POST" {
+			notificationPreferencesHandler(w, r)
+		} else {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	http.HandleFunc("/api/notifications", authMethod("GET", notificationsHandler))
+	http.HandleFunc("/api/notifications/read", authMethod("POST", markNotificationsReadHandler(false)))
+	http.HandleFunc("/api/notifications/read-all", authMethod("POST", markNotificationsReadHandler(true)))
+	http.HandleFunc("/api/notifications/push/key", pushKeyHandler)
+	http.HandleFunc("/api/notifications/push/subscribe", authMethod("POST", pushSubscriptionHandler(true)))
+	http.HandleFunc("/api/notifications/push/unsubscribe", authMethod("POST", pushSubscriptionHandler(false)))
+	http.HandleFunc("/api/rides/saved-searches", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "POST" {
+			savedSearchesHandler(w, r)
+		} else {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	http.HandleFunc("/api/rides/saved-searches/alerts", authMethod("POST", savedSearchAlertsHandler))
+	http.HandleFunc("/api/rides/saved-searches/delete", authMethod("POST", deleteSavedSearchHandler))
+	http.HandleFunc("/api/rides/matches", authMethod("GET", myMatchesHandler))
+	http.HandleFunc("/api/rides/matches/dismiss", authMethod("POST", dismissMatchHandler))
+	http.HandleFunc("/api/rides/requests/mine", authMethod("GET", myRideRequestsHandler))
+	http.HandleFunc("/api/rides/requests/cancel", authMethod("POST", cancelRideRequestHandler))
+	http.HandleFunc("/api/rides/requests/offer", authMethod("POST", offerRideHandler))
+	http.HandleFunc("/api/rides/requests/accept", authMethod("POST", acceptRideOfferHandler))
+	http.HandleFunc("/api/rides/requests/decline", authMethod("POST", declineRideOfferHandler))
+	http.HandleFunc("/api/rides/waitlist", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "POST" {
+			waitlistHandler(w, r)
+		} else {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	http.HandleFunc("/api/rides/waitlist/entries", authMethod("GET", waitlistEntriesHandler))
+	http.HandleFunc("/api/rides/waitlist/leave", authMethod("POST", leaveWaitlistHandler))
+	http.HandleFunc("/api/rides/waitlist/accept", authMethod("POST", acceptWaitlistOfferHandler))
 	http.HandleFunc("/api/rides/join", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
         if r.Method == "POST" {
             joinRideHandler(w, r)
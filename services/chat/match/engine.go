@@ -0,0 +1,114 @@
+package match
+
+import (
+	"context"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/db"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/events"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 上車站可能是中途站，比旅程出發時間晚；找候選時把出發時間往前放寬這麼多
+const PickupSlack = 6 * time.Hour
+
+// ForRide: 新旅程建立後，找時間區間對得上的需求
+func ForRide(c context.Context, bus *events.Bus, rideID string) (int, error) {
+	rides, occupancy, err := db.MatchRide(rideID)
+	if err != nil || len(rides) == 0 {
+		return 0, err
+	}
+	departure := rides[0].DepartureTime
+	requests, err := db.MatchRequests(departure, departure.Add(PickupSlack))
+	if err != nil {
+		return 0, err
+	}
+	return propose(c, bus, rides, Pairs(rides, occupancy, requests))
+}
+
+// ForRequest: 新需求建立後，找可以載這位乘客的旅程
+func ForRequest(c context.Context, bus *events.Bus, requestID string) (int, error) {
+	q, err := db.GetRideRequest(requestID)
+	if err != nil || q.Status != "open" {
+		return 0, err
+	}
+	rides, occupancy, err := db.MatchRides(q.EarliestDeparture.Add(-PickupSlack), q.LatestDeparture)
+	if err != nil {
+		return 0, err
+	}
+	return propose(c, bus, rides, Pairs(rides, occupancy, []types.RideRequest{q}))
+}
+
+// Batch: 定期全部重新比對一次 (補上增量媒合漏掉的，例如有人離開後多出座位)
+// horizon 是往後看多久以內出發的需求
+func Batch(c context.Context, bus *events.Bus, horizon time.Duration) (int, error) {
+	now := time.Now().UTC()
+	requests, err := db.MatchRequests(now, now.Add(horizon))
+	if err != nil || len(requests) == 0 {
+		return 0, err
+	}
+	rides, occupancy, err := db.MatchRides(now.Add(-PickupSlack), now.Add(horizon))
+	if err != nil {
+		return 0, err
+	}
+	return propose(c, bus, rides, Pairs(rides, occupancy, requests))
+}
+
+// propose: 記錄配對，新的配對發 MatchProposed 事件 (司機與乘客兩邊都會收到)
+func propose(c context.Context, bus *events.Bus, rides []types.Ride, proposals []types.MatchProposal) (int, error) {
+	proposals, err := allowed(rides, proposals)
+	if err != nil || len(proposals) == 0 {
+		return 0, err
+	}
+	created, err := db.SaveMatchProposals(proposals)
+	for _, p := range created {
+		bus.Publish(c, events.Event{Type: events.MatchProposed, RideID: p.RideID, RequestID: p.RequestID}, p)
+	}
+	return len(created), err
+}
+
+// allowed: 組織限定的旅程只配給同組織的乘客，有封鎖關係的司機與乘客不配對
+func allowed(rides []types.Ride, proposals []types.MatchProposal) ([]types.MatchProposal, error) {
+	orgOf := make(map[string]string)
+	for _, r := range rides {
+		if r.Visibility == "org" {
+			orgOf[r.ID] = r.OrgID
+		}
+	}
+	byOrg := make(map[string][]string)
+	byDriver := make(map[string][]string)
+	for _, p := range proposals {
+		if org, ok := orgOf[p.RideID]; ok {
+			byOrg[org] = append(byOrg[org], p.PassengerID)
+		}
+		byDriver[p.DriverID] = append(byDriver[p.DriverID], p.PassengerID)
+	}
+	members := make(map[string]map[string]bool, len(byOrg))
+	for org, ids := range byOrg {
+		m, err := db.OrgMembers(org, ids)
+		if err != nil {
+			return nil, err
+		}
+		members[org] = m
+	}
+	blocked := make(map[string]map[string]bool, len(byDriver))
+	for driver, ids := range byDriver {
+		b, err := db.BlockedWith(driver, ids)
+		if err != nil {
+			return nil, err
+		}
+		blocked[driver] = b
+	}
+
+	kept := proposals[:0]
+	for _, p := range proposals {
+		if org, ok := orgOf[p.RideID]; ok && !members[org][p.PassengerID] {
+			continue
+		}
+		if blocked[p.DriverID][p.PassengerID] {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept, nil
+}
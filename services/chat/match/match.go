@@ -0,0 +1,191 @@
+package match
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/route"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/search"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 各項分數的權重 (加總為 1)
+const (
+	TimeWeight       = 0.3
+	ProximityWeight  = 0.4
+	SeatWeight       = 0.1
+	PreferenceWeight = 0.2
+)
+
+// 低於 MinScore 的配對不推薦；每個需求最多推薦 MaxPerRequest 趟旅程
+const (
+	MinScore      = 0.5
+	MaxPerRequest = 5
+)
+
+// 上下車點離需求的起終點多遠以內才算配得上 (公里)
+const RadiusKm = search.DefaultRadiusKm
+
+// Score: 計算一趟旅程與一筆需求的配對分數，不能配對時回傳 false
+// occ 是旅程每一小段已經被佔用的座位 (route.Occupancy)
+// 只用傳入的資料計算，同樣的輸入一定得到同樣的結果
+func Score(ride types.Ride, occ []int, q types.RideRequest) (types.MatchProposal, bool) {
+	p := types.MatchProposal{RideID: ride.ID, RequestID: q.ID, DriverID: ride.DriverID, PassengerID: q.PassengerID}
+	if ride.DriverID == q.PassengerID || q.OriginLat == nil || q.DestinationLat == nil {
+		return p, false
+	}
+
+	// 起終點：沿用搜尋的上下車站挑選邏輯
+	m, ok := search.Match(ride, types.RideSearch{
+		OriginLat: q.OriginLat, OriginLng: q.OriginLng, OriginRadiusKm: RadiusKm,
+		DestinationLat: q.DestinationLat, DestinationLng: q.DestinationLng, DestinationRadiusKm: RadiusKm,
+	})
+	if !ok {
+		return p, false
+	}
+	p.FromStop, p.ToStop = m.FromStop, m.ToStop
+	p.OriginDistanceKm, p.DestinationDistanceKm = m.OriginDistanceKm, m.DestinationDistanceKm
+	p.ProximityScore = clamp(1 - m.DetourKm/(2*RadiusKm))
+
+	// 時間：上車站的預估時間要落在需求的區間內，越接近乘客想要的時間分數越高
+	pickup := pickupTime(ride, m.FromStop)
+	if pickup.Before(q.EarliestDeparture) || pickup.After(q.LatestDeparture) {
+		return p, false
+	}
+	p.TimeScore = timeScore(pickup, q)
+
+	// 座位：這一段要坐得下，剩下的位子越剛好越優先 (讓車子坐滿)
+	p.FreeSeats = route.FreeSeats(ride.MaxPassengers, occ, route.Segment{From: m.FromStop, To: m.ToStop})
+	if p.FreeSeats < q.Seats || q.Seats <= 0 {
+		return p, false
+	}
+	p.SeatScore = float64(q.Seats) / float64(p.FreeSeats)
+
+	// 偏好：行李與無障礙是硬性條件，其他照符合的比例給分
+	score, ok := preferenceScore(ride, q.Preferences)
+	if !ok {
+		return p, false
+	}
+	p.PreferenceScore = score
+
+	p.Score = round(TimeWeight*p.TimeScore + ProximityWeight*p.ProximityScore +
+		SeatWeight*p.SeatScore + PreferenceWeight*p.PreferenceScore)
+	p.TimeScore, p.ProximityScore = round(p.TimeScore), round(p.ProximityScore)
+	p.SeatScore, p.PreferenceScore = round(p.SeatScore), round(p.PreferenceScore)
+	return p, p.Score >= MinScore
+}
+
+// Pairs: 所有旅程 x 需求兩兩計分，每個需求保留分數最高的 MaxPerRequest 筆
+// occupancy 以旅程 ID 為 key，沒有資料就當作還沒有人訂位
+func Pairs(rides []types.Ride, occupancy map[string][]int, requests []types.RideRequest) []types.MatchProposal {
+	byRequest := make(map[string][]types.MatchProposal)
+	for _, q := range requests {
+		for _, r := range rides {
+			if p, ok := Score(r, occupancy[r.ID], q); ok {
+				byRequest[q.ID] = append(byRequest[q.ID], p)
+			}
+		}
+	}
+
+	proposals := make([]types.MatchProposal, 0)
+	for _, list := range byRequest {
+		Rank(list)
+		if len(list) > MaxPerRequest {
+			list = list[:MaxPerRequest]
+		}
+		proposals = append(proposals, list...)
+	}
+	Rank(proposals)
+	return proposals
+}
+
+// Rank: 分數高的排前面；同分時依旅程、需求 ID 排序，確保順序固定
+func Rank(proposals []types.MatchProposal) {
+	sort.SliceStable(proposals, func(i, j int) bool {
+		a, b := proposals[i], proposals[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.RideID != b.RideID {
+			return a.RideID < b.RideID
+		}
+		return a.RequestID < b.RequestID
+	})
+}
+
+// pickupTime: 上車站有預估時間就用，沒有就用旅程的出發時間
+func pickupTime(ride types.Ride, fromStop int) time.Time {
+	for _, s := range route.Of(ride) {
+		if s.Seq == fromStop && s.EstimatedTime != nil {
+			return s.EstimatedTime.UTC()
+		}
+	}
+	return ride.DepartureTime.UTC()
+}
+
+// timeScore: 剛好是乘客想要的時間 = 1，到區間邊緣 = 0
+func timeScore(t time.Time, q types.RideRequest) float64 {
+	want := q.DepartureTime.UTC()
+	edge := q.LatestDeparture.Sub(want)
+	if t.Before(want) {
+		edge = want.Sub(q.EarliestDeparture)
+	}
+	if edge <= 0 {
+		return 1
+	}
+	diff := t.Sub(want)
+	if diff < 0 {
+		diff = -diff
+	}
+	return clamp(1 - float64(diff)/float64(edge))
+}
+
+// preferenceScore: 乘客沒有任何偏好就是滿分
+func preferenceScore(ride types.Ride, f types.FeatureFilter) (float64, bool) {
+	if f.MinLuggage != "" && !slices.Contains(search.LuggageAtLeast(f.MinLuggage), ride.Luggage) {
+		return 0, false
+	}
+	if f.WheelchairAccessible != nil && *f.WheelchairAccessible && !ride.WheelchairAccessible {
+		return 0, false
+	}
+
+	wanted, met := 0, 0
+	for _, c := range []struct {
+		want *bool
+		have bool
+	}{
+		{f.PetsAllowed, ride.PetsAllowed},
+		{f.SmokingAllowed, ride.SmokingAllowed},
+		{f.Music, ride.Music},
+		{f.ChildSeat, ride.ChildSeat},
+	} {
+		if c.want == nil {
+			continue
+		}
+		wanted++
+		if *c.want == c.have {
+			met++
+		}
+	}
+	for _, a := range f.Amenities {
+		wanted++
+		if ride.Vehicle != nil && slices.Contains(ride.Vehicle.Amenities, a) {
+			met++
+		}
+	}
+	if wanted == 0 {
+		return 1, true
+	}
+	return float64(met) / float64(wanted), true
+}
+
+func clamp(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// round: 取到小數點後 4 位，避免浮點誤差影響排序
+func round(v float64) float64 {
+	return math.Round(v*10000) / 10000
+}
@@ -0,0 +1,200 @@
+package match
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 固定的時間與地點，測試結果不受執行時間影響
+var base = time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)
+
+func ptr(v float64) *float64 { return &v }
+
+func yes() *bool { v := true; return &v }
+
+// 台北車站 → 桃園機場
+func testRide(id string, departure time.Time) types.Ride {
+	r := types.Ride{
+		ID: id, DriverID: "driver", MaxPassengers: 3, DepartureTime: departure,
+		OriginLat: ptr(25.0478), OriginLng: ptr(121.5170),
+		DestinationLat: ptr(25.0797), DestinationLng: ptr(121.2342),
+	}
+	r.Luggage = "medium"
+	return r
+}
+
+func testRequest(id string) types.RideRequest {
+	return types.RideRequest{
+		ID: id, PassengerID: "passenger", Seats: 1,
+		OriginLat: ptr(25.0478), OriginLng: ptr(121.5170),
+		DestinationLat: ptr(25.0797), DestinationLng: ptr(121.2342),
+		DepartureTime: base, EarliestDeparture: base.Add(-time.Hour), LatestDeparture: base.Add(time.Hour),
+	}
+}
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		name      string
+		ride      func() types.Ride
+		occ       []int
+		request   func() types.RideRequest
+		ok        bool
+		score     float64
+		timeScore float64
+	}{
+		{
+			name:    "exact match",
+			ride:    func() types.Ride { return testRide("r1", base) },
+			request: func() types.RideRequest { return testRequest("q1") },
+			ok:      true,
+			// 0.3*1 + 0.4*1 + 0.1*(1/3) + 0.2*1
+			score: 0.9333, timeScore: 1,
+		},
+		{
+			name:    "half way to the window edge",
+			ride:    func() types.Ride { return testRide("r1", base.Add(30*time.Minute)) },
+			request: func() types.RideRequest { return testRequest("q1") },
+			ok:      true,
+			score:   0.7833, timeScore: 0.5,
+		},
+		{
+			name:    "departure outside window",
+			ride:    func() types.Ride { return testRide("r1", base.Add(2*time.Hour)) },
+			request: func() types.RideRequest { return testRequest("q1") },
+		},
+		{
+			name: "own request",
+			ride: func() types.Ride { return testRide("r1", base) },
+			request: func() types.RideRequest {
+				q := testRequest("q1")
+				q.PassengerID = "driver"
+				return q
+			},
+		},
+		{
+			name:    "ride is full",
+			ride:    func() types.Ride { return testRide("r1", base) },
+			occ:     []int{3},
+			request: func() types.RideRequest { return testRequest("q1") },
+		},
+		{
+			name: "destination too far",
+			ride: func() types.Ride { return testRide("r1", base) },
+			request: func() types.RideRequest {
+				q := testRequest("q1")
+				q.DestinationLat, q.DestinationLng = ptr(24.1477), ptr(120.6736) // 台中
+				return q
+			},
+		},
+		{
+			name: "luggage is a hard requirement",
+			ride: func() types.Ride { return testRide("r1", base) },
+			request: func() types.RideRequest {
+				q := testRequest("q1")
+				q.Preferences.MinLuggage = "large"
+				return q
+			},
+		},
+		{
+			name: "unmet soft preference lowers the score",
+			ride: func() types.Ride { return testRide("r1", base) },
+			request: func() types.RideRequest {
+				q := testRequest("q1")
+				q.Preferences.PetsAllowed = yes()
+				return q
+			},
+			ok:    true,
+			score: 0.7333, timeScore: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, ok := Score(tt.ride(), tt.occ, tt.request())
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v (score %v)", ok, tt.ok, p.Score)
+			}
+			if !ok {
+				return
+			}
+			if p.Score != tt.score || p.TimeScore != tt.timeScore {
+				t.Errorf("score = %v, timeScore = %v; want %v, %v", p.Score, p.TimeScore, tt.score, tt.timeScore)
+			}
+			if p.FromStop != 0 || p.ToStop != 1 {
+				t.Errorf("stops = %d-%d, want 0-1", p.FromStop, p.ToStop)
+			}
+		})
+	}
+}
+
+func TestScoreIsDeterministic(t *testing.T) {
+	ride, q := testRide("r1", base.Add(10*time.Minute)), testRequest("q1")
+	first, _ := Score(ride, nil, q)
+	for i := 0; i < 10; i++ {
+		if p, _ := Score(ride, nil, q); p != first {
+			t.Fatalf("run %d = %+v, want %+v", i, p, first)
+		}
+	}
+}
+
+func TestPairs(t *testing.T) {
+	// 七趟旅程出發時間各差 5 分鐘，越接近 8:00 分數越高
+	var rides []types.Ride
+	for i := 6; i >= 0; i-- {
+		rides = append(rides, testRide(fmt.Sprintf("r%d", i), base.Add(time.Duration(i)*5*time.Minute)))
+	}
+	// r0 已經坐滿
+	occupancy := map[string][]int{"r0": {3}}
+	requests := []types.RideRequest{testRequest("q1"), testRequest("q2")}
+
+	got := Pairs(rides, occupancy, requests)
+	if len(got) != 2*MaxPerRequest {
+		t.Fatalf("got %d proposals, want %d", len(got), 2*MaxPerRequest)
+	}
+	// 每個需求留下 r1..r5，兩個需求同分時依需求 ID 排
+	var order []string
+	for _, p := range got {
+		order = append(order, p.RideID+"/"+p.RequestID)
+	}
+	want := []string{"r1/q1", "r1/q2", "r2/q1", "r2/q2", "r3/q1", "r3/q2", "r4/q1", "r4/q2", "r5/q1", "r5/q2"}
+	if fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Errorf("order = %v, want %v", order, want)
+	}
+}
+
+func TestRank(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []types.MatchProposal
+		want []string
+	}{
+		{
+			name: "higher score first",
+			in:   []types.MatchProposal{{RideID: "a", Score: 0.6}, {RideID: "b", Score: 0.9}},
+			want: []string{"b/", "a/"},
+		},
+		{
+			name: "ties by ride then request",
+			in: []types.MatchProposal{
+				{RideID: "b", RequestID: "1", Score: 0.7},
+				{RideID: "a", RequestID: "2", Score: 0.7},
+				{RideID: "a", RequestID: "1", Score: 0.7},
+			},
+			want: []string{"a/1", "a/2", "b/1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Rank(tt.in)
+			var got []string
+			for _, p := range tt.in {
+				got = append(got, p.RideID+"/"+p.RequestID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// SMTP: 用 SMTP 寄 email；伺服器支援 STARTTLS 就會升級加密
+type SMTP struct {
+	Addr    string    // host:port
+	From    string    // 寄件人地址
+	Auth    smtp.Auth // nil = 不登入 (例如本機的 FakeSMTP)
+	BaseURL string    // 通知連結的前綴 (例如 https://ride.example.com)
+}
+
+func (s *SMTP) Send(c context.Context, to Recipient, m Message) error {
+	if to.Email == "" {
+		return Permanent(fmt.Errorf("user %s has no email", to.UserID))
+	}
+	d := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := d.DialContext(c, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := c.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	host, _, _ := net.SplitHostPort(s.Addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Auth != nil {
+		if err := client.Auth(s.Auth); err != nil {
+			return classifySMTP(err)
+		}
+	}
+	if err := client.Mail(s.From); err != nil {
+		return classifySMTP(err)
+	}
+	if err := client.Rcpt(to.Email); err != nil {
+		return classifySMTP(err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return classifySMTP(err)
+	}
+	if _, err := w.Write(s.compose(to, m)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return classifySMTP(err)
+	}
+	return client.Quit()
+}
+
+// compose: 純文字信件，內文用 base64 避免中文與長行的問題
+// Message-ID 用佇列工作的 ID，重送的信收件端可以認出是同一封
+func (s *SMTP) compose(to Recipient, m Message) []byte {
+	domain := "localhost"
+	if i := strings.LastIndex(s.From, "@"); i >= 0 {
+		domain = s.From[i+1:]
+	}
+	body := m.Body
+	if m.Link != "" {
+		body += "\r\n\r\n" + s.BaseURL + m.Link
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", s.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", (&mailAddress{to.Name, to.Email}).String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", m.Title))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <notification-%d@%s>\r\n", m.ID, domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString([]byte(body))
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	return buf.Bytes()
+}
+
+type mailAddress struct{ name, address string }
+
+func (a *mailAddress) String() string {
+	if a.name == "" {
+		return "<" + a.address + ">"
+	}
+	return mime.QEncoding.Encode("UTF-8", a.name) + " <" + a.address + ">"
+}
+
+// classifySMTP: 5xx 是永久錯誤 (例如收件人不存在)，4xx 與連線問題可以重試
+func classifySMTP(err error) error {
+	var tp *textproto.Error
+	if errors.As(err, &tp) && tp.Code >= 500 {
+		return Permanent(err)
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package notify
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestSMTPSend(t *testing.T) {
+	fake, err := StartFakeSMTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+
+	s := &SMTP{Addr: fake.Addr(), From: "no-reply@ride.example.com", BaseURL: "https://ride.example.com"}
+	to := Recipient{UserID: "u1", Email: "alice@example.com", Name: "Alice"}
+	m := Message{ID: 7, Kind: KindRideJoined, Title: "Bob 加入了你的旅程", Body: "Bob booked a seat.", Link: "/rides/r1"}
+	if err := s.Send(context.Background(), to, m); err != nil {
+		t.Fatal(err)
+	}
+
+	mails := fake.Mails()
+	if len(mails) != 1 {
+		t.Fatalf("got %d mails, want 1", len(mails))
+	}
+	got := mails[0]
+	if got.From != s.From || len(got.To) != 1 || got.To[0] != to.Email {
+		t.Errorf("envelope = %s -> %v", got.From, got.To)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(got.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 重送的信 Message-ID 不變，收件端才認得出是同一封
+	if id := msg.Header.Get("Message-ID"); id != "<notification-7@ride.example.com>" {
+		t.Errorf("Message-ID = %q", id)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); subject != m.Title {
+		t.Errorf("Subject = %q, want %q", subject, m.Title)
+	}
+	raw, _ := io.ReadAll(msg.Body)
+	body, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(raw)), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := m.Body + "\r\n\r\nhttps://ride.example.com/rides/r1"; string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestSMTPWithoutEmailIsPermanent(t *testing.T) {
+	s := &SMTP{Addr: "127.0.0.1:1", From: "no-reply@ride.example.com"}
+	err := s.Send(context.Background(), Recipient{UserID: "u1"}, Message{ID: 1})
+	if !IsPermanent(err) {
+		t.Errorf("err = %v, want permanent", err)
+	}
+}
+
+func TestClassifySMTP(t *testing.T) {
+	if err := classifySMTP(&textproto.Error{Code: 550, Msg: "no such user"}); !IsPermanent(err) {
+		t.Errorf("550 should not be retried")
+	}
+	if err := classifySMTP(&textproto.Error{Code: 451, Msg: "try again later"}); IsPermanent(err) {
+		t.Errorf("451 should be retried")
+	}
+}
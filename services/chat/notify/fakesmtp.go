@@ -0,0 +1,128 @@
+package notify
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Mail: FakeSMTP 收到的一封信
+type Mail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// FakeSMTP: 本機的假 SMTP 伺服器，只實作寄信需要的指令 (不支援 STARTTLS / AUTH)
+// 開發環境用 SMTP_ADDR=fake 啟動，收到的信只記在記憶體並交給 OnMail
+type FakeSMTP struct {
+	OnMail func(Mail)
+
+	ln    net.Listener
+	mu    sync.Mutex
+	mails []Mail
+}
+
+// StartFakeSMTP: addr 用 "127.0.0.1:0" 會挑一個空的 port，實際位址看 Addr()
+func StartFakeSMTP(addr string) (*FakeSMTP, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	f := &FakeSMTP{ln: ln}
+	go f.serve()
+	return f, nil
+}
+
+func (f *FakeSMTP) Addr() string {
+	return f.ln.Addr().String()
+}
+
+// Mails: 目前為止收到的信
+func (f *FakeSMTP) Mails() []Mail {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Mail(nil), f.mails...)
+}
+
+func (f *FakeSMTP) Close() error {
+	return f.ln.Close()
+}
+
+func (f *FakeSMTP) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *FakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake-smtp ready")
+
+	var mail Mail
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 fake-smtp")
+		case "MAIL":
+			mail = Mail{From: addressOf(line)}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			mail.To = append(mail.To, addressOf(line))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			if mail.From == "" || len(mail.To) == 0 {
+				tp.PrintfLine("503 need MAIL and RCPT first")
+				continue
+			}
+			tp.PrintfLine("354 end with <CRLF>.<CRLF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			mail.Data = string(data)
+			f.mu.Lock()
+			f.mails = append(f.mails, mail)
+			f.mu.Unlock()
+			if f.OnMail != nil {
+				f.OnMail(mail)
+			}
+			mail = Mail{}
+			tp.PrintfLine("250 OK")
+		case "RSET":
+			mail = Mail{}
+			tp.PrintfLine("250 OK")
+		case "NOOP":
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+// addressOf: "MAIL FROM:<a@b>" -> "a@b"
+func addressOf(line string) string {
+	if i := strings.Index(line, "<"); i >= 0 {
+		if j := strings.Index(line[i:], ">"); j >= 0 {
+			return line[i+1 : i+j]
+		}
+	}
+	if i := strings.Index(line, ":"); i >= 0 {
+		return strings.TrimSpace(line[i+1:])
+	}
+	return ""
+}
@@ -0,0 +1,38 @@
+package notify
+
+import (
+	"context"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/db"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// Inbox: 站內通知，寫進使用者的通知中心 (同一個佇列工作重送不會重複)
+type Inbox struct {
+	// 新的一則寫進去之後呼叫 (main 用來推給 WebSocket 上的使用者)；重送的不會再呼叫
+	Delivered func(types.Notification)
+}
+
+func (b Inbox) Send(c context.Context, to Recipient, m Message) error {
+	n := types.Notification{
+		UserID:    to.UserID,
+		Kind:      m.Kind,
+		Title:     m.Title,
+		Body:      m.Body,
+		RideID:    m.RideID,
+		Link:      m.Link,
+		CreatedAt: time.Now().UTC(),
+	}
+	if m.MessageID != 0 {
+		n.MessageID = &m.MessageID
+	}
+	inserted, err := db.InsertNotification(&n, m.ID)
+	if err != nil {
+		return err
+	}
+	if inserted && b.Delivered != nil {
+		b.Delivered(n)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package notify
+
+import (
+	"context"
+	"errors"
+)
+
+// 通知管道 (也是 notification_jobs.channel 的值)
+const (
+	Email = "email"
+	Push  = "push"
+	InApp = "in_app"
+)
+
+// Recipient: 收件人
+type Recipient struct {
+	UserID string
+	Email  string
+	Name   string
+}
+
+// Message: 已經套好範本的通知內容；ID 是佇列工作的 ID，重送時不變，管道可以拿來去重
+type Message struct {
+	ID        int64
+	Kind      string
+	Title     string
+	Body      string
+	RideID    string
+	MessageID int64
+	Link      string
+}
+
+// Notifier: 一種通知管道；回傳錯誤的話佇列會重試，用 Permanent 包起來的錯誤不重試
+type Notifier interface {
+	Send(c context.Context, to Recipient, m Message) error
+}
+
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent: 重送也不會成功的錯誤 (例如收件人沒有 email)
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// IsPermanent: 是否為 Permanent 包起來的錯誤
+func IsPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
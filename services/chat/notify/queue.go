@@ -0,0 +1,186 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/db"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 重試策略：RetryBase * 2^(次數-1)，最多 RetryMax；送了 MaxAttempts 次還失敗就放棄
+const (
+	MaxAttempts = 6
+	RetryBase   = 30 * time.Second
+	RetryMax    = time.Hour
+)
+
+// 一次取幾筆、每筆的租約 (送到一半 replica 掛掉，租約過期後別的 replica 會重送)
+const (
+	batchSize = 50
+	lease     = 2 * time.Minute
+)
+
+// Queue: 通知佇列存在 Postgres (notification_jobs)，每個 replica 都跑 Run 一起消化
+type Queue struct {
+	Channels     map[string]Notifier // 只有設定好的管道會排進佇列
+	PollInterval time.Duration
+
+	wake chan struct{}
+}
+
+func NewQueue() *Queue {
+	return &Queue{Channels: make(map[string]Notifier), PollInterval: 5 * time.Second, wake: make(chan struct{}, 1)}
+}
+
+// Notify: 套範本後依每個人的設定排進佇列
+// key 用來去重：同一個 kind + key 對同一個人只會通知一次 (例如同一則配對、同一次改時間)
+func (q *Queue) Notify(userIDs []string, kind string, d Data, key string) error {
+	title, body, link, err := Render(kind, d)
+	if err != nil {
+		return err
+	}
+	// 某個人失敗不影響其他人，錯誤最後一起回傳
+	var errs []error
+	queued := false
+	for _, userID := range userIDs {
+		prefs, err := db.GetNotificationPreferences(userID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("preferences of %s: %v", userID, err))
+			continue
+		}
+		for _, channel := range q.channelsFor(prefs, kind) {
+			ok, err := db.EnqueueNotification(types.NotificationJob{
+				UserID:    userID,
+				Channel:   channel,
+				Kind:      kind,
+				Title:     title,
+				Body:      body,
+				RideID:    d.Ride.ID,
+				MessageID: d.MessageID,
+				Link:      link,
+				DedupeKey: fmt.Sprintf("%s:%s:%s:%s", kind, key, userID, channel),
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("enqueue %s to %s: %v", channel, userID, err))
+				continue
+			}
+			queued = queued || ok
+		}
+	}
+	if queued {
+		q.Kick()
+	}
+	return errors.Join(errs...)
+}
+
+// channelsFor: 使用者開著、而且伺服器有設定的管道 (靜音的類型一個都不送)
+func (q *Queue) channelsFor(p types.NotificationPreferences, kind string) []string {
+	for _, m := range p.Muted {
+		if m == kind {
+			return nil
+		}
+	}
+	var channels []string
+	if inAppOnly[kind] {
+		if _, ok := q.Channels[InApp]; ok && p.InApp {
+			channels = append(channels, InApp)
+		}
+		return channels
+	}
+	for _, c := range []struct {
+		name    string
+		enabled bool
+	}{{InApp, p.InApp}, {Email, p.Email}, {Push, p.Push}} {
+		if _, ok := q.Channels[c.name]; ok && c.enabled {
+			channels = append(channels, c.name)
+		}
+	}
+	return channels
+}
+
+// Kick: 有新工作，不用等到下一次輪詢
+func (q *Queue) Kick() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run: 持續取出到期的工作送出，直到 c 結束
+func (q *Queue) Run(c context.Context) {
+	for {
+		n, err := q.process(c)
+		if err != nil {
+			log.Printf("Notification queue error: %v", err)
+		}
+		if n == batchSize {
+			continue
+		}
+		select {
+		case <-c.Done():
+			return
+		case <-q.wake:
+		case <-time.After(q.PollInterval):
+		}
+	}
+}
+
+func (q *Queue) process(c context.Context) (int, error) {
+	jobs, err := db.ClaimNotificationJobs(batchSize, lease)
+	if err != nil {
+		return 0, err
+	}
+	for _, j := range jobs {
+		err := q.deliver(c, j)
+		if err == nil {
+			if err := db.CompleteNotificationJob(j.ID); err != nil {
+				log.Printf("Complete notification %d failed: %v", j.ID, err)
+			}
+			continue
+		}
+
+		retryAt := nextAttempt(err, j.Attempts, time.Now().UTC())
+		log.Printf("Notification %d (%s to %s) attempt %d failed: %v", j.ID, j.Channel, j.UserID, j.Attempts, err)
+		if err := db.RetryNotificationJob(j.ID, err, retryAt); err != nil {
+			log.Printf("Reschedule notification %d failed: %v", j.ID, err)
+		}
+	}
+	return len(jobs), nil
+}
+
+func (q *Queue) deliver(c context.Context, j types.NotificationJob) error {
+	n, ok := q.Channels[j.Channel]
+	if !ok {
+		return Permanent(fmt.Errorf("channel %s is not configured", j.Channel))
+	}
+	u, err := db.GetUserContact(j.UserID)
+	if err != nil {
+		return err
+	}
+	c, cancel := context.WithTimeout(c, 30*time.Second)
+	defer cancel()
+	return n.Send(c, Recipient{UserID: u.ID, Email: u.Email, Name: u.Name},
+		Message{ID: j.ID, Kind: j.Kind, Title: j.Title, Body: j.Body, RideID: j.RideID, MessageID: j.MessageID, Link: j.Link})
+}
+
+// nextAttempt: 第 attempts 次送出失敗後什麼時候重送，nil 代表放棄 (永久錯誤或次數用完)
+func nextAttempt(err error, attempts int, now time.Time) *time.Time {
+	if IsPermanent(err) || attempts >= MaxAttempts {
+		return nil
+	}
+	t := now.Add(Backoff(attempts))
+	return &t
+}
+
+// Backoff: 第 attempts 次失敗後要等多久
+func Backoff(attempts int) time.Duration {
+	d := RetryBase
+	for i := 1; i < attempts && d < RetryMax; i++ {
+		d *= 2
+	}
+	return min(d, RetryMax)
+}
@@ -0,0 +1,80 @@
+package notify
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{6, 16 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{20, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempts); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestNextAttempt(t *testing.T) {
+	now := time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)
+	transient := errors.New("connection refused")
+
+	if at := nextAttempt(transient, 1, now); at == nil || !at.Equal(now.Add(RetryBase)) {
+		t.Errorf("first failure retries at %v, want %v", at, now.Add(RetryBase))
+	}
+	if at := nextAttempt(transient, MaxAttempts-1, now); at == nil {
+		t.Errorf("attempt %d should still be retried", MaxAttempts-1)
+	}
+	if at := nextAttempt(transient, MaxAttempts, now); at != nil {
+		t.Errorf("attempt %d should give up, got %v", MaxAttempts, at)
+	}
+	if at := nextAttempt(Permanent(transient), 1, now); at != nil {
+		t.Errorf("permanent error should give up, got %v", at)
+	}
+}
+
+func TestChannelsFor(t *testing.T) {
+	q := NewQueue()
+	q.Channels[InApp] = Inbox{}
+	q.Channels[Email] = &SMTP{}
+	// 沒有設定推播，使用者開著也不會排進佇列
+
+	all := types.NotificationPreferences{InApp: true, Email: true, Push: true}
+	tests := []struct {
+		name  string
+		prefs types.NotificationPreferences
+		kind  string
+		want  []string
+	}{
+		{"configured channels only", all, KindRideJoined, []string{InApp, Email}},
+		{"email turned off", types.NotificationPreferences{InApp: true, Push: true}, KindRideJoined, []string{InApp}},
+		{"chat messages are in-app only", all, KindNewMessage, []string{InApp}},
+		{"muted kind", types.NotificationPreferences{InApp: true, Email: true, Muted: []string{KindRideJoined}}, KindRideJoined, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := q.channelsFor(tt.prefs, tt.kind)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
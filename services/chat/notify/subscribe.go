@@ -0,0 +1,167 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/db"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/events"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// Subscribe: 把旅程事件轉成通知 (事件只在產生它的 replica 處理一次)
+func (q *Queue) Subscribe(bus *events.Bus) {
+	// 乘客加入 / 離開：通知司機
+	bus.Subscribe(func(e events.Event) {
+		kind := KindRideJoined
+		if e.Type == events.RideLeft {
+			kind = KindRideLeft
+		}
+		q.forRide(e, kind, func(ride types.Ride, _ []string) []string { return []string{ride.DriverID} },
+			fmt.Sprintf("%s:%d", e.ActorID, e.At.UnixNano()))
+	}, events.RideJoined, events.RideLeft, events.RideRequestMatched)
+
+	// 司機移除乘客：通知被移除的人
+	bus.Subscribe(func(e events.Event) {
+		q.forRide(e, KindRemovedFromRide, func(types.Ride, []string) []string { return []string{e.UserID} },
+			fmt.Sprintf("%s:%d", e.UserID, e.At.UnixNano()))
+	}, events.PassengerRemoved)
+
+	// 取消、改時間：通知 confirmed 乘客
+	bus.Subscribe(func(e events.Event) {
+		q.forRide(e, KindRideCancelled, passengers, "")
+	}, events.RideCancelled)
+	bus.Subscribe(func(e events.Event) {
+		q.forRide(e, KindRideTimeChanged, passengers, "")
+	}, events.RideTimeChanged)
+
+	// 候補遞補或拿到保留位：通知候補的人 (保留位要在期限內確認)
+	bus.Subscribe(func(e events.Event) {
+		var entry types.WaitlistEntry
+		if err := json.Unmarshal(e.Data, &entry); err != nil {
+			log.Printf("Invalid %s event: %v", e.Type, err)
+			return
+		}
+		ride, _, err := db.GetRideAudience(e.RideID)
+		if err != nil {
+			log.Printf("Notify %s failed: %v", e.Type, err)
+			return
+		}
+		kind, d, key := KindWaitlistPromoted, Data{Ride: ride}, fmt.Sprintf("%s:%d", e.RideID, e.At.UnixNano())
+		if e.Type == events.WaitlistOffered && entry.OfferExpiresAt != nil {
+			kind, d.ExpiresAt = KindWaitlistOffered, *entry.OfferExpiresAt
+			key = fmt.Sprintf("%s:%d", e.RideID, entry.OfferExpiresAt.Unix())
+		}
+		if err := q.Notify([]string{e.UserID}, kind, d, key); err != nil {
+			log.Printf("Notify %s failed: %v", e.Type, err)
+		}
+	}, events.WaitlistPromoted, events.WaitlistOffered)
+
+	// 媒合引擎的配對：司機、乘客各一則
+	bus.Subscribe(func(e events.Event) {
+		var p types.MatchProposal
+		if err := json.Unmarshal(e.Data, &p); err != nil {
+			log.Printf("Invalid %s event: %v", e.Type, err)
+			return
+		}
+		ride, _, err := db.GetRideAudience(p.RideID)
+		if err != nil {
+			log.Printf("Notify %s failed: %v", e.Type, err)
+			return
+		}
+		key := fmt.Sprint(p.ID)
+		if err := q.Notify([]string{p.DriverID}, KindMatchProposed, Data{Ride: ride, ForDriver: true}, key); err != nil {
+			log.Printf("Notify %s failed: %v", e.Type, err)
+		}
+		if err := q.Notify([]string{p.PassengerID}, KindMatchProposed, Data{Ride: ride}, key); err != nil {
+			log.Printf("Notify %s failed: %v", e.Type, err)
+		}
+	}, events.MatchProposed)
+
+	// 儲存的搜尋條件有新旅程 (去重與每日上限在 alerts 處理過了)
+	bus.Subscribe(func(e events.Event) {
+		var alert struct {
+			SearchName string     `json:"searchName"`
+			Ride       types.Ride `json:"ride"`
+		}
+		if err := json.Unmarshal(e.Data, &alert); err != nil {
+			log.Printf("Invalid %s event: %v", e.Type, err)
+			return
+		}
+		err := q.Notify([]string{e.UserID}, KindSavedSearchMatched, Data{Ride: alert.Ride, SearchName: alert.SearchName}, alert.Ride.ID)
+		if err != nil {
+			log.Printf("Notify %s failed: %v", e.Type, err)
+		}
+	}, events.SavedSearchMatched)
+
+	// 聊天室有新訊息：通知車上其他人；同一個聊天室 10 分鐘內只通知一次，避免洗版
+	bus.Subscribe(func(e events.Event) {
+		var m types.ChatMessage
+		if err := json.Unmarshal(e.Data, &m); err != nil {
+			log.Printf("Invalid %s event: %v", e.Type, err)
+			return
+		}
+		ride, _, err := db.GetRideAudience(e.RideID)
+		if err != nil {
+			return // 不是旅程的聊天室 (例如 general)
+		}
+		audience, err := db.GetChatAudience(e.RideID)
+		if err != nil {
+			log.Printf("Notify %s failed: %v", e.Type, err)
+			return
+		}
+		// 封鎖了發送者的人不會收到
+		blockers, err := db.Blockers(e.ActorID)
+		if err != nil {
+			log.Printf("Notify %s failed: %v", e.Type, err)
+			return
+		}
+		recipients := make([]string, 0, len(audience))
+		for _, id := range audience {
+			if id != e.ActorID && !blockers[id] {
+				recipients = append(recipients, id)
+			}
+		}
+		d := Data{Ride: ride, ActorName: m.SenderName, MessageID: int64(m.ID), Message: m.Content}
+		if d.ActorName == "" {
+			d.ActorName = "Someone"
+		}
+		key := fmt.Sprintf("%s:%d", e.RideID, e.At.Unix()/int64(MessageCollapse/time.Second))
+		if err := q.Notify(recipients, KindNewMessage, d, key); err != nil {
+			log.Printf("Notify %s failed: %v", e.Type, err)
+		}
+	}, events.MessagePosted)
+}
+
+// 同一個聊天室的訊息通知多久合併成一則
+const MessageCollapse = 10 * time.Minute
+
+// forRide: 載入旅程與乘客，挑出收件人後通知；改時間的 key 用新的出發時間 (改兩次就通知兩次)
+func (q *Queue) forRide(e events.Event, kind string, recipients func(types.Ride, []string) []string, key string) {
+	ride, passengerIDs, err := db.GetRideAudience(e.RideID)
+	if err != nil {
+		log.Printf("Notify %s for ride %s failed: %v", kind, e.RideID, err)
+		return
+	}
+	d := Data{Ride: ride}
+	if e.ActorID != "" {
+		if u, err := db.GetUserInfo(e.ActorID); err == nil {
+			d.ActorName = u.Name
+		}
+	}
+	if d.ActorName == "" {
+		d.ActorName = "A passenger"
+	}
+	if kind == KindRideTimeChanged {
+		key = fmt.Sprint(ride.DepartureTime.Unix())
+	}
+	if err := q.Notify(recipients(ride, passengerIDs), kind, d, e.RideID+":"+key); err != nil {
+		log.Printf("Notify %s for ride %s failed: %v", kind, e.RideID, err)
+	}
+}
+
+func passengers(_ types.Ride, passengerIDs []string) []string {
+	return passengerIDs
+}
@@ -0,0 +1,177 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 通知類型 (使用者可以個別靜音)
+const (
+	KindRideJoined         = "ride_joined"
+	KindRideLeft           = "ride_left"
+	KindRemovedFromRide    = "removed_from_ride"
+	KindRideCancelled      = "ride_cancelled"
+	KindRideTimeChanged    = "ride_time_changed"
+	KindRideReminder       = "ride_reminder"
+	KindWaitlistPromoted   = "waitlist_promoted"
+	KindWaitlistOffered    = "waitlist_offered"
+	KindMatchProposed      = "match_proposed"
+	KindSavedSearchMatched = "saved_search_matched"
+	KindNewMessage         = "chat_message"
+)
+
+// 只送站內通知的類型 (聊天訊息太頻繁，不寄信也不推播)
+var inAppOnly = map[string]bool{KindNewMessage: true}
+
+// Data: 範本可以用的欄位
+type Data struct {
+	Ride       types.Ride
+	ActorName  string        // 觸發通知的人 (加入 / 離開的乘客)
+	Before     time.Duration // 出發前多久的提醒
+	SearchName string        // 儲存的搜尋條件名稱
+	ForDriver  bool          // 配對通知：收件人是司機還是乘客
+	MessageID  int64         // 聊天訊息的 ID
+	Message    string        // 聊天訊息內容
+	ExpiresAt  time.Time     // 候補保留位的期限
+}
+
+// 通知裡的時間用這個時區顯示 (main 可以用 NOTIFY_TIMEZONE 覆蓋)
+var Location = time.UTC
+
+var sources = map[string][2]string{
+	KindRideJoined: {
+		`{{.ActorName}} joined your ride`,
+		`{{.ActorName}} booked a seat on {{route .Ride}}, departing {{when .Ride.DepartureTime}}.`,
+	},
+	KindRideLeft: {
+		`{{.ActorName}} left your ride`,
+		`{{.ActorName}} is no longer riding {{route .Ride}} on {{when .Ride.DepartureTime}}.`,
+	},
+	KindRemovedFromRide: {
+		`You were removed from a ride`,
+		`{{.Ride.DriverName}} removed you from {{route .Ride}}, which was departing {{when .Ride.DepartureTime}}.`,
+	},
+	KindRideCancelled: {
+		`Ride cancelled`,
+		`{{.Ride.DriverName}} cancelled {{route .Ride}}, which was departing {{when .Ride.DepartureTime}}.`,
+	},
+	KindRideTimeChanged: {
+		`Departure time changed`,
+		`{{route .Ride}} now departs {{when .Ride.DepartureTime}}.`,
+	},
+	KindRideReminder: {
+		`Your ride departs in {{duration .Before}}`,
+		`{{route .Ride}} departs {{when .Ride.DepartureTime}}.`,
+	},
+	KindWaitlistPromoted: {
+		`You're off the waitlist`,
+		`A seat opened up on {{route .Ride}}, departing {{when .Ride.DepartureTime}}. You're now confirmed.`,
+	},
+	KindWaitlistOffered: {
+		`A seat is being held for you`,
+		`A seat opened up on {{route .Ride}}, departing {{when .Ride.DepartureTime}}. Accept it by {{when .ExpiresAt}} to keep it.`,
+	},
+	KindMatchProposed: {
+		`{{if .ForDriver}}A passenger is looking for your ride{{else}}We found a ride for you{{end}}`,
+		`{{route .Ride}}, departing {{when .Ride.DepartureTime}}, matches {{if .ForDriver}}a ride request{{else}}your ride request{{end}}.`,
+	},
+	KindSavedSearchMatched: {
+		`New ride for "{{.SearchName}}"`,
+		`{{.Ride.DriverName}} posted {{route .Ride}}, departing {{when .Ride.DepartureTime}}.`,
+	},
+	KindNewMessage: {
+		`New message from {{.ActorName}}`,
+		`{{route .Ride}}: {{excerpt .Message}}`,
+	},
+}
+
+var templates = make(map[string][2]*template.Template)
+
+func init() {
+	funcs := template.FuncMap{
+		"route": func(r types.Ride) string { return r.Origin + " → " + r.Destination },
+		"when": func(t time.Time) string {
+			return t.In(Location).Format("Mon Jan 2 15:04")
+		},
+		"duration": humanize,
+		"excerpt":  excerpt,
+	}
+	for kind, src := range sources {
+		templates[kind] = [2]*template.Template{
+			template.Must(template.New(kind + ".title").Funcs(funcs).Parse(src[0])),
+			template.Must(template.New(kind + ".body").Funcs(funcs).Parse(src[1])),
+		}
+	}
+}
+
+// ValidKind: 設定靜音時檢查類型
+func ValidKind(kind string) bool {
+	_, ok := sources[kind]
+	return ok
+}
+
+// Render: 套範本，回傳標題、內文與前端的連結
+func Render(kind string, d Data) (title, body, link string, err error) {
+	t, ok := templates[kind]
+	if !ok {
+		return "", "", "", fmt.Errorf("unknown notification kind %q", kind)
+	}
+	var buf bytes.Buffer
+	if err := t[0].Execute(&buf, d); err != nil {
+		return "", "", "", err
+	}
+	title = buf.String()
+	buf.Reset()
+	if err := t[1].Execute(&buf, d); err != nil {
+		return "", "", "", err
+	}
+	return title, buf.String(), linkFor(kind, d), nil
+}
+
+// linkFor: 已經在車上的人連到「我的旅程」，推薦類的通知連到大廳
+func linkFor(kind string, d Data) string {
+	if d.Ride.ID == "" {
+		return ""
+	}
+	switch kind {
+	case KindMatchProposed, KindSavedSearchMatched:
+		return "/?rideId=" + d.Ride.ID
+	case KindNewMessage:
+		return fmt.Sprintf("/my-rides?rideId=%s&messageId=%d", d.Ride.ID, d.MessageID)
+	default:
+		return "/my-rides?rideId=" + d.Ride.ID
+	}
+}
+
+// humanize: 24h -> "24 hours"、30m -> "30 minutes"
+func humanize(d time.Duration) string {
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		return plural(int(d/time.Hour), "hour")
+	case d >= time.Minute:
+		return plural(int(d.Round(time.Minute)/time.Minute), "minute")
+	default:
+		return "less than a minute"
+	}
+}
+
+// excerpt: 通知裡只放訊息的前 100 個字
+func excerpt(s string) string {
+	r := []rune(strings.TrimSpace(s))
+	if len(r) <= 100 {
+		return string(r)
+	}
+	return string(r[:100]) + "…"
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
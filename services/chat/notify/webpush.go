@@ -0,0 +1,267 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// WebPush: 瀏覽器推播 (RFC 8030)，內容用 RFC 8291 (aes128gcm) 加密，伺服器身分用 VAPID (RFC 8292)
+type WebPush struct {
+	Subject string // VAPID 聯絡方式，例如 mailto:ops@example.com
+	Client  *http.Client
+
+	// 查使用者的訂閱；推播服務回報訂閱失效 (404 / 410) 時呼叫 Gone
+	Subscriptions func(userID string) ([]types.PushSubscription, error)
+	Gone          func(endpoint string)
+
+	// 記錄同一個佇列工作已經送到哪些裝置，重送時只推還沒送到的 (沒設定就每次都推全部)
+	Delivered     func(jobID int64) (map[string]bool, error)
+	MarkDelivered func(jobID int64, endpoint string) error
+
+	key *ecdsa.PrivateKey
+}
+
+// NewWebPush: privateKey 是 base64url 編碼的 P-256 私鑰 (32 bytes)
+func NewWebPush(privateKey, subject string) (*WebPush, error) {
+	raw, err := decodeBase64URL(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %v", err)
+	}
+	key, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %v", err)
+	}
+	return &WebPush{Subject: subject, Client: &http.Client{Timeout: 10 * time.Second}, key: key}, nil
+}
+
+// PublicKey: 給前端 pushManager.subscribe 的 applicationServerKey (base64url)
+func (p *WebPush) PublicKey() string {
+	pub, err := p.key.PublicKey.ECDH()
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(pub.Bytes())
+}
+
+// Send: 推到使用者所有的裝置；Topic 用佇列工作 ID，重送時推播服務會取代還沒送達的那一則
+func (p *WebPush) Send(c context.Context, to Recipient, m Message) error {
+	subs, err := p.Subscriptions(to.UserID)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]string{
+		"kind": m.Kind, "title": m.Title, "body": m.Body, "rideId": m.RideID, "link": m.Link,
+	})
+	if err != nil {
+		return err
+	}
+
+	delivered := map[string]bool{}
+	if p.Delivered != nil {
+		if delivered, err = p.Delivered(m.ID); err != nil {
+			return err
+		}
+	}
+
+	// 有一台可以重試就整個工作重試 (已經送到的下次會跳過)，全部都是永久錯誤才放棄
+	var failed []error
+	retry := false
+	for _, s := range subs {
+		if delivered[s.Endpoint] {
+			continue
+		}
+		err := p.push(c, s, payload, fmt.Sprintf("n%d", m.ID))
+		if err == nil {
+			p.markDelivered(m.ID, s.Endpoint)
+			continue
+		}
+		failed = append(failed, fmt.Errorf("%s: %v", s.Endpoint, err))
+		retry = retry || !IsPermanent(err)
+	}
+	switch {
+	case len(failed) == 0:
+		return nil
+	case retry:
+		return fmt.Errorf("push failed for %d of %d devices: %v", len(failed), len(subs), errors.Join(failed...))
+	default:
+		return Permanent(errors.Join(failed...))
+	}
+}
+
+// markDelivered: 記錄失敗只會讓那台裝置在重送時多收一次，不影響這次的結果
+func (p *WebPush) markDelivered(jobID int64, endpoint string) {
+	if p.MarkDelivered == nil {
+		return
+	}
+	if err := p.MarkDelivered(jobID, endpoint); err != nil {
+		log.Printf("Record push delivery %d to %s failed: %v", jobID, endpoint, err)
+	}
+}
+
+func (p *WebPush) push(c context.Context, s types.PushSubscription, payload []byte, topic string) error {
+	body, err := encryptPayload(s, payload)
+	if err == errPayloadTooLarge {
+		return Permanent(err)
+	}
+	if err != nil {
+		// 訂閱的金鑰壞掉，重送也沒用
+		p.gone(s.Endpoint)
+		return nil
+	}
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		p.gone(s.Endpoint)
+		return nil
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": endpoint.Scheme + "://" + endpoint.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": p.Subject,
+	}).SignedString(p.key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(c, "POST", s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", "86400")
+	req.Header.Set("Topic", topic)
+	req.Header.Set("Urgency", "normal")
+	req.Header.Set("Authorization", "vapid t="+token+", k="+p.PublicKey())
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		p.gone(s.Endpoint)
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("push service returned %d", resp.StatusCode)
+	default:
+		// 400 / 401 / 413 之類的，重送一樣會失敗
+		return Permanent(fmt.Errorf("push service returned %d", resp.StatusCode))
+	}
+}
+
+func (p *WebPush) gone(endpoint string) {
+	if p.Gone != nil {
+		p.Gone(endpoint)
+	}
+}
+
+// 單一 record 的大小 (RFC 8188)；推播內容遠小於這個值
+const recordSize = 4096
+
+var errPayloadTooLarge = errors.New("push payload too large")
+
+// encryptPayload: RFC 8291 的 aes128gcm 加密
+// 產生一次性的 ECDH 金鑰，跟瀏覽器的 p256dh 算出共用密鑰，再加上 auth secret 推導出內容金鑰
+func encryptPayload(s types.PushSubscription, payload []byte) ([]byte, error) {
+	uaPublic, err := decodeBase64URL(s.Keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := decodeBase64URL(s.Keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+	curve := ecdh.P256()
+	ua, err := curve.NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	as, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := as.ECDH(ua)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := as.PublicKey().Bytes()
+
+	prkKey, err := hkdf.Extract(sha256.New, shared, authSecret)
+	if err != nil {
+		return nil, err
+	}
+	ikm, err := hkdf.Expand(sha256.New, prkKey, "WebPush: info\x00"+string(uaPublic)+string(asPublic), 32)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 只有一個 record，結尾補上 0x02 分隔符號
+	plaintext := append(append([]byte{}, payload...), 0x02)
+	if len(plaintext)+gcm.Overhead() > recordSize {
+		return nil, errPayloadTooLarge
+	}
+
+	// header: salt (16) | record size (4) | key id 長度 (1) | key id (伺服器的公鑰)
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, recordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// 瀏覽器給的金鑰是 base64url，有些實作會帶 padding
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,159 @@
+package notify
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// fakePushService: 依路徑決定回應，/flaky 第一次回 503 之後成功
+type fakePushService struct {
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+func (f *fakePushService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.hits[r.URL.Path]++
+	n := f.hits[r.URL.Path]
+	f.mu.Unlock()
+
+	if r.Header.Get("Content-Encoding") != "aes128gcm" || !strings.HasPrefix(r.Header.Get("Authorization"), "vapid t=") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch {
+	case r.URL.Path == "/flaky" && n == 1:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case r.URL.Path == "/gone":
+		w.WriteHeader(http.StatusGone)
+	case r.URL.Path == "/bad":
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	default:
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (f *fakePushService) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hits[path]
+}
+
+func newSubscription(t *testing.T, endpoint string) types.PushSubscription {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	var s types.PushSubscription
+	s.Endpoint = endpoint
+	s.Keys.P256dh = base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+	s.Keys.Auth = base64.RawURLEncoding.EncodeToString(auth)
+	return s
+}
+
+// newTestWebPush: 訂閱與送達紀錄都放記憶體，取代 main 接上的資料庫
+func newTestWebPush(t *testing.T, subs []types.PushSubscription) *WebPush {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := key.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewWebPush(base64.RawURLEncoding.EncodeToString(raw), "mailto:ops@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	delivered := map[int64]map[string]bool{}
+	p.Subscriptions = func(string) ([]types.PushSubscription, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]types.PushSubscription(nil), subs...), nil
+	}
+	p.Gone = func(endpoint string) {
+		mu.Lock()
+		defer mu.Unlock()
+		for i, s := range subs {
+			if s.Endpoint == endpoint {
+				subs = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+	}
+	p.Delivered = func(jobID int64) (map[string]bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		m := map[string]bool{}
+		for e := range delivered[jobID] {
+			m[e] = true
+		}
+		return m, nil
+	}
+	p.MarkDelivered = func(jobID int64, endpoint string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if delivered[jobID] == nil {
+			delivered[jobID] = map[string]bool{}
+		}
+		delivered[jobID][endpoint] = true
+		return nil
+	}
+	return p
+}
+
+func TestWebPushRetriesOnlyFailedDevices(t *testing.T) {
+	svc := &fakePushService{hits: map[string]int{}}
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+
+	p := newTestWebPush(t, []types.PushSubscription{
+		newSubscription(t, srv.URL+"/ok"),
+		newSubscription(t, srv.URL+"/flaky"),
+		newSubscription(t, srv.URL+"/gone"),
+	})
+	c, to, m := context.Background(), Recipient{UserID: "u1"}, Message{ID: 42, Kind: KindRideReminder, Title: "t", Body: "b"}
+
+	err := p.Send(c, to, m)
+	if err == nil || IsPermanent(err) {
+		t.Fatalf("first send = %v, want a retryable error", err)
+	}
+	if err := p.Send(c, to, m); err != nil {
+		t.Fatalf("retry = %v", err)
+	}
+	// 第一次已經送到的裝置重送時不會再收到
+	for path, want := range map[string]int{"/ok": 1, "/flaky": 2, "/gone": 1} {
+		if got := svc.count(path); got != want {
+			t.Errorf("%s got %d pushes, want %d", path, got, want)
+		}
+	}
+}
+
+func TestWebPushPermanentFailure(t *testing.T) {
+	svc := &fakePushService{hits: map[string]int{}}
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+
+	p := newTestWebPush(t, []types.PushSubscription{newSubscription(t, srv.URL+"/bad")})
+	err := p.Send(context.Background(), Recipient{UserID: "u1"}, Message{ID: 1, Title: "t"})
+	if !IsPermanent(err) {
+		t.Errorf("err = %v, want permanent", err)
+	}
+}
@@ -0,0 +1,199 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// Redis 裡的 key：fakepay:seq 是流水號、fakepay:key:<idempotency key> 對到交易、fakepay:txn:<reference> 是交易本身
+const fakePrefix = "fakepay:"
+
+type fakeTxn struct {
+	key      string
+	amount   int64
+	captured int64
+	status   string
+}
+
+// Fake: 模擬的金流供應商，狀態放在 Redis (跟真的供應商一樣，每個 replica 看到的是同一份)
+// 行為跟真的供應商一樣：授權、請款、作廢、退款都有狀態檢查而且 idempotent，
+// 每個操作完成後再用 OnEvent 非同步送一次相同的事件，模擬 callback 重送
+type Fake struct {
+	// 超過這個金額的授權會被拒絕 (0 = 不限)，用來模擬刷卡失敗
+	Limit int64
+	// 模擬 callback，沒設定就不送
+	OnEvent func(types.PaymentEvent)
+
+	rdb *redis.Client
+}
+
+func NewFake(rdb *redis.Client) *Fake {
+	return &Fake{rdb: rdb}
+}
+
+func (f *Fake) Authorize(c context.Context, req AuthorizeRequest) (types.PaymentEvent, error) {
+	if req.Amount <= 0 {
+		return types.PaymentEvent{}, fmt.Errorf("amount must be positive")
+	}
+	ref, err := f.reference(c, req)
+	if err != nil {
+		return types.PaymentEvent{}, err
+	}
+
+	t, err := f.load(c, f.rdb, ref)
+	if err != nil {
+		return types.PaymentEvent{}, err
+	}
+	// 授權之後狀態可能已經往前走了，重送只回報授權本身的結果
+	kind := Authorized
+	if t.status == Failed {
+		kind = Failed
+	}
+	return f.emit(ref, t.key, kind, t.amount), nil
+}
+
+// reference: 同一個 idempotency key 只會有一筆交易
+// 先把交易寫好再搶 key (SET NX)，搶輸的那筆交易沒有人會用到
+func (f *Fake) reference(c context.Context, req AuthorizeRequest) (string, error) {
+	keyKey := fakePrefix + "key:" + req.IdempotencyKey
+	ref, err := f.rdb.Get(c, keyKey).Result()
+	if err != redis.Nil {
+		return ref, err
+	}
+	seq, err := f.rdb.Incr(c, fakePrefix+"seq").Result()
+	if err != nil {
+		return "", err
+	}
+	ref = fmt.Sprintf("fake_%d", seq)
+	t := fakeTxn{key: req.IdempotencyKey, amount: req.Amount, status: Authorized}
+	if f.Limit > 0 && req.Amount > f.Limit {
+		t.status = Failed
+	}
+	if err := f.rdb.HSet(c, txnKey(ref), t.fields()...).Err(); err != nil {
+		return "", err
+	}
+	err = f.rdb.SetArgs(c, keyKey, ref, redis.SetArgs{Mode: "NX"}).Err()
+	if err == redis.Nil {
+		return f.rdb.Get(c, keyKey).Result()
+	}
+	return ref, err
+}
+
+func (f *Fake) Capture(c context.Context, reference string, amount int64) (types.PaymentEvent, error) {
+	t, err := f.update(c, reference, func(t *fakeTxn) error {
+		switch {
+		case t.status == Captured:
+		case t.status == Authorized && amount > 0 && amount <= t.amount:
+			t.status, t.captured = Captured, amount
+		default:
+			return ErrInvalidState
+		}
+		return nil
+	})
+	if err != nil {
+		return types.PaymentEvent{}, err
+	}
+	return f.emit(reference, t.key, Captured, t.captured), nil
+}
+
+func (f *Fake) Void(c context.Context, reference string) (types.PaymentEvent, error) {
+	t, err := f.update(c, reference, func(t *fakeTxn) error {
+		switch t.status {
+		case Voided:
+		case Authorized:
+			t.status = Voided
+		default:
+			return ErrInvalidState
+		}
+		return nil
+	})
+	if err != nil {
+		return types.PaymentEvent{}, err
+	}
+	return f.emit(reference, t.key, Voided, t.amount), nil
+}
+
+func (f *Fake) Refund(c context.Context, reference string, amount int64) (types.PaymentEvent, error) {
+	t, err := f.update(c, reference, func(t *fakeTxn) error {
+		switch {
+		case t.status == Refunded:
+		case t.status == Captured && amount == t.captured:
+			t.status = Refunded
+		default:
+			return ErrInvalidState
+		}
+		return nil
+	})
+	if err != nil {
+		return types.PaymentEvent{}, err
+	}
+	return f.emit(reference, t.key, Refunded, t.captured), nil
+}
+
+// update: 用 WATCH 做樂觀鎖改交易狀態，別的 replica 同時改同一筆時重來
+func (f *Fake) update(c context.Context, reference string, change func(t *fakeTxn) error) (fakeTxn, error) {
+	var t fakeTxn
+	for attempt := 0; attempt < 10; attempt++ {
+		err := f.rdb.Watch(c, func(tx *redis.Tx) error {
+			var err error
+			if t, err = f.load(c, tx, reference); err != nil {
+				return err
+			}
+			if err := change(&t); err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(c, func(p redis.Pipeliner) error {
+				p.HSet(c, txnKey(reference), t.fields()...)
+				return nil
+			})
+			return err
+		}, txnKey(reference))
+		if !errors.Is(err, redis.TxFailedErr) {
+			return t, err
+		}
+	}
+	return t, redis.TxFailedErr
+}
+
+func (f *Fake) load(c context.Context, r redis.Cmdable, reference string) (fakeTxn, error) {
+	m, err := r.HGetAll(c, txnKey(reference)).Result()
+	if err != nil {
+		return fakeTxn{}, err
+	}
+	if len(m) == 0 {
+		return fakeTxn{}, ErrUnknownReference
+	}
+	t := fakeTxn{key: m["key"], status: m["status"]}
+	t.amount, _ = strconv.ParseInt(m["amount"], 10, 64)
+	t.captured, _ = strconv.ParseInt(m["captured"], 10, 64)
+	return t, nil
+}
+
+func (t fakeTxn) fields() []interface{} {
+	return []interface{}{"key", t.key, "amount", t.amount, "captured", t.captured, "status", t.status}
+}
+
+func txnKey(reference string) string {
+	return fakePrefix + "txn:" + reference
+}
+
+// emit: 組出事件，有設定 OnEvent 的話另外非同步送一次
+func (f *Fake) emit(reference, key, kind string, amount int64) types.PaymentEvent {
+	e := types.PaymentEvent{
+		ID:             eventID(reference, kind),
+		Type:           kind,
+		Reference:      reference,
+		IdempotencyKey: key,
+		Amount:         amount,
+	}
+	if f.OnEvent != nil {
+		go f.OnEvent(e)
+	}
+	return e
+}
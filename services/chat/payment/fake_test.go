@@ -0,0 +1,77 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/redisfake"
+)
+
+// 兩個 replica 各自一個 Fake，共用同一個 Redis
+func newReplicas(t *testing.T) (*Fake, *Fake) {
+	t.Helper()
+	srv, err := redisfake.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	client := func() *redis.Client {
+		rdb := redis.NewClient(&redis.Options{Addr: srv.Addr(), Protocol: 2})
+		t.Cleanup(func() { rdb.Close() })
+		return rdb
+	}
+	return NewFake(client()), NewFake(client())
+}
+
+func TestFakeSharedAcrossReplicas(t *testing.T) {
+	c := context.Background()
+	a, b := newReplicas(t)
+	req := AuthorizeRequest{IdempotencyKey: "ride1:alice:1", Amount: 500, Currency: "TWD"}
+
+	first, err := a.Authorize(c, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := b.Authorize(c, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Reference != first.Reference || again.ID != first.ID {
+		t.Fatalf("retry on another replica = %+v, want %+v", again, first)
+	}
+
+	captured, err := b.Capture(c, first.Reference, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if captured.Type != Captured || captured.Amount != 400 || captured.IdempotencyKey != req.IdempotencyKey {
+		t.Errorf("capture = %+v", captured)
+	}
+	// 另一個 replica 看得到已經請款，不能再作廢
+	if _, err := a.Void(c, first.Reference); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("void after capture = %v, want ErrInvalidState", err)
+	}
+	if _, err := a.Refund(c, first.Reference, 400); err != nil {
+		t.Errorf("refund = %v", err)
+	}
+}
+
+func TestFakeLimitAndUnknownReference(t *testing.T) {
+	c := context.Background()
+	a, _ := newReplicas(t)
+	a.Limit = 100
+
+	e, err := a.Authorize(c, AuthorizeRequest{IdempotencyKey: "k", Amount: 101})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != Failed {
+		t.Errorf("over limit = %s, want %s", e.Type, Failed)
+	}
+	if _, err := a.Capture(c, "fake_999", 1); !errors.Is(err, ErrUnknownReference) {
+		t.Errorf("unknown reference = %v", err)
+	}
+}
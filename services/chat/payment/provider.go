@@ -0,0 +1,70 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 事件類型 (也是 ride_payments.status 的值)
+const (
+	Authorized = "authorized"
+	Captured   = "captured"
+	Voided     = "voided"
+	Refunded   = "refunded"
+	Failed     = "failed"
+)
+
+var (
+	ErrUnknownReference = errors.New("unknown payment reference")
+	ErrInvalidState     = errors.New("invalid payment state")
+)
+
+// AuthorizeRequest: 授權 (預先圈存) 乘客要付的金額
+// IdempotencyKey 相同的請求重送時，供應商要回傳同一筆交易
+type AuthorizeRequest struct {
+	IdempotencyKey string
+	PayerID        string
+	PayeeID        string
+	Amount         int64
+	Currency       string
+}
+
+// Provider: 金流供應商
+// 每個操作都要是 idempotent 的 (重送不會重複扣款)，回傳的事件跟 callback 送來的事件 ID 相同
+// 授權被拒絕不算 error，回傳 Failed 事件；error 只代表呼叫本身失敗，之後可以重試
+type Provider interface {
+	Authorize(ctx context.Context, req AuthorizeRequest) (types.PaymentEvent, error)
+	Capture(ctx context.Context, reference string, amount int64) (types.PaymentEvent, error)
+	Void(ctx context.Context, reference string) (types.PaymentEvent, error)
+	Refund(ctx context.Context, reference string, amount int64) (types.PaymentEvent, error)
+}
+
+// New: 依照 PAYMENT_PROVIDER 環境變數選擇實作 (預設 fake，開發與測試用；fake 的狀態放在 rdb)
+func New(rdb *redis.Client) (Provider, error) {
+	switch provider := os.Getenv("PAYMENT_PROVIDER"); provider {
+	case "", "fake":
+		f := NewFake(rdb)
+		if v := os.Getenv("FAKE_PAYMENT_LIMIT"); v != "" {
+			limit, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid FAKE_PAYMENT_LIMIT: %v", err)
+			}
+			f.Limit = limit
+		}
+		return f, nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider: %s", provider)
+	}
+}
+
+// eventID: 同一筆交易的同一種事件只會有一個 ID
+func eventID(reference, kind string) string {
+	return reference + ":" + kind
+}
@@ -0,0 +1,103 @@
+package payment
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/db"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// Settle: 讓一個旅程的付款跟目前的訂位一致
+//   - 旅程進行中：confirmed 乘客授權應付金額，金額改變就作廢重新授權，離開的乘客作廢 (退回圈存)
+//   - 旅程完成：請款
+//   - 旅程取消：作廢授權，已請款的退款
+//
+// 可以重複呼叫 (多個 replica 同時跑也一樣)，供應商與帳本都是 idempotent 的
+func Settle(ctx context.Context, p Provider, rideID string) error {
+	s, err := db.GetSettlement(rideID)
+	if err != nil {
+		return err
+	}
+	active := s.Status != "completed" && s.Status != "cancelled"
+
+	for passengerID, pay := range s.Payments {
+		share := s.Shares[passengerID]
+		var e types.PaymentEvent
+		var err error
+		switch {
+		case pay.Status == Authorized && s.Status == "completed" && share > 0:
+			e, err = p.Capture(ctx, pay.Reference, min(share, pay.Amount))
+		case pay.Status == Authorized && (!active || share != pay.Amount):
+			e, err = p.Void(ctx, pay.Reference)
+		case pay.Status == Captured && s.Status == "cancelled":
+			e, err = p.Refund(ctx, pay.Reference, pay.Captured)
+		case pay.Status == "authorizing" && share != pay.Amount && time.Since(pay.UpdatedAt) >= db.AuthorizationRetryAfter:
+			// 乘客已經離開但授權結果一直沒回來：用同一個 key 重送拿到結果，下一輪再作廢
+			e, err = p.Authorize(ctx, AuthorizeRequest{
+				IdempotencyKey: pay.IdempotencyKey,
+				PayerID:        passengerID,
+				PayeeID:        s.DriverID,
+				Amount:         pay.Amount,
+				Currency:       pay.Currency,
+			})
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := db.ApplyPaymentEvent(e); err != nil {
+			return err
+		}
+	}
+
+	if !active {
+		return nil
+	}
+	for passengerID, share := range s.Shares {
+		key, err := db.StartAuthorization(rideID, passengerID, share, s.Currency)
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			continue
+		}
+		e, err := p.Authorize(ctx, AuthorizeRequest{
+			IdempotencyKey: key,
+			PayerID:        passengerID,
+			PayeeID:        s.DriverID,
+			Amount:         share,
+			Currency:       s.Currency,
+		})
+		if err != nil {
+			// 留在 authorizing，過一段時間用同一個 key 重送
+			return err
+		}
+		if _, err := db.ApplyPaymentEvent(e); err != nil {
+			return err
+		}
+		if e.Type == Failed {
+			log.Printf("Payment authorization declined: ride=%s passenger=%s", rideID, passengerID)
+		}
+	}
+	return nil
+}
+
+// SettlePending: 結算所有付款狀態不一致的旅程，回傳處理了幾個
+func SettlePending(ctx context.Context, p Provider) (int, error) {
+	ids, err := db.RidesToSettle(100)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		if err := Settle(ctx, p, id); err != nil {
+			log.Printf("Settle ride %s failed: %v", id, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,77 @@
+package pricing
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// 計價方式 (金額一律用最小貨幣單位的整數，例如 TWD 的「分」、USD 的 cent)
+const (
+	Free    = ""         // 不收費
+	PerSeat = "per_seat" // 每個座位固定價格
+	Split   = "split"    // 整趟費用 (油錢 + 過路費) 由所有乘客座位平分
+)
+
+// DefaultCurrency: 沒指定幣別時使用
+const DefaultCurrency = "TWD"
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Price: 司機設定的價格；PerSeat 時 Amount 是單一座位價格，Split 時是整趟總額
+type Price struct {
+	Mode     string
+	Amount   int64
+	Currency string
+}
+
+// Validate: 檢查計價方式、金額與幣別 (ISO 4217 三碼)
+func (p Price) Validate() error {
+	switch p.Mode {
+	case Free:
+		if p.Amount != 0 {
+			return fmt.Errorf("free rides cannot have a price")
+		}
+		return nil
+	case PerSeat, Split:
+	default:
+		return fmt.Errorf("unknown price mode %q", p.Mode)
+	}
+	if p.Amount <= 0 {
+		return fmt.Errorf("price must be positive")
+	}
+	if !currencyPattern.MatchString(p.Currency) {
+		return fmt.Errorf("invalid currency %q", p.Currency)
+	}
+	return nil
+}
+
+// Shares: 依照每筆訂位的座位數算出各自要付的金額，回傳順序與 seats 相同
+// Split 除不盡的餘數一次給一個最小單位，從 seats 的第一個座位開始分 (呼叫端用加入順序排好)，
+// 所以結果是固定的，而且總和剛好等於總額
+func Shares(p Price, seats []int) []int64 {
+	shares := make([]int64, len(seats))
+	switch p.Mode {
+	case PerSeat:
+		for i, n := range seats {
+			shares[i] = p.Amount * int64(n)
+		}
+	case Split:
+		var total int64
+		for _, n := range seats {
+			total += int64(n)
+		}
+		if total == 0 {
+			return shares
+		}
+		base, remainder := p.Amount/total, p.Amount%total
+		for i, n := range seats {
+			extra := int64(n)
+			if extra > remainder {
+				extra = remainder
+			}
+			remainder -= extra
+			shares[i] = base*int64(n) + extra
+		}
+	}
+	return shares
+}
@@ -0,0 +1,499 @@
+package redisfake
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server: 本機的假 Redis (RESP2)，只實作分散式鎖與排程用到的指令
+// 字串：GET / SET (NX / XX / PX / EX) / DEL / EXISTS / INCR / PEXPIRE / PTTL
+// Hash：HSET / HGET / HGETALL；交易：WATCH / UNWATCH / MULTI / EXEC / DISCARD
+// 過期是在讀取時才檢查；Now 可以換掉，模擬時間經過
+type Server struct {
+	Now func() time.Time
+
+	ln      net.Listener
+	mu      sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	expires map[string]time.Time
+	version map[string]int64 // 每次寫入 +1，WATCH 用來判斷有沒有被改過
+}
+
+// Start: addr 用 "127.0.0.1:0" 會挑一個空的 port，實際位址看 Addr()
+func Start(addr string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Now:     time.Now,
+		ln:      ln,
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		expires: make(map[string]time.Time),
+		version: make(map[string]int64),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *Server) Close() error {
+	return s.ln.Close()
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// conn: 每條連線自己的交易狀態
+type conn struct {
+	w       *bufio.Writer
+	watched map[string]int64
+	queued  [][]string // MULTI 之後排隊的指令
+	inMulti bool
+	failed  bool // 交易中有指令格式錯誤，EXEC 要整個放棄
+}
+
+func (s *Server) handle(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	c := &conn{w: bufio.NewWriter(nc)}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		s.dispatch(c, args)
+		if r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) dispatch(c *conn, args []string) {
+	name := strings.ToUpper(args[0])
+	switch name {
+	case "MULTI":
+		if c.inMulti {
+			writeError(c.w, "ERR MULTI calls can not be nested")
+			return
+		}
+		c.inMulti, c.queued, c.failed = true, nil, false
+		writeStatus(c.w, "OK")
+	case "DISCARD":
+		if !c.inMulti {
+			writeError(c.w, "ERR DISCARD without MULTI")
+			return
+		}
+		c.inMulti, c.queued, c.watched = false, nil, nil
+		writeStatus(c.w, "OK")
+	case "EXEC":
+		if !c.inMulti {
+			writeError(c.w, "ERR EXEC without MULTI")
+			return
+		}
+		s.exec(c)
+	case "WATCH":
+		if c.inMulti {
+			writeError(c.w, "ERR WATCH inside MULTI is not allowed")
+			return
+		}
+		s.mu.Lock()
+		if c.watched == nil {
+			c.watched = make(map[string]int64)
+		}
+		for _, key := range args[1:] {
+			s.expire(key)
+			c.watched[key] = s.version[key]
+		}
+		s.mu.Unlock()
+		writeStatus(c.w, "OK")
+	case "UNWATCH":
+		c.watched = nil
+		writeStatus(c.w, "OK")
+	default:
+		if !c.inMulti {
+			s.mu.Lock()
+			s.run(c.w, args)
+			s.mu.Unlock()
+			return
+		}
+		if _, ok := commands[name]; !ok {
+			c.failed = true
+			writeError(c.w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+			return
+		}
+		c.queued = append(c.queued, args)
+		writeStatus(c.w, "QUEUED")
+	}
+}
+
+// exec: WATCH 的 key 都沒被改過才整批執行 (中間不會插進別的連線的指令)
+func (s *Server) exec(c *conn) {
+	queued, watched, failed := c.queued, c.watched, c.failed
+	c.inMulti, c.queued, c.watched, c.failed = false, nil, nil, false
+	if failed {
+		writeError(c.w, "EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, v := range watched {
+		s.expire(key)
+		if s.version[key] != v {
+			writeNilArray(c.w)
+			return
+		}
+	}
+	fmt.Fprintf(c.w, "*%d\r\n", len(queued))
+	for _, args := range queued {
+		s.run(c.w, args)
+	}
+}
+
+type command struct {
+	arity int // 最少幾個參數 (含指令本身)
+	fn    func(s *Server, w *bufio.Writer, args []string)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"PING":    {1, (*Server).ping},
+		"GET":     {2, (*Server).get},
+		"SET":     {3, (*Server).set},
+		"DEL":     {2, (*Server).del},
+		"EXISTS":  {2, (*Server).exists},
+		"INCR":    {2, (*Server).incr},
+		"PEXPIRE": {3, (*Server).pexpire},
+		"PTTL":    {2, (*Server).pttl},
+		"HSET":    {4, (*Server).hset},
+		"HGET":    {3, (*Server).hget},
+		"HGETALL": {2, (*Server).hgetall},
+	}
+}
+
+// run: 呼叫端要持有 s.mu
+func (s *Server) run(w *bufio.Writer, args []string) {
+	cmd, ok := commands[strings.ToUpper(args[0])]
+	if !ok {
+		writeError(w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if len(args) < cmd.arity {
+		writeError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(args[0])))
+		return
+	}
+	cmd.fn(s, w, args)
+}
+
+// expire: 已經過期的 key 在這裡刪掉 (算一次寫入)
+func (s *Server) expire(key string) {
+	if at, ok := s.expires[key]; ok && !s.Now().Before(at) {
+		s.remove(key)
+	}
+}
+
+func (s *Server) remove(key string) bool {
+	_, isString := s.strings[key]
+	_, isHash := s.hashes[key]
+	delete(s.strings, key)
+	delete(s.hashes, key)
+	delete(s.expires, key)
+	if isString || isHash {
+		s.version[key]++
+	}
+	return isString || isHash
+}
+
+func (s *Server) ping(w *bufio.Writer, args []string) {
+	if len(args) > 1 {
+		writeBulk(w, args[1])
+		return
+	}
+	writeStatus(w, "PONG")
+}
+
+func (s *Server) get(w *bufio.Writer, args []string) {
+	s.expire(args[1])
+	if _, ok := s.hashes[args[1]]; ok {
+		writeError(w, errWrongType)
+		return
+	}
+	v, ok := s.strings[args[1]]
+	if !ok {
+		writeNil(w)
+		return
+	}
+	writeBulk(w, v)
+}
+
+func (s *Server) set(w *bufio.Writer, args []string) {
+	key, value := args[1], args[2]
+	var nx, xx bool
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "PX", "EX":
+			if i+1 >= len(args) {
+				writeError(w, errSyntax)
+				return
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				writeError(w, "ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl = time.Duration(n) * time.Millisecond
+			if strings.ToUpper(args[i]) == "EX" {
+				ttl = time.Duration(n) * time.Second
+			}
+			i++
+		default:
+			writeError(w, errSyntax)
+			return
+		}
+	}
+
+	s.expire(key)
+	_, exists := s.strings[key]
+	if _, ok := s.hashes[key]; ok {
+		exists = true
+	}
+	if (nx && exists) || (xx && !exists) {
+		writeNil(w)
+		return
+	}
+	delete(s.hashes, key)
+	delete(s.expires, key)
+	s.strings[key] = value
+	if ttl > 0 {
+		s.expires[key] = s.Now().Add(ttl)
+	}
+	s.version[key]++
+	writeStatus(w, "OK")
+}
+
+func (s *Server) del(w *bufio.Writer, args []string) {
+	n := 0
+	for _, key := range args[1:] {
+		s.expire(key)
+		if s.remove(key) {
+			n++
+		}
+	}
+	writeInt(w, int64(n))
+}
+
+func (s *Server) exists(w *bufio.Writer, args []string) {
+	n := 0
+	for _, key := range args[1:] {
+		s.expire(key)
+		_, isString := s.strings[key]
+		_, isHash := s.hashes[key]
+		if isString || isHash {
+			n++
+		}
+	}
+	writeInt(w, int64(n))
+}
+
+func (s *Server) incr(w *bufio.Writer, args []string) {
+	key := args[1]
+	s.expire(key)
+	if _, ok := s.hashes[key]; ok {
+		writeError(w, errWrongType)
+		return
+	}
+	var n int64
+	if v, ok := s.strings[key]; ok {
+		var err error
+		if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, "ERR value is not an integer or out of range")
+			return
+		}
+	}
+	n++
+	s.strings[key] = strconv.FormatInt(n, 10)
+	s.version[key]++
+	writeInt(w, n)
+}
+
+func (s *Server) pexpire(w *bufio.Writer, args []string) {
+	key := args[1]
+	ms, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		writeError(w, "ERR value is not an integer or out of range")
+		return
+	}
+	s.expire(key)
+	_, isString := s.strings[key]
+	_, isHash := s.hashes[key]
+	if !isString && !isHash {
+		writeInt(w, 0)
+		return
+	}
+	if ms <= 0 {
+		s.remove(key)
+	} else {
+		s.expires[key] = s.Now().Add(time.Duration(ms) * time.Millisecond)
+		s.version[key]++
+	}
+	writeInt(w, 1)
+}
+
+func (s *Server) pttl(w *bufio.Writer, args []string) {
+	key := args[1]
+	s.expire(key)
+	_, isString := s.strings[key]
+	_, isHash := s.hashes[key]
+	if !isString && !isHash {
+		writeInt(w, -2)
+		return
+	}
+	at, ok := s.expires[key]
+	if !ok {
+		writeInt(w, -1)
+		return
+	}
+	writeInt(w, at.Sub(s.Now()).Milliseconds())
+}
+
+func (s *Server) hset(w *bufio.Writer, args []string) {
+	key := args[1]
+	if len(args)%2 != 0 {
+		writeError(w, "ERR wrong number of arguments for 'hset' command")
+		return
+	}
+	s.expire(key)
+	if _, ok := s.strings[key]; ok {
+		writeError(w, errWrongType)
+		return
+	}
+	h, ok := s.hashes[key]
+	if !ok {
+		h = make(map[string]string)
+		s.hashes[key] = h
+	}
+	added := 0
+	for i := 2; i < len(args); i += 2 {
+		if _, ok := h[args[i]]; !ok {
+			added++
+		}
+		h[args[i]] = args[i+1]
+	}
+	s.version[key]++
+	writeInt(w, int64(added))
+}
+
+func (s *Server) hget(w *bufio.Writer, args []string) {
+	s.expire(args[1])
+	if _, ok := s.strings[args[1]]; ok {
+		writeError(w, errWrongType)
+		return
+	}
+	v, ok := s.hashes[args[1]][args[2]]
+	if !ok {
+		writeNil(w)
+		return
+	}
+	writeBulk(w, v)
+}
+
+func (s *Server) hgetall(w *bufio.Writer, args []string) {
+	s.expire(args[1])
+	if _, ok := s.strings[args[1]]; ok {
+		writeError(w, errWrongType)
+		return
+	}
+	h := s.hashes[args[1]]
+	fmt.Fprintf(w, "*%d\r\n", 2*len(h))
+	for k, v := range h {
+		writeBulk(w, k)
+		writeBulk(w, v)
+	}
+}
+
+const (
+	errWrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+	errSyntax    = "ERR syntax error"
+)
+
+// readCommand: go-redis 送的都是 RESP array of bulk strings；也接受 redis-cli 的單行指令
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, errors.New("invalid multibulk length")
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errors.New("expected bulk string")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, errors.New("invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeStatus(w *bufio.Writer, s string) { fmt.Fprintf(w, "+%s\r\n", s) }
+func writeError(w *bufio.Writer, s string)  { fmt.Fprintf(w, "-%s\r\n", s) }
+func writeInt(w *bufio.Writer, n int64)     { fmt.Fprintf(w, ":%d\r\n", n) }
+func writeNil(w *bufio.Writer)              { w.WriteString("$-1\r\n") }
+func writeNilArray(w *bufio.Writer)         { w.WriteString("*-1\r\n") }
+func writeBulk(w *bufio.Writer, s string)   { fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s) }
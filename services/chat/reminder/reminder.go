@@ -0,0 +1,125 @@
+package reminder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/db"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/notify"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 預設在出發前 24 小時與 30 分鐘提醒
+var DefaultOffsets = []time.Duration{24 * time.Hour, 30 * time.Minute}
+
+// Scheduler: 出發前提醒，同時發聊天室系統訊息與通知
+// 送過的提醒記在 ride_reminders (旅程 + 提前多久 + 當時的出發時間)，重啟或多個 replica 都不會重複送
+type Scheduler struct {
+	Offsets []time.Duration
+	Queue   *notify.Queue
+	Post    func(types.ChatMessage) // 把系統訊息送進聊天室 (Redis stream + 即時廣播)
+}
+
+// Due: 現在該送哪一個提醒 (回傳提前多久)
+// 只送最接近出發的那個；晚太久 (超過提前量的一半，例如服務停機或旅程是臨時建立的) 就不送
+func Due(departure, now time.Time, offsets []time.Duration) (time.Duration, bool) {
+	if !now.Before(departure) {
+		return 0, false
+	}
+	sorted := append([]time.Duration{}, offsets...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for _, o := range sorted {
+		if o <= 0 {
+			continue
+		}
+		at := departure.Add(-o)
+		if now.Before(at) {
+			continue
+		}
+		return o, now.Sub(at) <= o/2
+	}
+	return 0, false
+}
+
+// Tick: 找出到期的提醒送出，回傳送了幾趟；fence 是背景工作的租約 (租約被接手就停下來)
+func (s *Scheduler) Tick(c context.Context, fence db.Fence) (int, error) {
+	if len(s.Offsets) == 0 {
+		return 0, nil
+	}
+	now := time.Now().UTC()
+	longest := s.Offsets[0]
+	for _, o := range s.Offsets {
+		longest = max(longest, o)
+	}
+	rides, err := db.GetUpcomingRides(now, now.Add(longest))
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, ride := range rides {
+		offset, ok := Due(ride.DepartureTime, now, s.Offsets)
+		if !ok {
+			continue
+		}
+		ok, err := s.remind(ride, offset, now, fence)
+		if err == db.ErrStaleFence {
+			return sent, err
+		}
+		if err != nil {
+			log.Printf("Reminder for ride %s failed: %v", ride.ID, err)
+		}
+		if ok {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// remind: 先登記提醒並寫系統訊息 (同一個 transaction)，只有搶到登記的 replica 會發聊天室訊息與排通知
+// 已經送過、旅程取消或改時間的不會再排通知；登記後排通知失敗的話這次提醒就只有聊天室訊息
+func (s *Scheduler) remind(ride types.Ride, offset time.Duration, now time.Time, fence db.Fence) (bool, error) {
+	d := notify.Data{Ride: ride, Before: remaining(ride.DepartureTime.Sub(now))}
+	title, body, _, err := notify.Render(notify.KindRideReminder, d)
+	if err != nil {
+		return false, err
+	}
+
+	msg := types.ChatMessage{
+		RideID:     ride.ID,
+		SenderName: "Ride reminder",
+		Content:    title + ". " + body,
+		System:     true,
+		CreatedAt:  now,
+		Timestamp:  now.In(notify.Location).Format("15:04"),
+	}
+	id, ok, err := db.ClaimRideReminder(ride.ID, offset, ride.DepartureTime, msg.Content, fence)
+	if err != nil || !ok {
+		return false, err
+	}
+	msg.ID = int(id)
+	if s.Post != nil {
+		s.Post(msg)
+	}
+
+	if s.Queue == nil {
+		return true, nil
+	}
+	audience, err := db.GetChatAudience(ride.ID)
+	if err != nil {
+		return true, err
+	}
+	key := fmt.Sprintf("%s:%d:%d", ride.ID, int64(offset/time.Second), ride.DepartureTime.Unix())
+	return true, s.Queue.Notify(audience, notify.KindRideReminder, d, key)
+}
+
+// remaining: 提醒裡顯示的剩餘時間，一小時以上取整點
+func remaining(d time.Duration) time.Duration {
+	if d >= time.Hour {
+		return d.Round(time.Hour)
+	}
+	return d.Round(time.Minute)
+}
@@ -0,0 +1,102 @@
+package route
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// Of: 旅程的完整路線 (起點 Seq 0 ... 終點)
+// 舊資料沒有 ride_stops 時，用 rides 表的起終點補成兩站
+func Of(r types.Ride) []types.Stop {
+	if len(r.Stops) >= 2 {
+		return r.Stops
+	}
+	departure := r.DepartureTime
+	return []types.Stop{
+		{Seq: 0, Name: r.Origin, Canonical: r.OriginCanonical, Lat: r.OriginLat, Lng: r.OriginLng, EstimatedTime: &departure},
+		{Seq: 1, Name: r.Destination, Canonical: r.DestinationCanonical, Lat: r.DestinationLat, Lng: r.DestinationLng},
+	}
+}
+
+// Validate: 路線至少要有起終點，而且停靠站的預估時間要照順序 (沒給時間的站略過)
+func Validate(stops []types.Stop) error {
+	if len(stops) < 2 {
+		return fmt.Errorf("a route needs at least an origin and a destination")
+	}
+	var last time.Time
+	for _, s := range stops {
+		if s.Name == "" {
+			return fmt.Errorf("stop %d has no name", s.Seq)
+		}
+		if s.EstimatedTime == nil {
+			continue
+		}
+		if s.EstimatedTime.Before(last) {
+			return fmt.Errorf("stop %q is scheduled before the previous stop", s.Name)
+		}
+		last = *s.EstimatedTime
+	}
+	return nil
+}
+
+// Segment: 搭乘區段 [From, To)，From / To 是停靠站 Seq
+type Segment struct {
+	From  int
+	To    int
+	Seats int
+}
+
+// Resolve: 把訂位的上下車站補上預設值 (整趟) 並檢查範圍
+func Resolve(b types.Booking, numStops int) (Segment, error) {
+	seg := Segment{From: 0, To: numStops - 1, Seats: 1}
+	if b.Seats > 0 {
+		seg.Seats = b.Seats
+	}
+	if b.FromStop != nil {
+		seg.From = *b.FromStop
+	}
+	if b.ToStop != nil {
+		seg.To = *b.ToStop
+	}
+	if seg.From < 0 || seg.To >= numStops || seg.From >= seg.To {
+		return seg, fmt.Errorf("invalid segment: stop %d to %d", seg.From, seg.To)
+	}
+	return seg, nil
+}
+
+// Occupancy: 每一小段 (stop k -> k+1) 被佔用的座位數，長度為 numStops-1
+func Occupancy(numStops int, bookings []Segment) []int {
+	if numStops < 2 {
+		return nil
+	}
+	occ := make([]int, numStops-1)
+	for _, b := range bookings {
+		to := b.To
+		if to > numStops-1 {
+			to = numStops - 1
+		}
+		for k := b.From; k < to; k++ {
+			if k >= 0 {
+				occ[k] += b.Seats
+			}
+		}
+	}
+	return occ
+}
+
+// FreeSeats: 區段內最擠的那一小段決定還剩幾個位子
+// 例如有人在 stop 2 下車，stop 2 -> 4 的位子就可以再賣一次
+func FreeSeats(maxPassengers int, occ []int, seg Segment) int {
+	busiest := 0
+	for k := seg.From; k < seg.To && k < len(occ); k++ {
+		if occ[k] > busiest {
+			busiest = occ[k]
+		}
+	}
+	if free := maxPassengers - busiest; free > 0 {
+		return free
+	}
+	return 0
+}
@@ -0,0 +1,147 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // 容器裡不一定有時區資料
+)
+
+const (
+	Daily    = "daily"    // 每天
+	Weekdays = "weekdays" // 週一到週五
+	Weekly   = "weekly"   // 指定星期幾
+
+	DefaultTimezone = "Asia/Taipei"
+	dateLayout      = "2006-01-02"
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Rule: 週期規則 (出發時間用司機當地時區表示，才不會遇到夏令時間跑掉)
+type Rule struct {
+	Frequency string   `json:"frequency"`           // daily, weekdays, weekly
+	Weekdays  []string `json:"weekdays,omitempty"`  // weekly 用：mon, tue, ...
+	Time      string   `json:"time"`                // 當地出發時間 HH:MM
+	Timezone  string   `json:"timezone,omitempty"`  // 預設 Asia/Taipei
+	StartDate string   `json:"startDate"`           // YYYY-MM-DD
+	UntilDate string   `json:"untilDate,omitempty"` // 含當天，空白代表不結束
+}
+
+// Occurrence: 規則展開後的一次出發
+type Occurrence struct {
+	Date      string    // 當地日期 YYYY-MM-DD (同一個 schedule 內唯一)
+	Departure time.Time // UTC
+}
+
+func (r Rule) location() (*time.Location, error) {
+	if r.Timezone == "" {
+		return time.LoadLocation(DefaultTimezone)
+	}
+	return time.LoadLocation(r.Timezone)
+}
+
+func (r Rule) clock() (hour, minute int, err error) {
+	t, err := time.Parse("15:04", r.Time)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time %q (want HH:MM)", r.Time)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// Validate: 檢查規則是否完整
+func (r Rule) Validate() error {
+	switch r.Frequency {
+	case Daily, Weekdays:
+	case Weekly:
+		if len(r.Weekdays) == 0 {
+			return fmt.Errorf("weekly schedules need at least one weekday")
+		}
+		for _, d := range r.Weekdays {
+			if _, ok := weekdayNames[strings.ToLower(d)]; !ok {
+				return fmt.Errorf("invalid weekday %q", d)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid frequency %q", r.Frequency)
+	}
+	if _, err := r.location(); err != nil {
+		return fmt.Errorf("invalid timezone %q", r.Timezone)
+	}
+	if _, _, err := r.clock(); err != nil {
+		return err
+	}
+	start, err := time.Parse(dateLayout, r.StartDate)
+	if err != nil {
+		return fmt.Errorf("invalid startDate %q", r.StartDate)
+	}
+	if r.UntilDate != "" {
+		until, err := time.Parse(dateLayout, r.UntilDate)
+		if err != nil {
+			return fmt.Errorf("invalid untilDate %q", r.UntilDate)
+		}
+		if until.Before(start) {
+			return fmt.Errorf("untilDate is before startDate")
+		}
+	}
+	return nil
+}
+
+// matches: 這一天是否符合規則
+func (r Rule) matches(day time.Weekday) bool {
+	switch r.Frequency {
+	case Weekdays:
+		return day >= time.Monday && day <= time.Friday
+	case Weekly:
+		for _, d := range r.Weekdays {
+			if weekdayNames[strings.ToLower(d)] == day {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// Occurrences: 展開 [from, to) 之間的所有出發時間 (依時間排序)
+func (r Rule) Occurrences(from, to time.Time) ([]Occurrence, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	loc, _ := r.location()
+	hour, minute, _ := r.clock()
+	start, _ := time.ParseInLocation(dateLayout, r.StartDate, loc)
+
+	// 從 from 的前一天開始找，避免時區差讓當天的班次被漏掉
+	day := from.In(loc).AddDate(0, 0, -1)
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc)
+	if day.Before(start) {
+		day = start
+	}
+
+	var out []Occurrence
+	for ; day.Before(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format(dateLayout)
+		if r.UntilDate != "" && date > r.UntilDate {
+			break
+		}
+		if !r.matches(day.Weekday()) {
+			continue
+		}
+		departure := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, loc)
+		if departure.Before(from) || !departure.Before(to) {
+			continue
+		}
+		out = append(out, Occurrence{Date: date, Departure: departure.UTC()})
+	}
+	return out, nil
+}
+
+// ParseDate: 驗證 YYYY-MM-DD 格式
+func ParseDate(s string) (time.Time, error) {
+	return time.Parse(dateLayout, s)
+}
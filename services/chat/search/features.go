@@ -0,0 +1,87 @@
+package search
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 行李大小 (由小到大)
+var LuggageSizes = []string{"none", "small", "medium", "large"}
+
+func ValidLuggage(size string) bool {
+	return slices.Contains(LuggageSizes, size)
+}
+
+// LuggageAtLeast: 可以放得下 min 的所有大小 (沒說明行李的旅程不算)
+func LuggageAtLeast(min string) []string {
+	for i, s := range LuggageSizes {
+		if s == min {
+			return LuggageSizes[i:]
+		}
+	}
+	return nil
+}
+
+// ValidateFilter: 檢查搜尋條件 (也用在儲存個人偏好)
+func ValidateFilter(f types.FeatureFilter) error {
+	if f.MinLuggage != "" && !ValidLuggage(f.MinLuggage) {
+		return fmt.Errorf("unknown luggage size %q", f.MinLuggage)
+	}
+	if len(f.Amenities) > 20 {
+		return fmt.Errorf("too many amenities")
+	}
+	return nil
+}
+
+// MatchFeatures: 跟 SearchRides 的 SQL 條件一樣，給已經載入的旅程用 (車輛設備要先 attach)
+func MatchFeatures(ride types.Ride, f types.FeatureFilter) bool {
+	if f.MinLuggage != "" && !slices.Contains(LuggageAtLeast(f.MinLuggage), ride.Luggage) {
+		return false
+	}
+	for _, c := range []struct {
+		want *bool
+		have bool
+	}{
+		{f.PetsAllowed, ride.PetsAllowed},
+		{f.SmokingAllowed, ride.SmokingAllowed},
+		{f.Music, ride.Music},
+		{f.ChildSeat, ride.ChildSeat},
+		{f.WheelchairAccessible, ride.WheelchairAccessible},
+	} {
+		if c.want != nil && *c.want != c.have {
+			return false
+		}
+	}
+	for _, a := range f.Amenities {
+		if ride.Vehicle == nil || !slices.Contains(ride.Vehicle.Amenities, a) {
+			return false
+		}
+	}
+	return true
+}
+
+// MergeFilter: 用個人預設偏好補上這次搜尋沒指定的條件
+func MergeFilter(explicit, defaults types.FeatureFilter) types.FeatureFilter {
+	f := explicit
+	if f.MinLuggage == "" {
+		f.MinLuggage = defaults.MinLuggage
+	}
+	f.PetsAllowed = orDefault(f.PetsAllowed, defaults.PetsAllowed)
+	f.SmokingAllowed = orDefault(f.SmokingAllowed, defaults.SmokingAllowed)
+	f.Music = orDefault(f.Music, defaults.Music)
+	f.ChildSeat = orDefault(f.ChildSeat, defaults.ChildSeat)
+	f.WheelchairAccessible = orDefault(f.WheelchairAccessible, defaults.WheelchairAccessible)
+	if len(f.Amenities) == 0 {
+		f.Amenities = defaults.Amenities
+	}
+	return f
+}
+
+func orDefault(v, def *bool) *bool {
+	if v != nil {
+		return v
+	}
+	return def
+}
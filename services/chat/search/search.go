@@ -0,0 +1,85 @@
+package search
+
+import (
+	"sort"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/geo"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/route"
+	"github.com/neo1202/k8s-ride-sharing/services/chat/types"
+)
+
+// 沒給半徑時的預設值 (公里)
+const DefaultRadiusKm = 5.0
+
+// Radii: 補上預設半徑
+func Radii(q types.RideSearch) (originKm, destinationKm float64) {
+	originKm, destinationKm = q.OriginRadiusKm, q.DestinationRadiusKm
+	if originKm <= 0 {
+		originKm = DefaultRadiusKm
+	}
+	if destinationKm <= 0 {
+		destinationKm = DefaultRadiusKm
+	}
+	return originKm, destinationKm
+}
+
+// Match: 判斷單一旅程是否符合搜尋條件，並挑出最適合的上下車站
+// 上車站必須在下車站之前；條件裡沒給的那一端不做過濾 (上車用起點、下車用終點)
+// 有給但停靠站沒座標就視為不符合
+func Match(ride types.Ride, q types.RideSearch) (types.RideMatch, bool) {
+	stops := route.Of(ride)
+	m := types.RideMatch{Ride: ride}
+	originKm, destinationKm := Radii(q)
+	wantOrigin, hasOrigin := geo.NewPoint(q.OriginLat, q.OriginLng)
+	wantDest, hasDest := geo.NewPoint(q.DestinationLat, q.DestinationLng)
+
+	found := false
+	for i := 0; i < len(stops)-1; i++ {
+		if !hasOrigin && i > 0 {
+			break
+		}
+		di, ok := distanceWithin(stops[i], wantOrigin, hasOrigin, originKm)
+		if !ok {
+			continue
+		}
+		for j := i + 1; j < len(stops); j++ {
+			if !hasDest && j < len(stops)-1 {
+				continue
+			}
+			dj, ok := distanceWithin(stops[j], wantDest, hasDest, destinationKm)
+			if !ok {
+				continue
+			}
+			if !found || di+dj < m.DetourKm {
+				found = true
+				m.FromStop, m.ToStop = stops[i].Seq, stops[j].Seq
+				m.OriginDistanceKm, m.DestinationDistanceKm = di, dj
+				m.DetourKm = di + dj
+			}
+		}
+	}
+	return m, found
+}
+
+// distanceWithin: 沒給條件 (enabled=false) 就當作距離 0
+func distanceWithin(stop types.Stop, want geo.Point, enabled bool, radiusKm float64) (float64, bool) {
+	if !enabled {
+		return 0, true
+	}
+	have, ok := geo.NewPoint(stop.Lat, stop.Lng)
+	if !ok {
+		return 0, false
+	}
+	d := geo.DistanceKm(want, have)
+	return d, d <= radiusKm
+}
+
+// Rank: 依繞路距離排序，距離相同時早出發的排前面
+func Rank(matches []types.RideMatch) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].DetourKm != matches[j].DetourKm {
+			return matches[i].DetourKm < matches[j].DetourKm
+		}
+		return matches[i].DepartureTime.Before(matches[j].DepartureTime)
+	})
+}
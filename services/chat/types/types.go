@@ -1,29 +1,566 @@
 package types
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/neo1202/k8s-ride-sharing/services/chat/schedule"
+)
 
 type Ride struct {
-	ID                string `json:"id"`
-	DriverID          string `json:"driverId"`
-	DriverName        string `json:"driverName"`
-	Origin            string `json:"origin"`
-	Destination       string `json:"destination"`
+	ID                string    `json:"id"`
+	DriverID          string    `json:"driverId"`
+	DriverName        string    `json:"driverName"`
+	Origin            string    `json:"origin"`
+	Destination       string    `json:"destination"`
 	DepartureTime     time.Time `json:"departureTime"` // 改用 time.Time 比較好操作 DB
-	MaxPassengers     int    `json:"maxPassengers"`
-	CurrentPassengers int    `json:"currentPassengers"`
-	Status            string `json:"status"` // open, closed
+	MaxPassengers     int       `json:"maxPassengers"`
+	CurrentPassengers int       `json:"currentPassengers"`
+	Status            string    `json:"status"` // open, closed
+
+	// Origin / Destination 保留使用者輸入的原始字串，Canonical 是地理編碼後的標準地名
+	OriginCanonical      string `json:"originCanonical,omitempty"`
+	DestinationCanonical string `json:"destinationCanonical,omitempty"`
+
+	// 選填的經緯度 (沒有座標的旅程不會出現在附近搜尋結果)
+	OriginLat      *float64 `json:"originLat,omitempty"`
+	OriginLng      *float64 `json:"originLng,omitempty"`
+	DestinationLat *float64 `json:"destinationLat,omitempty"`
+	DestinationLng *float64 `json:"destinationLng,omitempty"`
+
+	// 完整路線 (含起點與終點)，建立時沒給就只有起點 -> 終點兩站
+	Stops []Stop `json:"stops,omitempty"`
+
+	// 客滿候補的處理方式：auto = 有空位直接遞補，offer = 保留位子給第一位候補限時確認
+	WaitlistMode string `json:"waitlistMode,omitempty"`
+
+	// 需要司機核准才能加入 (核准前不佔座位)
+	RequiresApproval bool `json:"requiresApproval"`
+
+	// public (預設)、org 或 private：不公開的旅程不會出現在列表、搜尋與配對，只能用邀請連結或邀請碼加入
+	// org 只有同組織的成員看得到、加入得了 (OrgID 是哪個組織)
+	Visibility string `json:"visibility,omitempty"`
+	OrgID      string `json:"orgId,omitempty"`
+
+	// 分攤費用：priceMode 為 per_seat (每座位價格) 或 split (整趟總額平分)，空字串代表免費
+	// 金額一律是最小貨幣單位的整數 (例如 15000 TWD = 150.00 元)
+	PriceMode   string `json:"priceMode,omitempty"`
+	PriceAmount int64  `json:"priceAmount,omitempty"`
+	Currency    string `json:"currency,omitempty"`
+
+	// 行李、寵物、吸菸等設定 (JSON 攤平在旅程上)
+	RideFeatures
+
+	// 使用的車輛 (建立時給 vehicleId，回傳時附上車輛摘要；車牌只有司機與 confirmed 乘客看得到)
+	VehicleID string   `json:"vehicleId,omitempty"`
+	Vehicle   *Vehicle `json:"vehicle,omitempty"`
+
+	// 司機的評分 (沒有人評過就不會有)
+	DriverRating *RatingSummary `json:"driverRating,omitempty"`
+
+	// 只有 GET /api/rides/mine 會填：我在這個旅程的訂位狀態 (pending, confirmed, rejected, expired)、座位數與應付金額
+	BookingStatus string `json:"bookingStatus,omitempty"`
+	BookedSeats   int    `json:"bookedSeats,omitempty"`
+	ShareAmount   int64  `json:"shareAmount,omitempty"`
+
+	// 由週期排程產生的旅程才有
+	ScheduleID     string `json:"scheduleId,omitempty"`
+	OccurrenceDate string `json:"occurrenceDate,omitempty"`
+
+	// 只有行事曆訂閱會填：改時間或狀態的次數 (iCalendar SEQUENCE) 與最後修改時間
+	CalendarSequence  int        `json:"-"`
+	CalendarUpdatedAt *time.Time `json:"-"`
+}
+
+// 週期性旅程：Ride 是每一班的範本 (ID / 出發時間由排程產生)
+type RideSchedule struct {
+	ID        string        `json:"id"`
+	DriverID  string        `json:"driverId"`
+	Ride      Ride          `json:"ride"`
+	Rule      schedule.Rule `json:"rule"`
+	Status    string        `json:"status"` // active, cancelled
+	CreatedAt time.Time     `json:"createdAt"`
+}
+
+// 修改單一班次 (沒給的欄位維持原樣)
+type OccurrenceOverride struct {
+	DepartureTime *time.Time `json:"departureTime,omitempty"`
+	MaxPassengers *int       `json:"maxPassengers,omitempty"`
+}
+
+// 停靠站 (Seq 0 是起點，最後一站是終點)
+type Stop struct {
+	Seq           int        `json:"seq"`
+	Name          string     `json:"name"`
+	Canonical     string     `json:"canonical,omitempty"`
+	Lat           *float64   `json:"lat,omitempty"`
+	Lng           *float64   `json:"lng,omitempty"`
+	EstimatedTime *time.Time `json:"estimatedTime,omitempty"`
+}
+
+// 乘客訂位 (可以只搭其中一段，FromStop / ToStop 是停靠站的 Seq，nil 代表起點 / 終點)
+type Booking struct {
+	RideID      string `json:"rideId"`
+	PassengerID string `json:"passengerId"`
+	FromStop    *int   `json:"fromStop,omitempty"`
+	ToStop      *int   `json:"toStop,omitempty"`
+	Message     string `json:"message,omitempty"` // 需要核准的旅程：給司機的留言
+	Seats       int    `json:"seats,omitempty"`   // 幫沒有帳號的同行朋友一起訂 (預設 1)
+
+	// 不公開的旅程要帶邀請：InviteID 是驗過簽章的邀請連結，InviteCode 是使用者輸入的邀請碼
+	InviteID   string `json:"-"`
+	InviteCode string `json:"-"`
+}
+
+// 待核准的加入申請 (司機的收件匣)
+type BookingRequest struct {
+	RideID           string    `json:"rideId"`
+	PassengerID      string    `json:"passengerId"`
+	PassengerName    string    `json:"passengerName"`
+	PassengerPicture string    `json:"passengerPicture,omitempty"`
+	Message          string    `json:"message,omitempty"`
+	Seats            int       `json:"seats"`
+	FromStop         int       `json:"fromStop"`
+	ToStop           int       `json:"toStop"`
+	Status           string    `json:"status"`
+	RequestedAt      time.Time `json:"requestedAt"`
+	ExpiresAt        time.Time `json:"expiresAt"` // 出發前的截止時間，過了就自動失效
+	Origin           string    `json:"origin"`
+	Destination      string    `json:"destination"`
+	DepartureTime    time.Time `json:"departureTime"`
+}
+
+// 候補名單 (FIFO)
+type WaitlistEntry struct {
+	RideID         string     `json:"rideId"`
+	UserID         string     `json:"userId"`
+	UserName       string     `json:"userName,omitempty"`
+	FromStop       int        `json:"fromStop"`
+	ToStop         int        `json:"toStop"`
+	Seats          int        `json:"seats"`
+	Status         string     `json:"status"`   // waiting, offered, promoted, expired, left
+	Position       int        `json:"position"` // 只有 waiting 狀態有意義 (從 1 開始)
+	OfferExpiresAt *time.Time `json:"offerExpiresAt,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+}
+
+// 減少自己訂的座位數 (POST /api/rides/seats)
+type SeatChange struct {
+	RideID string `json:"rideId"`
+	Seats  int    `json:"seats"`
+}
+
+// 旅程的結構化設定，建立旅程時填寫
+type RideFeatures struct {
+	Luggage              string `json:"luggage,omitempty"` // none, small, medium, large (空字串 = 沒說明)
+	PetsAllowed          bool   `json:"petsAllowed"`
+	SmokingAllowed       bool   `json:"smokingAllowed"`
+	Music                bool   `json:"music"`
+	ChildSeat            bool   `json:"childSeat"`
+	WheelchairAccessible bool   `json:"wheelchairAccessible"`
+}
+
+// 搜尋用的設定條件 (nil / 空值 = 不限)，也是乘客存在個人檔案裡的預設偏好
+type FeatureFilter struct {
+	MinLuggage           string   `json:"minLuggage,omitempty"` // 至少可以放這個大小的行李
+	PetsAllowed          *bool    `json:"petsAllowed,omitempty"`
+	SmokingAllowed       *bool    `json:"smokingAllowed,omitempty"`
+	Music                *bool    `json:"music,omitempty"`
+	ChildSeat            *bool    `json:"childSeat,omitempty"`
+	WheelchairAccessible *bool    `json:"wheelchairAccessible,omitempty"`
+	Amenities            []string `json:"amenities,omitempty"` // 車輛要有全部這些設備
+}
+
+// 乘客發布的搭車需求：「我想在 T 前後從 A 到 B」
+// 建立時給 departureTime + flexMinutes，會換算成可以接受的出發時間區間
+type RideRequest struct {
+	ID                   string        `json:"id"`
+	PassengerID          string        `json:"passengerId"`
+	PassengerName        string        `json:"passengerName"`
+	Origin               string        `json:"origin"`
+	Destination          string        `json:"destination"`
+	OriginCanonical      string        `json:"originCanonical,omitempty"`
+	DestinationCanonical string        `json:"destinationCanonical,omitempty"`
+	OriginLat            *float64      `json:"originLat,omitempty"`
+	OriginLng            *float64      `json:"originLng,omitempty"`
+	DestinationLat       *float64      `json:"destinationLat,omitempty"`
+	DestinationLng       *float64      `json:"destinationLng,omitempty"`
+	DepartureTime        time.Time     `json:"departureTime"`
+	FlexMinutes          int           `json:"flexMinutes,omitempty"`
+	EarliestDeparture    time.Time     `json:"earliestDeparture"`
+	LatestDeparture      time.Time     `json:"latestDeparture"`
+	Seats                int           `json:"seats"`
+	Preferences          FeatureFilter `json:"preferences"`
+	Message              string        `json:"message,omitempty"`
+	Status               string        `json:"status"`           // open, matched, cancelled, expired
+	RideID               string        `json:"rideId,omitempty"` // matched 之後搭的旅程
+	CreatedAt            time.Time     `json:"createdAt"`
+	Offers               []RideOffer   `json:"offers,omitempty"` // 只有 GET /api/rides/requests/mine 會填
+}
+
+// 司機對搭車需求的回應：用現有的旅程 (RideID) 或開一趟新的 (Ride)
+// 乘客接受後乘客直接被加進那趟旅程
+type RideOffer struct {
+	ID         int64     `json:"id"`
+	RequestID  string    `json:"requestId"`
+	DriverID   string    `json:"driverId"`
+	DriverName string    `json:"driverName"`
+	RideID     string    `json:"rideId,omitempty"`
+	Ride       *Ride     `json:"ride,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	Status     string    `json:"status"` // pending, accepted, declined
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// 每個人的通知設定：各管道的開關，Muted 是不想收到的通知類型 (例如 ride_reminder)
+type NotificationPreferences struct {
+	Email bool     `json:"email"`
+	Push  bool     `json:"push"`
+	InApp bool     `json:"inApp"`
+	Muted []string `json:"muted"`
+}
+
+// 瀏覽器 Web Push 訂閱 (PushSubscription.toJSON() 的格式)
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// 站內通知 (通知中心的一筆)
+type Notification struct {
+	ID        int64      `json:"id"`
+	UserID    string     `json:"userId"`
+	Kind      string     `json:"kind"` // ride_joined, ride_cancelled ... (見 notify 套件)
+	Title     string     `json:"title"`
+	Body      string     `json:"body"`
+	RideID    string     `json:"rideId,omitempty"`
+	MessageID *int64     `json:"messageId,omitempty"` // 聊天訊息的通知才有
+	Link      string     `json:"link,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ReadAt    *time.Time `json:"readAt,omitempty"`
+}
+
+// GET /api/notifications 的一頁；NextCursor 空字串代表沒有更舊的了
+type NotificationPage struct {
+	Items      []Notification `json:"items"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+	Unread     int            `json:"unread"`
+}
+
+// 通知佇列裡的一筆工作：一則通知 x 一個管道，失敗會照 NextAttemptAt 重試
+type NotificationJob struct {
+	ID        int64
+	UserID    string
+	Channel   string // email, push, in_app
+	Kind      string
+	Title     string
+	Body      string
+	RideID    string
+	MessageID int64 // 0 = 不是聊天訊息的通知
+	Link      string
+	DedupeKey string // 同一個 key 只會排進佇列一次
+	Attempts  int
+}
+
+// 背景工作最近一次的執行結果 (存在 Redis，任何一個 replica 查到的都一樣)
+type JobStatus struct {
+	Name       string     `json:"name"`
+	Interval   string     `json:"interval"`
+	LastRunAt  *time.Time `json:"lastRunAt,omitempty"`
+	LastOwner  string     `json:"lastOwner,omitempty"` // 跑的那個 replica
+	LastToken  int64      `json:"lastToken,omitempty"` // 當時租約的 fencing token
+	DurationMs int64      `json:"durationMs"`
+	LastError  string     `json:"lastError,omitempty"` // 空字串代表成功
+	Failures   int        `json:"failures"`            // 連續失敗次數
+	NextRunAt  *time.Time `json:"nextRunAt,omitempty"`
+}
+
+// 乘客儲存的搜尋條件 (跟 GET /api/rides/search 一樣)，Alerts 開著的話有新旅程符合就通知
+type SavedSearch struct {
+	ID          string     `json:"id"`
+	UserID      string     `json:"userId"`
+	Name        string     `json:"name"`
+	Origin      string     `json:"origin,omitempty"` // 使用者輸入的地名，只用來顯示 (座標在 Criteria)
+	Destination string     `json:"destination,omitempty"`
+	Criteria    RideSearch `json:"criteria"`
+	Alerts      bool       `json:"alerts"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	LastAlertAt *time.Time `json:"lastAlertAt,omitempty"`
+}
+
+// 媒合引擎找到的「旅程 x 需求」配對，會同時推薦給司機與乘客
+// Score 是加權後的總分 (0-1)，各項分數也一併回傳方便前端解釋為什麼推薦
+type MatchProposal struct {
+	ID                    int64        `json:"id"`
+	RideID                string       `json:"rideId"`
+	RequestID             string       `json:"requestId"`
+	DriverID              string       `json:"driverId"`
+	PassengerID           string       `json:"passengerId"`
+	Score                 float64      `json:"score"`
+	TimeScore             float64      `json:"timeScore"`
+	ProximityScore        float64      `json:"proximityScore"`
+	SeatScore             float64      `json:"seatScore"`
+	PreferenceScore       float64      `json:"preferenceScore"`
+	OriginDistanceKm      float64      `json:"originDistanceKm"`
+	DestinationDistanceKm float64      `json:"destinationDistanceKm"`
+	FromStop              int          `json:"fromStop"`
+	ToStop                int          `json:"toStop"`
+	FreeSeats             int          `json:"freeSeats"`
+	CreatedAt             time.Time    `json:"createdAt"`
+	Ride                  *Ride        `json:"ride,omitempty"`    // 只有 GET /api/rides/matches 會填
+	Request               *RideRequest `json:"request,omitempty"` // 同上
+}
+
+// 司機登記的車輛，Seats 是可以載的乘客數 (不含司機)
+type Vehicle struct {
+	ID        string   `json:"id"`
+	OwnerID   string   `json:"ownerId,omitempty"`
+	Make      string   `json:"make"`
+	Model     string   `json:"model"`
+	Color     string   `json:"color"`
+	Plate     string   `json:"plate,omitempty"`
+	Seats     int      `json:"seats"`
+	Amenities []string `json:"amenities"`
+}
+
+// 旅程完成後的互評：乘客評司機、司機評每位乘客 (每個旅程每個對象只能評一次)
+type Rating struct {
+	RideID    string    `json:"rideId"`
+	RaterID   string    `json:"raterId"`
+	RaterName string    `json:"raterName,omitempty"`
+	RateeID   string    `json:"rateeId"`
+	Role      string    `json:"role"`  // 被評的人在這趟的身分：driver 或 passenger
+	Score     int       `json:"score"` // 1-5
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// 評分統計
+type RatingSummary struct {
+	Average float64 `json:"average"`
+	Count   int     `json:"count"`
+}
+
+// 使用者公開資料 (GET /api/users/profile)
+type UserProfile struct {
+	ID            string         `json:"id"`
+	Name          string         `json:"name"`
+	Picture       string         `json:"picture"`
+	Role          string         `json:"role"`
+	AsDriver      *RatingSummary `json:"asDriver,omitempty"`
+	AsPassenger   *RatingSummary `json:"asPassenger,omitempty"`
+	RecentRatings []Rating       `json:"recentRatings"`
+}
+
+// 單一乘客的分攤金額
+type CostShare struct {
+	PassengerID   string `json:"passengerId"`
+	PassengerName string `json:"passengerName"`
+	Seats         int    `json:"seats"`
+	Amount        int64  `json:"amount"`
+}
+
+// 旅程費用明細 (GET /api/rides/costs)，Total 是目前所有乘客分攤的總和
+type CostBreakdown struct {
+	RideID      string      `json:"rideId"`
+	PriceMode   string      `json:"priceMode"`
+	PriceAmount int64       `json:"priceAmount"`
+	Currency    string      `json:"currency"`
+	Seats       int         `json:"seats"`
+	Total       int64       `json:"total"`
+	Shares      []CostShare `json:"shares"`
+}
+
+// 乘客對某個旅程的一筆付款 (金額改變時會作廢重新授權，所以同一位乘客可能有多筆)
+// Status: authorizing, authorized, captured, voided, refunded, failed
+type Payment struct {
+	ID             int64     `json:"id"`
+	RideID         string    `json:"rideId"`
+	PassengerID    string    `json:"passengerId"`
+	Reference      string    `json:"reference,omitempty"` // 金流供應商的交易編號
+	IdempotencyKey string    `json:"-"`
+	Amount         int64     `json:"amount"`   // 授權金額
+	Captured       int64     `json:"captured"` // 實際請款金額
+	Currency       string    `json:"currency"`
+	Status         string    `json:"status"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// 金流供應商的結果通知：同步呼叫的回傳跟非同步 callback 都是這個格式
+// 同一個事件重送時 ID 不變，所以可以重複處理
+type PaymentEvent struct {
+	ID             string `json:"id"`
+	Type           string `json:"type"` // authorized, captured, voided, refunded, failed
+	Reference      string `json:"reference"`
+	IdempotencyKey string `json:"idempotencyKey,omitempty"` // 授權時我們給的 key，用來對應還沒有 reference 的付款
+	Amount         int64  `json:"amount"`
+}
+
+// 帳本科目與餘額 (正數為借方)
+type LedgerAccount struct {
+	ID       string `json:"id"`
+	Kind     string `json:"kind"` // payer, driver, escrow
+	Currency string `json:"currency"`
+	Balance  int64  `json:"balance"`
+}
+
+// 司機修改旅程 (沒給的欄位維持原樣)
+type RideUpdate struct {
+	RideID           string  `json:"rideId"`
+	MaxPassengers    *int    `json:"maxPassengers,omitempty"`
+	WaitlistMode     *string `json:"waitlistMode,omitempty"`
+	RequiresApproval *bool   `json:"requiresApproval,omitempty"`
+	Visibility       *string `json:"visibility,omitempty"`
+}
+
+// 組織 (公司、學校)：同網域 email 的人登入時自動加入，其他人用邀請碼加入
+type Organization struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	EmailDomains []string  `json:"emailDomains"`
+	MemberCount  int       `json:"memberCount"`
+	Role         string    `json:"role,omitempty"` // 只有「我的組織」會填：admin 或 member
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+type OrgMember struct {
+	OrgID     string    `json:"orgId"`
+	UserID    string    `json:"userId"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`      // admin, member
+	JoinedVia string    `json:"joinedVia"` // creator, domain, invite
+	JoinedAt  time.Time `json:"joinedAt"`
+}
+
+// 組織的邀請碼 (管理員建立)
+type OrgInvite struct {
+	Code      string     `json:"code"`
+	OrgID     string     `json:"orgId"`
+	MaxUses   *int       `json:"maxUses,omitempty"` // nil = 不限次數
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// 不公開旅程的邀請 (綁定一趟旅程，或週期排程產生的每一班)
+type RideInvite struct {
+	ID         string     `json:"id"`
+	RideID     string     `json:"rideId,omitempty"`
+	ScheduleID string     `json:"scheduleId,omitempty"`
+	Code       string     `json:"code"`
+	Link       string     `json:"link,omitempty"`
+	MaxUses    *int       `json:"maxUses,omitempty"` // nil = 不限次數
+	Uses       int        `json:"uses"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// 附近旅程搜尋條件 (GET /api/rides/search)
+type RideSearch struct {
+	OriginLat           *float64 `json:"originLat,omitempty"`
+	OriginLng           *float64 `json:"originLng,omitempty"`
+	OriginRadiusKm      float64  `json:"originRadiusKm,omitempty"`
+	DestinationLat      *float64 `json:"destinationLat,omitempty"`
+	DestinationLng      *float64 `json:"destinationLng,omitempty"`
+	DestinationRadiusKm float64  `json:"destinationRadiusKm,omitempty"`
+	FeatureFilter
+	OrgID    string `json:"orgId,omitempty"` // 只看這個組織的旅程 (組織看板)
+	ViewerID string `json:"-"`               // 搜尋的人，決定看得到哪些組織的旅程
+}
+
+// 搜尋結果：旅程 + 距離資訊 (DetourKm = 上車點距離 + 下車點距離，越小越前面)
+// FromStop / ToStop 是最適合的上下車站，AvailableSeats 是這一段還剩的座位
+type RideMatch struct {
+	Ride
+	OriginDistanceKm      float64 `json:"originDistanceKm"`
+	DestinationDistanceKm float64 `json:"destinationDistanceKm"`
+	DetourKm              float64 `json:"detourKm"`
+	FromStop              int     `json:"fromStop"`
+	ToStop                int     `json:"toStop"`
+	AvailableSeats        int     `json:"availableSeats"`
 }
 
 // 訊息 (增加發送者頭貼)
 type ChatMessage struct {
-	ID            int    `json:"id"`
-	RideID        string `json:"rideId"` // 對應 Ride.ID
-	SenderID      string `json:"senderId"`
-	SenderName    string `json:"senderName"`
-	SenderPicture string `json:"senderPicture"` // 從 Users 表 Join 出來
-	Content       string `json:"content"`
-	Timestamp     string `json:"timestamp"`     // 前端傳來的顯示時間
-	CreatedAt     time.Time `json:"createdAt"` // DB 存的實際時間
+	ID            int       `json:"id"`
+	RideID        string    `json:"rideId"` // 對應 Ride.ID
+	SenderID      string    `json:"senderId"`
+	SenderName    string    `json:"senderName"`
+	SenderPicture string    `json:"senderPicture"` // 從 Users 表 Join 出來
+	Content       string    `json:"content"`
+	System        bool      `json:"system,omitempty"`   // 系統訊息 (出發前提醒等)，沒有發送者
+	StreamID      string    `json:"streamId,omitempty"` // Redis stream 裡的 ID (管理員刪除訊息時用來通知前端拿掉)
+	Timestamp     string    `json:"timestamp"`          // 前端傳來的顯示時間
+	CreatedAt     time.Time `json:"createdAt"`          // DB 存的實際時間
+}
+
+// 我封鎖的人 (GET /api/users/blocks)
+type BlockedUser struct {
+	UserID    string    `json:"userId"`
+	Name      string    `json:"name"`
+	Picture   string    `json:"picture"`
+	BlockedAt time.Time `json:"blockedAt"`
+}
+
+// 檢舉：對象是使用者、旅程或訊息 (TargetID 是訊息 ID 的字串)
+type Report struct {
+	ID           int64      `json:"id"`
+	ReporterID   string     `json:"reporterId"`
+	TargetType   string     `json:"targetType"` // user, ride, message
+	TargetID     string     `json:"targetId"`
+	TargetUserID string     `json:"targetUserId,omitempty"` // 被檢舉的人
+	Category     string     `json:"category"`               // spam, harassment, inappropriate, safety, fraud, other
+	Details      string     `json:"details,omitempty"`
+	Status       string     `json:"status"` // open, resolved, dismissed
+	Resolution   string     `json:"resolution,omitempty"`
+	ResolvedAt   *time.Time `json:"resolvedAt,omitempty"`
+	CreatedAt    time.Time  `json:"createdAt"`
+
+	// 只有管理員的審核佇列會填
+	ReporterName   string `json:"reporterName,omitempty"`
+	TargetUserName string `json:"targetUserName,omitempty"`
+}
+
+// 管理員的審核佇列 (舊的在前，cursor 是最後一筆的 ID)
+type ReportPage struct {
+	Items      []Report `json:"items"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+}
+
+// 管理員搜尋使用者的結果
+type AdminUser struct {
+	ID               string     `json:"id"`
+	Email            string     `json:"email"`
+	Name             string     `json:"name"`
+	Role             string     `json:"role"`
+	SuspendedAt      *time.Time `json:"suspendedAt,omitempty"` // 目前停權中才有
+	SuspendedUntil   *time.Time `json:"suspendedUntil,omitempty"`
+	SuspensionReason string     `json:"suspensionReason,omitempty"`
+	OpenReports      int        `json:"openReports"` // 針對這個人、還沒處理的檢舉
+}
+
+// 管理員操作紀錄 (新的在前)
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	AdminID    string          `json:"adminId"`
+	AdminName  string          `json:"adminName"`
+	Action     string          `json:"action"` // suspend_user, unsuspend_user, cancel_ride, delete_message, resolve_report
+	TargetType string          `json:"targetType"`
+	TargetID   string          `json:"targetId"`
+	Reason     string          `json:"reason,omitempty"`
+	Details    json.RawMessage `json:"details,omitempty"`
+	CreatedAt  time.Time       `json:"createdAt"`
+}
+
+type AuditPage struct {
+	Items      []AuditEntry `json:"items"`
+	NextCursor string       `json:"nextCursor,omitempty"`
 }
 
 type User struct {
@@ -31,5 +568,5 @@ type User struct {
 	Email   string `json:"email"`
 	Name    string `json:"name"`
 	Picture string `json:"picture"`
-	Role    string `json:"role"` // passenger 或 driver
-}
\ No newline at end of file
+	Role    string `json:"role"` // passenger、driver 或 admin
+}